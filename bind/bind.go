@@ -15,8 +15,12 @@ import (
 )
 
 // dialKey is the key to the LRU caches that store dialed services.
+// A service dialed with TLS pins accepts only the pinned certificates,
+// so the pins are part of the key and a service dialed without them is
+// not reused by a config that has them.
 type dialKey struct {
 	user     upspin.UserName
+	tlsPins  string
 	endpoint upspin.Endpoint
 	dialer   upspin.Dialer
 }
@@ -259,6 +263,7 @@ func reachableService(cc upspin.Config, op string, e upspin.Endpoint, cache dial
 	}
 	key := dialKey{
 		user:     cc.UserName(),
+		tlsPins:  cc.Value("tlspins"),
 		endpoint: e,
 		dialer:   dialer,
 	}
@@ -80,10 +80,22 @@ func TestSwitch(t *testing.T) {
 	if u1.(*dummyKey).pingCount != 0 {
 		t.Errorf("Expected zero pings. Got %d", du.pingCount)
 	}
+	// As does one that pins TLS certificates.
+	cfg3 := pinnedConfig{cfg, "addr1=sha256:00"}
+	u4, err := KeyServer(cfg3, e) // Dials again,
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u4 == u1 {
+		t.Errorf("Expected a new instance for pinned config.")
+	}
+	if du.dialed != 3 {
+		t.Errorf("Expected three dials. Got %d", du.dialed)
+	}
 
 	// Now check that Release works.
-	if len(userDialCache) != 2 {
-		t.Errorf("Expected two user services in the cache, got %d", len(userDialCache))
+	if len(userDialCache) != 3 {
+		t.Errorf("Expected three user services in the cache, got %d", len(userDialCache))
 	}
 
 	err = Release(u1) // u2 == u1
@@ -94,6 +106,10 @@ func TestSwitch(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = Release(u4)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(userDialCache) != 0 {
 		t.Errorf("Expected only no user service in the cache.")
@@ -168,6 +184,19 @@ type dummyDirServer struct {
 	endpoint upspin.Endpoint
 }
 
+// pinnedConfig is a config with a value for tlspins.
+type pinnedConfig struct {
+	upspin.Config
+	tlsPins string
+}
+
+func (c pinnedConfig) Value(key string) string {
+	if key == "tlspins" {
+		return c.tlsPins
+	}
+	return c.Config.Value(key)
+}
+
 func (d *dummyKey) Ping() bool {
 	d.pingCount++
 	return true
@@ -163,6 +163,17 @@ func (c *LRU) PeekNewest() (key, value interface{}) {
 	return ent.key, ent.value
 }
 
+// Peek fetches the key's value from the cache, like Get, but without
+// marking it as recently used.
+func (c *LRU) Peek(key interface{}) (value interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, hit := c.cache[key]; hit {
+		return ele.Value.(*entry).value, true
+	}
+	return
+}
+
 // Iterator is an iterator through the list. The iterator points to a nil
 // element at the end of the list or when the list changes.
 type Iterator struct {
@@ -86,6 +86,17 @@ func TestPeek(t *testing.T) {
 	if k, v := c.PeekNewest(); k != "k3" || v != "v3" {
 		t.Errorf("MRU = %q, %q; want k3, v3", k, v)
 	}
+
+	// Peek finds k1 but leaves it the least recently used.
+	if v, ok := c.Peek("k1"); !ok || v != "v1" {
+		t.Errorf("Peek(k1) = %q, %t; want v1, true", v, ok)
+	}
+	if k, _ := c.PeekOldest(); k != "k1" {
+		t.Errorf("LRU after Peek = %q, want k1", k)
+	}
+	if _, ok := c.Peek("k2"); ok {
+		t.Error("Peek found evicted k2")
+	}
 }
 
 func TestRemoveOldest(t *testing.T) {
@@ -0,0 +1,39 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"upspin.io/log"
+	"upspin.io/store/storecache"
+)
+
+// compacter is implemented by the store cache server.
+type compacter interface {
+	Compact() (storecache.Compaction, error)
+}
+
+// compactHandler serves /admin/compact, by which an operator has the
+// storage cache remove at once the files in its directories that it
+// does not know of, such as those left by a crash, rather than waiting
+// for the next compaction. The request is a POST with no form. The
+// response reports how many files were removed and the bytes they held.
+func compactHandler(c compacter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		done, err := c.Compact()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		log.Info.Printf("cacheserver: compaction removed %d files holding %d bytes", done.Files, done.Bytes)
+		fmt.Fprintf(w, "removed %d files holding %d bytes\n", done.Files, done.Bytes)
+	})
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"upspin.io/store/storecache"
+	"upspin.io/upspin"
+)
+
+// fakeCompacter reports the compaction in done, or err.
+type fakeCompacter struct {
+	done storecache.Compaction
+	err  error
+}
+
+func (f *fakeCompacter) Compact() (storecache.Compaction, error) {
+	return f.done, f.err
+}
+
+func TestCompactHandler(t *testing.T) {
+	compact := func(c compacter, method string) (int, string) {
+		w := httptest.NewRecorder()
+		compactHandler(c).ServeHTTP(w, httptest.NewRequest(method, "/admin/compact", nil))
+		return w.Code, w.Body.String()
+	}
+	c := &fakeCompacter{done: storecache.Compaction{Files: 2, Bytes: 1234}}
+	if code, body := compact(c, "POST"); code != http.StatusOK || body != "removed 2 files holding 1234 bytes\n" {
+		t.Errorf("POST: got %d %q", code, body)
+	}
+	if code, _ := compact(c, "GET"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	c.err = upspin.ErrNotSupported
+	if code, _ := compact(c, "POST"); code != http.StatusNotImplemented {
+		t.Errorf("unsupported: got %d, want %d", code, http.StatusNotImplemented)
+	}
+}
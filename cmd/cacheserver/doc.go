@@ -35,10 +35,158 @@ The flags are:
  		Set the log level to 'level'.
 	-cachedir=directory
 		Cache all state in 'directory'/{storecache,dircache}.
-	-writethrough
-		Make storage cache writethrough.
 	-cachesize=bytes
 		Set the maximum bytes usable for the on disk cache to 'bytes'.
+	-writethrough
+		Make storage cache writethrough.
+	-memory
+		Keep cached blocks in memory, written through, rather than on
+		disk. The other storage cache flags are ignored, and -warm,
+		-originpin, and -mirror may not be given.
+	-warm=file
+		Fetch the blocks listed in 'file' into the cache at startup.
+	-auditlog=file
+		Append to 'file' a JSON record of each Delete.
+
+The other flags configure the storage cache. Each sets the option of
+upspin.io/store/storecache.New named in parentheses, whose documentation
+describes it more fully. Flags taking a list take it separated by spaces.
+
+	-compress
+		Compress blocks that compress well. (compress)
+	-verify
+		Check blocks against their references before use. (verify)
+	-dedup
+		Keep one copy on disk of a whole block cached more than once. (dedup)
+	-admission
+		Cache only blocks requested more than once recently. (admission)
+	-colddir=directory
+		Keep evicted blocks in a cold tier in 'directory'. (colddir)
+	-coldsize=bytes
+		With -colddir, the size of the cold tier. (coldbytes)
+	-highwater=percent
+		Start evicting at 'percent' of -cachesize; default 100. (highwater)
+	-lowwater=percent
+		Evict down to 'percent' of -cachesize; default -highwater. (lowwater)
+	-pinsize=bytes
+		Allow 'bytes' of blocks pinned through /admin/pin. (pinbytes)
+	-shardlevels=levels
+		Shard cached blocks into 'levels' of subdirectories. (shardlevels)
+	-passthrough=endpoints
+		Do not cache the stores listed. (passthrough)
+	-originpin=pins
+		Accept from stores only the TLS certificates pinned, each
+		as endpoint@sha256:hash or endpoint@ca:file. (originpin)
+	-mirror=pairs
+		Also Put to a store's mirrors, each as endpoint@mirror. (mirror)
+	-mirrorquorum=stores
+		With -mirror, the stores that must take a Put; 0 for all. (mirrorquorum)
+	-storetimeout=duration
+		Give up on a store after 'duration'. (timeout)
+	-storeretries=times
+		Retry a Get that fails transiently up to 'times' times. (retries)
+	-storeretrywait=duration
+		Wait 'duration' before the first retry; default 100ms. (retrywait)
+	-storelimit=requests
+		Send at most 'requests' at a time to each store. (storelimit)
+	-storewait=duration
+		Wait at most 'duration' for a turn at a store. (storewait)
+	-bandwidth=bytes
+		Limit transfers to all stores to 'bytes' per second. (bandwidth)
+	-storebandwidth=bytes
+		Likewise limit transfers to each store. (storebandwidth)
+	-negativettl=duration
+		Remember for 'duration' that a store lacks a block. (negativettl)
+	-maxstale=duration
+		Serve blocks 'duration' past expiry while refetching. (maxstale)
+	-accessttl=duration
+		Cache Access and Group files for at most 'duration'. (accessttl)
+	-userquota=bytes
+		Limit the blocks cached for each user to 'bytes'. (userquota)
+	-maxentrysize=bytes
+		Do not cache or Put blocks larger than 'bytes'. (maxentrybytes)
+	-fsync=policy
+		Sync Put blocks always, interval, or never (the default). (fsync)
+	-fsyncinterval=duration
+		With -fsync=interval, sync every 'duration'; default 1s. (fsyncinterval)
+	-compactinterval=duration
+		Remove files the cache does not know of every 'duration'. (compactinterval)
+	-requestlog=pairs
+		Log operations at other levels, such as "Get:none". (loglevel)
+	-requestsample=pairs
+		Log only one in n of operations, such as "Get:100". (logsample)
+
+When the storage cache reaches its share of the cache size, the least recently
+used blocks are removed to make room. The bytes and blocks currently held are
+published as storecache-bytes and storecache-entries at /debug/vars, and
+storecache-stats reports hits, misses, evictions, and request latencies.
+Its Origins list, for each store, the calls made to it, those that
+failed, the fraction that failed in the last five minutes, and the last
+few errors with their times, on which a dashboard may alert.
+
+The manifest given to -warm lists one block per line as a store endpoint
+and a reference separated by white space, for example
+
+	remote,store.example.com:443 1b4f0e9851971998e732078544c96b36c3d01cedf7caa332359d6f1d83567014
+
+Blank lines and lines beginning with # are ignored. Blocks are fetched in
+the background, in order, until they fill the storage cache.
+
+Stores do not announce the blocks deleted from them, so a block deleted by
+a client that does not use this cache is served from it until evicted.
+Whoever knows of such a deletion may have the cache drop the block by
+POSTing to /admin/invalidate on the cacheserver's address a form holding
+the store's endpoint and the refs of the blocks, for example
+
+	curl -d endpoint=remote,store.example.com:443 -d ref=1b4f0e98... http://localhost:9999/admin/invalidate
+
+With 'cache: yes' the address is a Unix domain socket in the temporary
+directory, reached with curl's --unix-socket flag. The blocks dropped are
+counted as Invalidations in storecache-stats.
+
+A client may send hints with a request for a block. With no-store, a
+block not already cached is fetched from its store, or a block put is
+stored, without being cached, as for a one-off scan of a large tree;
+with refresh, any cached copy of a block is dropped and fetched afresh.
+They are counted as NoStore and Refreshes in storecache-stats.
+
+With -pinsize, blocks that should stay cached whatever else is read, such
+as those of a root directory and its Access file, may be pinned by
+POSTing the same form to /admin/pin, which fetches them if need be, and
+unpinned again through /admin/unpin. Pins are forgotten when the
+cacheserver restarts.
+
+For debugging, /admin/list describes the blocks in the storage cache as
+JSON: for each its store and reference, size, last use, expiry, and
+whether it is pinned or in the cold tier. At most 1000 are described at
+once, or as many as the max query parameter says; the Next field of the
+result, given as the cursor parameter, fetches the next page.
+
+Files in the storage cache's directories that it does not know of, such
+as those left by a crash, are removed at startup, every -compactinterval,
+and when /admin/compact is POSTed to. The response, the log, and the
+Orphans and OrphanBytes of storecache-stats report the files removed and
+the bytes they held.
+
+To tell slowness between the clients and the cacheserver from slowness
+between the cacheserver and a store, /admin/ping?endpoint=<endpoint>
+pings the store, for example
+
+	curl 'http://localhost:9999/admin/ping?endpoint=remote,store.example.com:443'
+
+and reports the round trip, or why the store did not answer. The ping
+does not wait for the bandwidth limits, and is abandoned after
+-storetimeout.
+
+For the probes of an orchestrator such as Kubernetes, /healthz answers
+200 OK while the storage cache can write its directories and 503 with
+the reason once it cannot, and /readyz answers the same and also 503
+once the cacheserver has begun to shut down.
+
+On SIGTERM or interrupt, the cacheserver stops accepting storage requests,
+waits for those in progress to finish, and writes back pending blocks
+before exiting. It waits at most 30 seconds; blocks not yet written back
+are written after the next start.
 
 Example $HOME/upspin/config entry:
 
@@ -0,0 +1,30 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// prober is implemented by the store cache server.
+type prober interface {
+	Health() error
+	Ready() error
+}
+
+// probeHandler serves a probe by an orchestrator such as Kubernetes,
+// answering 200 and "ok" if check reports no error and 503 and the error
+// if it does. The cacheserver serves the Health check of its store cache
+// as /healthz, for liveness, and the Ready check as /readyz.
+func probeHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,32 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbeHandler(t *testing.T) {
+	var err error
+	h := probeHandler(func() error { return err })
+	for _, test := range []struct {
+		err  error
+		code int
+		body string
+	}{
+		{nil, http.StatusOK, "ok\n"},
+		{errors.New("disk on fire"), http.StatusServiceUnavailable, "disk on fire\n"},
+	} {
+		err = test.err
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != test.code || w.Body.String() != test.body {
+			t.Errorf("error %v: got %d %q, want %d %q", test.err, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+}
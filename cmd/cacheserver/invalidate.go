@@ -0,0 +1,72 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// invalidator is implemented by the store cache server.
+type invalidator interface {
+	Invalidate(upspin.Reference, upspin.Endpoint) bool
+}
+
+// invalidateHandler serves /admin/invalidate, by which a process that
+// knows of blocks deleted from a store behind the cache's back, such as
+// the client that deleted them, has the cache drop its copies. The
+// request is a POST of a form holding the store's endpoint and one or
+// more refs, such as
+//
+//	endpoint=remote,store.example.com:443&ref=1b4f...&ref=8e2a...
+//
+// The response reports how many of the blocks were cached.
+func invalidateHandler(inv invalidator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, refs, ok := refsForm(w, r)
+		if !ok {
+			return
+		}
+		n := 0
+		for _, ref := range refs {
+			if inv.Invalidate(ref, *e) {
+				n++
+			}
+		}
+		log.Info.Printf("cacheserver: invalidated %d of %d blocks from %s", n, len(refs), e)
+		fmt.Fprintf(w, "invalidated %d of %d\n", n, len(refs))
+	})
+}
+
+// refsForm returns the endpoint and refs POSTed to an admin handler.
+// If they are missing or malformed it reports the error to the client
+// and returns false.
+func refsForm(w http.ResponseWriter, r *http.Request) (*upspin.Endpoint, []upspin.Reference, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	e, err := upspin.ParseEndpoint(r.PostForm.Get("endpoint"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if len(r.PostForm["ref"]) == 0 {
+		http.Error(w, "no ref given", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	var refs []upspin.Reference
+	for _, ref := range r.PostForm["ref"] {
+		refs = append(refs, upspin.Reference(ref))
+	}
+	return e, refs, true
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+// fakeInvalidator holds the references named in cached.
+type fakeInvalidator struct {
+	cached map[upspin.Reference]bool
+}
+
+func (f *fakeInvalidator) Invalidate(ref upspin.Reference, e upspin.Endpoint) bool {
+	ok := f.cached[ref]
+	delete(f.cached, ref)
+	return ok
+}
+
+func TestInvalidateHandler(t *testing.T) {
+	inv := &fakeInvalidator{cached: map[upspin.Reference]bool{"a": true, "b": true}}
+	h := invalidateHandler(inv)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/invalidate", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(url.Values{"endpoint": {"remote,store.example.com:443"}, "ref": {"a", "c"}})
+	if w.Code != http.StatusOK || w.Body.String() != "invalidated 1 of 2\n" {
+		t.Errorf("got %d %q, want 200 \"invalidated 1 of 2\"", w.Code, w.Body.String())
+	}
+	if inv.cached["a"] || !inv.cached["b"] {
+		t.Errorf("cached after invalidation: %v", inv.cached)
+	}
+	for _, form := range []url.Values{
+		{"endpoint": {"nonsense"}, "ref": {"b"}},
+		{"endpoint": {"remote,store.example.com:443"}},
+	} {
+		if w := post(form); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %d, want %d", form, w.Code, http.StatusBadRequest)
+		}
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/invalidate?endpoint=inprocess&ref=b", nil))
+	if w.Code != http.StatusMethodNotAllowed || !inv.cached["b"] {
+		t.Errorf("GET: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
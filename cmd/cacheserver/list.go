@@ -0,0 +1,55 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"upspin.io/store/storecache"
+)
+
+// lister is implemented by the store cache server.
+type lister interface {
+	List(cursor string, max int) ([]storecache.Entry, string, error)
+}
+
+// listPage is the response to /admin/list.
+type listPage struct {
+	Entries []storecache.Entry
+	Next    string // Cursor for the next page; empty after the last.
+}
+
+// listHandler serves /admin/list, which describes the blocks in the
+// storage cache, for debugging, as a JSON listPage. The optional query
+// parameters are max, the most blocks to describe, and cursor, the Next
+// of the previous page, such as
+//
+//	/admin/list?max=100&cursor=remote,store.example.com:443/1b/1b4f...
+func listHandler(l lister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "GET required", http.StatusMethodNotAllowed)
+			return
+		}
+		max := 0
+		if v := r.FormValue("max"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid max: "+v, http.StatusBadRequest)
+				return
+			}
+			max = n
+		}
+		entries, next, err := l.List(r.FormValue("cursor"), max)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listPage{Entries: entries, Next: next})
+	})
+}
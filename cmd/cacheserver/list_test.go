@@ -0,0 +1,61 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"upspin.io/store/storecache"
+	"upspin.io/upspin"
+)
+
+// fakeLister lists the references in refs, a page at a time.
+type fakeLister struct {
+	refs []upspin.Reference
+}
+
+func (f *fakeLister) List(cursor string, max int) ([]storecache.Entry, string, error) {
+	var entries []storecache.Entry
+	for _, ref := range f.refs {
+		if string(ref) <= cursor {
+			continue
+		}
+		if len(entries) == max {
+			return entries, string(entries[max-1].Location.Reference), nil
+		}
+		entries = append(entries, storecache.Entry{Location: upspin.Location{Reference: ref}, Size: 1})
+	}
+	return entries, "", nil
+}
+
+func TestListHandler(t *testing.T) {
+	h := listHandler(&fakeLister{refs: []upspin.Reference{"a", "b", "c"}})
+	get := func(url string) (int, listPage) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var page listPage
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatalf("%s: %v", url, err)
+			}
+		}
+		return w.Code, page
+	}
+
+	code, page := get("/admin/list?max=2")
+	if code != http.StatusOK || len(page.Entries) != 2 || page.Next != "b" {
+		t.Errorf("first page: got %d %+v, want 2 entries and Next b", code, page)
+	}
+	code, page = get("/admin/list?max=2&cursor=" + page.Next)
+	if code != http.StatusOK || len(page.Entries) != 1 || page.Entries[0].Location.Reference != "c" || page.Next != "" {
+		t.Errorf("last page: got %d %+v, want entry c and no Next", code, page)
+	}
+	if code, _ := get("/admin/list?max=lots"); code != http.StatusBadRequest {
+		t.Errorf("bad max: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// pinner is implemented by the store cache server.
+type pinner interface {
+	Pin(upspin.Reference, upspin.Endpoint) error
+	Unpin(upspin.Reference, upspin.Endpoint) bool
+}
+
+// pinHandler serves /admin/pin, by which blocks that should stay cached
+// whatever else is read, such as those of a root directory and its Access
+// file, are pinned in the cache. The request is a POST of a form like
+// that of /admin/invalidate. The blocks are fetched if need be; the
+// response reports how many were pinned and why the others were not.
+func pinHandler(p pinner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, refs, ok := refsForm(w, r)
+		if !ok {
+			return
+		}
+		n := 0
+		var msgs []string
+		for _, ref := range refs {
+			if err := p.Pin(ref, *e); err != nil {
+				msgs = append(msgs, fmt.Sprintf("%s: %v", ref, err))
+				continue
+			}
+			n++
+		}
+		log.Info.Printf("cacheserver: pinned %d of %d blocks from %s", n, len(refs), e)
+		fmt.Fprintf(w, "pinned %d of %d\n", n, len(refs))
+		for _, msg := range msgs {
+			fmt.Fprintln(w, msg)
+		}
+	})
+}
+
+// unpinHandler serves /admin/unpin, which unpins blocks pinned through
+// /admin/pin so that they may be evicted again. The response reports how
+// many of the blocks were pinned.
+func unpinHandler(p pinner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, refs, ok := refsForm(w, r)
+		if !ok {
+			return
+		}
+		n := 0
+		for _, ref := range refs {
+			if p.Unpin(ref, *e) {
+				n++
+			}
+		}
+		log.Info.Printf("cacheserver: unpinned %d of %d blocks from %s", n, len(refs), e)
+		fmt.Fprintf(w, "unpinned %d of %d\n", n, len(refs))
+	})
+}
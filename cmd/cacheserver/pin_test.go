@@ -0,0 +1,69 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// fakePinner pins the references in the store and no others.
+type fakePinner struct {
+	store  map[upspin.Reference]bool
+	pinned map[upspin.Reference]bool
+}
+
+func (f *fakePinner) Pin(ref upspin.Reference, e upspin.Endpoint) error {
+	if !f.store[ref] {
+		return errors.E(errors.NotExist, errors.Str("no such block"))
+	}
+	f.pinned[ref] = true
+	return nil
+}
+
+func (f *fakePinner) Unpin(ref upspin.Reference, e upspin.Endpoint) bool {
+	ok := f.pinned[ref]
+	delete(f.pinned, ref)
+	return ok
+}
+
+func TestPinHandlers(t *testing.T) {
+	p := &fakePinner{
+		store:  map[upspin.Reference]bool{"a": true, "b": true},
+		pinned: make(map[upspin.Reference]bool),
+	}
+	post := func(h http.Handler, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/pin", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	const endpoint = "remote,store.example.com:443"
+
+	w := post(pinHandler(p), url.Values{"endpoint": {endpoint}, "ref": {"a", "b", "c"}})
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "pinned 2 of 3\nc: ") {
+		t.Errorf("pin: got %d %q, want 200 \"pinned 2 of 3\" and an error for c", w.Code, w.Body.String())
+	}
+	if !p.pinned["a"] || !p.pinned["b"] {
+		t.Errorf("pinned: %v", p.pinned)
+	}
+	w = post(unpinHandler(p), url.Values{"endpoint": {endpoint}, "ref": {"a", "c"}})
+	if w.Code != http.StatusOK || w.Body.String() != "unpinned 1 of 2\n" {
+		t.Errorf("unpin: got %d %q, want 200 \"unpinned 1 of 2\"", w.Code, w.Body.String())
+	}
+	if p.pinned["a"] || !p.pinned["b"] {
+		t.Errorf("pinned after unpin: %v", p.pinned)
+	}
+	if w := post(pinHandler(p), url.Values{"endpoint": {endpoint}}); w.Code != http.StatusBadRequest {
+		t.Errorf("pin with no ref: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
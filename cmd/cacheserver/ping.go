@@ -0,0 +1,47 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// pinger is implemented by the store cache server.
+type pinger interface {
+	PingOrigin(upspin.Endpoint) (time.Duration, error)
+}
+
+// pingHandler serves /admin/ping, which measures the round trip from the
+// cache to a store, so that an operator can tell slowness between the
+// clients and the cache from slowness between the cache and the store.
+// The query parameter endpoint names the store, such as
+//
+//	/admin/ping?endpoint=remote,store.example.com:443
+//
+// The response gives the round trip or, with status 502, why the store
+// did not answer.
+func pingHandler(p pinger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "GET required", http.StatusMethodNotAllowed)
+			return
+		}
+		e, err := upspin.ParseEndpoint(r.FormValue("endpoint"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rtt, err := p.PingOrigin(*e)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "%s answered in %v\n", e, rtt)
+	})
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// fakePinger answers pings of up in 5ms and fails those of other stores.
+type fakePinger struct {
+	up upspin.Endpoint
+}
+
+func (f *fakePinger) PingOrigin(e upspin.Endpoint) (time.Duration, error) {
+	if e != f.up {
+		return 0, errors.E(errors.IO, errors.Str("no answer"))
+	}
+	return 5 * time.Millisecond, nil
+}
+
+func TestPingHandler(t *testing.T) {
+	h := pingHandler(&fakePinger{up: upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"}})
+	for _, test := range []struct {
+		method, url string
+		code        int
+		body        string
+	}{
+		{"GET", "/admin/ping?endpoint=remote,store.example.com:443", http.StatusOK, "remote,store.example.com:443 answered in 5ms\n"},
+		{"GET", "/admin/ping?endpoint=remote,down.example.com:443", http.StatusBadGateway, "I/O error: no answer\n"},
+		{"GET", "/admin/ping", http.StatusBadRequest, ""},
+		{"POST", "/admin/ping?endpoint=remote,store.example.com:443", http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.url, nil))
+		if w.Code != test.code || test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s %s: got %d %q, want %d %q", test.method, test.url, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+}
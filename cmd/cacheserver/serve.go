@@ -5,16 +5,25 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"expvar"
 	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"upspin.io/config"
 	"upspin.io/dir/dircache"
 	"upspin.io/flags"
+	"upspin.io/log"
 	"upspin.io/rpc/dirserver"
 	"upspin.io/rpc/local"
 	"upspin.io/rpc/storeserver"
+	"upspin.io/shutdown"
 	"upspin.io/store/storecache"
 	"upspin.io/upspin"
 
@@ -28,9 +37,48 @@ import (
 
 var (
 	cacheSizeFlag = flag.Int64("cachesize", 5e9, "max disk `bytes` for cache")
+	coldDir       = flag.String("colddir", "", "`directory` for blocks evicted from the cache, typically on a slower disk")
+	coldSize      = flag.Int64("coldsize", 0, "max disk `bytes` for blocks in -colddir")
+	highWater     = flag.Int("highwater", 100, "`percent` of -cachesize in use at which to start evicting blocks")
+	lowWater      = flag.Int("lowwater", 0, "`percent` of -cachesize to which to evict blocks once past -highwater (0 for the same)")
+	pinSize       = flag.Int64("pinsize", 0, "max disk `bytes` for blocks pinned through /admin/pin (0 to disallow pinning)")
+	shardLevels   = flag.Int("shardlevels", 1, "`levels` of subdirectories into which to shard cached blocks")
 	writethrough  = flag.Bool("writethrough", false, "make storage cache writethrough")
+	memory        = flag.Bool("memory", false, "keep cached blocks in memory rather than on disk")
+	compress      = flag.Bool("compress", false, "compress cached blocks that compress well")
+	verify        = flag.Bool("verify", false, "check cached blocks against their references before use")
+	dedup         = flag.Bool("dedup", false, "keep one copy on disk of a block cached from several stores or references")
+	admission     = flag.Bool("admission", false, "cache a fetched block only if it is requested more often than the block it would evict")
+	userQuota     = flag.Int64("userquota", 0, "max disk `bytes` for each user's cached blocks (0 for no limit)")
+	maxEntrySize  = flag.Int64("maxentrysize", 0, "max `bytes` of a block to cache (0 for no limit)")
+	fsync         = flag.String("fsync", "never", "`policy` for syncing Put blocks to disk: always, interval, or never")
+	fsyncInterval = flag.Duration("fsyncinterval", time.Second, "`duration` between batches of syncs with -fsync=interval")
+	passthrough   = flag.String("passthrough", "", "space-separated `endpoints` of stores not to cache")
+	originPins    = flag.String("originpin", "", "space-separated `pins`, endpoint@sha256:hash or endpoint@ca:file, of the TLS certificates to accept from stores")
+	mirrors       = flag.String("mirror", "", "space-separated `pairs`, endpoint@mirror, of stores and the stores to which to mirror blocks Put to them")
+	mirrorQuorum  = flag.Int("mirrorquorum", 0, "`stores`, including the store itself, that must take a mirrored Put or Delete (0 for all)")
+	storeTimeout  = flag.Duration("storetimeout", 0, "max `duration` to wait for a store to answer (0 for no limit)")
+	storeRetries  = flag.Int("storeretries", 0, "`times` to retry a Get from a store that fails transiently")
+	storeRetry    = flag.Duration("storeretrywait", 100*time.Millisecond, "`duration` to wait before the first retry with -storeretries; it doubles with each retry")
+	storeLimit    = flag.Int("storelimit", 0, "max `requests` in progress to each store (0 for no limit)")
+	storeWait     = flag.Duration("storewait", 10*time.Second, "max `duration` a request waits for its turn at a store limited by -storelimit")
+	bandwidth     = flag.Int64("bandwidth", 0, "max `bytes` per second of blocks fetched from and sent to all stores (0 for no limit)")
+	storeBW       = flag.Int64("storebandwidth", 0, "max `bytes` per second of blocks fetched from and sent to each store (0 for no limit)")
+	maxStale      = flag.Duration("maxstale", 0, "max `duration` past its expiry for which to serve a block while fetching it again")
+	accessTTL     = flag.Duration("accessttl", 0, "max `duration` for which to cache a block holding an Access or Group file (0 for no limit)")
+	negativeTTL   = flag.Duration("negativettl", 0, "`duration` for which to remember that a store lacks a block (0 to not remember)")
+	compactEvery  = flag.Duration("compactinterval", time.Hour, "`duration` between removals of files in the cache directory the cache does not know of (0 for only at startup)")
+	requestLog    = flag.String("requestlog", "", "space-separated `pairs`, operation:level, of storage cache operations, such as Get, and the levels at which to log their requests: debug, info, error, or none")
+	requestSample = flag.String("requestsample", "", "space-separated `pairs`, operation:n, of storage cache operations and the n such that only one in n of their requests is logged")
+	auditLog      = flag.String("auditlog", "", "`file` to which to append a record of each Delete")
+	warmFile      = flag.String("warm", "", "manifest `file` of blocks to fetch into the cache at startup")
 )
 
+// drainTimeout is how long the store cache is given on shutdown to finish
+// the requests in progress and write back pending blocks. It leaves the
+// rest of shutdown.GracePeriod for the other shutdown handlers.
+const drainTimeout = shutdown.GracePeriod / 2
+
 func serve(cfg upspin.Config, addr string) (<-chan error, error) {
 	// Stop the cache server recursing.
 	cfg = config.SetCacheEndpoint(cfg, upspin.Endpoint{})
@@ -39,13 +87,106 @@ func serve(cfg upspin.Config, addr string) (<-chan error, error) {
 	maxRefBytes := (9 * (*cacheSizeFlag)) / 10
 	maxLogBytes := maxRefBytes / 9
 
-	sc, blockFlusher, err := storecache.New(cfg, flags.CacheDir, maxRefBytes, *writethrough)
-	if err != nil {
-		return nil, err
+	options := []string{
+		fmt.Sprintf("verify=%t", *verify),
+		fmt.Sprintf("compress=%t", *compress),
+		fmt.Sprintf("dedup=%t", *dedup),
+		fmt.Sprintf("admission=%t", *admission),
+		fmt.Sprintf("userquota=%d", *userQuota),
+		fmt.Sprintf("maxentrybytes=%d", *maxEntrySize),
+		"fsync=" + *fsync,
+		fmt.Sprintf("fsyncinterval=%v", *fsyncInterval),
+		fmt.Sprintf("timeout=%v", *storeTimeout),
+		fmt.Sprintf("retries=%d", *storeRetries),
+		fmt.Sprintf("retrywait=%v", *storeRetry),
+		fmt.Sprintf("negativettl=%v", *negativeTTL),
+		fmt.Sprintf("maxstale=%v", *maxStale),
+		fmt.Sprintf("accessttl=%v", *accessTTL),
+		fmt.Sprintf("storelimit=%d", *storeLimit),
+		fmt.Sprintf("storewait=%v", *storeWait),
+		fmt.Sprintf("bandwidth=%d", *bandwidth),
+		fmt.Sprintf("storebandwidth=%d", *storeBW),
+		fmt.Sprintf("shardlevels=%d", *shardLevels),
+		fmt.Sprintf("compactinterval=%v", *compactEvery),
+		fmt.Sprintf("pinbytes=%d", *pinSize),
+		fmt.Sprintf("highwater=%d", *highWater),
+	}
+	if *lowWater != 0 {
+		options = append(options, fmt.Sprintf("lowwater=%d", *lowWater))
+	}
+	if *coldDir != "" {
+		options = append(options, "colddir="+*coldDir, fmt.Sprintf("coldbytes=%d", *coldSize))
+	}
+	for _, e := range strings.Fields(*passthrough) {
+		options = append(options, "passthrough="+e)
+	}
+	for _, p := range strings.Fields(*originPins) {
+		options = append(options, "originpin="+p)
+	}
+	for _, l := range strings.Fields(*requestLog) {
+		options = append(options, "loglevel="+l)
+	}
+	for _, l := range strings.Fields(*requestSample) {
+		options = append(options, "logsample="+l)
+	}
+	for _, m := range strings.Fields(*mirrors) {
+		options = append(options, "mirror="+m)
+	}
+	options = append(options, fmt.Sprintf("mirrorquorum=%d", *mirrorQuorum))
+	var (
+		sc           upspin.StoreServer
+		blockFlusher func(upspin.Location)
+	)
+	if *memory {
+		if *warmFile != "" {
+			return nil, fmt.Errorf("-warm cannot be combined with -memory")
+		}
+		if *originPins != "" {
+			return nil, fmt.Errorf("-originpin cannot be combined with -memory")
+		}
+		if *mirrors != "" {
+			return nil, fmt.Errorf("-mirror cannot be combined with -memory")
+		}
+		sc = storecache.NewServer(cfg, storecache.NewMemory(maxRefBytes))
+	} else {
+		var err error
+		sc, blockFlusher, err = storecache.New(cfg, flags.CacheDir, maxRefBytes, *writethrough, options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		sc.(interface {
+			SetAuditLog(io.Writer)
+		}).SetAuditLog(f)
 	}
 	ss := storeserver.New(cfg, sc, "")
+	shutdown.Handle(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		err := sc.(interface {
+			Shutdown(context.Context) error
+		}).Shutdown(ctx)
+		if err != nil {
+			log.Error.Printf("cacheserver: %v", err)
+		}
+	})
+	if *warmFile != "" {
+		manifest, err := readManifest(*warmFile)
+		if err != nil {
+			return nil, err
+		}
+		go warm(sc, manifest)
+	}
 
-	dc, err := dircache.New(cfg, flags.CacheDir, maxLogBytes, blockFlusher)
+	prefetch := sc.(interface {
+		Prefetch([]upspin.Location)
+	}).Prefetch
+	dc, err := dircache.New(cfg, flags.CacheDir, maxLogBytes, blockFlusher, prefetch)
 	if err != nil {
 		return nil, err
 	}
@@ -64,9 +205,62 @@ func serve(cfg upspin.Config, addr string) (<-chan error, error) {
 	mux.Handle("/api/Store/", ss)
 	mux.Handle("/api/Dir/", ds)
 	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/admin/invalidate", invalidateHandler(sc.(invalidator)))
+	mux.Handle("/admin/compact", compactHandler(sc.(compacter)))
+	mux.Handle("/admin/list", listHandler(sc.(lister)))
+	mux.Handle("/admin/pin", pinHandler(sc.(pinner)))
+	mux.Handle("/admin/unpin", unpinHandler(sc.(pinner)))
+	mux.Handle("/admin/ping", pingHandler(sc.(pinger)))
+	mux.Handle("/healthz", probeHandler(sc.(prober).Health))
+	mux.Handle("/readyz", probeHandler(sc.(prober).Ready))
 	done := make(chan error)
 	go func() {
 		done <- httpServer.Serve(ln)
 	}()
 	return done, nil
 }
+
+// readManifest reads a warm up manifest. Each line holds a store
+// endpoint and a reference, separated by white space; blank lines and
+// those beginning with # are ignored. It returns the references listed
+// for each endpoint, in the order in which they appear.
+func readManifest(file string) (map[upspin.Endpoint][]upspin.Reference, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifest := make(map[upspin.Endpoint][]upspin.Reference)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		words := strings.Fields(line)
+		if len(words) != 2 {
+			return nil, fmt.Errorf("%s:%d: want endpoint and reference", file, n)
+		}
+		e, err := upspin.ParseEndpoint(words[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		manifest[*e] = append(manifest[*e], upspin.Reference(words[1]))
+	}
+	return manifest, scanner.Err()
+}
+
+// warm fetches the blocks in the manifest into the store cache,
+// logging those that could not be fetched.
+func warm(sc upspin.StoreServer, manifest map[upspin.Endpoint][]upspin.Reference) {
+	warmer := sc.(interface {
+		Warm([]upspin.Reference, upspin.Endpoint) []error
+	})
+	for e, refs := range manifest {
+		for i, err := range warmer.Warm(refs, e) {
+			if err != nil {
+				log.Info.Printf("cacheserver: warming %s from %s: %v", refs[i], e, err)
+			}
+		}
+	}
+}
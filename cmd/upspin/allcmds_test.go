@@ -448,16 +448,16 @@ var keygenTests = []cmdTest{
 		"create a temporary key",
 		ann,
 		do(
-			"keygen -secretseed deter-gonad-pivot-rotor.visit-roman-widow-woman " + testTempDir("key", deleteOld),
+			"keygen -secretseed dotam-gonad-pivot-rotor.vizit-roman-vidon-zoman " + testTempDir("key", deleteOld),
 		),
 		"",
-		keygenVerify(testTempDir("key", keepOld), "p256\n3078263077187835", "1623258616618034", "", keepOld),
+		keygenVerify(testTempDir("key", keepOld), "p256\n6738392344253824", "3875634883420952", "", keepOld),
 	},
 	{
 		"keygen again will fail",
 		ann,
 		do(
-			"keygen -secretseed desex-fetid-pecan-fakir.color-civil-comet-haven " + testTempDir("key", keepOld),
+			"keygen -secretseed dasid-fotid-pukan-fakir.kolor-sivil-komit-havin " + testTempDir("key", keepOld),
 		),
 		"",
 		fail("prior keys exist"),
@@ -466,10 +466,10 @@ var keygenTests = []cmdTest{
 		"keygen rotate",
 		ann,
 		do(
-			"keygen -rotate -secretseed desex-fetid-pecan-fakir.color-civil-comet-haven " + testTempDir("key", keepOld),
+			"keygen -rotate -yes -secretseed dasid-fotid-pukan-fakir.kolor-sivil-komit-havin " + testTempDir("key", keepOld),
 		),
 		"",
-		keygenVerify(testTempDir("key", keepOld), "p256\n1048813400173469", "7863414033373202", "1623258616618034", deleteOld),
+		keygenVerify(testTempDir("key", keepOld), "p256\n1935532124610447", "3939976177828976", "3875634883420952", deleteOld),
 	},
 	{
 		"use new keys",
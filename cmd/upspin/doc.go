@@ -50,14 +50,18 @@ Upspin commands:
 	countersign
 	cp
 	deletestorage
+	finalizekeys
+	fixkeyperms
 	get
 	getref
 	info
 	keygen
+	keyhash
 	link
 	ls
 	mkdir
 	put
+	reencodeseed
 	repack
 	rm
 	rotate
@@ -70,6 +74,7 @@ Upspin commands:
 	snapshot
 	tar
 	user
+	verifykeys
 	version
 	watch
 	whichaccess
@@ -167,6 +172,58 @@ Flags:
 
 
 
+Sub-command finalizekeys
+
+Usage: upspin finalizekeys [<directory>]
+
+Finalizekeys ends the grace period begun by "keygen -rotate -grace":
+it drops the prior key pair from the secret key file in the specified
+directory, or if none is given, in the directory named by the config
+file's secrets, leaving it only in the archive of prior keys.
+
+Flags:
+  -archivefile name
+    	name of the file in the directory to which -rotate appends prior keys (default "secret2.upspinkey")
+  -help
+    	print more information about the command
+  -key-mode mode
+    	mode of the rewritten secret key file, at most 0440 (default "0400")
+  -publicfile name
+    	name of the file in the directory that holds the public key (default "public.upspinkey")
+  -secretfile name
+    	name of the file in the directory that holds the secret key (default "secret.upspinkey")
+
+
+
+Sub-command fixkeyperms
+
+Usage: upspin fixkeyperms [-n] [<directory>]
+
+Fixkeyperms corrects the modes of the files keygen keeps in the
+specified directory, or if none is given, in the directory named by the
+config file's secrets. The key files are given the mode of -key-mode,
+and the archive of prior keys and keygen.log are made private to their
+owner. Only files more permissive than that, or unreadable by their
+owner, are changed, and each change is reported. It is not supported on
+Windows, which does not keep Unix permissions.
+
+Flags:
+  -archivefile name
+    	name of the file in the directory to which -rotate appends prior keys (default "secret2.upspinkey")
+  -dry-run
+    	same as -n
+  -help
+    	print more information about the command
+  -key-mode mode
+    	mode of the key files, at most 0440 (default "0400")
+  -n	report the changes without making them
+  -publicfile name
+    	name of the file in the directory that holds the public key (default "public.upspinkey")
+  -secretfile name
+    	name of the file in the directory that holds the secret key (default "secret.upspinkey")
+
+
+
 Sub-command get
 
 Usage: upspin get [-out=outputfile] path
@@ -225,27 +282,369 @@ Flags:
 
 Sub-command keygen
 
-Usage: upspin keygen [-curve=256] [-secretseed=seed] <directory>
+Usage: upspin keygen [-curve=256] [-secretseed=seed] [-json] [<directory>]
+       upspin keygen -stdout [-curve=256] [-secretseed=seed]
+       upspin keygen -public-only [-curve=256] -secretseed=seed
 
 Keygen creates a new Upspin key pair and stores the pair in local files
-secret.upspinkey and public.upspinkey in the specified directory.
+secret.upspinkey and public.upspinkey in the specified directory, or if
+none is given, in the directory named by the config file's secrets.
 Existing key pairs are appended to secret2.upspinkey.
 Keygen does not update the information in the key server;
 use the "user -put" command for that.
 
 New users should instead use the "signup" command to create their first key.
 
+The verifykeys, finalizekeys, fixkeyperms, reencodeseed, and keyhash
+commands work on existing keys.
+
+The -next-steps flag also prints to standard output, ready to be copied
+and pasted, the commands that put the new public key into use, each
+filled in with the key's file and fingerprint. For new keys, that is a
+"user -put" of the user's record bearing the key, with the user name and
+servers taken from the config file; for keys made with -rotate, it is
+the sequence of commands described by "upspin rotate -help", and with
+-grace the finalizekeys that ends it. The flag requires keys written to
+files, and cannot be combined with -json or -n.
+
+If no directory is given, keygen uses the one in which clients look for
+the user's keys: the secrets directory named in the config file, or if
+it names none, $HOME/.ssh/<username> for the user it names. If the
+config file cannot be read, or its secrets are "none", the directory
+must be given.
+
+The -n flag reports whether prior keys exist, whether they would be
+archived to secret2.upspinkey, and with what modification time, without
+writing any files. As without -n, it fails if prior keys exist and
+-rotate is not set.
+
+So that keys are not replaced by mistake, such as those of another
+identity in a directory given in error, the refusal to replace prior
+keys, the report of -n, and the confirmation asked for by -rotate all
+describe the prior keys: their public key's fingerprint, their label,
+and the user they belong to, if the directory is named for one as
+$HOME/.ssh/<username> is.
+
+The -force flag overwrites any prior keys without archiving them. It is
+meant for throwaway identities, such as those made by test scripts; the
+overwritten keys are lost, so it should not be used for a real identity.
+
+The -stdout flag writes the key pair to standard output instead of to
+files, each key delimited by BEGIN and END marker lines naming the file
+it would otherwise be stored in. In that mode no files are read or
+written and the directory argument may be omitted.
+
+The -public-only flag, given with -secretseed, recovers just the public
+key from a recorded seed: it writes the public key made from the seed
+for the -curve to standard output, in the format of public.upspinkey,
+and its fingerprint to standard error. It needs no network access and
+writes no files, and the directory argument may be omitted.
+
+The secret key file ends with a comment line recording a checksum of
+the rest of the file, so that a file truncated or damaged, say by an
+editor, is refused when the keys are read rather than failing in some
+less obvious way. The verifykeys command checks the keys, the checksum
+among them, without writing anything.
+
+After writing new keys, keygen reads them back, signs a fixed challenge
+with the secret key, as the ee packing signs a directory entry, and
+checks the signature with the public key. If the check fails the keys
+are damaged, and keygen exits with status 7 rather than reporting
+success, so that the damage is found at once rather than at their first
+use; the keys it wrote must not be used. With -stdout the keys are
+checked before they are written. The -self-test=false flag skips the
+check.
+
+The -comment flag records a label, such as "laptop 2024", in a comment
+line in both key files, to tell apart the keys of many identities. It
+means nothing to Upspin, which ignores the line, and is shown by
+verifykeys.
+
+The -curve flag selects the ECDSA curve of the key: p256, p384, or
+p521.
+
+Given several curves separated by commas, such as -curve p256,p384,
+keygen makes a key pair for each from the same seed and writes each to
+the subdirectory of the directory named for its curve, so that a single
+recorded seed recreates them all. It cannot then be combined with the
+flags that write keys or the seed elsewhere, or with -rotate.
+
+Without -curve, keygen uses the curve named by the environment
+variable UPSPIN_KEYGEN_CURVE, if it is set, and otherwise p256. With
+-rotate, it instead uses the curve of the existing public key, so that
+the kind of key does not change by accident; if -curve names another
+curve, keygen warns that the kind of key changes.
+
+New keys are made from 128 random bits, which by default come from the
+operating system. The -entropyfile flag reads them from the named file
+instead, such as the device node of a hardware random number generator
+on a machine without a network. Either way, keygen refuses to use bits
+that are evidently not random, such as all zeros.
+
+The -secretseed flag recreates keys from a seed recorded earlier. Its
+value may be the seed itself, the name of a file holding it, or "-" to
+read it from standard input, which keeps it out of the argument list
+seen by other users of the machine. The file or standard input may
+instead hold shares of the seed made with -split, one to a line; given
+enough of them, keygen recreates the seed from the shares.
+
+The -secret-hex and -secret-b64 flags instead supply a new seed's 128
+bits directly, for those with a source of entropy of their own, as 32
+hexadecimal digits or in base64. The bits are written as a proquint seed,
+made into keys exactly as any other, and must be exactly 16 bytes and
+evidently random. Like -secretseed, they are seen by other users of the
+machine while keygen runs.
+
+A secret given on the command line, with -secretseed, -secret-hex, or
+-secret-b64, is recorded in the shell's history, so keygen warns when it
+sees one; the -no-inline-seed flag makes it refuse such a secret instead.
+
+The -expect-public flag guards against recreating keys from the wrong
+seed: keygen fails, before writing anything, unless the new public key
+is the one given. Its value may be the name of a file holding the key,
+such as a copy of public.upspinkey, the key itself, or its fingerprint
+as printed by keygen.
+
+The seed is normally written as eight proquints, such as
+lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat. With -seedformat=bip39
+it is instead written as a 12-word BIP 39 mnemonic, the form used by
+many password managers and hardware wallets. Both forms hold the same
+128 bits and make the same keys, and -secretseed accepts either; a
+proquint seed given with -seedformat=bip39 is converted to a mnemonic.
+Since some password managers mangle the '.' in the middle of a proquint
+seed, the -seedstyle flag writes it with other separators: dashed, as in
+lusab-babad-gutih-tugad-gutuk-bisog-mudof-sakat, or spaced, as in
+lusab babad gutih tugad gutuk bisog mudof sakat, rather than dotted.
+The separators carry no information and -secretseed accepts any of them.
+
+The reencodeseed command rewrites a recorded seed in another of these
+forms.
+
+The -split=K-of-N flag also splits the secret seed into N shares, any
+K of which recreate it, while fewer reveal nothing about it. The shares
+are written to files beside the secret key, named after it with .share1,
+.share2, and so on appended, from which they should be moved to N
+different safe places. Each share is written like a seed, with one more
+proquint at the start.
+
+The -escrow-to flag also seals the secret seed for an escrow agent,
+such as an organization that must be able to recover its members' keys.
+Its value names a file holding the agent's public key, on one of the
+NIST curves. The seed is encrypted for that key alone, as files are
+encrypted for their readers, and written to escrow.upspinkey.enc beside
+the secret key, whence it should be sent to the agent. Only the agent's
+private key can recover the seed from it; the plaintext seed is never
+written there. A later -rotate replaces the file along with the keys.
+
+The -backup-recipient flag also writes a copy of the secret key file
+encrypted for the named recipient, for disaster recovery, such as from
+cloud storage. An age recipient, beginning age1, or an SSH public key is
+encrypted for with the age program, and a GPG key ID or fingerprint, in
+hexadecimal, with gpg; either must be installed. The copy is written
+beside the secret key, named after it with .age or .gpg appended. The
+secret key is passed to the program on its standard input, so no
+unencrypted copy is written.
+
+The -qr flag also shows the secret seed as a QR code, which is easier
+to photograph and keep offline than to copy by hand. The code is drawn
+in the terminal with ANSI colors or, with -qrfile, written to the named
+file as a PNG image. Either way it holds the secret, so it must be kept
+as safely as the seed itself.
+
+The -recovery-sheet flag also writes a one-page PDF document to the
+named file, to be printed and stored somewhere safe. It holds a blank
+for the user name, the curve, the public key fingerprint, the secret
+seed, the command that re-creates the keys, and a QR code of the seed.
+The document is written straight to the file, through no temporary
+file, but the file holds the secret, so it should be deleted once it is
+printed. The flag cannot be combined with -split, which keeps the whole
+seed out of any one place.
+
+Keygen also prints a fingerprint of the public key, the start of the
+hash by which encrypted data refers to it. It can be used to check
+that the key in the key server is the one on disk.
+
+It prints the whole hash too, as 64 hexadecimal digits, in the one
+form the key server, factotum, and encrypted data use: the SHA-256 hash
+of the public key exactly as the "user -put" command registers it, with
+any comment lines and carriage returns of the key file removed. The
+keyhash command prints just that hash of existing keys.
+
+It then reports the security level of the keys, as the length of a
+symmetric key that would be about as hard to break: 128 bits for p256,
+192 for p384, and 256 for p521. Since the secret seed holds only 128
+bits, though, keys made from it are no stronger than that, and keygen
+warns that p384 and p521 keys are slower than p256 keys but, made from
+a seed, no more secure.
+
+With -rotate, keygen first looks up the current user in the key server
+and warns if the public key registered there does not match the one in
+the directory. Rotating away from a key the key server does not know
+about can lock the user out, since the key server will only accept the
+new key when the request is signed with the registered one. The -strict
+flag makes such a mismatch, or a failure to check, an error instead.
+Since rotating replaces the keys in use, keygen then asks for it to be
+confirmed by typing YES. The -yes flag skips the question, as scripts
+must: if standard input is not a terminal, keygen refuses to rotate
+without -yes.
+
+While keys are rotated, some key servers may still offer the old public
+key, so that data is still encrypted for it. The prior key pair is
+archived to secret2.upspinkey, but where only secret.upspinkey is
+copied to the machines that read the data, the -grace flag, given with
+-rotate, keeps the prior key pair in secret.upspinkey as well, between
+marker lines, so that data encrypted for either key can be read. Once
+the migration is done, the finalizekeys command drops the prior key
+from secret.upspinkey, leaving it only in the archive.
+
+The -export flag also writes the key pair in another format, for use
+with tools that do not understand Upspin keys: pem for a PKIX public key
+and PKCS #8 private key, as read by OpenSSL, or openssh for an
+authorized_keys line and an OpenSSH private key. The exported keys are
+stored beside the Upspin ones, in files named after them with the format
+appended, such as secret.upspinkey.pem. With -stdout, the exported keys
+are written to standard output instead of the Upspin ones.
+
+Key files are made readable only by their owner, and a directory
+created for them usable only by its owner. Where a service must read
+the keys through a group, the -key-mode flag sets the mode of the key
+files, up to 0440, and the -dir-mode flag that of a new directory, up
+to 0750. As when any file is created, the modes are narrowed by the
+umask. The archive of prior keys is always private to its owner.
+
+Each time keygen writes keys to a directory it appends a line to
+keygen.log there recording the time, whether the keys were generated or
+rotated, the curve, the host name, and the new public key's fingerprint,
+so that the directory keeps a history of its keys. The log holds
+nothing secret, and like the archive is private to its owner.
+
+The -publicfile, -secretfile, and -archivefile flags change the names
+of the files in the directory, so that the keys of several identities
+may be kept side by side; -rotate archives to the named file as well.
+Factotum and the other Upspin tools read only the default names, so
+keys stored under other names must be copied to a directory of their
+own, with the default names, before they can be used.
+
+The -archive-dir flag makes -rotate also append the prior keys, in the
+same format, to an archive file of the same name, secret2.upspinkey or
+as -archivefile says, in the given directory, which is created private
+to its owner if need be, so that a history of the keys is kept outside
+a key directory that may not last. Giving a directory for each user
+keeps their histories apart. With
+-archive-local=false the prior keys are archived only there; then
+factotum, which reads the archive in the key directory, cannot decrypt
+data encrypted for them until they are copied back.
+
+Keygen exits with a status that tells why it failed:
+
+	3  the secret seed is malformed, or the entropy is evidently not random
+	4  the curve is not supported
+	5  prior keys exist and neither -rotate nor -force was given
+	6  a file could not be read or written
+	7  with -expect-public, the new public key is not the one expected;
+	   or the new keys fail the self-test
+	1  any other failure (2 if the flags cannot be parsed)
+
+With -json, the status is also reported as the ExitCode of the error.
+
 See the description for rotate for information about updating keys.
 
 Flags:
+  -archive-dir directory
+    	also append prior keys archived by -rotate to the archive file in directory, creating it if need be
+  -archive-local
+    	with -archive-dir, also archive prior keys in the key directory (default true)
+  -archivefile name
+    	name of the file in the directory to which -rotate appends prior keys (default "secret2.upspinkey")
+  -backup-recipient recipient
+    	also write a copy of the secret key encrypted for recipient, an age recipient or GPG key ID
+  -comment label
+    	label to record in a comment line in both key files
   -curve name
-    	cryptographic curve name: p256, p384, or p521 (default "p256")
+    	cryptographic curve name: p256, p384, or p521, or several separated by commas (default "p256")
+  -dir-mode mode
+    	mode of the directory if keygen creates it, at most 0750 (default "0700")
+  -dry-run
+    	same as -n
+  -entropyfile file
+    	file from which to read the random bits for a new key, such as a hardware random number generator
+  -escrow-to file
+    	also seal the secret seed for the escrow agent whose public key is in file
+  -expect-public key
+    	fail unless the new public key is key: a file holding it, the key itself, or its fingerprint
+  -export format
+    	also write the keys in format pem or openssh
+  -force
+    	overwrite existing keys without archiving them
+  -grace
+    	with -rotate, keep the prior key in the secret key file until finalizekeys
   -help
     	print more information about the command
+  -json
+    	write the result, or any error, as a JSON object to standard output
+  -key-mode mode
+    	mode of the key files, at most 0440 (default "0400")
+  -n	report what would be done to existing keys without writing any files
+  -next-steps
+    	also print to standard output the commands that register the new public key with the key server
+  -no-inline-seed
+    	refuse a secret seed given on the command line rather than in a file or on standard input
+  -public-only
+    	with -secretseed, only write the public key to standard output
+  -publicfile name
+    	name of the file in the directory that holds the public key (default "public.upspinkey")
+  -qr
+    	also show the secret seed as a QR code
+  -qrfile file
+    	with -qr, write the QR code as a PNG image to file rather than to the terminal
+  -recovery-sheet file
+    	also write a one-page PDF file to print, holding the secret seed, the command to re-create the keys, and a QR code
   -rotate
     	back up the existing keys and replace them with new ones
+  -secret-b64 secret
+    	the 128-bit secret for a new seed, in base64
+  -secret-hex secret
+    	the 128-bit secret for a new seed, as 32 hexadecimal digits
+  -secretfile name
+    	name of the file in the directory that holds the secret key (default "secret.upspinkey")
   -secretseed string
-    	the seed containing a 128-bit secret in proquint format or a file that contains it
+    	the seed containing a 128-bit secret in proquint or BIP 39 format, a file that contains it, or - to read it from standard input
+  -seedformat format
+    	format in which to write the secret seed: proquint or bip39 (default "proquint")
+  -seedstyle style
+    	style of the separators in a proquint secret seed: dotted, dashed, or spaced (default "dotted")
+  -self-test
+    	sign and verify a challenge with the new keys before reporting success (default true)
+  -split K-of-N
+    	also split the secret seed into K-of-N shares, any K of which recreate it
+  -stdout
+    	write the keys to standard output rather than to files
+  -strict
+    	with -rotate, fail if the existing public key does not match the key server
+  -yes
+    	with -rotate, replace the keys without asking for confirmation
+
+
+
+Sub-command keyhash
+
+Usage: upspin keyhash [<directory>]
+
+Keyhash prints the hash of the public key in the specified directory, or
+if none is given, in the directory named by the config file's secrets,
+as 64 hexadecimal digits. It is the one form the key server, factotum,
+and encrypted data use: the SHA-256 hash of the public key exactly as
+the "user -put" command registers it, with any comment lines and
+carriage returns of the key file removed, so it can be compared with the
+key server's.
+
+Flags:
+  -help
+    	print more information about the command
+  -publicfile name
+    	name of the file in the directory that holds the public key (default "public.upspinkey")
+  -secretfile name
+    	name of the file in the directory that holds the secret key (default "secret.upspinkey")
 
 
 
@@ -322,6 +721,34 @@ Flags:
 
 
 
+Sub-command reencodeseed
+
+Usage: upspin reencodeseed [-seedformat=format] [-seedstyle=style] [<directory>]
+
+Reencodeseed rewrites the secret seed recorded in the secret key file in
+the specified directory, or if none is given, in the directory named by
+the config file's secrets, in the form given by -seedformat and
+-seedstyle, for instance to move a seed to a password manager that takes
+only BIP 39 mnemonics. The seed must make the keys in the directory; the
+keys themselves, their label, and any prior key kept by "keygen -grace"
+are left exactly as they are.
+
+Flags:
+  -help
+    	print more information about the command
+  -key-mode mode
+    	mode of the rewritten secret key file, at most 0440 (default "0400")
+  -publicfile name
+    	name of the file in the directory that holds the public key (default "public.upspinkey")
+  -secretfile name
+    	name of the file in the directory that holds the secret key (default "secret.upspinkey")
+  -seedformat format
+    	format in which to write the secret seed: proquint or bip39 (default "proquint")
+  -seedstyle style
+    	style of the separators in a proquint secret seed: dotted, dashed, or spaced (default "dotted")
+
+
+
 Sub-command repack
 
 Usage: upspin repack [-pack ee] [flags] path...
@@ -617,28 +1044,63 @@ the -dir and -store flags must not be set.
 
 By default, signup creates new keys with the p256 cryptographic curve set.
 The -curve and -secretseed flags allow the user to control the curve or to
-recreate or reuse prior keys.
+recreate or reuse prior keys, and the -secret-hex and -secret-b64 flags to
+supply the bits of a new seed. The -seedformat flag writes the secret seed
+as a BIP 39 mnemonic, the -seedstyle flag writes it with other separators
+than the usual proquint ones, the -split flag splits it into shares, the -qr
+and -qrfile flags show it as a QR code, the -no-inline-seed flag refuses a
+seed given on the command line, the -recovery-sheet flag writes a
+PDF recovery sheet bearing the user name, the -comment flag labels the
+keys, the -self-test flag checks the new keys, and the -key-mode and
+-dir-mode flags set the modes of the key files and their directory, as
+described for keygen.
 
 The -signuponly flag tells signup to skip the generation of the configuration
 file and keys and only send the signup request to the key server.
 
 Flags:
+  -comment label
+    	label to record in a comment line in both key files
   -curve name
     	cryptographic curve name: p256, p384, or p521 (default "p256")
   -dir address
     	Directory server address
+  -dir-mode mode
+    	mode of the key directory if signup creates it, at most 0750 (default "0700")
   -force
     	create a new user even if keys and config file exist
   -help
     	print more information about the command
+  -key-mode mode
+    	mode of the key files, at most 0440 (default "0400")
+  -no-inline-seed
+    	refuse a secret seed given on the command line rather than in a file or on standard input
+  -qr
+    	also show the secret seed as a QR code
+  -qrfile file
+    	with -qr, write the QR code as a PNG image to file rather than to the terminal
+  -recovery-sheet file
+    	also write a one-page PDF file to print, holding the secret seed, the command to re-create the keys, and a QR code
+  -secret-b64 secret
+    	the 128-bit secret for a new seed, in base64
+  -secret-hex secret
+    	the 128-bit secret for a new seed, as 32 hexadecimal digits
   -secrets directory
     	directory to store key pair
   -secretseed string
-    	the seed containing a 128 bit secret in proquint format or a file that contains it
+    	the seed containing a 128 bit secret in proquint or BIP 39 format, a file that contains it, or - to read it from standard input
+  -seedformat format
+    	format in which to write the secret seed: proquint or bip39 (default "proquint")
+  -seedstyle style
+    	style of the separators in a proquint secret seed: dotted, dashed, or spaced (default "dotted")
+  -self-test
+    	sign and verify a challenge with the new keys before reporting success (default true)
   -server address
     	Store and Directory server address (if combined)
   -signuponly
     	only send signup request to key server; do not generate config or keys
+  -split K-of-N
+    	also split the secret seed into K-of-N shares, any K of which recreate it
   -store address
     	Store server address
 
@@ -720,6 +1182,31 @@ Flags:
 
 
 
+Sub-command verifykeys
+
+Usage: upspin verifykeys [-json] [<directory>]
+
+Verifykeys checks the keys in the specified directory, or if none is
+given, in the directory named by the config file's secrets, without
+writing anything: that the secret key matches its checksum, if it has
+one, that the public key is the one made from it, that the secret seed
+recorded beside the secret key makes them both, and that the key files
+are readable by no one but their owner, or their group if keygen's
+-key-mode allowed it. It prints OK if every check passes and otherwise
+names the check that failed and exits with status 7.
+
+Flags:
+  -help
+    	print more information about the command
+  -json
+    	write the result, or any error, as a JSON object to standard output
+  -publicfile name
+    	name of the file in the directory that holds the public key (default "public.upspinkey")
+  -secretfile name
+    	name of the file in the directory that holds the secret key (default "secret.upspinkey")
+
+
+
 Sub-command version
 
 Usage: upspin version
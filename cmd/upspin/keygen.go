@@ -7,184 +7,1647 @@ package main
 // This file contains the implementation of the keygen command.
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	yaml "gopkg.in/yaml.v2"
+	"rsc.io/qr"
+
+	"upspin.io/bind"
+	"upspin.io/config"
 	"upspin.io/errors"
-	"upspin.io/key/proquint"
+	"upspin.io/factotum"
+	"upspin.io/flags"
+	"upspin.io/key/keygen"
+	"upspin.io/key/shamir"
 	"upspin.io/pack/ee"
 	"upspin.io/subcmd"
+	"upspin.io/transports"
+	"upspin.io/upspin"
+	"upspin.io/user"
 )
 
 func (s *State) keygen(args ...string) {
 	const help = `
 Keygen creates a new Upspin key pair and stores the pair in local files
-secret.upspinkey and public.upspinkey in the specified directory.
+secret.upspinkey and public.upspinkey in the specified directory, or if
+none is given, in the directory named by the config file's secrets.
 Existing key pairs are appended to secret2.upspinkey.
 Keygen does not update the information in the key server;
 use the "user -put" command for that.
 
 New users should instead use the "signup" command to create their first key.
 
+The verifykeys, finalizekeys, fixkeyperms, reencodeseed, and keyhash
+commands work on existing keys. The package documentation describes the
+flags in full, along with the files keygen writes and its exit statuses.
+
 See the description for rotate for information about updating keys.
 `
 	// Keep flags in sync with signup.go. New flags here should appear
 	// there as well.
+	if len(args) == 1 && (args[0] == "-list-curves" || args[0] == "--list-curves") {
+		// For completion scripts and the like, so left out of the
+		// flags and help.
+		for _, curve := range keygen.Curves() {
+			fmt.Fprintln(s.Stdout, curve)
+		}
+		return
+	}
 	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
 	var (
-		curve      = fs.String("curve", "p256", "cryptographic curve `name`: p256, p384, or p521")
-		secretSeed = fs.String("secretseed", "", "the seed containing a 128-bit secret in proquint format or a file that contains it")
-		rotate     = fs.Bool("rotate", false, "back up the existing keys and replace them with new ones")
+		curve       = fs.String("curve", "p256", "cryptographic curve `name`: p256, p384, or p521, or several separated by commas")
+		backupTo    = fs.String("backup-recipient", "", "also write a copy of the secret key encrypted for `recipient`, an age recipient or GPG key ID")
+		comment     = fs.String("comment", "", "`label` to record in a comment line in both key files")
+		escrowTo    = fs.String("escrow-to", "", "also seal the secret seed for the escrow agent whose public key is in `file`")
+		expectPub   = fs.String("expect-public", "", "fail unless the new public key is `key`: a file holding it, the key itself, or its fingerprint")
+		entropyFile = fs.String("entropyfile", "", "`file` from which to read the random bits for a new key, such as a hardware random number generator")
+		secretHex   = fs.String("secret-hex", "", "the 128-bit `secret` for a new seed, as 32 hexadecimal digits")
+		secretB64   = fs.String("secret-b64", "", "the 128-bit `secret` for a new seed, in base64")
+		secretSeed  = fs.String("secretseed", "", "the seed containing a 128-bit secret in proquint or BIP 39 format, a file that contains it, or - to read it from standard input")
+		seedFormat  = fs.String("seedformat", "proquint", "`format` in which to write the secret seed: proquint or bip39")
+		seedStyle   = fs.String("seedstyle", keygen.SeedDotted, "`style` of the separators in a proquint secret seed: dotted, dashed, or spaced")
+		split       = fs.String("split", "", "also split the secret seed into `K-of-N` shares, any K of which recreate it")
+		rotate      = fs.Bool("rotate", false, "back up the existing keys and replace them with new ones")
+		force       = fs.Bool("force", false, "overwrite existing keys without archiving them")
+		strict      = fs.Bool("strict", false, "with -rotate, fail if the existing public key does not match the key server")
+		yes         = fs.Bool("yes", false, "with -rotate, replace the keys without asking for confirmation")
+		grace       = fs.Bool("grace", false, "with -rotate, keep the prior key in the secret key file until finalizekeys")
+		jsonOut     = fs.Bool("json", false, "write the result, or any error, as a JSON object to standard output")
+		stdout      = fs.Bool("stdout", false, "write the keys to standard output rather than to files")
+		publicOnly  = fs.Bool("public-only", false, "with -secretseed, only write the public key to standard output")
+		noInline    = fs.Bool("no-inline-seed", false, "refuse a secret seed given on the command line rather than in a file or on standard input")
+		selfTest    = fs.Bool("self-test", true, "sign and verify a challenge with the new keys before reporting success")
+		export      = fs.String("export", "", "also write the keys in `format` pem or openssh")
+		qrCode      = fs.Bool("qr", false, "also show the secret seed as a QR code")
+		qrFile      = fs.String("qrfile", "", "with -qr, write the QR code as a PNG image to `file` rather than to the terminal")
+		sheetFile   = fs.String("recovery-sheet", "", "also write a one-page PDF `file` to print, holding the secret seed, the command to re-create the keys, and a QR code")
+		archiveDir  = fs.String("archive-dir", "", "also append prior keys archived by -rotate to the archive file in `directory`, creating it if need be")
+		archiveHere = fs.Bool("archive-local", true, "with -archive-dir, also archive prior keys in the key directory")
+		nextSteps   = fs.Bool("next-steps", false, "also print to standard output the commands that register the new public key with the key server")
+		keyMode     = fs.String("key-mode", "0400", "`mode` of the key files, at most 0440")
+		dirMode     = fs.String("dir-mode", "0700", "`mode` of the directory if keygen creates it, at most 0750")
+		dryRun      bool
 	)
-	s.ParseFlags(fs, args, help, "keygen [-curve=256] [-secretseed=seed] <directory>")
-	if fs.NArg() != 1 {
+	names := keyFileFlags(fs, true)
+	fs.BoolVar(&dryRun, "n", false, "report what would be done to existing keys without writing any files")
+	fs.BoolVar(&dryRun, "dry-run", false, "same as -n")
+	s.ParseFlags(fs, args, help, "keygen [-curve=256] [-secretseed=seed] [-json] [<directory>]\n       upspin keygen -stdout [-curve=256] [-secretseed=seed]\n       upspin keygen -public-only [-curve=256] -secretseed=seed")
+	if !flagSet(fs, "curve") {
+		if env := os.Getenv(curveEnv); env != "" {
+			*curve = env
+		}
+	}
+	s.checkFlagRules(fs)
+	if fs.NArg() > 1 {
 		usageAndExit(fs)
 	}
-	s.keygenCommand(fs.Arg(0), *curve, *secretSeed, *rotate)
+	splitK, splitN := s.parseSplit(*split)
+	perm := s.parseKeyPerm(*keyMode, *dirMode)
+	switch *export {
+	case "", "pem", "openssh":
+		// ok
+	default:
+		s.Exitf("unknown export format %q", *export)
+	}
+	switch *seedFormat {
+	case "proquint", "bip39":
+		// ok
+	default:
+		s.Exitf("unknown seed format %q", *seedFormat)
+	}
+	ks := &keygenState{
+		state:       s,
+		curve:       *curve,
+		curveSet:    flagSet(fs, "curve"),
+		comment:     *comment,
+		expectPub:   *expectPub,
+		escrowTo:    *escrowTo,
+		backupTo:    *backupTo,
+		secretseed:  *secretSeed,
+		seedFormat:  *seedFormat,
+		seedStyle:   s.parseSeedStyle(fs, *seedStyle, *seedFormat),
+		splitK:      splitK,
+		splitN:      splitN,
+		entropyFile: *entropyFile,
+		rotate:      *rotate,
+		force:       *force,
+		strict:      *strict,
+		yes:         *yes,
+		grace:       *grace,
+		export:      *export,
+		qr:          *qrCode,
+		qrFile:      *qrFile,
+		sheetFile:   *sheetFile,
+		names:       *names,
+		archiveDir:  *archiveDir,
+		noLocalArch: !*archiveHere,
+		nextSteps:   *nextSteps,
+		perm:        perm,
+		json:        *jsonOut,
+		stdout:      *stdout,
+		publicOnly:  *publicOnly,
+		selfTest:    *selfTest,
+		inlineSeed:  inlineSeedFlag(*secretSeed, *secretHex, *secretB64),
+		noInline:    *noInline,
+		dryRun:      dryRun,
+	}
+	if *secretHex != "" || *secretB64 != "" {
+		seed, err := seedFromSecret(*secretHex, *secretB64)
+		if err != nil {
+			ks.exitf(keygenExitSeed, "%v", err)
+		}
+		ks.secretseed = seed
+	}
+	s.keygenCommand(ks, fs.Arg(0))
+}
+
+// keygenState holds the options for a single run of keygen.
+type keygenState struct {
+	state       *State
+	curve       string
+	curveSet    bool   // The curve was named by -curve rather than defaulted.
+	comment     string // Label to record in the key files, if any.
+	expectPub   string // The public key the new one must match, if any; see checkExpectedKey.
+	escrowTo    string // File holding the public key to seal the seed for, if any; see escrowKey.
+	backupTo    string // Recipient for whom to encrypt a backup of the secret key, if any; see backupTool.
+	secretseed  string
+	seedFormat  string // Form in which to write the seed: proquint (or empty) or bip39.
+	seedStyle   string // Separators for a proquint seed, as for keygen.FormatSeed; empty to keep those given.
+	splitK      int    // With splitN, the number of shares needed to recreate the seed.
+	splitN      int    // If positive, split the seed into this many shares.
+	entropyFile string // Source of the bits for a new seed; empty for the system's.
+	rotate      bool
+	force       bool   // Overwrite prior keys without archiving them.
+	strict      bool   // With rotate, fail rather than warn if the key server disagrees.
+	yes         bool   // With rotate, do not ask for confirmation.
+	grace       bool   // With rotate, keep the prior key in the secret key file too.
+	json        bool   // Report the result or error as JSON on standard output.
+	stdout      bool   // Write the keys to standard output, not to files.
+	publicOnly  bool   // Write only the public key, to standard output.
+	selfTest    bool   // Check that the new keys sign and verify; see selfTestKeys.
+	inlineSeed  string // The flag that gave the seed on the command line, if one did; see checkInlineSeed.
+	noInline    bool   // Refuse a seed given on the command line.
+	dryRun      bool   // Report what would happen but change no files.
+	export      string // Format in which to export the keys as well, if any.
+	qr          bool   // Show the secret seed as a QR code.
+	qrFile      string // With qr, the PNG file to write it to rather than the terminal.
+	sheetFile   string // PDF file to write a recovery sheet to, if any.
+	nextSteps   bool   // Print the commands that register the new key; see printNextSteps.
+
+	// sheetUser is the user to name on the recovery sheet, if known,
+	// as it is to signup but not to keygen.
+	sheetUser upspin.UserName
+
+	// names holds the names of the key files within the directory.
+	// Empty names are replaced by the defaults.
+	names keyFiles
+
+	// archiveDir, if set, is a directory in which prior keys are also
+	// archived, and if noLocalArch is set, the only one. See files.
+	archiveDir  string
+	noLocalArch bool
+
+	// perm holds the modes of the key files and of their directory
+	// if it is created. Zero modes are replaced by the defaults.
+	perm keyPerm
+
+	// entropy, if not nil, stands in for the system's random source as
+	// the source of the bits for a new seed, so that tests make the same
+	// keys every time. Only tests set it; entropyFile overrides it.
+	entropy io.Reader
+}
+
+// keyPerm holds the modes with which key files, and the directories
+// holding them, are created.
+type keyPerm struct {
+	file, dir os.FileMode
+}
+
+// defaultKeyPerm makes key files readable, and their directories
+// usable, only by their owner.
+var defaultKeyPerm = keyPerm{file: 0400, dir: 0700}
+
+// Most permissive modes allowed by -key-mode and -dir-mode.
+const (
+	maxKeyFileMode os.FileMode = 0440
+	maxKeyDirMode  os.FileMode = 0750
+)
+
+// parseKeyPerm returns the modes given by the values of the -key-mode
+// and -dir-mode flags. A key file must be readable by its owner and a
+// directory usable by its owner, and neither may be more permissive
+// than the maximum.
+func (s *State) parseKeyPerm(file, dir string) keyPerm {
+	return keyPerm{
+		file: s.parseMode("key-mode", file, 0400, maxKeyFileMode),
+		dir:  s.parseMode("dir-mode", dir, 0700, maxKeyDirMode),
+	}
 }
 
-func (s *State) keygenCommand(where, curve, secretseed string, rotate bool) {
-	switch curve {
-	case "p256", "p384", "p521":
+// parseMode returns the mode given as value by the named flag, which
+// must be octal, include need, and be within max.
+func (s *State) parseMode(name, value string, need, max os.FileMode) os.FileMode {
+	m, err := strconv.ParseUint(value, 8, 32)
+	mode := os.FileMode(m)
+	if err != nil || mode&need != need || mode&^max != 0 {
+		s.Exitf("invalid -%s %q: must be an octal mode including %04o and within %04o", name, value, need, max)
+	}
+	return mode
+}
+
+// keyPerm returns the modes for the key files, with the defaults for
+// any not set.
+func (ks *keygenState) keyPerm() keyPerm {
+	perm := ks.perm
+	if perm.file == 0 {
+		perm.file = defaultKeyPerm.file
+	}
+	if perm.dir == 0 {
+		perm.dir = defaultKeyPerm.dir
+	}
+	return perm
+}
+
+// parseSeedStyle returns the value of the -seedstyle flag, style, if it
+// was set, and otherwise the empty string, so that a seed given to keygen
+// is written as it was. The style must be one known to keygen.FormatSeed
+// and applies only to seeds written as proquints.
+func (s *State) parseSeedStyle(fs *flag.FlagSet, style, format string) string {
+	if !flagSet(fs, "seedstyle") {
+		return ""
+	}
+	switch style {
+	case keygen.SeedDotted, keygen.SeedDashed, keygen.SeedSpaced:
 		// ok
 	default:
-		s.Exitf("no such curve %q", curve)
+		s.Exitf("unknown seed style %q", style)
+	}
+	if format == "bip39" {
+		s.Exitf("-seedstyle cannot be combined with -seedformat=bip39")
+	}
+	return style
+}
+
+// curveEnv is the environment variable naming the curve
+// for keygen to use if the -curve flag is not given.
+const curveEnv = "UPSPIN_KEYGEN_CURVE"
+
+// flagSet reports whether the named flag was set on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// flagRule says with which other flags a flag of keygen or signup may
+// be given. A flag is given if it is set on the command line to other
+// than false or the empty string.
+type flagRule struct {
+	flag string
+	// If value is set, the rule applies only when the flag is set to
+	// it, as with -archive-local=false.
+	value string
+	// If several is set, the rule applies only when the flag holds
+	// several values separated by commas, however it got them.
+	several  bool
+	requires []string // At least one of these must be given as well.
+	excludes []string // None of these may be given as well.
+}
+
+// keyFlagRules are the rules for the flags of keygen and signup, in the
+// order checkFlagRules checks them. Rules for flags that a command does
+// not define do not apply to it.
+var keyFlagRules = []flagRule{
+	{flag: "public-only", excludes: []string{"stdout", "rotate", "force", "json", "n", "dry-run", "export", "split", "qr", "recovery-sheet", "escrow-to", "backup-recipient", "next-steps"}},
+	{flag: "public-only", requires: []string{"secretseed", "secret-hex", "secret-b64"}},
+	{flag: "stdout", excludes: []string{"rotate", "json", "n", "dry-run", "split", "escrow-to", "backup-recipient", "next-steps"}},
+	{flag: "curve", several: true, excludes: []string{"stdout", "public-only", "rotate", "json", "export", "split", "qr", "recovery-sheet", "escrow-to", "backup-recipient", "expect-public", "next-steps"}},
+	{flag: "secretseed", excludes: []string{"secret-hex", "secret-b64"}},
+	{flag: "secret-hex", excludes: []string{"secret-b64"}},
+	{flag: "entropyfile", excludes: []string{"secretseed", "secret-hex", "secret-b64"}},
+	{flag: "force", excludes: []string{"rotate"}},
+	{flag: "strict", requires: []string{"rotate"}},
+	{flag: "yes", requires: []string{"rotate"}},
+	{flag: "grace", requires: []string{"rotate"}},
+	{flag: "qrfile", requires: []string{"qr"}},
+	{flag: "archive-local", value: "false", requires: []string{"archive-dir"}},
+	{flag: "next-steps", excludes: []string{"json", "n", "dry-run"}},
+	{flag: "recovery-sheet", excludes: []string{"split"}},
+	{flag: "n", excludes: []string{"json"}},
+	{flag: "dry-run", excludes: []string{"json"}},
+	{flag: "server", excludes: []string{"dir", "store"}},
+}
+
+// checkFlagRules exits, naming the flags at fault, if the flags given
+// in fs break any of keyFlagRules.
+func (s *State) checkFlagRules(fs *flag.FlagSet) {
+	given := func(name string) bool {
+		f := fs.Lookup(name)
+		return f != nil && flagSet(fs, name) && f.Value.String() != "" && f.Value.String() != "false"
+	}
+	anyGiven := func(names []string) bool {
+		for _, name := range names {
+			if given(name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range keyFlagRules {
+		f := fs.Lookup(r.flag)
+		if f == nil {
+			continue
+		}
+		what := "-" + r.flag
+		switch {
+		case r.several:
+			if !strings.Contains(f.Value.String(), ",") {
+				continue
+			}
+			what += " with several values"
+		case r.value != "":
+			if !flagSet(fs, r.flag) || f.Value.String() != r.value {
+				continue
+			}
+			what += "=" + r.value
+		case !given(r.flag):
+			continue
+		}
+		for _, name := range r.excludes {
+			if given(name) {
+				s.Exitf("%s cannot be combined with -%s", what, name)
+			}
+		}
+		if len(r.requires) > 0 && !anyGiven(r.requires) {
+			s.Exitf("%s requires %s", what, flagList(r.requires))
+		}
+	}
+}
+
+// flagList returns the names of the flags as a list for a message, as
+// in "-a, -b, or -c".
+func flagList(names []string) string {
+	list := "-" + names[0]
+	for i, name := range names[1:] {
+		switch {
+		case i < len(names)-2:
+			list += ", -" + name
+		case len(names) == 2:
+			list += " or -" + name
+		default:
+			list += ", or -" + name
+		}
+	}
+	return list
+}
+
+// keyFileFlags defines in fs the flags that name the files in a key
+// directory, and if archive is set the archive among them, returning
+// the names, which hold the flags' values once fs is parsed.
+func keyFileFlags(fs *flag.FlagSet, archive bool) *keyFiles {
+	names := new(keyFiles)
+	fs.StringVar(&names.public, "publicfile", publicKeyFile, "`name` of the file in the directory that holds the public key")
+	fs.StringVar(&names.secret, "secretfile", secretKeyFile, "`name` of the file in the directory that holds the secret key")
+	if archive {
+		fs.StringVar(&names.archive, "archivefile", archiveKeyFile, "`name` of the file in the directory to which -rotate appends prior keys")
+	}
+	return names
+}
+
+// keyDir returns the directory holding the keys on which a command such
+// as verifykeys works: its argument, if given, and otherwise the
+// default directory for the user's keys.
+func (ks *keygenState) keyDir(fs *flag.FlagSet) string {
+	// The seed and keys are read into memory, so at least keep them
+	// out of core dumps.
+	protectSecrets()
+	switch fs.NArg() {
+	case 0:
+		return ks.defaultKeyDir()
+	case 1:
+		return fs.Arg(0)
+	}
+	usageAndExit(fs)
+	return ""
+}
+
+// Default names of the key files.
+const (
+	publicKeyFile  = "public.upspinkey"
+	secretKeyFile  = "secret.upspinkey"
+	archiveKeyFile = "secret2.upspinkey"
+	logKeyFile     = "keygen.log"
+	escrowKeyFile  = "escrow.upspinkey.enc"
+)
+
+// keyTimeLayout is the layout of the times recorded in the archive
+// and the log.
+const keyTimeLayout = "2006-01-02 15:04:05Z"
+
+// keyFiles holds the names of the files that hold a key pair and the
+// archive of the key pairs it replaced.
+type keyFiles struct {
+	public, secret, archive string
+
+	// extArchive, if set, is a further archive outside the directory.
+	// See -archive-dir.
+	extArchive string
+}
+
+// keyFilesIn returns the key files with the default names in dir.
+func keyFilesIn(dir string) keyFiles {
+	return keyFiles{
+		public:  filepath.Join(dir, publicKeyFile),
+		secret:  filepath.Join(dir, secretKeyFile),
+		archive: filepath.Join(dir, archiveKeyFile),
+	}
+}
+
+// files returns the key files in where, with the names given by ks.
+func (ks *keygenState) files(where string) keyFiles {
+	files := keyFilesIn(where)
+	if ks.names.public != "" {
+		files.public = filepath.Join(where, ks.names.public)
+	}
+	if ks.names.secret != "" {
+		files.secret = filepath.Join(where, ks.names.secret)
+	}
+	if ks.names.archive != "" {
+		files.archive = filepath.Join(where, ks.names.archive)
+	}
+	if ks.archiveDir != "" {
+		ext := filepath.Join(subcmd.Tilde(ks.archiveDir), filepath.Base(files.archive))
+		if ks.noLocalArch {
+			files.archive = ext
+		} else {
+			files.extArchive = ext
+		}
+	}
+	return files
+}
+
+// archives returns the files to which prior keys are appended.
+func (files keyFiles) archives() []string {
+	if files.extArchive == "" {
+		return []string{files.archive}
+	}
+	return []string{files.archive, files.extArchive}
+}
+
+// shares returns the files that hold the n shares of the secret seed.
+func (files keyFiles) shares(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s.share%d", files.secret, i+1)
+	}
+	return names
+}
+
+// escrow returns the file that holds the secret seed sealed for escrow.
+func (files keyFiles) escrow() string {
+	return filepath.Join(filepath.Dir(files.secret), escrowKeyFile)
+}
+
+// parseSplit returns the numbers in the value of a -split flag, K-of-N,
+// or zeros if it is empty.
+func (s *State) parseSplit(split string) (k, n int) {
+	if split == "" {
+		return 0, 0
+	}
+	_, err := fmt.Sscanf(split, "%d-of-%d", &k, &n)
+	if err != nil || fmt.Sprintf("%d-of-%d", k, n) != split || k < 2 || k > n || n > shamir.MaxShares {
+		s.Exitf("invalid -split %q: must be K-of-N, where 2 <= K <= N <= %d", split, shamir.MaxShares)
+	}
+	return k, n
+}
+
+// exported returns the files that hold the keys of files exported in
+// the given format.
+func (files keyFiles) exported(format string) keyFiles {
+	return keyFiles{
+		public: files.public + "." + format,
+		secret: files.secret + "." + format,
+	}
+}
+
+// exportKeys converts an Upspin key pair to the given format,
+// pem or openssh.
+func exportKeys(format, public, private string) (pub, priv []byte, err error) {
+	if format == "pem" {
+		return keygen.ExportPEM(upspin.PublicKey(public), private)
+	}
+	return keygen.ExportOpenSSH(upspin.PublicKey(public), private, "upspin")
+}
+
+// nameFlags returns the flags that reproduce any key file names that
+// are not the defaults, for use in a command line.
+func (ks *keygenState) nameFlags() string {
+	var flags string
+	for _, f := range []struct{ flag, name, def string }{
+		{"publicfile", ks.names.public, publicKeyFile},
+		{"secretfile", ks.names.secret, secretKeyFile},
+		{"archivefile", ks.names.archive, archiveKeyFile},
+	} {
+		if f.name != "" && f.name != f.def {
+			flags += fmt.Sprintf(" -%s %s", f.flag, f.name)
+		}
+	}
+	return flags
+}
+
+// keygenResult is the JSON object written by keygen -json on success.
+type keygenResult struct {
+	Curve       string
+	PublicKey   upspin.PublicKey
+	KeyHash     string // Hex-encoded SHA-256 hash of PublicKey.
+	Fingerprint string // Short form of KeyHash, as printed by keygen.
+	// SecurityBits is the security level of the keys: that of
+	// the curve, but no more than the seed can provide.
+	SecurityBits int
+	SecretSeed   string
+	Files        []string
+}
+
+// keygenError is the JSON object written by keygen -json on failure.
+type keygenError struct {
+	Error    string
+	ExitCode int // The status with which keygen exits.
+}
+
+// Exit statuses of keygen, so that scripts can tell failures apart.
+// Other failures exit with status 1, or 2 for flags that do not parse.
+const (
+	keygenExitSeed  = 3 // The secret seed or entropy is not valid.
+	keygenExitCurve = 4 // The curve is not supported.
+	keygenExitExist = 5 // Prior keys exist and neither -rotate nor -force was given.
+	keygenExitIO    = 6 // A file could not be read or written.
+	keygenExitBad   = 7 // With verifykeys, the keys fail a check; with -expect-public, the key is not the one expected; the new keys fail the self-test.
+)
+
+// keygenExitCode returns the exit status for err, according to its kind.
+func keygenExitCode(err error) int {
+	if _, ok := err.(*os.PathError); ok {
+		return keygenExitIO
+	}
+	switch {
+	case errors.Match(errExist, err):
+		return keygenExitExist
+	case errors.Match(errors.E(errors.IO), err):
+		return keygenExitIO
+	case errors.Match(errors.E(errors.Invalid), err):
+		return keygenExitSeed
+	}
+	return 1
+}
+
+// exitf reports the error and exits with the given status. With -json,
+// the error is written to standard output as a keygenError rather than
+// as text.
+func (ks *keygenState) exitf(code int, format string, args ...interface{}) {
+	s := ks.state
+	if ks.json {
+		ks.writeJSON(keygenError{Error: fmt.Sprintf(format, args...), ExitCode: code})
+	} else {
+		fmt.Fprintf(s.Stderr, "upspin: %s: %s\n", s.Name, fmt.Sprintf(format, args...))
+	}
+	if s.Interactive {
+		panic("exit")
+	}
+	s.ExitCode = code
+	s.ExitNow()
+}
+
+// inlineSeedFlag returns the name of the flag, if any, that gives the
+// secret seed, or the secret for one, on the command line itself rather
+// than in a file or on standard input.
+func inlineSeedFlag(secretSeed, secretHex, secretB64 string) string {
+	switch {
+	case secretHex != "":
+		return "-secret-hex"
+	case secretB64 != "":
+		return "-secret-b64"
+	case secretSeed == "" || secretSeed == "-":
+		return ""
+	case keygen.CheckSeed(secretSeed) == nil:
+		return "-secretseed"
+	}
+	// Not a valid seed, but if it is not a file either it is most
+	// likely a mistyped one, which is still a secret.
+	if _, err := os.Stat(subcmd.Tilde(secretSeed)); os.IsNotExist(err) {
+		return "-secretseed"
+	}
+	return ""
+}
+
+// checkInlineSeed warns, prominently, that a seed given on the command
+// line is recorded in the shell's history and was visible to other users
+// of the machine, or with noInline refuses it.
+func (ks *keygenState) checkInlineSeed() {
+	if ks.inlineSeed == "" {
+		return
+	}
+	if ks.noInline {
+		ks.exitf(keygenExitSeed, "%s gives the secret on the command line, which -no-inline-seed forbids; give -secretseed a file holding the seed, or - to read it from standard input", ks.inlineSeed)
 	}
+	w := ks.state.Stderr
+	fmt.Fprintf(w, "Warning: the secret was given on the command line, with %s.\n", ks.inlineSeed)
+	fmt.Fprintln(w, "It is now in your shell's history, and other users of this machine could see it, with ps for instance, while keygen ran.")
+	fmt.Fprintln(w, "Remove it from the history; in bash, history -d deletes an entry and history -c clears them all.")
+	fmt.Fprintln(w, "Next time, give -secretseed the name of a file holding the seed, or - to read it from standard input.")
+}
 
-	public, private, secretStr, err := s.createKeys(curve, secretseed)
+// writeJSON writes v as indented JSON to standard output.
+func (ks *keygenState) writeJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "\t")
 	if err != nil {
-		s.Exitf("creating keys: %v", err)
+		ks.state.Exit(err)
+	}
+	fmt.Fprintf(ks.state.Stdout, "%s\n", b)
+}
+
+// defaultKeyDir returns the directory in which clients using the config
+// file look for the user's keys, for keygen given no directory: the
+// secrets directory the config names, or the default for its user.
+func (ks *keygenState) defaultKeyDir() string {
+	fail := func(code int, format string, args ...interface{}) {
+		ks.exitf(code, "no directory given, and "+format+"; give the directory for the keys", args...)
+	}
+	file := flags.Config
+	if !filepath.IsAbs(file) {
+		home, err := config.Homedir()
+		if err != nil {
+			fail(1, "no home directory to find the config file: %v", err)
+		}
+		file = filepath.Join(home, file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fail(keygenExitIO, "cannot read the config file to find the default: %v", err)
+	}
+	var cfg struct {
+		UserName upspin.UserName `yaml:"username"`
+		Secrets  string          `yaml:"secrets"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		fail(keygenExitIO, "cannot parse the config file %s: %v", file, err)
+	}
+	switch {
+	case cfg.Secrets == "none":
+		fail(1, "the config file %s has no secrets directory", file)
+	case cfg.Secrets != "":
+		return subcmd.Tilde(cfg.Secrets)
+	case cfg.UserName == "":
+		fail(1, "the config file %s names no user", file)
+	}
+	name, err := user.Clean(cfg.UserName)
+	if err != nil {
+		fail(1, "the config file %s names a bad user: %v", file, err)
+	}
+	dir, err := config.DefaultSecretsDir(name)
+	if err != nil {
+		fail(1, "%v", err)
+	}
+	return dir
+}
+
+// isCurve reports whether keys can be made on the named curve.
+func isCurve(name string) bool {
+	for _, curve := range keygen.Curves() {
+		if curve == name {
+			return true
+		}
+	}
+	return false
+}
+
+// keygenCurves makes key pairs for each of the curves from a single
+// seed, so that one recorded seed recreates them all, and writes each
+// pair to the subdirectory of where named for its curve.
+func (s *State) keygenCurves(ks *keygenState, where string, curves []string) {
+	seen := make(map[string]bool)
+	for _, curve := range curves {
+		if !isCurve(curve) {
+			ks.exitf(keygenExitCurve, "no such curve %q", curve)
+		}
+		if seen[curve] {
+			ks.exitf(1, "curve %s given twice", curve)
+		}
+		seen[curve] = true
 	}
 
-	err = s.saveKeys(where, rotate, public, private)
+	// Settle the seed once, reading it from its file or standard
+	// input or making a new one, for the keys of every curve.
+	entropy := ks.entropy
+	if ks.entropyFile != "" {
+		f, err := os.Open(subcmd.Tilde(ks.entropyFile))
+		if err != nil {
+			ks.exitf(keygenExitIO, "opening entropy source: %v", err)
+		}
+		defer f.Close()
+		entropy = f
+	}
+	_, _, seed, err := s.createKeys(curves[0], ks.secretseed, entropy)
+	if err != nil {
+		ks.exitf(keygenExitCode(err), "creating keys: %v", err)
+	}
+	for _, curve := range curves {
+		each := *ks
+		each.curve = curve
+		each.curveSet = true
+		each.secretseed = seed
+		each.entropyFile = ""
+		each.inlineSeed = ""
+		s.keygenCommand(&each, filepath.Join(where, curve))
+	}
+	if ks.secretseed != "" || ks.dryRun {
+		return
+	}
+	seed, err = ks.formatSeed(seed)
 	if err != nil {
-		s.Exitf("saving previous keys failed, keys not generated: %s", err)
+		ks.exitf(keygenExitCode(err), "creating keys: %v", err)
+	}
+	if strings.Contains(seed, " ") {
+		seed = "'" + seed + "'" // A mnemonic or spaced proquints; quote it for the shell.
+	}
+	fmt.Fprintln(s.Stderr, "If you lose the keys you can re-create them all by running this command:")
+	fmt.Fprintf(s.Stderr, "\tupspin keygen -curve %s -secretseed %s%s %s\n", ks.curve, seed, ks.nameFlags(), where)
+	fmt.Fprintln(s.Stderr, "Write this command down and store it in a secure, private place.")
+	fmt.Fprintln(s.Stderr, "Do not share your private key or this command with anyone.")
+}
+
+// formatSeed returns the seed in the form given by -seedformat and
+// -seedstyle.
+func (ks *keygenState) formatSeed(seed string) (string, error) {
+	if ks.seedFormat == "bip39" {
+		return keygen.Mnemonic(seed)
 	}
-	private = strings.TrimSpace(private) + " # " + secretStr + "\n"
-	err = s.writeKeys(where, public, private)
+	if ks.seedStyle != "" {
+		return keygen.FormatSeed(seed, ks.seedStyle)
+	}
+	return seed, nil
+}
+
+func (s *State) keygenCommand(ks *keygenState, where string) {
+	// The seed and keys are held in strings, which cannot be cleared,
+	// so at least keep them out of core dumps.
+	protectSecrets()
+	ks.checkInlineSeed()
+	if where == "" && !ks.stdout && !ks.publicOnly {
+		where = ks.defaultKeyDir()
+	}
+	if curves := strings.Split(ks.curve, ","); len(curves) > 1 {
+		s.keygenCurves(ks, where, curves)
+		return
+	}
+	if ks.rotate && !ks.stdout {
+		ks.rotateCurve(ks.files(where).public)
+	}
+	if !isCurve(ks.curve) {
+		ks.exitf(keygenExitCurve, "no such curve %q", ks.curve)
+	}
+	if strings.ContainsAny(ks.comment, "\r\n") {
+		ks.exitf(1, "-comment must be a single line")
+	}
+
+	if ks.publicOnly {
+		s.printPublicKey(ks)
+		return
+	}
+
+	files := ks.files(where)
+	exportFiles := files.exported(ks.export)
+	if !ks.stdout && !ks.dryRun {
+		// Find out now, before any keys are made, whether they can be saved.
+		names := []string{files.public, files.secret}
+		if ks.export != "" {
+			names = append(names, exportFiles.public, exportFiles.secret)
+		}
+		names = append(names, files.shares(ks.splitN)...)
+		if ks.escrowTo != "" {
+			names = append(names, files.escrow())
+		}
+		if ks.backupTo != "" {
+			names = append(names, ks.backupFile(files))
+		}
+		if err := checkWritable(ks.keyPerm().dir, names...); err != nil {
+			ks.exitf(keygenExitIO, "cannot write keys: %v", err)
+		}
+	}
+
+	escrowKey := ks.escrowKey()
+	backupProg, backupArgs, err := backupTool(ks.backupTo)
 	if err != nil {
-		s.Exitf("writing keys: %v", err)
+		ks.exitf(1, "%v", err)
+	}
+	if backupProg != "" {
+		if _, err := exec.LookPath(backupProg); err != nil {
+			ks.exitf(1, "-backup-recipient requires %s: %v", backupProg, err)
+		}
+	}
+
+	entropy := ks.entropy
+	if ks.entropyFile != "" {
+		f, err := os.Open(subcmd.Tilde(ks.entropyFile))
+		if err != nil {
+			ks.exitf(keygenExitIO, "opening entropy source: %v", err)
+		}
+		defer f.Close()
+		entropy = f
+	}
+	public, private, secretStr, err := s.createKeys(ks.curve, ks.secretseed, entropy)
+	if err != nil {
+		ks.exitf(keygenExitCode(err), "creating keys: %v", err)
+	}
+	ks.checkExpectedKey(public)
+	secretStr, err = ks.formatSeed(secretStr)
+	if err != nil {
+		ks.exitf(keygenExitCode(err), "creating keys: %v", err)
+	}
+	var shares []string
+	if ks.splitN > 0 {
+		shares, err = keygen.SplitSeed(secretStr, ks.splitK, ks.splitN)
+		if err != nil {
+			ks.exitf(keygenExitCode(err), "splitting seed: %v", err)
+		}
+	}
+	shareFiles := files.shares(ks.splitN)
+	var escrowed []byte
+	if escrowKey != "" {
+		escrowed, err = ee.Seal(escrowKey, []byte(secretStr))
+		if err != nil {
+			ks.exitf(1, "sealing seed for escrow: %v", err)
+		}
+	}
+	var exportPublic, exportPrivate []byte
+	if ks.export != "" {
+		exportPublic, exportPrivate, err = exportKeys(ks.export, public, private)
+		if err != nil {
+			ks.exitf(1, "exporting keys: %v", err)
+		}
+	}
+
+	if ks.rotate && !ks.stdout {
+		if err := s.checkRegisteredKey(files.public); err != nil {
+			if ks.strict {
+				ks.exitf(1, "%v", err)
+			}
+			fmt.Fprintf(s.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	if ks.dryRun {
+		err = s.dryRunKeys(files, ks.rotate, ks.force, public, private)
+		if err != nil {
+			ks.exitf(keygenExitCode(err), "%v", err)
+		}
+		if ks.grace {
+			fmt.Fprintf(s.Stdout, "The prior key pair would also be kept in %s until finalizekeys.\n", files.secret)
+		}
+		if ks.export != "" {
+			fmt.Fprintf(s.Stdout, "Keys in %s format would be written to:\n", ks.export)
+			fmt.Fprintf(s.Stdout, "\t%s\n", exportFiles.public)
+			fmt.Fprintf(s.Stdout, "\t%s\n", exportFiles.secret)
+		}
+		if ks.qrFile != "" {
+			fmt.Fprintf(s.Stdout, "The secret seed QR code would be written to:\n\t%s\n", ks.qrFile)
+		}
+		if ks.sheetFile != "" {
+			fmt.Fprintf(s.Stdout, "A recovery sheet would be written to:\n\t%s\n", ks.sheetFile)
+		}
+		if len(shares) > 0 {
+			fmt.Fprintf(s.Stdout, "%d shares of the secret seed, any %d of which recreate it, would be written to:\n", ks.splitN, ks.splitK)
+			for _, name := range shareFiles {
+				fmt.Fprintf(s.Stdout, "\t%s\n", name)
+			}
+		}
+		if escrowed != nil {
+			fmt.Fprintf(s.Stdout, "The secret seed sealed for escrow would be written to:\n\t%s\n", files.escrow())
+		}
+		if backupProg != "" {
+			fmt.Fprintf(s.Stdout, "A copy of the secret key encrypted by %s would be written to:\n\t%s\n", backupProg, ks.backupFile(files))
+		}
+		return
+	}
+
+	if ks.stdout {
+		if ks.selfTest {
+			if err := signChallenge([]byte(public), []byte(private), nil); err != nil {
+				ks.exitf(keygenExitBad, "the new keys fail the self-test: %v", err)
+			}
+		}
+		if ks.export != "" {
+			s.Stdout.Write(exportPublic)
+			s.Stdout.Write(exportPrivate)
+			fmt.Fprintf(s.Stderr, "Private/public key pair written to standard output in %s format.\n", ks.export)
+		} else {
+			private = strings.TrimSpace(private) + " # " + secretStr + "\n"
+			s.printKeys(files, ks.labeled(public), ks.labeled(private))
+			fmt.Fprintln(s.Stderr, "Upspin private/public key pair written to standard output.")
+		}
+	} else {
+		if ks.rotate && !ks.yes {
+			ks.confirmRotate(files)
+		}
+		var grace string
+		if ks.grace {
+			prior, err := readPriorKeys(files, true)
+			if err != nil {
+				ks.exitf(keygenExitCode(err), "%v", err)
+			}
+			if !prior.same(public, private) {
+				grace = factotum.GraceKey(prior.archived())
+			}
+		}
+		if !ks.force {
+			err = s.saveKeys(files, ks.rotate, public, private)
+		}
+		switch {
+		case errors.Match(errExist, err), errors.Match(errNotExist, err):
+			ks.exitf(keygenExitCode(err), "%v", err)
+		case err != nil:
+			ks.exitf(keygenExitIO, "saving previous keys failed, keys not generated: %s", err)
+		}
+		private = strings.TrimSpace(private) + " # " + secretStr + "\n"
+		secretKey := checksummed(ks.labeled(private) + grace)
+		err = s.writeKeys(files, ks.labeled(public), secretKey, ks.keyPerm())
+		if err != nil {
+			ks.exitf(keygenExitIO, "writing keys: %v", err)
+		}
+		if ks.selfTest {
+			if err := selfTestKeys(files); err != nil {
+				ks.exitf(keygenExitBad, "the keys written to %s fail the self-test and must not be used: %v", where, err)
+			}
+		}
+		fmt.Fprintln(s.Stderr, "Upspin private/public key pair written to:")
+		fmt.Fprintf(s.Stderr, "\t%s\n", files.public)
+		fmt.Fprintf(s.Stderr, "\t%s\n", files.secret)
+		if grace != "" {
+			fmt.Fprintln(s.Stderr, "The prior key pair is kept in the secret key file too.")
+			fmt.Fprintf(s.Stderr, "Once it is no longer needed, run:\n\tupspin finalizekeys%s %s\n", ks.nameFlags(), where)
+		}
+		if err := ks.logKeys(filepath.Join(where, logKeyFile), public, time.Now()); err != nil {
+			fmt.Fprintf(s.Stderr, "Warning: recording the keys in the log: %v\n", err)
+		}
+		if ks.export != "" {
+			err = s.writeKeys(exportFiles, string(exportPublic), string(exportPrivate), ks.keyPerm())
+			if err != nil {
+				ks.exitf(keygenExitIO, "writing exported keys: %v", err)
+			}
+			fmt.Fprintf(s.Stderr, "Keys in %s format written to:\n", ks.export)
+			fmt.Fprintf(s.Stderr, "\t%s\n", exportFiles.public)
+			fmt.Fprintf(s.Stderr, "\t%s\n", exportFiles.secret)
+		}
+		if len(shares) > 0 {
+			if err := writeShares(shareFiles, shares, ks.keyPerm()); err != nil {
+				ks.exitf(keygenExitIO, "writing shares: %v", err)
+			}
+			fmt.Fprintf(s.Stderr, "%d shares of the secret seed, any %d of which recreate it, written to:\n", ks.splitN, ks.splitK)
+			for _, name := range shareFiles {
+				fmt.Fprintf(s.Stderr, "\t%s\n", name)
+			}
+			fmt.Fprintln(s.Stderr, "Move each share to a different secure, private place.")
+		}
+		if escrowed != nil {
+			if err := writeKeyFile(files.escrow(), string(escrowed), ks.keyPerm()); err != nil {
+				ks.exitf(keygenExitIO, "writing escrow file: %v", err)
+			}
+			fmt.Fprintf(s.Stderr, "The secret seed sealed for escrow written to:\n\t%s\n", files.escrow())
+			fmt.Fprintln(s.Stderr, "Send this file to the escrow agent.")
+		}
+		if backupProg != "" {
+			backup, err := encryptBackup(backupProg, backupArgs, secretKey)
+			if err != nil {
+				ks.exitf(1, "keys written, but backing up the secret key failed: %v", err)
+			}
+			if err := writeKeyFile(ks.backupFile(files), string(backup), ks.keyPerm()); err != nil {
+				ks.exitf(keygenExitIO, "writing backup of the secret key: %v", err)
+			}
+			fmt.Fprintf(s.Stderr, "A copy of the secret key encrypted by %s written to:\n\t%s\n", backupProg, ks.backupFile(files))
+		}
+	}
+	fingerprint := keygen.Fingerprint(upspin.PublicKey(public))
+	fmt.Fprintf(s.Stderr, "The public key fingerprint is %s.\n", fingerprint)
+	fmt.Fprintf(s.Stderr, "The public key hash, as the key server computes it, is %s.\n", keyHash([]byte(public)))
+	curveBits, err := keygen.SecurityBits(ks.curve)
+	if err != nil {
+		ks.exitf(keygenExitCurve, "%v", err)
+	}
+	securityBits := curveBits
+	if securityBits > keygen.SeedBits {
+		securityBits = keygen.SeedBits
+	}
+	fmt.Fprintf(s.Stderr, "Keys on the %s curve are about as hard to break as a %d-bit symmetric key.\n", ks.curve, curveBits)
+	if curveBits > keygen.SeedBits {
+		fmt.Fprintf(s.Stderr, "Warning: the secret seed holds only %d bits, so these keys provide at most %d bits of security.\n", keygen.SeedBits, securityBits)
+		fmt.Fprintln(s.Stderr, "They are slower than p256 keys but, made from a seed, no more secure.")
 	}
-	fmt.Fprintln(s.Stderr, "Upspin private/public key pair written to:")
-	fmt.Fprintf(s.Stderr, "\t%s\n", filepath.Join(where, "public.upspinkey"))
-	fmt.Fprintf(s.Stderr, "\t%s\n", filepath.Join(where, "secret.upspinkey"))
 	fmt.Fprintln(s.Stderr, "This key pair provides access to your Upspin identity and data.")
-	if secretseed == "" {
+	if ks.stdout {
+		where = "-stdout"
+	}
+	seedArg := secretStr
+	if strings.Contains(seedArg, " ") {
+		seedArg = "'" + seedArg + "'" // A mnemonic or spaced proquints; quote it for the shell.
+	}
+	recreate := fmt.Sprintf("upspin keygen -curve %s -secretseed %s%s %s", ks.curve, seedArg, ks.nameFlags(), where)
+	if ks.secretseed == "" {
 		fmt.Fprintln(s.Stderr, "If you lose the keys you can re-create them by running this command:")
-		fmt.Fprintf(s.Stderr, "\tupspin keygen -curve %s -secretseed %s %s\n", curve, secretseed, where)
+		fmt.Fprintf(s.Stderr, "\t%s\n", recreate)
 		fmt.Fprintln(s.Stderr, "Write this command down and store it in a secure, private place.")
 		fmt.Fprintln(s.Stderr, "Do not share your private key or this command with anyone.")
 	}
-	if rotate {
+	if len(shares) > 0 {
+		fmt.Fprintf(s.Stderr, "To re-create the keys from %d of the shares, put them in a file, one to a line, and run:\n", ks.splitK)
+		fmt.Fprintf(s.Stderr, "\tupspin keygen -curve %s -secretseed <file>%s %s\n", ks.curve, ks.nameFlags(), where)
+	}
+	if ks.qr {
+		if err := s.writeSeedQR(ks.qrFile, secretStr); err != nil {
+			ks.exitf(keygenExitIO, "writing QR code: %v", err)
+		}
+	}
+	if ks.sheetFile != "" {
+		sheet := &recoverySheet{
+			user:        ks.sheetUser,
+			curve:       ks.curve,
+			fingerprint: fingerprint,
+			seed:        secretStr,
+			command:     recreate,
+		}
+		if err := s.writeRecoverySheet(ks.sheetFile, sheet); err != nil {
+			ks.exitf(keygenExitIO, "writing recovery sheet: %v", err)
+		}
+	}
+	if ks.rotate {
 		fmt.Fprintln(s.Stderr, "\nTo install new keys in the key server, see 'upspin rotate -help'.")
 	}
 	fmt.Fprintln(s.Stderr)
+	if ks.nextSteps {
+		s.printNextSteps(ks, files, public, where)
+	}
+	if ks.json {
+		names := []string{files.public, files.secret}
+		if ks.export != "" {
+			names = append(names, exportFiles.public, exportFiles.secret)
+		}
+		names = append(names, shareFiles...)
+		if escrowed != nil {
+			names = append(names, files.escrow())
+		}
+		if backupProg != "" {
+			names = append(names, ks.backupFile(files))
+		}
+		ks.writeJSON(keygenResult{
+			Curve:        ks.curve,
+			PublicKey:    upspin.PublicKey(public),
+			KeyHash:      keyHash([]byte(public)),
+			Fingerprint:  fingerprint,
+			SecurityBits: securityBits,
+			SecretSeed:   secretStr,
+			Files:        names,
+		})
+	}
+}
+
+// isTerminal reports whether r is a terminal.
+// It is a variable so tests can pretend to be one.
+var isTerminal = func(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmRotate asks for confirmation that the keys in files are to be
+// replaced and exits unless it is given. It refuses outright if standard
+// input is not a terminal, since then nobody is there to answer.
+func (ks *keygenState) confirmRotate(files keyFiles) {
+	s := ks.state
+	dir := filepath.Dir(files.secret)
+	if !isTerminal(s.Stdin) {
+		ks.exitf(1, "standard input is not a terminal; use -yes to rotate the keys for %s", dir)
+	}
+	if desc := describeKeys(files.public); desc != "" {
+		dir += " (" + desc + ")"
+	}
+	fmt.Fprintf(s.Stderr, "This will replace the keys for %s. Type YES to continue: ", dir)
+	answer, _ := bufio.NewReader(s.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != "YES" {
+		ks.exitf(1, "keys not rotated")
+	}
+}
+
+// writeSeedQR encodes the secret seed as a QR code and writes it as a PNG
+// image to the named file or, if there is none, draws it on standard error.
+func (s *State) writeSeedQR(file, secretStr string) error {
+	code, err := qr.Encode(secretStr, qr.M)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		fmt.Fprintln(s.Stderr, "The secret seed as a QR code:")
+		printQR(s.Stderr, code)
+		return nil
+	}
+	file = subcmd.Tilde(file)
+	if err := ioutil.WriteFile(file, code.PNG(), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.Stderr, "The secret seed QR code written to:\n\t%s\n", file)
+	return nil
+}
+
+// qrQuietZone is the width in modules of the blank margin that scanners
+// need around a QR code.
+const qrQuietZone = 4
+
+// printQR draws code on w, two columns to each module so it comes out
+// roughly square. The modules are drawn as ANSI background colors rather
+// than as characters so the code reads the same on light and dark
+// terminals.
+func printQR(w io.Writer, code *qr.Code) {
+	const (
+		black = "\x1b[40m"
+		white = "\x1b[47m"
+		reset = "\x1b[0m"
+	)
+	var buf bytes.Buffer
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y++ {
+		color := ""
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			// Black reports false outside the code.
+			c := white
+			if code.Black(x, y) {
+				c = black
+			}
+			if c != color {
+				buf.WriteString(c)
+				color = c
+			}
+			buf.WriteString("  ")
+		}
+		buf.WriteString(reset + "\n")
+	}
+	w.Write(buf.Bytes())
 }
 
-func (s *State) createKeys(curveName, secretFlag string) (public, private, secretStr string, err error) {
-	// Pick secret 128 bits.
-	// TODO(ehg)  Consider whether we are willing to ask users to write long seeds for P521.
-	b := make([]byte, 16)
+// seedFromSecret returns the proquint seed holding the 128-bit secret
+// given by the -secret-hex flag, as hexStr, or the -secret-b64 flag, as
+// b64Str. Only one of them may be set. Base64 may be in the standard or
+// URL-safe alphabet, with or without padding.
+func seedFromSecret(hexStr, b64Str string) (string, error) {
+	var b []byte
+	var err error
+	if hexStr != "" {
+		hexStr = strings.TrimPrefix(strings.TrimSpace(hexStr), "0x")
+		b, err = hex.DecodeString(hexStr)
+		if err != nil {
+			return "", errors.E("keygen", errors.Invalid, errors.Errorf("-secret-hex: %v", err))
+		}
+	} else {
+		b64Str = strings.TrimSpace(b64Str)
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			b, err = enc.DecodeString(b64Str)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", errors.E("keygen", errors.Invalid, errors.Errorf("-secret-b64: %v", err))
+		}
+	}
+	defer keygen.Zero(b)
+	return keygen.SeedFromBytes(b)
+}
 
-	// There are three cases:
+// createKeys creates a key pair for the named curve from the secret seed
+// described by secretFlag. If there is no secretFlag, it makes a new seed
+// from the bits read from entropy or, if entropy is nil, from the system's
+// random source.
+func (s *State) createKeys(curveName, secretFlag string, entropy io.Reader) (public, private, secretStr string, err error) {
+	// There are four cases:
 	// 1) No secretFlag was given. Create a new secret seed.
 	// 2) A secretFlag looks valid. Accept it.
-	// 3) The secretFlag must be a file. Try to read it.
+	// 3) The secretFlag is "-". Read the seed from standard input.
+	// 4) The secretFlag must be a file. Try to read it.
 	switch {
-	case secretFlag == "":
-		ee.GenEntropy(b)
-		proquints := make([]interface{}, 8)
-		for i := 0; i < 8; i++ {
-			proquints[i] = proquint.Encode(binary.BigEndian.Uint16(b[2*i : 2*i+2]))
+	case secretFlag == "" && entropy != nil:
+		secretStr, err = keygen.NewSeedFrom(entropy)
+		if err != nil {
+			return "", "", "", err
 		}
-		secretStr = fmt.Sprintf("%s-%s-%s-%s.%s-%s-%s-%s", proquints...)
-		// Ignore punctuation on input;  this format is just to help the user keep their place.
-
-	case validSecretSeed(secretFlag):
+	case secretFlag == "":
+		// keygen.FromSeed creates a new one.
+	case keygen.CheckSeed(secretFlag) == nil:
 		secretStr = secretFlag
 	default:
-		data, err := ioutil.ReadFile(subcmd.Tilde(secretFlag))
+		var data []byte
+		if secretFlag == "-" {
+			data, err = ioutil.ReadAll(s.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(subcmd.Tilde(secretFlag))
+		}
+		defer lockSecret(data)()
+		if os.IsNotExist(err) && (len(secretFlag) == keygen.SeedLen || len(strings.Fields(secretFlag)) == keygen.MnemonicWords) {
+			// Most likely a mistyped seed rather than a file name;
+			// say what is wrong with it.
+			return "", "", "", errors.E("keygen", errors.Invalid, keygen.CheckSeed(secretFlag))
+		}
 		if err != nil {
 			return "", "", "", errors.E("keygen", errors.IO, err)
 		}
 		secretStr = strings.TrimSpace(string(data))
+		if shares := strings.Fields(secretStr); len(shares) > 0 && keygen.CheckShare(shares[0]) == nil {
+			// Shares of a seed made with -split.
+			secretStr, err = keygen.CombineShares(shares)
+			if err != nil {
+				return "", "", "", errors.E("keygen", err)
+			}
+		}
+		if err := keygen.CheckSeed(secretStr); err != nil {
+			log.Printf("expected secret like\n lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat\n"+
+				"or a %d-word BIP 39 mnemonic, not\n %s\nkey not generated", keygen.MnemonicWords, secretStr)
+			return "", "", "", errors.E("keygen", errors.Invalid, err)
+		}
 	}
+	return keygen.FromSeed(curveName, secretStr)
+}
 
-	if !validSecretSeed(secretStr) {
-		log.Printf("expected secret like\n lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat\n"+
-			"not\n %s\nkey not generated", secretStr)
-		return "", "", "", errors.E("keygen", errors.Invalid, errors.Str("bad format for secret"))
-	}
-	for i := 0; i < 8; i++ {
-		binary.BigEndian.PutUint16(b[2*i:2*i+2], proquint.Decode([]byte((secretStr)[6*i:6*i+5])))
+// checkWritable reports an error unless the directory holding each of
+// the named files exists, or can be created with mode dirMode, and files
+// can be created in it.
+func checkWritable(dirMode os.FileMode, names ...string) error {
+	for _, name := range names {
+		dir := filepath.Dir(name)
+		if err := os.MkdirAll(dir, dirMode); err != nil {
+			return err
+		}
+		fd, err := ioutil.TempFile(dir, ".keygen")
+		if err != nil {
+			return err
+		}
+		fd.Close()
+		os.Remove(fd.Name())
 	}
+	return nil
+}
 
-	pub, priv, err := ee.CreateKeys(curveName, b)
+// writeTempKey writes a key to a new temporary file in the directory
+// of the named file, creating the directory if necessary, and returns
+// the temporary file's name. The file and directory are created with
+// the modes in perm, narrowed by the umask; the file is left unwritable.
+func writeTempKey(name, key string, perm keyPerm) (string, error) {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, perm.dir); err != nil {
+		return "", err
+	}
+	fd, err := createTemp(dir, "."+filepath.Base(name), perm.file)
 	if err != nil {
-		return "", "", "", err
+		return "", err
+	}
+	tmp := fd.Name()
+	_, err = fd.WriteString(key)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
 	}
-	return string(pub), priv, secretStr, nil
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
 }
 
-// validSecretSeed reports whether a seed conforms to the proquint format.
-// TODO: this could be more strict.
-func validSecretSeed(seed string) bool {
-	return len(seed) == 47 && seed[5] == '-'
+// createTemp is like ioutil.TempFile but creates the file with the
+// given mode, rather than 0600, before the umask is applied. The file
+// is open for writing even if the mode does not allow it.
+func createTemp(dir, prefix string, mode os.FileMode) (*os.File, error) {
+	var err error
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		var f *os.File
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+	return nil, err
 }
 
-// writeKeyFile writes a single key to its file, removing the file
+// renameKey moves the temporary key file tmp to name, removing name
 // beforehand if necessary due to permission errors.
-// If the file's parent directory does not exist, writeKeyFile creates it.
-func (s *State) writeKeyFile(name, key string) error {
-	// Make the directory if it does not exist.
-	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
-		return err
-	}
-	// Create the file.
-	const create = os.O_RDWR | os.O_CREATE | os.O_TRUNC
-	fd, err := os.OpenFile(name, create, 0400)
+func renameKey(tmp, name string) error {
+	err := os.Rename(tmp, name)
 	if os.IsPermission(err) && os.Remove(name) == nil {
-		// Create may fail if file already exists and is unwritable,
+		// Rename may fail if the file already exists and is unwritable,
 		// which is how it was created.
-		fd, err = os.OpenFile(name, create, 0400)
+		err = os.Rename(tmp, name)
+	}
+	return err
+}
+
+// writeShares writes each share of the secret seed to the file
+// of the same index, with the modes in perm.
+func writeShares(names, shares []string, perm keyPerm) error {
+	for i, name := range names {
+		if err := writeKeyFile(name, shares[i]+"\n", perm); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// writeKeyFile replaces the named file with one holding data, with the
+// modes in perm.
+func writeKeyFile(name, data string, perm keyPerm) error {
+	tmp, err := writeTempKey(name, data, perm)
 	if err != nil {
 		return err
 	}
-	// Write the key.
-	_, err = fd.WriteString(key)
+	if err := renameKey(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// printPublicKey writes the public key made from the seed given with
+// -secretseed to standard output, and its fingerprint to standard error.
+func (s *State) printPublicKey(ks *keygenState) {
+	public, _, _, err := s.createKeys(ks.curve, ks.secretseed, nil)
+	if err != nil {
+		ks.exitf(keygenExitCode(err), "creating keys: %v", err)
+	}
+	ks.checkExpectedKey(public)
+	fmt.Fprint(s.Stdout, ks.labeled(public))
+	fmt.Fprintf(s.Stderr, "The public key fingerprint is %s.\n", keygen.Fingerprint(upspin.PublicKey(public)))
+	fmt.Fprintf(s.Stderr, "The public key hash, as the key server computes it, is %s.\n", keyHash([]byte(public)))
+}
+
+// checkExpectedKey exits unless public, a new public key, is the one
+// given by the -expect-public flag, if it was given. The flag's value
+// may be the key itself, recognized by its several lines, its
+// fingerprint, or the name of a file holding it.
+func (ks *keygenState) checkExpectedKey(public string) {
+	if ks.expectPub == "" {
+		return
+	}
+	got := keygen.Fingerprint(upspin.PublicKey(strings.TrimSpace(public) + "\n"))
+	want := strings.TrimSpace(ks.expectPub)
+	switch {
+	case strings.Contains(want, "\n"):
+		want = keygen.Fingerprint(upspin.PublicKey(want + "\n"))
+	case isFingerprint(want):
+		// Compare as it is.
+	default:
+		data, err := ioutil.ReadFile(subcmd.Tilde(want))
+		if err != nil {
+			ks.exitf(keygenExitIO, "reading expected public key: %v", err)
+		}
+		data = factotum.StripCommentLines(bytes.Replace(data, []byte("\r"), nil, -1))
+		want = keygen.Fingerprint(upspin.PublicKey(strings.TrimSpace(string(data)) + "\n"))
+	}
+	if got != want {
+		ks.exitf(keygenExitBad, "the new public key (fingerprint %s) is not the one expected (fingerprint %s); is the secret seed the right one?", got, want)
+	}
+}
+
+// escrowKey returns the public key in the file given by the -escrow-to
+// flag, if it was given, after checking that it can be sealed for.
+func (ks *keygenState) escrowKey() upspin.PublicKey {
+	if ks.escrowTo == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(subcmd.Tilde(ks.escrowTo))
+	if err != nil {
+		ks.exitf(keygenExitIO, "reading escrow public key: %v", err)
+	}
+	data = factotum.StripCommentLines(bytes.Replace(data, []byte("\r"), nil, -1))
+	key := upspin.PublicKey(strings.TrimSpace(string(data)) + "\n")
+	if _, err := factotum.ParsePublicKey(key); err != nil {
+		ks.exitf(1, "escrow public key in %s: %v", ks.escrowTo, err)
+	}
+	return key
+}
+
+// backupTool returns the program, age or gpg, that encrypts a backup of
+// the secret key for recipient, and the arguments with which to run it,
+// judging by the form of recipient. It returns no program if recipient
+// is empty.
+func backupTool(recipient string) (tool string, args []string, err error) {
+	switch {
+	case recipient == "":
+		return "", nil, nil
+	case strings.HasPrefix(recipient, "age1"), strings.HasPrefix(recipient, "ssh-"):
+		return "age", []string{"-r", recipient}, nil
+	case isKeyID(recipient):
+		return "gpg", []string{"--batch", "--quiet", "--encrypt", "--recipient", recipient, "--output", "-"}, nil
+	}
+	return "", nil, errors.Errorf("-backup-recipient %q is neither an age recipient nor a GPG key ID", recipient)
+}
+
+// isKeyID reports whether s is written as a GPG key ID or fingerprint:
+// 8, 16, or 40 hexadecimal digits, perhaps after 0x.
+func isKeyID(s string) bool {
+	s = strings.TrimPrefix(s, "0x")
+	switch len(s) {
+	case 8, 16, 40:
+		_, err := hex.DecodeString(s)
+		return err == nil
+	}
+	return false
+}
+
+// backupFile returns the file that holds the encrypted backup of the
+// secret key in files, named for the program that encrypts it.
+func (ks *keygenState) backupFile(files keyFiles) string {
+	tool, _, _ := backupTool(ks.backupTo)
+	return files.secret + "." + tool
+}
+
+// encryptBackup returns secret encrypted by the program tool, run with
+// args. The secret is passed on the program's standard input and the
+// result read from its standard output, so neither touches the disk.
+func encryptBackup(tool string, args []string, secret string) ([]byte, error) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = strings.NewReader(secret)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Errorf("%s: %v: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.Errorf("%s wrote nothing", tool)
+	}
+	return stdout.Bytes(), nil
+}
+
+// isFingerprint reports whether s is written as a key fingerprint,
+// such as 89ab:cdef:0123:4567.
+func isFingerprint(s string) bool {
+	groups := strings.Split(s, ":")
+	if len(groups) != 4 {
+		return false
+	}
+	for _, g := range groups {
+		if len(g) != 4 || strings.Trim(g, "0123456789abcdef") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// selfTestChallenge is the text keygen signs to test new keys.
+const selfTestChallenge = "upspin keygen self-test"
+
+// selfTestKeys reads back the keys written to files and checks, with
+// signChallenge, that they work.
+func selfTestKeys(files keyFiles) error {
+	secret, err := ioutil.ReadFile(files.secret)
+	if err != nil {
+		return err
+	}
+	defer lockSecret(secret)()
+	public, err := ioutil.ReadFile(files.public)
 	if err != nil {
-		fd.Close()
 		return err
 	}
-	return fd.Close()
+	private, err := factotum.CheckSecret(secret)
+	if err != nil {
+		return err
+	}
+	private, previous, err := factotum.SplitGrace(private)
+	if err != nil {
+		return err
+	}
+	return signChallenge(factotum.StripCommentLines(public), factotum.StripCommentLines(private), previous)
+}
+
+// signChallenge signs selfTestChallenge with the private key, as the
+// ee packing signs a directory entry, and checks the signature with the
+// public key.
+func signChallenge(public, private, previous []byte) error {
+	f, err := factotum.NewFromKeys(public, private, previous)
+	if err != nil {
+		return err
+	}
+	hash := f.DirEntryHash(selfTestChallenge, "", upspin.AttrNone, upspin.EEPack, 0, nil, nil)
+	sig, err := f.FileSign(hash)
+	if err != nil {
+		return err
+	}
+	return factotum.Verify(hash, sig, upspin.PublicKey(public))
+}
 
+// printKeys writes both the public and private keys to standard output,
+// each enclosed in marker lines naming the file that would hold it.
+func (s *State) printKeys(files keyFiles, publicKey, privateKey string) {
+	for _, k := range []struct{ name, key string }{
+		{filepath.Base(files.public), publicKey},
+		{filepath.Base(files.secret), privateKey},
+	} {
+		fmt.Fprintf(s.Stdout, "-----BEGIN %s-----\n", k.name)
+		fmt.Fprint(s.Stdout, k.key)
+		fmt.Fprintf(s.Stdout, "-----END %s-----\n", k.name)
+	}
 }
 
-// writeKeys save both the public and private keys to their respective files.
-func (s *State) writeKeys(where, publicKey, privateKey string) error {
-	err := s.writeKeyFile(filepath.Join(where, "secret.upspinkey"), privateKey)
+// labeled returns key, the contents of a key file, followed by the line
+// recording the -comment flag, if it was given.
+func (ks *keygenState) labeled(key string) string {
+	if ks.comment == "" {
+		return key
+	}
+	return key + factotum.CommentLine(ks.comment)
+}
+
+// checksummed returns the contents of a secret key file holding private:
+// private followed by a line recording its checksum, by which factotum
+// detects a damaged file.
+func checksummed(private string) string {
+	return private + factotum.SecretChecksum(private)
+}
+
+// writeKeys saves both the public and private keys to their respective files.
+// Both keys are written to temporary files before either file is replaced,
+// so a failure while writing leaves any existing pair as it was. If the
+// public key cannot be put in place once the secret key has been, the
+// previous secret key, if any, is restored. The files are created with
+// the modes in perm.
+func (s *State) writeKeys(files keyFiles, publicKey, privateKey string, perm keyPerm) error {
+	secretTmp, err := writeTempKey(files.secret, privateKey, perm)
 	if err != nil {
 		return err
 	}
-	err = s.writeKeyFile(filepath.Join(where, "public.upspinkey"), publicKey)
+	defer os.Remove(secretTmp) // In case it is not renamed.
+	publicTmp, err := writeTempKey(files.public, publicKey, perm)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(publicTmp)
+
+	oldSecret, oldErr := ioutil.ReadFile(files.secret)
+	defer lockSecret(oldSecret)()
+	if err := renameKey(secretTmp, files.secret); err != nil {
+		return err
+	}
+	if err := renameKey(publicTmp, files.public); err != nil {
+		if oldErr == nil {
+			if tmp, terr := writeTempKey(files.secret, string(oldSecret), perm); terr == nil {
+				if renameKey(tmp, files.secret) != nil {
+					os.Remove(tmp)
+				}
+			}
+		} else if os.IsNotExist(oldErr) {
+			os.Remove(files.secret)
+		}
+		return err
+	}
 	return nil
 }
 
-func (s *State) saveKeys(where string, rotate bool, newPublic, newPrivate string) error {
+// priorKeys holds the key pair already present in a keygen directory.
+type priorKeys struct {
+	public, private []byte
+	modtime         string // Secret key file's modification time, formatted for the archive.
+}
+
+// readPriorKeys returns the existing key pair in files, or nil if there is none.
+// It returns an error of kind Exist if there are prior keys but rotate is
+// false, and of kind NotExist if rotate is true but there are no prior keys.
+func readPriorKeys(files keyFiles, rotate bool) (*priorKeys, error) {
 	var (
-		publicFile  = filepath.Join(where, "public.upspinkey")
-		privateFile = filepath.Join(where, "secret.upspinkey")
-		archiveFile = filepath.Join(where, "secret2.upspinkey")
+		where       = filepath.Dir(files.secret)
+		publicFile  = files.public
+		privateFile = files.secret
 	)
 
 	// Read existing key pair.
@@ -192,45 +1655,330 @@ func (s *State) saveKeys(where string, rotate bool, newPublic, newPrivate string
 	if os.IsNotExist(err) {
 		// There is nothing to save. Did we expect there to be?
 		if rotate {
-			s.Exitf("cannot rotate keys: no prior keys exist in %s", where)
+			return nil, errors.E(errors.NotExist, errors.Errorf("cannot rotate keys: no prior keys exist in %s", where))
 		}
-		return nil
+		return nil, nil
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !rotate {
-		s.Exitf("prior keys exist in %s; rerun with rotate command to update keys", where)
+		if desc := describeKeys(publicFile); desc != "" {
+			where += " (" + desc + ")"
+		}
+		return nil, errors.E(errors.Exist, errors.Errorf("prior keys exist in %s; rerun with rotate command to update keys", where))
+	}
+	public, err := ioutil.ReadFile(publicFile)
+	if err != nil {
+		return nil, err // Halt. Existing files are corrupted and need manual attention.
+	}
+	// Archive the keys without their checksum and comment lines,
+	// which the archive's format has no room for, nor any prior key
+	// kept by -grace, which was archived when it was replaced, but not
+	// if the checksum shows the secret key to be damaged.
+	private, err = factotum.CheckSecret(private)
+	if err != nil {
+		return nil, errors.Errorf("%s: %v", privateFile, err)
+	}
+	private, _, err = factotum.SplitGrace(private)
+	if err != nil {
+		return nil, errors.Errorf("%s: %v", privateFile, err)
 	}
+	prior := &priorKeys{
+		public:  factotum.StripCommentLines(public),
+		private: factotum.StripCommentLines(private),
+	}
+	if info, err := os.Stat(privateFile); err == nil {
+		prior.modtime = " " + info.ModTime().UTC().Format(keyTimeLayout)
+	}
+	return prior, nil
+}
+
+// describeKeys describes the public key in publicFile, so that a user
+// about to replace it can tell whose it is: its fingerprint, the user it
+// belongs to if the directory is named for one, as $HOME/.ssh/<username>
+// is, and its label, if any. It returns "" if the file cannot be read.
+func describeKeys(publicFile string) string {
 	public, err := ioutil.ReadFile(publicFile)
 	if err != nil {
-		return err // Halt. Existing files are corrupted and need manual attention.
+		return ""
 	}
-	if string(public) == newPublic && string(private) == newPrivate {
+	desc := "fingerprint " + keygen.Fingerprint(upspin.PublicKey(factotum.StripCommentLines(public)))
+	if name := filepath.Base(filepath.Dir(publicFile)); strings.Contains(name, "@") {
+		if u, err := user.Clean(upspin.UserName(name)); err == nil {
+			desc += ", user " + string(u)
+		}
+	}
+	if comment := factotum.KeyComment(public); comment != "" {
+		desc += fmt.Sprintf(", labeled %q", comment)
+	}
+	return desc
+}
+
+// same reports whether the prior keys are identical to the new ones,
+// in which case there is no need to archive them.
+func (p *priorKeys) same(newPublic, newPrivate string) bool {
+	return string(p.public) == newPublic && string(p.private) == newPrivate
+}
+
+// archived returns the prior keys in the format of the archive file.
+func (p *priorKeys) archived() string {
+	return fmt.Sprintf("# EE%s\n%s%s", p.modtime, p.public, p.private)
+}
+
+// saveKeys appends any existing key pair in files to the archive files.
+// It returns the same errors as readPriorKeys.
+func (s *State) saveKeys(files keyFiles, rotate bool, newPublic, newPrivate string) error {
+	prior, err := readPriorKeys(files, rotate)
+	if err != nil || prior == nil {
+		return err
+	}
+	if prior.same(newPublic, newPrivate) {
 		return nil // No need to save duplicates.
 	}
 
-	// Write old key pair to archive file.
-	archive, err := os.OpenFile(archiveFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	// Write old key pair to the archive files.
+	defer keygen.Zero(prior.private)
+	archives := files.archives()
+	for _, archiveFile := range archives {
+		if err := appendArchive(archiveFile, prior.archived()); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(s.Stderr, "Saved previous key pair to:")
+	for _, archiveFile := range archives {
+		fmt.Fprintf(s.Stderr, "\t%s\n", archiveFile)
+	}
+	return nil
+}
+
+// appendArchive appends keys, in the format of the archive, to the
+// named archive file, creating it and its directory, private to their
+// owner, if need be.
+func appendArchive(name, keys string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	archive, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		return err // We don't have permission to archive old keys?
 	}
+	_, err = fmt.Fprint(archive, keys)
+	if cerr := archive.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
-	var modtime string
-	info, err := os.Stat(privateFile)
+// logKeys appends to file a line recording that the key pair with the
+// given public key was made at time t: the time, whether the keys were
+// generated or rotated, the curve, the host, and the key's fingerprint.
+// It records nothing secret.
+func (ks *keygenState) logKeys(file, public string, t time.Time) error {
+	event := "generated"
+	if ks.rotate {
+		event = "rotated"
+	}
+	host, err := os.Hostname()
 	if err != nil {
-		modtime = ""
-	} else {
-		modtime = info.ModTime().UTC().Format(" 2006-01-02 15:04:05Z")
+		host = "unknown"
 	}
-	_, err = fmt.Fprintf(archive, "# EE%s\n%s%s", modtime, public, private)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
-	err = archive.Close()
+	_, err = fmt.Fprintf(f, "%s %s curve=%s host=%s fingerprint=%s\n",
+		t.UTC().Format(keyTimeLayout), event, ks.curve, host, keygen.Fingerprint(upspin.PublicKey(public)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rotateCurve makes the keys of a rotation use the curve of the existing
+// public key in publicFile, unless -curve names another, in which case it
+// warns that the kind of key changes. It does nothing if there is no such
+// file; readPriorKeys reports that case.
+func (ks *keygenState) rotateCurve(publicFile string) {
+	public, err := ioutil.ReadFile(publicFile)
+	if err != nil {
+		return
+	}
+	curve := keyCurve(factotum.StripCommentLines(public))
+	if !isCurve(curve) {
+		return
+	}
+	if !ks.curveSet {
+		ks.curve = curve
+	} else if ks.curve != curve {
+		fmt.Fprintf(ks.state.Stderr, "Warning: the existing keys in %s are on the %s curve; -curve %s changes the kind of key.\n", filepath.Dir(publicFile), curve, ks.curve)
+	}
+}
+
+// keyCurve returns the name of the curve of a public key, which is
+// its first line.
+func keyCurve(public []byte) string {
+	curve := string(public)
+	if i := strings.IndexByte(curve, '\n'); i >= 0 {
+		curve = curve[:i]
+	}
+	return strings.TrimSpace(curve)
+}
+
+// checkRegisteredKey reports whether the public key in publicFile matches
+// the one registered in the key server for the current user. It returns
+// nil if there is no such file; readPriorKeys reports that case.
+func (s *State) checkRegisteredKey(publicFile string) error {
+	public, err := ioutil.ReadFile(publicFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(s.Stderr, "Saved previous key pair to:\n\t%s\n", archiveFile)
+	cfg := s.Config
+	if cfg == nil {
+		// Keygen runs without a config, so load it now.
+		cfg, err = config.FromFile(flags.Config)
+		if err != nil && err != config.ErrNoFactotum {
+			return errors.Errorf("cannot check key server: %v", err)
+		}
+		transports.Init(cfg)
+	}
+	key, err := bind.KeyServer(cfg, cfg.KeyEndpoint())
+	if err != nil {
+		return errors.Errorf("cannot check key server: %v", err)
+	}
+	public = factotum.StripCommentLines(public)
+	return registeredKeyMatches(key, cfg.UserName(), upspin.PublicKey(public))
+}
+
+// registeredKeyMatches returns an error unless the key server holds
+// public as the key for the named user.
+func registeredKeyMatches(key upspin.KeyServer, name upspin.UserName, public upspin.PublicKey) error {
+	u, err := key.Lookup(name)
+	if err != nil {
+		return errors.Errorf("cannot check key server: %v", err)
+	}
+	if strings.TrimSpace(string(u.PublicKey)) != strings.TrimSpace(string(public)) {
+		return errors.E(name, errors.Errorf("existing public key (fingerprint %s) does not match the one in the key server (fingerprint %s); rotating may lock you out",
+			keygen.Fingerprint(public), keygen.Fingerprint(u.PublicKey)))
+	}
+	return nil
+}
+
+// printNextSteps prints to standard output, ready to be copied and
+// pasted, the commands that put into use the new public key just written
+// to files in where: for new keys, a "user -put" of the current user's
+// record bearing the key, and for rotated ones the sequence described by
+// "rotate -help". The record is filled in from the config file; if that
+// cannot be read, the values it would supply are left to the user.
+func (s *State) printNextSteps(ks *keygenState, files keyFiles, public, where string) {
+	w := s.Stdout
+	fmt.Fprintln(w, "Next steps:")
+	if ks.nameFlags() != "" {
+		fmt.Fprintf(w, "\nFactotum reads only %s and %s, so first copy the keys\n", publicKeyFile, secretKeyFile)
+		fmt.Fprintln(w, "to files of those names in the secrets directory named in the config file.")
+	}
+	cfg, cfgErr := config.FromFile(flags.Config)
+	if cfgErr == config.ErrNoFactotum {
+		cfgErr = nil
+	}
+	if cfgErr != nil {
+		cfg = nil
+	}
+	userName := upspin.UserName("<username>")
+	if cfg != nil {
+		userName = cfg.UserName()
+	}
+	fmt.Fprintf(w, "\nThe new public key, fingerprint %s, is in\n\t%s\n", keygen.Fingerprint(upspin.PublicKey(public)), files.public)
+	if ks.rotate {
+		fmt.Fprintln(w, "To sign files with it, register it with the key server in place of the prior")
+		fmt.Fprintln(w, "key, and re-wrap for it the keys of encrypted files, run in turn:")
+		fmt.Fprintln(w, "\n\tupspin countersign")
+		fmt.Fprintln(w, "\tupspin rotate")
+		fmt.Fprintf(w, "\tupspin share -r -fix %s/\n", userName)
+		if ks.grace {
+			fmt.Fprintln(w, "\nOnce the prior key is no longer needed, drop it from the secret key file:")
+			fmt.Fprintf(w, "\n\tupspin finalizekeys%s %s\n", ks.nameFlags(), where)
+		}
+		if cfg == nil {
+			fmt.Fprintf(w, "\nFirst replace <username>; the config file could not be read: %v\n", cfgErr)
+		}
+		fmt.Fprintln(w, "\nSee 'upspin rotate -help' for what each step does.")
+		return
+	}
+	u := &upspin.User{
+		Name:      userName,
+		Dirs:      []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: "<dir server address>"}},
+		Stores:    []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: "<store server address>"}},
+		PublicKey: upspin.PublicKey(canonicalPublicKey([]byte(public))),
+	}
+	if cfg != nil {
+		u.Dirs = []upspin.Endpoint{cfg.DirEndpoint()}
+		u.Stores = []upspin.Endpoint{cfg.StoreEndpoint()}
+	}
+	record, err := yaml.Marshal(u)
+	if err != nil {
+		ks.exitf(1, "formatting user record: %v", err)
+	}
+	fmt.Fprintf(w, "To register it with the key server as the key of %s, run:\n\n", userName)
+	// The <<- form strips the leading tabs, as YAML requires.
+	fmt.Fprintln(w, "\tupspin user -put <<-'EOF'")
+	for _, line := range strings.SplitAfter(string(record), "\n") {
+		if line != "" {
+			fmt.Fprintf(w, "\t%s", line)
+		}
+	}
+	fmt.Fprintln(w, "\tEOF")
+	if cfg == nil {
+		fmt.Fprintf(w, "\nFirst replace the values in angle brackets; the config file could not be read: %v\n", cfgErr)
+	}
+	fmt.Fprintln(w, "\nThe key server takes the record only if it is signed by the key it already")
+	fmt.Fprintln(w, "holds for the user, if any, or by an administrator of the domain. To replace")
+	fmt.Fprintln(w, "keys it holds, instead make new ones and follow the steps they print:")
+	fmt.Fprintf(w, "\n\tupspin keygen -rotate -next-steps%s %s\n", ks.nameFlags(), where)
+}
+
+// dryRunKeys reports to standard output what keygenCommand would do
+// with the existing keys in files, without changing any files.
+// It returns the same errors as readPriorKeys, except that with force
+// prior keys need not exist and are never archived.
+func (s *State) dryRunKeys(files keyFiles, rotate, force bool, newPublic, newPrivate string) error {
+	where := filepath.Dir(files.secret)
+	prior, err := readPriorKeys(files, rotate || force)
+	if force && errors.Match(errNotExist, err) {
+		prior, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.Stdout, "Dry run; no files will be changed.")
+	switch {
+	case prior == nil:
+		fmt.Fprintf(s.Stdout, "No prior keys exist in %s.\n", where)
+	case force:
+		fmt.Fprintf(s.Stdout, "Prior keys exist in %s and would be overwritten without being archived.\n", where)
+	case prior.same(newPublic, newPrivate):
+		fmt.Fprintf(s.Stdout, "Prior keys in %s match the new keys and would not be archived.\n", where)
+	default:
+		modtime := strings.TrimSpace(prior.modtime)
+		if modtime == "" {
+			modtime = "unknown"
+		}
+		fmt.Fprintf(s.Stdout, "Prior keys exist in %s and would be appended to:\n", where)
+		for _, archiveFile := range files.archives() {
+			fmt.Fprintf(s.Stdout, "\t%s\n", archiveFile)
+		}
+		fmt.Fprintf(s.Stdout, "recorded with modification time %s.\n", modtime)
+	}
+	if prior != nil {
+		if desc := describeKeys(files.public); desc != "" {
+			fmt.Fprintf(s.Stdout, "The prior keys have %s.\n", desc)
+		}
+	}
+	fmt.Fprintln(s.Stdout, "Upspin private/public key pair would be written to:")
+	fmt.Fprintf(s.Stdout, "\t%s\n", files.public)
+	fmt.Fprintf(s.Stdout, "\t%s\n", files.secret)
 	return nil
 }
@@ -0,0 +1,75 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file contains the implementation of the finalizekeys command.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"upspin.io/factotum"
+)
+
+func (s *State) finalizekeys(args ...string) {
+	const help = `
+Finalizekeys ends the grace period begun by "keygen -rotate -grace":
+it drops the prior key pair from the secret key file in the specified
+directory, or if none is given, in the directory named by the config
+file's secrets, leaving it only in the archive of prior keys.
+`
+	fs := flag.NewFlagSet("finalizekeys", flag.ExitOnError)
+	keyMode := fs.String("key-mode", "0400", "`mode` of the rewritten secret key file, at most 0440")
+	names := keyFileFlags(fs, true)
+	s.ParseFlags(fs, args, help, "finalizekeys [<directory>]")
+	ks := &keygenState{
+		state: s,
+		names: *names,
+		perm:  keyPerm{file: s.parseMode("key-mode", *keyMode, 0400, maxKeyFileMode)},
+	}
+	s.finalizeKeys(ks, ks.keyDir(fs))
+}
+
+// finalizeKeys drops the prior key pair kept by -grace from the secret
+// key file in where, leaving the current key, and any comment, as it was.
+// The prior key pair remains in the archive.
+func (s *State) finalizeKeys(ks *keygenState, where string) {
+	files := ks.files(where)
+	secret, err := ioutil.ReadFile(files.secret)
+	if err != nil {
+		ks.exitf(keygenExitIO, "%v", err)
+	}
+	defer lockSecret(secret)()
+	secret = bytes.Replace(secret, []byte("\r"), nil, -1)
+	private, err := factotum.CheckSecret(secret)
+	if err != nil {
+		ks.exitf(keygenExitBad, "%s: %v", files.secret, err)
+	}
+	current, previous, err := factotum.SplitGrace(private)
+	if err != nil {
+		ks.exitf(keygenExitBad, "%s: %v", files.secret, err)
+	}
+	if len(previous) == 0 {
+		fmt.Fprintf(s.Stderr, "No prior key is kept in %s.\n", files.secret)
+		return
+	}
+	key := string(current)
+	if len(private) < len(secret) {
+		key = checksummed(key)
+	}
+	tmp, err := writeTempKey(files.secret, key, ks.keyPerm())
+	if err != nil {
+		ks.exitf(keygenExitIO, "writing keys: %v", err)
+	}
+	if err := renameKey(tmp, files.secret); err != nil {
+		os.Remove(tmp)
+		ks.exitf(keygenExitIO, "writing keys: %v", err)
+	}
+	fmt.Fprintf(s.Stderr, "The prior key pair was dropped from:\n\t%s\n", files.secret)
+	fmt.Fprintf(s.Stderr, "It remains archived in:\n\t%s\n", files.archive)
+}
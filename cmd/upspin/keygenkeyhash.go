@@ -0,0 +1,62 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file contains the implementation of the keyhash command.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+func (s *State) keyhash(args ...string) {
+	const help = `
+Keyhash prints the hash of the public key in the specified directory, or
+if none is given, in the directory named by the config file's secrets,
+as 64 hexadecimal digits. It is the one form the key server, factotum,
+and encrypted data use: the SHA-256 hash of the public key exactly as
+the "user -put" command registers it, with any comment lines and
+carriage returns of the key file removed, so it can be compared with the
+key server's.
+`
+	fs := flag.NewFlagSet("keyhash", flag.ExitOnError)
+	names := keyFileFlags(fs, false)
+	s.ParseFlags(fs, args, help, "keyhash [<directory>]")
+	ks := &keygenState{state: s, names: *names}
+	s.printKeyHash(ks, ks.keyDir(fs))
+}
+
+// printKeyHash writes the hash of the public key in where to standard
+// output, as keyHash computes it.
+func (s *State) printKeyHash(ks *keygenState, where string) {
+	file := ks.files(where).public
+	public, err := ioutil.ReadFile(file)
+	if err != nil {
+		ks.exitf(keygenExitIO, "%v", err)
+	}
+	if _, err := factotum.ParsePublicKey(upspin.PublicKey(canonicalPublicKey(public))); err != nil {
+		ks.exitf(1, "%s: %v", file, err)
+	}
+	fmt.Fprintln(s.Stdout, keyHash(public))
+}
+
+// canonicalPublicKey returns the public key held in a public key file
+// as factotum reads it, and so as "user -put" registers it in the key
+// server: without carriage returns or comment lines.
+func canonicalPublicKey(public []byte) []byte {
+	return factotum.StripCommentLines(bytes.Replace(public, []byte("\r"), nil, -1))
+}
+
+// keyHash returns the hash of the public key held in a public key file,
+// hex-encoded, in the form the key server and factotum compute it: the
+// SHA-256 hash of the canonical key.
+func keyHash(public []byte) string {
+	return fmt.Sprintf("%x", factotum.KeyHash(upspin.PublicKey(canonicalPublicKey(public))))
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file contains the implementation of the fixkeyperms command.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+func (s *State) fixkeyperms(args ...string) {
+	const help = `
+Fixkeyperms corrects the modes of the files keygen keeps in the
+specified directory, or if none is given, in the directory named by the
+config file's secrets. The key files are given the mode of -key-mode,
+and the archive of prior keys and keygen.log are made private to their
+owner. Only files more permissive than that, or unreadable by their
+owner, are changed, and each change is reported. It is not supported on
+Windows, which does not keep Unix permissions.
+`
+	fs := flag.NewFlagSet("fixkeyperms", flag.ExitOnError)
+	var dryRun bool
+	fs.BoolVar(&dryRun, "n", false, "report the changes without making them")
+	fs.BoolVar(&dryRun, "dry-run", false, "same as -n")
+	keyMode := fs.String("key-mode", "0400", "`mode` of the key files, at most 0440")
+	names := keyFileFlags(fs, true)
+	s.ParseFlags(fs, args, help, "fixkeyperms [-n] [<directory>]")
+	if runtime.GOOS == "windows" {
+		s.Exitf("fixkeyperms is not supported on Windows, which does not keep Unix permissions")
+	}
+	ks := &keygenState{
+		state:  s,
+		names:  *names,
+		perm:   keyPerm{file: s.parseMode("key-mode", *keyMode, 0400, maxKeyFileMode)},
+		dryRun: dryRun,
+	}
+	s.fixPerms(ks, ks.keyDir(fs))
+}
+
+// fixPerms gives the files keygen keeps in where the modes keygen makes
+// them with, where they are more permissive or unreadable by their
+// owner, reporting each change on standard output. With -n, it reports
+// the changes without making them.
+func (s *State) fixPerms(ks *keygenState, where string) {
+	files := ks.files(where)
+	perm := ks.keyPerm().file
+	keys := []string{files.public, files.secret, files.escrow(), files.secret + ".age", files.secret + ".gpg"}
+	for _, format := range []string{"pem", "openssh"} {
+		exported := files.exported(format)
+		keys = append(keys, exported.public, exported.secret)
+	}
+	shares, err := filepath.Glob(files.secret + ".share*")
+	if err != nil {
+		ks.exitf(1, "%v", err)
+	}
+	keys = append(keys, shares...)
+	type file struct {
+		name string
+		mode os.FileMode
+	}
+	var all []file
+	for _, name := range keys {
+		all = append(all, file{name, perm})
+	}
+	// The archive and log are always private to their owner.
+	all = append(all, file{files.archive, 0600}, file{filepath.Join(where, logKeyFile), 0600})
+
+	found, fixed := false, false
+	for _, f := range all {
+		info, err := os.Stat(f.name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			ks.exitf(keygenExitIO, "%v", err)
+		}
+		found = true
+		mode := info.Mode().Perm()
+		if mode&^f.mode == 0 && mode&0400 != 0 {
+			continue
+		}
+		fixed = true
+		if ks.dryRun {
+			fmt.Fprintf(s.Stdout, "%s has mode %#o; it would be changed to %#o.\n", f.name, mode, f.mode)
+			continue
+		}
+		if err := os.Chmod(f.name, f.mode); err != nil {
+			ks.exitf(keygenExitIO, "%v", err)
+		}
+		fmt.Fprintf(s.Stdout, "%s had mode %#o; changed to %#o.\n", f.name, mode, f.mode)
+	}
+	switch {
+	case !found:
+		ks.exitf(keygenExitIO, "no key files in %s", where)
+	case !fixed:
+		fmt.Fprintln(s.Stdout, "The key files already have the right modes.")
+	}
+}
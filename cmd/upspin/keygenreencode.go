@@ -0,0 +1,142 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file contains the implementation of the reencodeseed command.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"upspin.io/factotum"
+	"upspin.io/key/keygen"
+)
+
+func (s *State) reencodeseed(args ...string) {
+	const help = `
+Reencodeseed rewrites the secret seed recorded in the secret key file in
+the specified directory, or if none is given, in the directory named by
+the config file's secrets, in the form given by -seedformat and
+-seedstyle, for instance to move a seed to a password manager that takes
+only BIP 39 mnemonics. The seed must make the keys in the directory; the
+keys themselves, their label, and any prior key kept by "keygen -grace"
+are left exactly as they are.
+`
+	fs := flag.NewFlagSet("reencodeseed", flag.ExitOnError)
+	var (
+		seedFormat = fs.String("seedformat", "proquint", "`format` in which to write the secret seed: proquint or bip39")
+		seedStyle  = fs.String("seedstyle", keygen.SeedDotted, "`style` of the separators in a proquint secret seed: dotted, dashed, or spaced")
+		keyMode    = fs.String("key-mode", "0400", "`mode` of the rewritten secret key file, at most 0440")
+	)
+	names := keyFileFlags(fs, false)
+	s.ParseFlags(fs, args, help, "reencodeseed [-seedformat=format] [-seedstyle=style] [<directory>]")
+	switch *seedFormat {
+	case "proquint", "bip39":
+		// ok
+	default:
+		s.Exitf("unknown seed format %q", *seedFormat)
+	}
+	ks := &keygenState{
+		state:      s,
+		names:      *names,
+		seedFormat: *seedFormat,
+		seedStyle:  s.parseSeedStyle(fs, *seedStyle, *seedFormat),
+		perm:       keyPerm{file: s.parseMode("key-mode", *keyMode, 0400, maxKeyFileMode)},
+	}
+	s.reencodeSeed(ks, ks.keyDir(fs))
+}
+
+// reencodeSeed rewrites the secret seed recorded in the secret key file
+// in the form given by ks.seedFormat and ks.seedStyle. Only the seed's
+// text changes: the seed must make the keys in the files, and the rest
+// of the secret key file is kept byte for byte.
+func (s *State) reencodeSeed(ks *keygenState, where string) {
+	files := ks.files(where)
+	secret, err := ioutil.ReadFile(files.secret)
+	if err != nil {
+		ks.exitf(keygenExitIO, "%v", err)
+	}
+	defer lockSecret(secret)()
+	public, err := ioutil.ReadFile(files.public)
+	if err != nil {
+		ks.exitf(keygenExitIO, "%v", err)
+	}
+	secret = bytes.Replace(secret, []byte("\r"), nil, -1)
+	private, err := factotum.CheckSecret(secret)
+	if err != nil {
+		ks.exitf(keygenExitBad, "%s: %v", files.secret, err)
+	}
+
+	// The seed is recorded in a comment at the end of the line holding
+	// the secret key, the first that is not itself a comment.
+	start := 0
+	for start < len(private) && private[start] == '#' {
+		if nl := bytes.IndexByte(private[start:], '\n'); nl >= 0 {
+			start += nl + 1
+		} else {
+			start = len(private)
+		}
+	}
+	end := len(private)
+	if nl := bytes.IndexByte(private[start:], '\n'); nl >= 0 {
+		end = start + nl + 1
+	}
+	line := private[start:end]
+	hash := bytes.IndexByte(line, '#')
+	if hash < 0 {
+		ks.exitf(1, "the secret key in %s records no seed to re-encode", files.secret)
+	}
+	key, seed := strings.TrimSpace(string(line[:hash])), strings.TrimSpace(string(line[hash+1:]))
+
+	curve := keyCurve(factotum.StripCommentLines(public))
+	seedPublic, seedPrivate, _, err := keygen.FromSeed(curve, seed)
+	if err != nil {
+		ks.exitf(keygenExitBad, "%s: the seed recorded with the secret key is not valid: %v", files.secret, err)
+	}
+	if seedPublic != string(factotum.StripCommentLines(public)) || strings.TrimSpace(seedPrivate) != key {
+		ks.exitf(keygenExitBad, "%s: the seed recorded with the secret key does not make the keys", files.secret)
+	}
+
+	var newSeed string
+	if ks.seedFormat == "bip39" {
+		newSeed, err = keygen.Mnemonic(seed)
+	} else {
+		style := ks.seedStyle
+		if style == "" {
+			style = keygen.SeedDotted
+		}
+		newSeed, err = keygen.FormatSeed(seed, style)
+	}
+	if err != nil {
+		ks.exitf(keygenExitCode(err), "re-encoding seed: %v", err)
+	}
+	if newSeed == seed {
+		fmt.Fprintf(s.Stderr, "The seed in %s is already written in that form.\n", files.secret)
+		return
+	}
+
+	var b bytes.Buffer
+	b.Write(private[:start])
+	b.WriteString(key + " # " + newSeed + "\n")
+	b.Write(private[end:])
+	newSecret := b.String()
+	if len(private) < len(secret) {
+		newSecret = checksummed(newSecret)
+	}
+	tmp, err := writeTempKey(files.secret, newSecret, ks.keyPerm())
+	if err != nil {
+		ks.exitf(keygenExitIO, "writing keys: %v", err)
+	}
+	if err := renameKey(tmp, files.secret); err != nil {
+		os.Remove(tmp)
+		ks.exitf(keygenExitIO, "writing keys: %v", err)
+	}
+	fmt.Fprintf(s.Stderr, "The secret seed was rewritten in:\n\t%s\n", files.secret)
+	fmt.Fprintf(s.Stderr, "The keys are unchanged. The seed is now:\n\t%s\n", newSeed)
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file contains the implementation of the verifykeys command.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"upspin.io/factotum"
+	"upspin.io/key/keygen"
+	"upspin.io/upspin"
+)
+
+func (s *State) verifykeys(args ...string) {
+	const help = `
+Verifykeys checks the keys in the specified directory, or if none is
+given, in the directory named by the config file's secrets, without
+writing anything: that the secret key matches its checksum, if it has
+one, that the public key is the one made from it, that the secret seed
+recorded beside the secret key makes them both, and that the key files
+are readable by no one but their owner, or their group if keygen's
+-key-mode allowed it. It prints OK if every check passes and otherwise
+names the check that failed and exits with status 7.
+`
+	fs := flag.NewFlagSet("verifykeys", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "write the result, or any error, as a JSON object to standard output")
+	names := keyFileFlags(fs, false)
+	s.ParseFlags(fs, args, help, "verifykeys [-json] [<directory>]")
+	ks := &keygenState{state: s, names: *names, json: *jsonOut}
+	s.verifyKeys(ks, ks.keyDir(fs))
+}
+
+// keygenVerifyResult is the JSON object written by verifykeys -json
+// when the keys pass its checks. A failure is reported as a keygenError.
+type keygenVerifyResult struct {
+	OK bool
+	// Checks lists those made: checksum, if the secret key has one;
+	// pair; seed, if the secret key file records one; and mode, except
+	// on Windows.
+	Checks      []string
+	Fingerprint string
+	Comment     string // The label recorded in the key files, if any.
+	PriorKey    bool   // The secret key file also holds the prior key; see -grace.
+}
+
+// verifyKeys checks the keys in where: that the secret key matches its
+// checksum, if it has one, that the public key is the one made from it,
+// that the secret seed recorded beside the secret key, if any, makes
+// both, and that the key files are private. It reports the result on standard output, ending
+// with OK if every check passes, or as a keygenVerifyResult with -json;
+// the first check to fail ends it with keygenExitBad.
+func (s *State) verifyKeys(ks *keygenState, where string) {
+	result := keygenVerifyResult{OK: true}
+	note := func(format string, args ...interface{}) {
+		if !ks.json {
+			fmt.Fprintf(s.Stdout, format, args...)
+		}
+	}
+	files := ks.files(where)
+	secret, err := ioutil.ReadFile(files.secret)
+	if err != nil {
+		ks.exitf(keygenExitIO, "%v", err)
+	}
+	defer lockSecret(secret)()
+	public, err := ioutil.ReadFile(files.public)
+	if err != nil {
+		ks.exitf(keygenExitIO, "%v", err)
+	}
+	// Factotum ignores carriage returns, as added by some editors.
+	secret = bytes.Replace(secret, []byte("\r"), nil, -1)
+	public = bytes.Replace(public, []byte("\r"), nil, -1)
+	private, err := factotum.CheckSecret(secret)
+	if err != nil {
+		ks.exitf(keygenExitBad, "%s: %v", files.secret, err)
+	}
+	if len(private) == len(secret) {
+		note("The secret key in %s has no checksum to check.\n", files.secret)
+	} else {
+		note("The secret key in %s matches its checksum.\n", files.secret)
+		result.Checks = append(result.Checks, "checksum")
+	}
+	private, previous, err := factotum.SplitGrace(private)
+	if err != nil {
+		ks.exitf(keygenExitBad, "%s: %v", files.secret, err)
+	}
+	if len(previous) > 0 {
+		note("The secret key file also holds the prior key, kept until finalizekeys.\n")
+		result.PriorKey = true
+	}
+	if comment := factotum.KeyComment(public); comment != "" {
+		result.Comment = comment
+	} else if comment := factotum.KeyComment(private); comment != "" {
+		result.Comment = comment
+	}
+	if result.Comment != "" {
+		note("The keys are labeled %q.\n", result.Comment)
+	}
+	public = factotum.StripCommentLines(public)
+	private = factotum.StripCommentLines(private)
+	result.Fingerprint = keygen.Fingerprint(upspin.PublicKey(public))
+	if _, err := factotum.NewFromKeys(public, private, previous); err != nil {
+		ks.exitf(keygenExitBad, "keys in %s do not belong together: %v", where, err)
+	}
+	note("The public key in %s is the one made from the secret key.\n", files.public)
+	result.Checks = append(result.Checks, "pair")
+	// Keygen records the seed in a comment after the secret key.
+	if i := bytes.IndexByte(private, '#'); i < 0 {
+		note("The secret key in %s records no seed to check.\n", files.secret)
+	} else {
+		seed := strings.TrimSpace(string(private[i+1:]))
+		seedPublic, seedPrivate, _, err := keygen.FromSeed(keyCurve(public), seed)
+		if err != nil {
+			ks.exitf(keygenExitBad, "%s: the seed recorded with the secret key is not valid: %v", files.secret, err)
+		}
+		if seedPublic != string(public) || strings.TrimSpace(seedPrivate) != strings.TrimSpace(string(private[:i])) {
+			ks.exitf(keygenExitBad, "%s: the seed recorded with the secret key does not make the keys", files.secret)
+		}
+		note("The seed recorded in %s makes the keys.\n", files.secret)
+		result.Checks = append(result.Checks, "seed")
+	}
+	if runtime.GOOS != "windows" {
+		// Windows does not keep Unix permissions.
+		for _, name := range []string{files.public, files.secret} {
+			info, err := os.Stat(name)
+			if err != nil {
+				ks.exitf(keygenExitIO, "%v", err)
+			}
+			if mode := info.Mode().Perm(); mode&^maxKeyFileMode != 0 {
+				ks.exitf(keygenExitBad, "%s has mode %#o; key files should have mode 0400, or at most %#o", name, mode, maxKeyFileMode)
+			}
+		}
+		note("The key files are readable only as keygen makes them.\n")
+		result.Checks = append(result.Checks, "mode")
+	}
+	if ks.json {
+		ks.writeJSON(result)
+		return
+	}
+	fmt.Fprintln(s.Stdout, "OK")
+}
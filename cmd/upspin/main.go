@@ -76,14 +76,18 @@ var commands = map[string]func(*State, ...string){
 	"countersign":   (*State).countersign,
 	"cp":            (*State).cp,
 	"deletestorage": (*State).deletestorage,
+	"finalizekeys":  (*State).finalizekeys,
+	"fixkeyperms":   (*State).fixkeyperms,
 	"get":           (*State).get,
 	"getref":        (*State).getref,
 	"info":          (*State).info,
 	"keygen":        (*State).keygen,
+	"keyhash":       (*State).keyhash,
 	"link":          (*State).link,
 	"ls":            (*State).ls,
 	"mkdir":         (*State).mkdir,
 	"put":           (*State).put,
+	"reencodeseed":  (*State).reencodeseed,
 	"repack":        (*State).repack,
 	"rotate":        (*State).rotate,
 	"rm":            (*State).rm,
@@ -95,11 +99,23 @@ var commands = map[string]func(*State, ...string){
 	"snapshot":      (*State).snapshot,
 	"tar":           (*State).tar,
 	"user":          (*State).user,
+	"verifykeys":    (*State).verifykeys,
 	"version":       (*State).version,
 	"watch":         (*State).watch,
 	"whichaccess":   (*State).whichAccess,
 }
 
+// noConfigCommands lists the commands that run without a config.
+var noConfigCommands = map[string]bool{
+	"signup":       true,
+	"keygen":       true,
+	"verifykeys":   true,
+	"finalizekeys": true,
+	"fixkeyperms":  true,
+	"reencodeseed": true,
+	"keyhash":      true,
+}
+
 // externalCommands lists the commands that are considered part of
 // the upspin command itself but are implemented as separate binaries.
 // We show their documentation when we generate doc.go
@@ -277,8 +293,9 @@ func newState(name string) *State {
 // usually including setting up a Config.
 func (s *State) init() {
 	// signup is special since there is no user yet.
-	// keygen simply does not require a config or anything else.
-	if s.Name != "signup" && s.Name != "keygen" {
+	// keygen and the commands that work on existing keys
+	// simply do not require a config or anything else.
+	if !noConfigCommands[s.Name] {
 		cfg, err := config.FromFile(flags.Config)
 		if err != nil && err != config.ErrNoFactotum {
 			s.Exit(err)
@@ -0,0 +1,216 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"rsc.io/qr"
+
+	"upspin.io/subcmd"
+	"upspin.io/upspin"
+)
+
+// recoverySheet holds what keygen -recovery-sheet prints on the page.
+type recoverySheet struct {
+	user        upspin.UserName // Left blank, to be filled in, if empty.
+	curve       string
+	fingerprint string
+	seed        string
+	command     string // The command that re-creates the keys.
+}
+
+// writeRecoverySheet writes the recovery sheet to the named file as a
+// one-page PDF document. The document is made in memory and written
+// straight to the file, which only its owner may read, so the seed it
+// holds is not left in any other file.
+func (s *State) writeRecoverySheet(file string, sheet *recoverySheet) error {
+	code, err := qr.Encode(sheet.seed, qr.M)
+	if err != nil {
+		return err
+	}
+	file = subcmd.Tilde(file)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(sheet.pdf(code))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	fmt.Fprintf(s.Stderr, "A recovery sheet to print written to:\n\t%s\n", file)
+	fmt.Fprintln(s.Stderr, "Delete the file once it is printed.")
+	return nil
+}
+
+// Layout of the recovery sheet, in points. The page is US Letter, and
+// everything on it lies within the width of A4, so it prints on either.
+const (
+	sheetWidth  = 612
+	sheetHeight = 792
+	sheetMargin = 54
+	sheetQRSize = 144 // Width of the QR code, including its quiet zone.
+)
+
+// pdf returns the sheet as a PDF document holding the QR code of the
+// seed, code. The document uses only the standard fonts, which every
+// reader has, and is not compressed.
+func (sheet *recoverySheet) pdf(code *qr.Code) []byte {
+	var page bytes.Buffer
+	y := float64(sheetHeight - sheetMargin)
+	line := func(font string, size float64, text string) {
+		y -= size * 1.4
+		fmt.Fprintf(&page, "BT /%s %.2f Tf %d %.2f Td (%s) Tj ET\n", font, size, sheetMargin, y, pdfEscape(text))
+	}
+	// A character of Courier is 0.6 of its size wide, and the text may
+	// use the width of A4 within the margins.
+	courierWidth := (595 - 2*sheetMargin) / 0.6
+	line("F2", 18, "Upspin key recovery sheet")
+	y -= 12
+	if sheet.user != "" {
+		line("F1", 12, "User: "+string(sheet.user))
+	} else {
+		line("F1", 12, "User: ______________________________________________")
+	}
+	line("F1", 12, "Curve: "+sheet.curve)
+	line("F1", 12, "Public key fingerprint: "+sheet.fingerprint)
+	y -= 12
+	line("F1", 12, "Secret seed:")
+	for _, l := range wrapWords(shellWords(sheet.seed), int(courierWidth/14), "") {
+		line("F3", 14, l)
+	}
+	y -= 12
+	line("F1", 12, "To re-create the keys, run this command:")
+	// The command is broken only between arguments, so a quoted one
+	// too long for a line shrinks the type instead.
+	args := shellWords(sheet.command)
+	size := 9.0
+	for _, a := range args {
+		if n := float64(len(a) + 2); n*size > courierWidth {
+			size = courierWidth / n
+		}
+	}
+	for _, l := range wrapWords(args, int(courierWidth/size), " \\") {
+		line("F3", size, l)
+	}
+	y -= 12
+	line("F1", 12, "The secret seed as a QR code:")
+
+	// The QR code, as a black square for each module, in a white
+	// quiet zone.
+	module := float64(sheetQRSize) / float64(code.Size+2*qrQuietZone)
+	top := y - 6
+	page.WriteString("0 g\n")
+	for qy := 0; qy < code.Size; qy++ {
+		for qx := 0; qx < code.Size; qx++ {
+			if code.Black(qx, qy) {
+				fmt.Fprintf(&page, "%.2f %.2f %.2f %.2f re\n",
+					sheetMargin+float64(qx+qrQuietZone)*module,
+					top-float64(qy+qrQuietZone+1)*module,
+					module, module)
+			}
+		}
+	}
+	page.WriteString("f\n")
+	y = top - sheetQRSize - 6
+
+	line("F2", 12, "Keep this sheet as safely as the keys themselves.")
+	line("F1", 12, "Anyone who has it can act as you in Upspin and read your data.")
+	line("F1", 12, "Do not copy, photograph, or share it, or keep it online.")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 4 0 R /F2 5 0 R /F3 6 0 R >> >> /Contents 7 0 R >>", sheetWidth, sheetHeight),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.Bytes()),
+	}
+	var doc bytes.Buffer
+	doc.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = doc.Len()
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		// Each entry is exactly 20 bytes.
+		fmt.Fprintf(&doc, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return doc.Bytes()
+}
+
+// pdfEscape returns text as the contents of a PDF literal string. Bytes
+// outside printable ASCII are written as octal escapes.
+func pdfEscape(text string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// shellWords splits text at the spaces outside single quotes.
+func shellWords(text string) []string {
+	var words []string
+	quoted := false
+	start := -1
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c == '\'' {
+			quoted = !quoted
+		}
+		switch {
+		case c == ' ' && !quoted:
+			if start >= 0 {
+				words = append(words, text[start:i])
+				start = -1
+			}
+		case start < 0:
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// wrapWords joins words with spaces into lines of at most width bytes,
+// where it can, ending each line but the last with cont.
+func wrapWords(words []string, width int, cont string) []string {
+	var lines []string
+	cur := ""
+	for _, w := range words {
+		if cur != "" && len(cur)+1+len(w)+len(cont) > width {
+			lines = append(lines, cur+cont)
+			cur = w
+			continue
+		}
+		if cur != "" {
+			cur += " "
+		}
+		cur += w
+	}
+	return append(lines, cur)
+}
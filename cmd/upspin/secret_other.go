@@ -0,0 +1,18 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !darwin,!linux
+
+package main
+
+import "upspin.io/key/keygen"
+
+// protectSecrets does nothing on this system.
+func protectSecrets() {}
+
+// lockSecret returns a function that zeros b, which holds a secret.
+// Its pages cannot be locked in memory on this system.
+func lockSecret(b []byte) (release func()) {
+	return func() { keygen.Zero(b) }
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin linux
+
+package main
+
+import (
+	"syscall"
+
+	"upspin.io/key/keygen"
+)
+
+// protectSecrets keeps the secrets keygen is about to hold in memory out
+// of any core dump, by turning core dumps off for the rest of the run.
+func protectSecrets() {
+	// Failure leaves things as they were, which is no worse.
+	syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+}
+
+// lockSecret asks that the pages holding b, which holds a secret, not be
+// swapped to disk. The returned function zeros b and unlocks the pages;
+// it must be called once b is no longer needed. If the pages cannot be
+// locked, as when the process is at its limit of locked memory, b is
+// still zeroed.
+func lockSecret(b []byte) (release func()) {
+	locked := len(b) > 0 && syscall.Mlock(b) == nil
+	return func() {
+		keygen.Zero(b)
+		if locked {
+			syscall.Munlock(b)
+		}
+	}
+}
@@ -115,20 +115,20 @@ If any state exists at the given location (-where) then the command aborts.
 	// Generate keys for the dirserver and the storeserver.
 	var noProquint string
 	dirCurve := *curveName
-	dirPublic, dirPrivate, dirProquint, err := s.createKeys(*curveName, noProquint)
+	dirPublic, dirPrivate, dirProquint, err := s.createKeys(*curveName, noProquint, nil)
 	if err != nil {
 		s.Exit(err)
 	}
 	storeCurve := *curveName
-	storePublic, storePrivate, storeProquint, err := s.createKeys(*curveName, noProquint)
+	storePublic, storePrivate, storeProquint, err := s.createKeys(*curveName, noProquint, nil)
 	if err != nil {
 		s.Exit(err)
 	}
-	err = s.writeKeys(dirServerPath, dirPublic, dirPrivate)
+	err = s.writeKeys(keyFilesIn(dirServerPath), dirPublic, checksummed(dirPrivate), defaultKeyPerm)
 	if err != nil {
 		s.Exit(err)
 	}
-	err = s.writeKeys(storeServerPath, storePublic, storePrivate)
+	err = s.writeKeys(keyFilesIn(storeServerPath), storePublic, checksummed(storePrivate), defaultKeyPerm)
 	if err != nil {
 		s.Exit(err)
 	}
@@ -277,11 +277,11 @@ func (s *State) setuphost(where, domain, curve, proquint string) {
 	s.MkdirAllLocal(cfgPath)
 
 	// Generate and write keys for the server user.
-	pub, pri, proquint, err := s.createKeys(curve, proquint)
+	pub, pri, proquint, err := s.createKeys(curve, proquint, nil)
 	if err != nil {
 		s.Exit(err)
 	}
-	err = s.writeKeys(cfgPath, pub, pri)
+	err = s.writeKeys(keyFilesIn(cfgPath), pub, checksummed(pri), defaultKeyPerm)
 	if err != nil {
 		s.Exit(err)
 	}
@@ -16,13 +16,16 @@ import (
 
 	"upspin.io/config"
 	"upspin.io/flags"
+	"upspin.io/key/keygen"
 	"upspin.io/serverutil/signup"
 	"upspin.io/subcmd"
 	"upspin.io/upspin"
 	"upspin.io/user"
 )
 
-const signupURL = "https://key.upspin.io/signup"
+// signupURL is where signup requests are sent.
+// A variable so that tests can redirect it.
+var signupURL = "https://key.upspin.io/signup"
 
 func (s *State) signup(args ...string) {
 	const help = `
@@ -50,7 +53,16 @@ the -dir and -store flags must not be set.
 
 By default, signup creates new keys with the p256 cryptographic curve set.
 The -curve and -secretseed flags allow the user to control the curve or to
-recreate or reuse prior keys.
+recreate or reuse prior keys, and the -secret-hex and -secret-b64 flags to
+supply the bits of a new seed. The -seedformat flag writes the secret seed
+as a BIP 39 mnemonic, the -seedstyle flag writes it with other separators
+than the usual proquint ones, the -split flag splits it into shares, the -qr
+and -qrfile flags show it as a QR code, the -no-inline-seed flag refuses a
+seed given on the command line, the -recovery-sheet flag writes a
+PDF recovery sheet bearing the user name, the -comment flag labels the
+keys, the -self-test flag checks the new keys, and the -key-mode and
+-dir-mode flags set the modes of the key files and their directory, as
+described for keygen.
 
 The -signuponly flag tells signup to skip the generation of the configuration
 file and keys and only send the signup request to the key server.
@@ -64,7 +76,20 @@ file and keys and only send the signup request to the key server.
 		signupOnly  = fs.Bool("signuponly", false, "only send signup request to key server; do not generate config or keys")
 		secrets     = fs.String("secrets", "", "`directory` to store key pair")
 		curve       = fs.String("curve", "p256", "cryptographic curve `name`: p256, p384, or p521")
-		secretseed  = fs.String("secretseed", "", "the seed containing a 128 bit secret in proquint format or a file that contains it")
+		comment     = fs.String("comment", "", "`label` to record in a comment line in both key files")
+		secretHex   = fs.String("secret-hex", "", "the 128-bit `secret` for a new seed, as 32 hexadecimal digits")
+		secretB64   = fs.String("secret-b64", "", "the 128-bit `secret` for a new seed, in base64")
+		secretseed  = fs.String("secretseed", "", "the seed containing a 128 bit secret in proquint or BIP 39 format, a file that contains it, or - to read it from standard input")
+		noInline    = fs.Bool("no-inline-seed", false, "refuse a secret seed given on the command line rather than in a file or on standard input")
+		seedFormat  = fs.String("seedformat", "proquint", "`format` in which to write the secret seed: proquint or bip39")
+		seedStyle   = fs.String("seedstyle", keygen.SeedDotted, "`style` of the separators in a proquint secret seed: dotted, dashed, or spaced")
+		split       = fs.String("split", "", "also split the secret seed into `K-of-N` shares, any K of which recreate it")
+		qrCode      = fs.Bool("qr", false, "also show the secret seed as a QR code")
+		qrFile      = fs.String("qrfile", "", "with -qr, write the QR code as a PNG image to `file` rather than to the terminal")
+		sheetFile   = fs.String("recovery-sheet", "", "also write a one-page PDF `file` to print, holding the secret seed, the command to re-create the keys, and a QR code")
+		selfTest    = fs.Bool("self-test", true, "sign and verify a challenge with the new keys before reporting success")
+		keyMode     = fs.String("key-mode", "0400", "`mode` of the key files, at most 0440")
+		dirMode     = fs.String("dir-mode", "0700", "`mode` of the key directory if signup creates it, at most 0750")
 	)
 
 	s.ParseFlags(fs, args, help, "[-config=<file>] signup -dir=<addr> -store=<addr> [flags] <username>\n       upspin [-config=<file>] signup -server=<addr> [flags] <username>")
@@ -90,11 +115,27 @@ file and keys and only send the signup request to the key server.
 		s.Failf("after flags parsed, expected 1 argument but saw %d", fs.NArg())
 		usageAndExit(fs)
 	}
-	if *bothServer != "" {
-		if *dirServer != "" || *storeServer != "" {
-			s.Failf("if -server provided -dir and -store must not be set")
-			usageAndExit(fs)
+	s.checkFlagRules(fs)
+	if *seedFormat != "proquint" && *seedFormat != "bip39" {
+		s.Exitf("unknown seed format %q", *seedFormat)
+	}
+	// Which flag gave the seed must be known before -secret-hex or
+	// -secret-b64 is turned into -secretseed.
+	inlineSeed := inlineSeedFlag(*secretseed, *secretHex, *secretB64)
+	if *noInline && inlineSeed != "" {
+		// Refuse it now, before the config file is written.
+		(&keygenState{state: s, inlineSeed: inlineSeed, noInline: true}).checkInlineSeed()
+	}
+	if *secretHex != "" || *secretB64 != "" {
+		seed, err := seedFromSecret(*secretHex, *secretB64)
+		if err != nil {
+			s.Exit(err)
 		}
+		*secretseed = seed
+	}
+	splitK, splitN := s.parseSplit(*split)
+	perm := s.parseKeyPerm(*keyMode, *dirMode)
+	if *bothServer != "" {
 		*dirServer = *bothServer
 		*storeServer = *bothServer
 	}
@@ -173,7 +214,24 @@ file and keys and only send the signup request to the key server.
 			s.Exit(err)
 		}
 	}
-	s.keygenCommand(*secrets, *curve, *secretseed, false)
+	s.keygenCommand(&keygenState{
+		state:      s,
+		curve:      *curve,
+		comment:    *comment,
+		secretseed: *secretseed,
+		inlineSeed: inlineSeed,
+		noInline:   *noInline,
+		seedFormat: *seedFormat,
+		seedStyle:  s.parseSeedStyle(fs, *seedStyle, *seedFormat),
+		splitK:     splitK,
+		splitN:     splitN,
+		qr:         *qrCode,
+		qrFile:     *qrFile,
+		sheetFile:  *sheetFile,
+		sheetUser:  userName,
+		selfTest:   *selfTest,
+		perm:       perm,
+	}, *secrets)
 
 	// Send the signup request to the key server.
 	s.registerUser(flags.Config)
@@ -126,6 +126,10 @@ func FromFile(name string) (upspin.Config, error) {
 // Files without the suffix ".pem" are ignored.
 // The default value for tlscerts is the empty string,
 // in which case just the system roots are used.
+//
+// The tlspins key pins the TLS certificates accepted from the servers
+// at some network addresses, each either by the hash of its public key
+// or by the CA certificates it must chain to; see upspin.io/rpc.
 func InitConfig(r io.Reader) (upspin.Config, error) {
 	const op = "config.InitConfig"
 	vals := map[string]string{
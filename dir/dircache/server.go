@@ -29,12 +29,16 @@ type server struct {
 	// TODO(p): make this less of a hack somehow
 	flushBlock func(upspin.Location)
 
+	// prefetch, if not nil, is given the block locations of files
+	// that are looked up so a store cache can read ahead.
+	prefetch func([]upspin.Location)
+
 	// The directory server this dialed server should talk to.
 	authority upspin.Endpoint
 }
 
 // New creates a new DirServer cache reading in the log and writing out a new compacted log.
-func New(cfg upspin.Config, cacheDir string, maxLogBytes int64, flushBlock func(upspin.Location)) (upspin.DirServer, error) {
+func New(cfg upspin.Config, cacheDir string, maxLogBytes int64, flushBlock func(upspin.Location), prefetch func([]upspin.Location)) (upspin.DirServer, error) {
 	clog, err := openLog(cfg, ospath.Join(cacheDir, "dircache"), maxLogBytes)
 	if err != nil {
 		return nil, err
@@ -43,6 +47,7 @@ func New(cfg upspin.Config, cacheDir string, maxLogBytes int64, flushBlock func(
 		cfg:        cfg,
 		clog:       clog,
 		flushBlock: flushBlock,
+		prefetch:   prefetch,
 	}, nil
 }
 
@@ -53,10 +58,14 @@ func (s *server) Dial(config upspin.Config, e upspin.Endpoint) (upspin.Service,
 	return &s2, nil
 }
 
+// errNotDialed is returned by a server that has not been dialed, so has no
+// directory to talk to. Callers can recognize it by its Kind, errors.Invalid.
+var errNotDialed = errors.E("dir/dircache", errors.Invalid, errors.Str("no directory endpoint configured (must dial first)"))
+
 // dirFor returns a DirServer instance.
 func (s *server) dirFor(path upspin.PathName) (upspin.DirServer, error) {
 	if s.authority.Transport == upspin.Unassigned {
-		return nil, errors.Str("not yet configured")
+		return nil, errNotDialed
 	}
 	dir, err := bind.DirServer(s.cfg, s.authority)
 	if err == nil {
@@ -77,15 +86,34 @@ func (s *server) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
 	}
 
 	if de, err, ok := s.clog.lookup(name); ok {
+		if err == nil {
+			s.prefetchBlocks(de)
+		}
 		return de, err
 	}
 
 	de, err := dir.Lookup(name)
 	s.clog.logRequest(lookupReq, name, err, de)
+	if err == nil {
+		s.prefetchBlocks(de)
+	}
 
 	return de, err
 }
 
+// prefetchBlocks hints the block list of a looked up file
+// to the store cache, since the file may be about to be read.
+func (s *server) prefetchBlocks(de *upspin.DirEntry) {
+	if s.prefetch == nil || de == nil || !de.IsRegular() || len(de.Blocks) < 2 {
+		return
+	}
+	locs := make([]upspin.Location, len(de.Blocks))
+	for i := range de.Blocks {
+		locs[i] = de.Blocks[i].Location
+	}
+	s.prefetch(locs)
+}
+
 // Glob implements upspin.DirServer.
 func (s *server) Glob(pattern string) ([]*upspin.DirEntry, error) {
 	op := logf("Glob %q", pattern)
@@ -60,12 +60,20 @@ func NewFromDir(dir string) (upspin.Factotum, error) {
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
-	privBytes = stripCR(privBytes)
+	privBytes, err = CheckSecret(stripCR(privBytes))
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("%s(%q)", op, dir), err)
+	}
+	privBytes, grace, err := SplitGrace(privBytes)
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("%s(%q)", op, dir), err)
+	}
+	privBytes = StripCommentLines(privBytes)
 	pubBytes, err := readFile(op, dir, "public.upspinkey")
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
-	pubBytes = stripCR(pubBytes)
+	pubBytes = StripCommentLines(stripCR(pubBytes))
 
 	// Read older key pairs.
 	s2, err := readFile(op, dir, "secret2.upspinkey")
@@ -73,6 +81,14 @@ func NewFromDir(dir string) (upspin.Factotum, error) {
 		return nil, err
 	}
 	s2 = stripCR(s2)
+	if len(grace) > 0 {
+		// The previous key pair kept in the secret key file is
+		// the most recent, so it goes last.
+		if len(s2) > 0 && s2[len(s2)-1] != '\n' {
+			s2 = append(s2, '\n')
+		}
+		s2 = append(s2, grace...)
+	}
 
 	return newFactotum(fmt.Sprintf("%s(%q)", op, dir), pubBytes, privBytes, s2)
 }
@@ -144,6 +160,113 @@ func stripCR(b []byte) []byte {
 	return bytes.Replace(b, []byte("\r"), []byte(""), -1)
 }
 
+// checksumPrefix begins the comment line, written at the end of a
+// secret.upspinkey file by keygen, that records a checksum of the rest.
+const checksumPrefix = "# checksum sha256:"
+
+// SecretChecksum returns the comment line to end a secret.upspinkey file
+// holding private, recording a checksum by which CheckSecret detects a
+// file that has been truncated or otherwise damaged. The checksum is the
+// start of the SHA-256 hash of private, without surrounding space, so it
+// covers any comment, such as the secret seed, as well as the key.
+func SecretChecksum(private string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(private)))
+	return fmt.Sprintf("%s%x\n", checksumPrefix, sum[:8])
+}
+
+// CheckSecret verifies the checksum line that ends secret, the contents
+// of a secret.upspinkey file, and returns the contents without it.
+// Files written before keygen recorded checksums have no such line and
+// are returned unchanged.
+func CheckSecret(secret []byte) ([]byte, error) {
+	i := bytes.LastIndex(secret, []byte(checksumPrefix))
+	if i < 0 || (i > 0 && secret[i-1] != '\n') {
+		return secret, nil
+	}
+	private := secret[:i]
+	got := strings.TrimSpace(string(secret[i:]))
+	if want := strings.TrimSpace(SecretChecksum(string(private))); got != want {
+		return nil, errors.E(errors.Invalid, errors.Str("secret key does not match its checksum; the file is damaged"))
+	}
+	return private, nil
+}
+
+// Marker lines around the previous key pair kept in a secret.upspinkey
+// file by keygen -rotate -grace, until upspin finalizekeys removes it.
+const (
+	graceBegin = "# BEGIN PREVIOUS KEY\n"
+	graceEnd   = "# END PREVIOUS KEY\n"
+)
+
+// GraceKey returns the lines to add to a secret.upspinkey file to keep
+// in it the previous key pair, given in the format of secret2.upspinkey,
+// while keys are rotated, so that data encrypted for either key can be
+// read. SplitGrace recovers it.
+func GraceKey(archived string) string {
+	return graceBegin + archived + graceEnd
+}
+
+// SplitGrace returns secret, the contents of a secret.upspinkey file
+// without its checksum line, divided into the rest of the file and the
+// previous key pair added by GraceKey, in the format of secret2.upspinkey.
+// The previous key pair is empty if there is none.
+func SplitGrace(secret []byte) (current, previous []byte, err error) {
+	begin := 0
+	if !bytes.HasPrefix(secret, []byte(graceBegin)) {
+		begin = bytes.Index(secret, []byte("\n"+graceBegin)) + 1
+		if begin == 0 {
+			return secret, nil, nil
+		}
+	}
+	start := begin + len(graceBegin)
+	end := bytes.Index(secret[start-1:], []byte("\n"+graceEnd))
+	if end < 0 {
+		return nil, nil, errors.E(errors.Invalid, errors.Str("previous key in secret key file has no end marker"))
+	}
+	end += start
+	current = append(append([]byte{}, secret[:begin]...), secret[end+len(graceEnd):]...)
+	return current, secret[start:end], nil
+}
+
+// commentPrefix begins the comment line, written to both key files by
+// keygen -comment, that labels the key pair for the people managing it.
+const commentPrefix = "# comment:"
+
+// KeyComment returns the label recorded by keygen -comment in key, the
+// contents of a public.upspinkey or secret.upspinkey file, or the empty
+// string if there is none. The label means nothing to Upspin.
+func KeyComment(key []byte) string {
+	for _, line := range strings.Split(string(key), "\n") {
+		if strings.HasPrefix(line, commentPrefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, commentPrefix))
+		}
+	}
+	return ""
+}
+
+// CommentLine returns the line recording comment to be added to the key
+// files, from which KeyComment recovers it.
+func CommentLine(comment string) string {
+	return commentPrefix + " " + comment + "\n"
+}
+
+// StripCommentLines returns key, the contents of a key file, without
+// any lines that begin with '#', such as that made by CommentLine.
+// A secret key file's checksum line must be checked by CheckSecret
+// first, as it too is such a line.
+func StripCommentLines(key []byte) []byte {
+	if !bytes.Contains(key, []byte("#")) {
+		return key
+	}
+	var out []byte
+	for _, line := range bytes.SplitAfter(key, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("#")) {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
 // makeKey creates a factotumKey by filling in the derived fields.
 func makeKey(pub upspin.PublicKey, priv string) (*factotumKey, error) {
 	ePublicKey, err := ParsePublicKey(pub)
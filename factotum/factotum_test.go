@@ -5,6 +5,7 @@
 package factotum
 
 import (
+	"io/ioutil"
 	"path/filepath"
 	"testing"
 
@@ -13,10 +14,11 @@ import (
 
 func TestNewFromDir(t *testing.T) {
 	const (
-		pubKey    = "p256\n86754568856409436056886548963722747418663925733852968840719951502625645703023\n55374006944977701639377273685946154797448684848748065688191847332792959379206\n"
-		secKey    = "33732563467898584041325590158539299810645722675081856412396066039103123277092\n"
-		newPubKey = "p256\n6640270742675236934700552659758623510932789581985633007789325329362331148012\n68892645101823987570169861213316538980647268870890981023717754447508722389034\n"
-		newSecKey = "73412709577437621283953284627141522517131750837511539431619352194608555895350\n"
+		pubKey       = "p256\n86754568856409436056886548963722747418663925733852968840719951502625645703023\n55374006944977701639377273685946154797448684848748065688191847332792959379206\n"
+		secKey       = "33732563467898584041325590158539299810645722675081856412396066039103123277092\n"
+		newPubKey    = "p256\n6640270742675236934700552659758623510932789581985633007789325329362331148012\n68892645101823987570169861213316538980647268870890981023717754447508722389034\n"
+		newSecKey    = "73412709577437621283953284627141522517131750837511539431619352194608555895350\n"
+		seededSecKey = "33732563467898584041325590158539299810645722675081856412396066039103123277092 # lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat\n"
 	)
 
 	cases := []struct {
@@ -37,6 +39,13 @@ func TestNewFromDir(t *testing.T) {
 		{"bad", false, "", "", "", ""},
 		{"empty", false, "", "", "", ""},
 		{"mismatched", false, pubKey, secKey, "", ""},
+		// A checksum line is checked and dropped.
+		{"checksum", true, pubKey, seededSecKey, "", ""},
+		{"bad-checksum", false, "", "", "", ""},
+		// So are the lines recording a comment.
+		{"labeled", true, pubKey, seededSecKey, "", ""},
+		// A previous key kept in the secret key file is read too.
+		{"grace", true, newPubKey, newSecKey, pubKey, secKey},
 	}
 	for _, c := range cases {
 		fi, err := NewFromDir(filepath.Join("testdata", c.dir))
@@ -91,6 +100,68 @@ func TestClean(t *testing.T) {
 
 }
 
+func TestCheckSecret(t *testing.T) {
+	const private = "1234 # some seed\n"
+	secret := private + SecretChecksum(private)
+	if got, err := CheckSecret([]byte(secret)); err != nil || string(got) != private {
+		t.Errorf("CheckSecret(%q) = %q, %v; want %q", secret, got, err, private)
+	}
+	// Without a checksum the contents are accepted as they are.
+	if got, err := CheckSecret([]byte(private)); err != nil || string(got) != private {
+		t.Errorf("CheckSecret(%q) = %q, %v; want it unchanged", private, got, err)
+	}
+	// Truncating the checksum itself is detected too.
+	for _, bad := range []string{secret[:len(secret)-4], "1235 # some seed\n" + SecretChecksum(private)} {
+		if _, err := CheckSecret([]byte(bad)); err == nil {
+			t.Errorf("CheckSecret(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSplitGrace(t *testing.T) {
+	const (
+		private  = "1234 # some seed\n"
+		label    = "# comment: work\n"
+		archived = "# EE 2017-05-01 10:00:00Z\np256\n1\n2\n3\n"
+	)
+	secret := private + label + GraceKey(archived)
+	current, previous, err := SplitGrace([]byte(secret))
+	if err != nil || string(current) != private+label || string(previous) != archived {
+		t.Errorf("SplitGrace(%q) = %q, %q, %v; want %q, %q", secret, current, previous, err, private+label, archived)
+	}
+	current, previous, err = SplitGrace([]byte(private))
+	if err != nil || string(current) != private || previous != nil {
+		t.Errorf("SplitGrace(%q) = %q, %q, %v; want it unchanged", private, current, previous, err)
+	}
+	unterminated := secret[:len(secret)-len(graceEnd)]
+	if _, _, err := SplitGrace([]byte(unterminated)); err == nil {
+		t.Errorf("SplitGrace(%q) succeeded", unterminated)
+	}
+}
+
+func TestKeyComment(t *testing.T) {
+	for _, name := range []string{"public.upspinkey", "secret.upspinkey"} {
+		key, err := ioutil.ReadFile(filepath.Join("testdata", "labeled", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := KeyComment(key), "laptop 2024"; got != want {
+			t.Errorf("KeyComment(%s) = %q; want %q", name, got, want)
+		}
+	}
+	const private = "1234 # some seed\n"
+	if got := KeyComment([]byte(private)); got != "" {
+		t.Errorf("KeyComment(%q) = %q; want none", private, got)
+	}
+	labeled := private + CommentLine("work")
+	if got := KeyComment([]byte(labeled)); got != "work" {
+		t.Errorf("KeyComment(%q) = %q; want %q", labeled, got, "work")
+	}
+	if got := StripCommentLines([]byte(labeled)); string(got) != private {
+		t.Errorf("StripCommentLines(%q) = %q; want %q", labeled, got, private)
+	}
+}
+
 func TestSign(t *testing.T) {
 	fi, err := NewFromDir(filepath.Join("testdata", "ok"))
 	if err != nil {
@@ -0,0 +1,98 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bip39 converts binary data to and from the mnemonic sentences
+// of BIP 39, the word lists used by many password managers and hardware
+// wallets to record secrets.
+//
+// A mnemonic is the data followed by a checksum, the first bits of the
+// data's SHA-256 hash, written as words of 11 bits each from a list of
+// 2048. Data of 128 bits, for example, takes 12 words, such as
+//
+//	legal winner thank year wave sausage worth useful legal winner thank yellow
+//
+// See https://github.com/bitcoin/bips/blob/master/bip-0039.mediawiki.
+package bip39 // import "upspin.io/key/bip39"
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"upspin.io/errors"
+)
+
+// index maps each word in the list to its position.
+var index = make(map[string]int, len(english))
+
+func init() {
+	for i, w := range english {
+		index[w] = i
+	}
+}
+
+// Encode returns the mnemonic for b, whose length must be a multiple
+// of four bytes between 16 and 32.
+func Encode(b []byte) (string, error) {
+	if len(b) < 16 || len(b) > 32 || len(b)%4 != 0 {
+		return "", errors.Errorf("bip39: cannot encode %d bytes", len(b))
+	}
+	sum := sha256.Sum256(b)
+	data := append(append([]byte(nil), b...), sum[0])
+	n := (len(b)*8 + len(b)/4) / 11
+	words := make([]string, n)
+	for i := range words {
+		words[i] = english[bits(data, i*11, 11)]
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Decode returns the data held in the mnemonic. The words may be
+// separated by any white space. It returns an error if the mnemonic
+// has the wrong number of words, contains a word not in the list, or
+// has a bad checksum.
+func Decode(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+		// ok
+	default:
+		return nil, errors.Errorf("bip39: %d words, expected 12, 15, 18, 21, or 24", len(words))
+	}
+	// Each word holds 11 bits. A checksum bit follows each
+	// 32 bits of data.
+	data := make([]byte, (len(words)*11+7)/8)
+	for i, w := range words {
+		x, ok := index[w]
+		if !ok {
+			return nil, errors.Errorf("bip39: word %d %q is not in the word list", i+1, w)
+		}
+		for j := 0; j < 11; j++ {
+			if x&(1<<uint(10-j)) != 0 {
+				n := i*11 + j
+				data[n/8] |= 0x80 >> uint(n%8)
+			}
+		}
+	}
+	size := len(words) * 11 * 32 / 33 / 8
+	b := data[:size]
+	sum := sha256.Sum256(b)
+	checkBits := size / 4
+	if bits(data, size*8, checkBits) != bits(sum[:], 0, checkBits) {
+		return nil, errors.Str("bip39: bad checksum")
+	}
+	return b, nil
+}
+
+// bits returns the n bits of b starting at bit offset off, most
+// significant first, as an integer.
+func bits(b []byte, off, n int) int {
+	x := 0
+	for i := off; i < off+n; i++ {
+		x <<= 1
+		if b[i/8]&(0x80>>uint(i%8)) != 0 {
+			x |= 1
+		}
+	}
+	return x
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bip39
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test vectors from the reference implementation,
+// https://github.com/trezor/python-mnemonic/blob/master/vectors.json.
+var vectors = []struct {
+	hex, mnemonic string
+}{
+	{"00000000000000000000000000000000", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"},
+	{"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f", "legal winner thank year wave sausage worth useful legal winner thank yellow"},
+	{"80808080808080808080808080808080", "letter advice cage absurd amount doctor acoustic avoid letter advice cage above"},
+	{"ffffffffffffffffffffffffffffffff", "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong"},
+	{"9e885d952ad362caeb4efe34a8e91bd2", "ozone drill grab fiber curtain grace pudding thank cruise elder eight picnic"},
+	{"0000000000000000000000000000000000000000000000000000000000000000", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art"},
+}
+
+func TestWordList(t *testing.T) {
+	const want = "2f5eed53a4727b4bf8880d8f3f199efc90e58503646d9ff8eff3a2ed3b24dbda"
+	sum := sha256.Sum256([]byte(strings.Join(english[:], "\n") + "\n"))
+	if got := fmt.Sprintf("%x", sum); got != want {
+		t.Errorf("word list hash = %s, want %s", got, want)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		b, err := hex.DecodeString(v.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Encode(b)
+		if err != nil {
+			t.Errorf("Encode(%s): %v", v.hex, err)
+			continue
+		}
+		if m != v.mnemonic {
+			t.Errorf("Encode(%s) = %q, want %q", v.hex, m, v.mnemonic)
+		}
+		d, err := Decode(v.mnemonic)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", v.mnemonic, err)
+			continue
+		}
+		if !bytes.Equal(d, b) {
+			t.Errorf("Decode(%q) = %x, want %s", v.mnemonic, d, v.hex)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, m := range []string{
+		"",
+		"abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon upspin",
+		"Abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+	} {
+		if b, err := Decode(m); err == nil {
+			t.Errorf("Decode(%q) = %x, want error", m, b)
+		}
+	}
+}
+
+func TestEncodeLength(t *testing.T) {
+	for _, n := range []int{0, 15, 17, 36} {
+		if _, err := Encode(make([]byte, n)); err == nil {
+			t.Errorf("Encode of %d bytes succeeded", n)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keygen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+// ExportPEM converts a key pair in the format returned by FromSeed to PEM.
+// The public key is a PKIX "PUBLIC KEY" block and the private key a PKCS #8
+// "PRIVATE KEY" block, as read by OpenSSL and most other tools.
+func ExportPEM(public upspin.PublicKey, private string) (pub, priv []byte, err error) {
+	const op = "key/keygen.ExportPEM"
+	pk, sk, err := parseKeys(public, private)
+	if err != nil {
+		return nil, nil, errors.E(op, err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return nil, nil, errors.E(op, errors.Invalid, err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return nil, nil, errors.E(op, errors.Invalid, err)
+	}
+	pub = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	priv = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	return pub, priv, nil
+}
+
+// ExportOpenSSH converts a key pair in the format returned by FromSeed to
+// the formats used by OpenSSH: a single line for an authorized_keys file,
+// ending in the comment, and an unencrypted "OPENSSH PRIVATE KEY" block.
+func ExportOpenSSH(public upspin.PublicKey, private, comment string) (pub, priv []byte, err error) {
+	const op = "key/keygen.ExportOpenSSH"
+	pk, sk, err := parseKeys(public, private)
+	if err != nil {
+		return nil, nil, errors.E(op, err)
+	}
+
+	// The key type, public key, and private key fields,
+	// in the wire format of RFC 4253 section 6.6 and its
+	// extension in RFC 5656.
+	curve := "nistp" + strings.TrimPrefix(pk.Curve.Params().Name, "P-")
+	keyType := "ecdsa-sha2-" + curve
+	point := elliptic.Marshal(pk.Curve, pk.X, pk.Y)
+	var pubBlob, privFields sshBuffer
+	pubBlob.string([]byte(keyType))
+	pubBlob.string([]byte(curve))
+	pubBlob.string(point)
+	privFields.string([]byte(keyType))
+	privFields.string([]byte(curve))
+	privFields.string(point)
+	privFields.mpint(sk.D)
+
+	// The check bytes let a reader tell whether it decrypted the
+	// private section correctly. It is not encrypted here, so any
+	// value will do; take it from the key so the output is stable.
+	check := binary.BigEndian.Uint32(factotum.KeyHash(public))
+	var section sshBuffer
+	section.uint32(check)
+	section.uint32(check)
+	section = append(section, privFields...)
+	section.string([]byte(comment))
+	for i := byte(1); len(section)%8 != 0; i++ {
+		section = append(section, i)
+	}
+
+	var key sshBuffer
+	key = append(key, "openssh-key-v1\x00"...)
+	key.string([]byte("none")) // Cipher.
+	key.string([]byte("none")) // Key derivation function.
+	key.string(nil)            // Key derivation options.
+	key.uint32(1)              // Number of keys.
+	key.string(pubBlob)
+	key.string(section)
+
+	line := keyType + " " + base64.StdEncoding.EncodeToString(pubBlob)
+	if comment != "" {
+		line += " " + comment
+	}
+	pub = []byte(line + "\n")
+	priv = pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: key})
+	return pub, priv, nil
+}
+
+// parseKeys converts a key pair in the format returned by FromSeed
+// to the corresponding crypto keys.
+func parseKeys(public upspin.PublicKey, private string) (*ecdsa.PublicKey, *ecdsa.PrivateKey, error) {
+	if i := strings.IndexByte(private, '#'); i >= 0 {
+		private = private[:i] // Drop any comment, such as the seed.
+	}
+	var d big.Int
+	if _, ok := d.SetString(strings.TrimSpace(private), 10); !ok {
+		return nil, nil, errors.E(errors.Invalid, errors.Str("private key is not a big int"))
+	}
+	pk, err := factotum.ParsePublicKey(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	x, y := pk.Curve.ScalarBaseMult(d.Bytes())
+	if x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+		return nil, nil, errors.E(errors.Invalid, errors.Str("public and private keys do not correspond"))
+	}
+	return pk, &ecdsa.PrivateKey{PublicKey: *pk, D: &d}, nil
+}
+
+// sshBuffer accumulates data in the SSH wire format.
+type sshBuffer []byte
+
+func (b *sshBuffer) uint32(n uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], n)
+	*b = append(*b, buf[:]...)
+}
+
+// string appends s as an SSH string: its length followed by its bytes.
+func (b *sshBuffer) string(s []byte) {
+	b.uint32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+// mpint appends the non-negative n as an SSH multiple precision integer.
+func (b *sshBuffer) mpint(n *big.Int) {
+	bytes := n.Bytes()
+	if len(bytes) > 0 && bytes[0]&0x80 != 0 {
+		// Keep the value positive in two's complement.
+		bytes = append([]byte{0}, bytes...)
+	}
+	b.string(bytes)
+}
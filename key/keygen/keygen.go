@@ -0,0 +1,421 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package keygen creates Upspin key pairs from secret seeds.
+//
+// A secret seed holds 128 bits of entropy written as eight proquints,
+// such as
+//
+//	lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat
+//
+// The separators carry no information, so the seed may as well be written
+// with dashes or spaces throughout; see FormatSeed.
+//
+// The same bits may instead be written as a 12-word BIP 39 mnemonic,
+// the form used by many password managers and hardware wallets; see
+// Mnemonic. Either form of a seed makes the same keys.
+//
+// The same seed and curve always produce the same key pair, so a user
+// who records the seed can recreate lost keys. A seed may also be split
+// into shares, some number of which are needed to recreate it; see
+// SplitSeed.
+package keygen // import "upspin.io/key/keygen"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/key/bip39"
+	"upspin.io/key/proquint"
+	"upspin.io/key/shamir"
+	"upspin.io/pack/ee"
+	"upspin.io/upspin"
+)
+
+// SeedLen is the length of a secret seed: eight five-letter
+// proquints separated by seven punctuation characters.
+const SeedLen = 8*5 + 7
+
+// SeedBits is the entropy held by a secret seed, and so the most
+// security that keys made from one can provide, whatever the curve.
+const SeedBits = 128
+
+// NewSeed returns a new secret seed holding 128 random bits.
+func NewSeed() (string, error) {
+	const op = "key/keygen.NewSeed"
+	// TODO(ehg)  Consider whether we are willing to ask users to write long seeds for P521.
+	// Until then, see SecurityBits.
+	b := make([]byte, SeedBits/8)
+	defer Zero(b)
+	if err := ee.GenEntropy(b); err != nil {
+		return "", errors.E(op, errors.IO, err)
+	}
+	return encodeSeed(op, b)
+}
+
+// NewSeedFrom is like NewSeed but reads the 128 bits from r,
+// such as a hardware random number generator, instead of the
+// system's source.
+func NewSeedFrom(r io.Reader) (string, error) {
+	const op = "key/keygen.NewSeedFrom"
+	b := make([]byte, SeedBits/8)
+	defer Zero(b)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", errors.E(op, errors.IO, err)
+	}
+	return encodeSeed(op, b)
+}
+
+// SeedFromBytes returns the seed holding the 128 bits in b, such as a
+// secret supplied in hex by a user with a source of entropy of their own.
+// Like NewSeedFrom, it rejects bits that are evidently not random.
+func SeedFromBytes(b []byte) (string, error) {
+	const op = "key/keygen.SeedFromBytes"
+	if len(b) != SeedBits/8 {
+		return "", errors.E(op, errors.Invalid, errors.Errorf("secret has %d bytes, want %d", len(b), SeedBits/8))
+	}
+	return encodeSeed(op, b)
+}
+
+// encodeSeed returns the seed holding the 128 bits in b,
+// after checking that they look random.
+func encodeSeed(op string, b []byte) (string, error) {
+	if err := CheckEntropy(b); err != nil {
+		return "", errors.E(op, errors.Invalid, err)
+	}
+	return proquints(b), nil
+}
+
+// Zero overwrites b with zeros, so that secret bits held in it do not
+// linger in memory once they have been used. It can only limit their
+// exposure: strings made from them cannot be cleared, and the garbage
+// collector may already have copied them elsewhere.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// proquints returns the 128 bits in b written as a seed.
+func proquints(b []byte) string {
+	proquints := make([]interface{}, 8)
+	for i := 0; i < 8; i++ {
+		proquints[i] = proquint.Encode(binary.BigEndian.Uint16(b[2*i : 2*i+2]))
+	}
+	// Ignore punctuation on input;  this format is just to help the user keep their place.
+	return fmt.Sprintf("%s-%s-%s-%s.%s-%s-%s-%s", proquints...)
+}
+
+// CheckEntropy returns an error if the bytes read from an entropy source
+// are evidently not random: all the same, repeating a short pattern, or
+// counting up or down. Passing the check is no proof of randomness, but
+// failing it means the source is broken and must not be used for keys.
+func CheckEntropy(b []byte) error {
+	if len(b) < 2 {
+		return nil
+	}
+	// A short repeating pattern, including all bytes the same.
+	for period := 1; period <= len(b)/2; period++ {
+		repeats := true
+		for i := period; i < len(b); i++ {
+			if b[i] != b[i-period] {
+				repeats = false
+				break
+			}
+		}
+		if repeats {
+			return errors.Errorf("entropy source is not random: %d-byte pattern repeats in %x", period, b)
+		}
+	}
+	// A counter, such as 0, 1, 2, ...
+	step := b[1] - b[0]
+	for i := 2; i < len(b); i++ {
+		if b[i]-b[i-1] != step {
+			return nil
+		}
+	}
+	return errors.Errorf("entropy source is not random: bytes count in steps of %d in %x", int8(step), b)
+}
+
+// MnemonicWords is the number of words in a secret seed written as
+// a BIP 39 mnemonic.
+const MnemonicWords = 12
+
+// CheckSeed returns an error describing how seed fails to conform
+// to the proquint format, or nil if it does. A seed is eight proquints,
+// each but the last followed by a '-', '.', or ' ' separator. The
+// separators carry no information; their placement just helps the user
+// keep their place.
+//
+// A seed containing white space is instead checked as a BIP 39 mnemonic
+// of MnemonicWords words, whose words must be in the English list and
+// whose checksum must be correct.
+func CheckSeed(seed string) error {
+	if isMnemonic(seed) {
+		_, err := decodeMnemonic(seed)
+		return err
+	}
+	if len(seed) != SeedLen {
+		return errors.Errorf("bad format for secret: length %d, expected %d", len(seed), SeedLen)
+	}
+	for i := 0; i < 8; i++ {
+		group := seed[6*i : 6*i+5]
+		if !proquint.Valid([]byte(group)) {
+			return errors.Errorf("bad format for secret: group %d %q is not a valid proquint", i+1, group)
+		}
+		if i < 7 {
+			if sep := seed[6*i+5]; sep != '-' && sep != '.' && sep != ' ' {
+				return errors.Errorf("bad format for secret: expected '-', '.', or ' ' after group %d, found %q", i+1, sep)
+			}
+		}
+	}
+	return nil
+}
+
+// FromSeed creates a key pair for the named curve from the secret seed.
+// If seed is empty, FromSeed creates a new one with NewSeed.
+// It returns the keys in the format of the public.upspinkey and
+// secret.upspinkey files, and the seed used to create them.
+func FromSeed(curve, seed string) (public, private, secretSeed string, err error) {
+	const op = "key/keygen.FromSeed"
+	if seed == "" {
+		seed, err = NewSeed()
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	b, err := decodeSeed(seed)
+	if err != nil {
+		return "", "", "", errors.E(op, errors.Invalid, err)
+	}
+	defer Zero(b)
+	pub, priv, err := ee.CreateKeys(curve, b)
+	if err != nil {
+		return "", "", "", errors.E(op, err)
+	}
+	return string(pub), priv, seed, nil
+}
+
+// Mnemonic returns the secret seed, in either form, written as a
+// BIP 39 mnemonic.
+func Mnemonic(seed string) (string, error) {
+	const op = "key/keygen.Mnemonic"
+	b, err := decodeSeed(seed)
+	if err != nil {
+		return "", errors.E(op, errors.Invalid, err)
+	}
+	defer Zero(b)
+	m, err := bip39.Encode(b)
+	if err != nil {
+		return "", errors.E(op, errors.Invalid, err)
+	}
+	return m, nil
+}
+
+// isMnemonic reports whether seed is evidently meant as a mnemonic
+// rather than as proquints, which may be separated by spaces too.
+func isMnemonic(seed string) bool {
+	seed = strings.TrimSpace(seed)
+	if len(seed) == SeedLen && len(strings.Fields(seed)) == 8 {
+		return false
+	}
+	return strings.ContainsAny(seed, " \t\n")
+}
+
+// Styles in which FormatSeed writes a seed in proquints.
+const (
+	SeedDotted = "dotted" // lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat, as made by NewSeed.
+	SeedDashed = "dashed" // lusab-babad-gutih-tugad-gutuk-bisog-mudof-sakat.
+	SeedSpaced = "spaced" // lusab babad gutih tugad gutuk bisog mudof sakat.
+)
+
+// FormatSeed returns the secret seed, in either form, written as
+// proquints with the separators of the named style, for those who store
+// seeds where some punctuation is mangled. All styles hold the same bits
+// and make the same keys.
+func FormatSeed(seed, style string) (string, error) {
+	const op = "key/keygen.FormatSeed"
+	if style != SeedDotted && style != SeedDashed && style != SeedSpaced {
+		return "", errors.E(op, errors.Invalid, errors.Errorf("unknown seed style %q", style))
+	}
+	b, err := decodeSeed(seed)
+	if err != nil {
+		return "", errors.E(op, errors.Invalid, err)
+	}
+	defer Zero(b)
+	formatted := proquints(b)
+	switch style {
+	case SeedDashed:
+		formatted = strings.Replace(formatted, ".", "-", 1)
+	case SeedSpaced:
+		formatted = strings.NewReplacer("-", " ", ".", " ").Replace(formatted)
+	}
+	return formatted, nil
+}
+
+// decodeSeed returns the 128 bits held in the secret seed.
+func decodeSeed(seed string) ([]byte, error) {
+	if isMnemonic(seed) {
+		return decodeMnemonic(seed)
+	}
+	if err := CheckSeed(seed); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	for i := 0; i < 8; i++ {
+		binary.BigEndian.PutUint16(b[2*i:2*i+2], proquint.Decode([]byte(seed[6*i:6*i+5])))
+	}
+	return b, nil
+}
+
+// decodeMnemonic returns the 128 bits held in a seed written as a
+// BIP 39 mnemonic.
+func decodeMnemonic(seed string) ([]byte, error) {
+	if n := len(strings.Fields(seed)); n != MnemonicWords {
+		return nil, errors.Errorf("bad format for secret: %d words, expected %d", n, MnemonicWords)
+	}
+	b, err := bip39.Decode(seed)
+	if err != nil {
+		return nil, errors.Errorf("bad format for secret: %v", err)
+	}
+	return b, nil
+}
+
+// ShareLen is the length of a share of a secret seed: nine five-letter
+// proquints separated by eight punctuation characters.
+const ShareLen = 9*5 + 8
+
+// SplitSeed splits the secret seed, in either form, into n shares, any k
+// of which can be given to CombineShares to recreate it. Fewer than k
+// reveal nothing about it. It requires 2 <= k <= n <= 255.
+//
+// A share is written like a seed in proquints with one more proquint,
+// recording k and the number of the share, at the start.
+func SplitSeed(seed string, k, n int) ([]string, error) {
+	const op = "key/keygen.SplitSeed"
+	b, err := decodeSeed(seed)
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	defer Zero(b)
+	split, err := shamir.Split(b, k, n)
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	shares := make([]string, n)
+	for i, s := range split {
+		header := proquint.Encode(uint16(k)<<8 | uint16(s[0]))
+		shares[i] = string(header) + "." + proquints(s[1:])
+		Zero(s)
+	}
+	return shares, nil
+}
+
+// CheckShare returns an error describing how share fails to conform to
+// the format of the shares made by SplitSeed, or nil if it does.
+func CheckShare(share string) error {
+	_, _, _, err := decodeShare(share)
+	return err
+}
+
+// CombineShares recreates a secret seed, in proquints, from shares made
+// by SplitSeed. It needs at least as many shares as the seed was split
+// with.
+func CombineShares(shares []string) (string, error) {
+	const op = "key/keygen.CombineShares"
+	if len(shares) == 0 {
+		return "", errors.E(op, errors.Invalid, errors.Str("no shares"))
+	}
+	var need int
+	split := make([][]byte, len(shares))
+	defer func() {
+		for _, s := range split {
+			Zero(s)
+		}
+	}()
+	for i, share := range shares {
+		k, x, b, err := decodeShare(share)
+		if err != nil {
+			return "", errors.E(op, errors.Invalid, errors.Errorf("share %d: %v", i+1, err))
+		}
+		if i > 0 && k != need {
+			return "", errors.E(op, errors.Invalid, errors.Errorf("shares are from different splits: thresholds %d and %d", need, k))
+		}
+		need = k
+		split[i] = append([]byte{x}, b...)
+		Zero(b)
+	}
+	if len(shares) < need {
+		return "", errors.E(op, errors.Invalid, errors.Errorf("need %d shares to recreate the seed, have %d", need, len(shares)))
+	}
+	b, err := shamir.Combine(split)
+	if err != nil {
+		return "", errors.E(op, errors.Invalid, err)
+	}
+	defer Zero(b)
+	return proquints(b), nil
+}
+
+// decodeShare returns the threshold and number of a share and the
+// bits it holds.
+func decodeShare(share string) (k int, x byte, b []byte, err error) {
+	if len(share) != ShareLen {
+		return 0, 0, nil, errors.Errorf("bad format for share: length %d, expected %d", len(share), ShareLen)
+	}
+	header := share[:5]
+	if !proquint.Valid([]byte(header)) {
+		return 0, 0, nil, errors.Errorf("bad format for share: group 1 %q is not a valid proquint", header)
+	}
+	if sep := share[5]; sep != '-' && sep != '.' {
+		return 0, 0, nil, errors.Errorf("bad format for share: expected '-' or '.' after group 1, found %q", sep)
+	}
+	h := proquint.Decode([]byte(header))
+	k, x = int(h>>8), byte(h)
+	if k < 2 || x == 0 {
+		return 0, 0, nil, errors.Errorf("bad format for share: group 1 %q does not number a share", header)
+	}
+	// The rest is written as a seed.
+	b, err = decodeSeed(share[6:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return k, x, b, nil
+}
+
+// Curves returns the names of the curves on which keys can be made, in
+// order of preference.
+func Curves() []string {
+	return []string{"p256", "p384", "p521"}
+}
+
+// SecurityBits returns the security level of keys on the named curve:
+// the length in bits of a symmetric key that would be about as hard to
+// break. Keys made from a secret seed provide no more than SeedBits,
+// however strong the curve.
+func SecurityBits(curve string) (int, error) {
+	switch curve {
+	case "p256":
+		return 128, nil
+	case "p384":
+		return 192, nil
+	case "p521":
+		return 256, nil
+	}
+	return 0, errors.E("key/keygen.SecurityBits", errors.Invalid, errors.Errorf("no such curve %q", curve))
+}
+
+// Fingerprint returns a short fingerprint of the public key, suitable for
+// comparing keys by eye and for recording in logs. It is the first eight
+// bytes of the SHA-256 hash by which ee-packed data refers to the key,
+// hex-encoded in colon-separated groups of four digits, such as
+//
+//	89ab:cdef:0123:4567
+func Fingerprint(public upspin.PublicKey) string {
+	h := factotum.KeyHash(public)
+	return fmt.Sprintf("%x:%x:%x:%x", h[0:2], h[2:4], h[4:6], h[6:8])
+}
@@ -0,0 +1,387 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keygen
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+const seed = "pibud-sijat-ponam-zizaz.kudol-visin-vakok-jinok"
+
+// mnemonic is seed written as a BIP 39 mnemonic.
+const mnemonic = "picnic mixed fat fee month tray ranch woman boring artwork night slush"
+
+func TestCheckSeed(t *testing.T) {
+	tests := []struct {
+		seed string
+		err  string // Substring of expected error; empty for valid seeds.
+	}{
+		{seed, ""},
+		{"lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat", ""},
+		{"pibud-sijat-ponam-zizaz-kudol-visin-vakok-jinok", ""},
+		{"pibud sijat ponam zizaz kudol visin vakok jinok", ""},
+		{"pibud-sijat-ponam-zizaz.kudol-visin-vakok", "length"},
+		{"pibud-sijat-pxnam-zizaz.kudol-visin-vakok-jinok", `group 3 "pxnam"`},
+		{"pibud-sijat-ponam-zizaz.kudol-visin-vakok-jinoa", `group 8 "jinoa"`},
+		{"pibud-sijat-ponam-zizaz.kudol-visin_vakok-jinok", "after group 6"},
+		{"pibudx-sijat-ponam-zizaz.kudol-visin-vakok-jinok"[1:], `group 1 "ibudx"`},
+		{mnemonic, ""},
+		{" picnic mixed fat fee month\ttray ranch woman boring artwork night slush\n", ""},
+		{"picnic mixed fat fee month tray ranch woman boring artwork night", "11 words"},
+		{"picnic mixed fat fee month tray ranch woman boring artwork night upspin", `word 12 "upspin"`},
+		{"picnic mixed fat fee month tray ranch woman boring artwork night night", "checksum"},
+	}
+	for _, test := range tests {
+		err := CheckSeed(test.seed)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("CheckSeed(%q) = %v, want nil", test.seed, err)
+		case test.err != "" && err == nil:
+			t.Errorf("CheckSeed(%q) = nil, want error containing %q", test.seed, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("CheckSeed(%q) = %v, want error containing %q", test.seed, err, test.err)
+		}
+	}
+}
+
+func TestFormatSeed(t *testing.T) {
+	for _, test := range []struct {
+		style, want string
+	}{
+		{SeedDotted, seed},
+		{SeedDashed, "pibud-sijat-ponam-zizaz-kudol-visin-vakok-jinok"},
+		{SeedSpaced, "pibud sijat ponam zizaz kudol visin vakok jinok"},
+	} {
+		// Any form of the seed may be reformatted.
+		for _, in := range []string{seed, mnemonic, test.want} {
+			got, err := FormatSeed(in, test.style)
+			if err != nil || got != test.want {
+				t.Errorf("FormatSeed(%q, %q) = %q, %v; want %q", in, test.style, got, err, test.want)
+			}
+		}
+		b, err := decodeSeed(test.want)
+		if err != nil {
+			t.Errorf("decodeSeed(%q): %v", test.want, err)
+			continue
+		}
+		if want, _ := decodeSeed(seed); !bytes.Equal(b, want) {
+			t.Errorf("decodeSeed(%q) = %x, want %x", test.want, b, want)
+		}
+	}
+	if _, err := FormatSeed(seed, "colons"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("FormatSeed with unknown style: err = %v, want Invalid", err)
+	}
+}
+
+func TestFromSeed(t *testing.T) {
+	public, private, secretSeed, err := FromSeed("p256", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretSeed != seed {
+		t.Errorf("seed = %q, want %q", secretSeed, seed)
+	}
+	if !strings.HasPrefix(public, "p256\n") {
+		t.Errorf("public key %q does not name curve p256", public)
+	}
+	if private == "" {
+		t.Errorf("empty private key")
+	}
+
+	// With no seed, FromSeed makes a new valid one.
+	_, _, secretSeed, err = FromSeed("p256", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSeed(secretSeed); err != nil {
+		t.Errorf("new seed %q: %v", secretSeed, err)
+	}
+
+	if _, _, _, err := FromSeed("p256", seed[1:]); err == nil {
+		t.Errorf("FromSeed accepted a short seed")
+	}
+	if _, _, _, err := FromSeed("p999", seed); err == nil {
+		t.Errorf("FromSeed accepted an unknown curve")
+	}
+}
+
+func TestMnemonic(t *testing.T) {
+	m, err := Mnemonic(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != mnemonic {
+		t.Errorf("Mnemonic(%q) = %q, want %q", seed, m, mnemonic)
+	}
+	if m, err := Mnemonic(mnemonic); err != nil || m != mnemonic {
+		t.Errorf("Mnemonic(%q) = %q, %v; want it unchanged", mnemonic, m, err)
+	}
+
+	// Both forms of the seed make the same key pair.
+	b1, err := decodeSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := decodeSeed(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Errorf("mnemonic holds %x, want %x", b2, b1)
+	}
+	pub1, priv1, _, err := FromSeed("p256", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub2, priv2, secretSeed, err := FromSeed("p256", mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub1 != pub2 || priv1 != priv2 {
+		t.Errorf("keys from mnemonic differ from keys from proquints")
+	}
+	if secretSeed != mnemonic {
+		t.Errorf("seed = %q, want %q", secretSeed, mnemonic)
+	}
+}
+
+func TestSplitSeed(t *testing.T) {
+	shares, err := SplitSeed(mnemonic, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("SplitSeed made %d shares, want 5", len(shares))
+	}
+	for i, share := range shares {
+		if err := CheckShare(share); err != nil {
+			t.Errorf("share %d %q: %v", i+1, share, err)
+		}
+	}
+	// The seed comes back in proquints from any three shares.
+	for _, some := range [][]string{shares[:3], shares[2:], {shares[4], shares[0], shares[2]}, shares} {
+		got, err := CombineShares(some)
+		if err != nil {
+			t.Fatalf("CombineShares(%q): %v", some, err)
+		}
+		if got != seed {
+			t.Errorf("CombineShares(%q) = %q, want %q", some, got, seed)
+		}
+	}
+
+	if _, err := CombineShares(shares[:2]); err == nil || !strings.Contains(err.Error(), "need 3 shares") {
+		t.Errorf("CombineShares of two shares: err = %v, want need 3 shares", err)
+	}
+	other, err := SplitSeed(seed, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CombineShares([]string{shares[0], shares[1], other[2]}); err == nil {
+		t.Errorf("CombineShares accepted shares from different splits")
+	}
+	for _, bad := range []string{seed, "babad." + seed, shares[0][:ShareLen-1] + "x"} {
+		if err := CheckShare(bad); err == nil {
+			t.Errorf("CheckShare(%q) succeeded", bad)
+		}
+	}
+	if _, err := SplitSeed(seed, 1, 3); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("SplitSeed 1 of 3: err = %v, want Invalid", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	public, _, _, err := FromSeed("p256", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := Fingerprint(upspin.PublicKey(public))
+	h := factotum.KeyHash(upspin.PublicKey(public))
+	if want := fmt.Sprintf("%x:%x:%x:%x", h[0:2], h[2:4], h[4:6], h[6:8]); fp != want {
+		t.Errorf("Fingerprint = %q, want %q", fp, want)
+	}
+	if len(fp) != 19 {
+		t.Errorf("Fingerprint %q has length %d, want 19", fp, len(fp))
+	}
+}
+
+func TestSecurityBits(t *testing.T) {
+	for _, c := range []struct {
+		curve string
+		bits  int
+	}{
+		{"p256", 128},
+		{"p384", 192},
+		{"p521", 256},
+	} {
+		bits, err := SecurityBits(c.curve)
+		if err != nil || bits != c.bits {
+			t.Errorf("SecurityBits(%q) = %d, %v; want %d", c.curve, bits, err, c.bits)
+		}
+	}
+	if _, err := SecurityBits("p224"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("SecurityBits(p224): err = %v, want Invalid", err)
+	}
+}
+
+func TestCurves(t *testing.T) {
+	const seed = "pibud-sijat-ponam-zizaz.kudol-visin-vakok-jinok"
+	for _, curve := range Curves() {
+		if _, err := SecurityBits(curve); err != nil {
+			t.Errorf("SecurityBits(%q): %v", curve, err)
+		}
+		if _, _, _, err := FromSeed(curve, seed); err != nil {
+			t.Errorf("FromSeed(%q): %v", curve, err)
+		}
+	}
+}
+
+func TestExportPEM(t *testing.T) {
+	for _, curve := range []string{"p256", "p521"} {
+		public, private, _, err := FromSeed(curve, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, priv, err := ExportPEM(upspin.PublicKey(public), private)
+		if err != nil {
+			t.Fatalf("%s: %v", curve, err)
+		}
+		block, _ := pem.Decode(pub)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			t.Fatalf("%s: bad public key PEM:\n%s", curve, pub)
+		}
+		pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: %v", curve, err)
+		}
+		block, _ = pem.Decode(priv)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			t.Fatalf("%s: bad private key PEM:\n%s", curve, priv)
+		}
+		sk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: %v", curve, err)
+		}
+		if sk, ok := sk.(*ecdsa.PrivateKey); !ok || !sk.PublicKey.Equal(pk) {
+			t.Errorf("%s: private key does not match public key", curve)
+		}
+	}
+}
+
+func TestExportOpenSSH(t *testing.T) {
+	for _, test := range []struct{ curve, keyType string }{
+		{"p256", "ecdsa-sha2-nistp256"},
+		{"p384", "ecdsa-sha2-nistp384"},
+	} {
+		public, private, _, err := FromSeed(test.curve, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, priv, err := ExportOpenSSH(upspin.PublicKey(public), private, "ann@example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", test.curve, err)
+		}
+		fields := strings.Fields(string(pub))
+		if len(fields) != 3 || fields[0] != test.keyType || fields[2] != "ann@example.com" {
+			t.Errorf("%s: public key = %q, want %s key with comment", test.curve, pub, test.keyType)
+		}
+		block, _ := pem.Decode(priv)
+		if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+			t.Fatalf("%s: bad private key PEM:\n%s", test.curve, priv)
+		}
+		if !strings.HasPrefix(string(block.Bytes), "openssh-key-v1\x00") {
+			t.Errorf("%s: private key lacks openssh-key-v1 magic", test.curve)
+		}
+		if !strings.Contains(string(block.Bytes), test.keyType) {
+			t.Errorf("%s: private key does not name key type %s", test.curve, test.keyType)
+		}
+	}
+
+	// Mismatched keys are rejected.
+	public, _, _, err := FromSeed("p256", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ExportOpenSSH(upspin.PublicKey(public), "12345\n", ""); err == nil {
+		t.Error("ExportOpenSSH accepted mismatched keys")
+	}
+}
+
+func TestCheckEntropy(t *testing.T) {
+	tests := []struct {
+		entropy string // Hex.
+		ok      bool
+	}{
+		{"5d0e2a8c7f31b94406e3dd1a92c5f870", true},
+		{"00000000000000000000000000000000", false},
+		{"ffffffffffffffffffffffffffffffff", false},
+		{"abababababababababababababababab", false},
+		{"0123456789abcdef0123456789abcdef", false},
+		{"000102030405060708090a0b0c0d0e0f", false},
+		{"fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0", false},
+		{"000102030405060708090a0b0c0d0e10", true},
+	}
+	for _, test := range tests {
+		b, err := hex.DecodeString(test.entropy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckEntropy(b)
+		if test.ok && err != nil {
+			t.Errorf("CheckEntropy(%s) = %v, want nil", test.entropy, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("CheckEntropy(%s) = nil, want error", test.entropy)
+		}
+	}
+}
+
+func TestNewSeedFrom(t *testing.T) {
+	b, _ := hex.DecodeString("5d0e2a8c7f31b94406e3dd1a92c5f870")
+	seed, err := NewSeedFrom(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSeed(seed); err != nil {
+		t.Errorf("NewSeedFrom made bad seed %q: %v", seed, err)
+	}
+	if _, err := NewSeedFrom(bytes.NewReader(make([]byte, 16))); err == nil {
+		t.Error("NewSeedFrom accepted zeros")
+	}
+	if _, err := NewSeedFrom(bytes.NewReader(b[:8])); err == nil {
+		t.Error("NewSeedFrom accepted a short read")
+	}
+}
+
+func TestSeedFromBytes(t *testing.T) {
+	b, _ := hex.DecodeString("5d0e2a8c7f31b94406e3dd1a92c5f870")
+	seed, err := SeedFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same bits make the same seed whichever way they arrive.
+	want, err := NewSeedFrom(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != want {
+		t.Errorf("SeedFromBytes = %q, want %q", seed, want)
+	}
+	for _, bad := range [][]byte{b[:15], append(b, 0), make([]byte, 16)} {
+		if _, err := SeedFromBytes(bad); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("SeedFromBytes(%x) = %v, want Invalid error", bad, err)
+		}
+	}
+}
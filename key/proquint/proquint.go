@@ -42,3 +42,22 @@ func Decode(s []byte) (x uint16) {
 	cons3 := uint16(bytes.IndexByte(cons, s[4]))
 	return (((cons1<<2|vow1)<<4|cons2)<<2|vow2)<<4 | cons3
 }
+
+// Valid reports whether s is a five-letter word that Decode can parse,
+// that is, consonant-vowel-consonant-vowel-consonant using the
+// proquint alphabet.
+func Valid(s []byte) bool {
+	if len(s) != 5 {
+		return false
+	}
+	for i, c := range s {
+		set := cons
+		if i%2 == 1 {
+			set = vowel
+		}
+		if bytes.IndexByte(set, c) < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -39,3 +39,24 @@ func TestEncode(t *testing.T) {
 		t.Errorf("Decode(\"xxxxx\") = %x", x)
 	}
 }
+
+func TestValid(t *testing.T) {
+	cases := []struct {
+		s     string
+		valid bool
+	}{
+		{"lusab", true},
+		{"zuzuz", true},
+		{"xxxxx", false},
+		{"lusa", false},
+		{"lusabb", false},
+		{"ulsab", false},
+		{"lusAb", false},
+		{"luseb", false},
+	}
+	for _, c := range cases {
+		if valid := Valid([]byte(c.s)); valid != c.valid {
+			t.Errorf("Valid(%q) = %v, want %v", c.s, valid, c.valid)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// Split divides a secret into n shares such that any k of them recover
+// it with Combine, while fewer than k reveal nothing about it. Each
+// byte of the secret is the constant term of its own random polynomial
+// of degree k-1, and each share holds the values of those polynomials
+// at one point.
+//
+// See Adi Shamir, "How to share a secret", Communications of the ACM
+// 22(11), 1979.
+package shamir // import "upspin.io/key/shamir"
+
+import (
+	"crypto/rand"
+	"io"
+
+	"upspin.io/errors"
+)
+
+// MaxShares is the most shares a secret may be split into. Each share
+// needs a distinct non-zero point in the field.
+const MaxShares = 255
+
+// Split divides secret into n shares, any k of which can be given to
+// Combine to recover it. It requires 2 <= k <= n <= MaxShares. Each share
+// is a byte holding its x coordinate, from 1 to n, followed by a byte
+// for each byte of secret.
+func Split(secret []byte, k, n int) ([][]byte, error) {
+	return split(secret, k, n, rand.Reader)
+}
+
+// split is Split with the coefficients read from r.
+func split(secret []byte, k, n int, r io.Reader) ([][]byte, error) {
+	if k < 2 || k > n || n > MaxShares {
+		return nil, errors.Errorf("shamir: cannot split into %d shares with threshold %d", n, k)
+	}
+	if len(secret) == 0 {
+		return nil, errors.Str("shamir: empty secret")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	coeffs := make([]byte, k) // coeffs[j] multiplies x^j.
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := io.ReadFull(r, coeffs[1:]); err != nil {
+			return nil, errors.E(errors.IO, err)
+		}
+		for _, share := range shares {
+			share[1+b] = eval(coeffs, share[0])
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from shares made by Split. Given fewer
+// shares than the threshold it returns garbage, since the shares do not
+// record the threshold; callers that need to know must record it
+// themselves.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.Str("shamir: no shares")
+	}
+	n := len(shares[0])
+	if n < 2 {
+		return nil, errors.Str("shamir: share too short")
+	}
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if len(s) != n {
+			return nil, errors.Str("shamir: shares differ in length")
+		}
+		if s[0] == 0 || seen[s[0]] {
+			return nil, errors.Errorf("shamir: bad or repeated share number %d", s[0])
+		}
+		seen[s[0]] = true
+	}
+
+	// Interpolate each polynomial at zero. The Lagrange basis
+	// polynomial for share i, evaluated at zero, is the product over
+	// the other shares j of x_j/(x_j-x_i); subtraction is XOR.
+	secret := make([]byte, n-1)
+	for i, si := range shares {
+		basis := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				basis = mul(basis, div(sj[0], sj[0]^si[0]))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= mul(si[1+b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// eval returns the value at x of the polynomial with the given
+// coefficients, lowest order first.
+func eval(coeffs []byte, x byte) byte {
+	var y byte
+	for j := len(coeffs) - 1; j >= 0; j-- {
+		y = mul(y, x) ^ coeffs[j]
+	}
+	return y
+}
+
+// Arithmetic in GF(2^8) modulo x^8 + x^4 + x^3 + x + 1, the field used
+// by AES, by way of tables of logarithms to the base 3, a generator.
+var (
+	exp [510]byte // exp[i] is 3^i; doubled so sums of logs need no reduction.
+	log [256]byte // log[x] is the i for which 3^i is x, for x != 0.
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// Multiply by 3: x*2 + x, reducing x*2 by the polynomial.
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return exp[int(log[a])+int(log[b])]
+}
+
+// div returns a/b. b must not be zero.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return exp[int(log[a])+255-int(log[b])]
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shamir
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		// Check the tables against multiplication done the long way.
+		for b := 0; b < 256; b++ {
+			if got, want := mul(byte(a), byte(b)), slowMul(byte(a), byte(b)); got != want {
+				t.Fatalf("mul(%#x, %#x) = %#x, want %#x", a, b, got, want)
+			}
+		}
+		if got := mul(byte(a), div(1, byte(a))); got != 1 {
+			t.Fatalf("%#x * 1/%#x = %#x, want 1", a, a, got)
+		}
+	}
+}
+
+// slowMul multiplies a and b in the field bit by bit.
+func slowMul(a, b byte) byte {
+	var p byte
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi != 0 {
+			a ^= 0x1b
+		}
+	}
+	return p
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret, _ := hex.DecodeString("9e885d952ad362caeb4efe34a8e91bd2")
+	for _, kn := range [][2]int{{2, 2}, {2, 3}, {3, 5}, {5, 5}, {4, 10}} {
+		k, n := kn[0], kn[1]
+		shares, err := Split(secret, k, n)
+		if err != nil {
+			t.Fatalf("Split(%d of %d): %v", k, n, err)
+		}
+		if len(shares) != n {
+			t.Fatalf("Split(%d of %d) made %d shares", k, n, len(shares))
+		}
+		// Every window of k consecutive shares, taken backwards so the
+		// order differs from Split's, recovers the secret.
+		for i := 0; i+k <= n; i++ {
+			var some [][]byte
+			for j := i + k - 1; j >= i; j-- {
+				some = append(some, shares[j])
+			}
+			got, err := Combine(some)
+			if err != nil {
+				t.Fatalf("Combine(%d of %d from %d): %v", k, n, i, err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("Combine(%d of %d from %d) = %x, want %x", k, n, i, got, secret)
+			}
+		}
+		// So do all n.
+		if got, _ := Combine(shares); !bytes.Equal(got, secret) {
+			t.Errorf("Combine(all %d) = %x, want %x", n, got, secret)
+		}
+		// Fewer than k do not.
+		if got, _ := Combine(shares[:k-1]); bytes.Equal(got, secret) {
+			t.Errorf("Combine(%d of %d) recovered the secret from %d shares", k, n, k-1)
+		}
+	}
+}
+
+// zeros is an io.Reader of zero bytes, making every polynomial constant.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestCoefficients(t *testing.T) {
+	// With zero coefficients every share holds the secret itself,
+	// which shows the coefficients come from the reader.
+	secret := []byte("secret")
+	shares, err := split(secret, 2, 3, zeros{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range shares {
+		if s[0] != byte(i+1) || !bytes.Equal(s[1:], secret) {
+			t.Errorf("share %d = %x, want %d then %x", i, s, i+1, secret)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, kn := range [][2]int{{1, 3}, {4, 3}, {2, 256}} {
+		if _, err := Split([]byte("x"), kn[0], kn[1]); err == nil {
+			t.Errorf("Split(%d of %d) succeeded", kn[0], kn[1])
+		}
+	}
+	if _, err := Split(nil, 2, 3); err == nil {
+		t.Errorf("Split of empty secret succeeded")
+	}
+	shares, err := Split([]byte("secret"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][][]byte{
+		nil,
+		{shares[0], shares[0]},
+		{shares[0], shares[1][:3]},
+		{shares[0], append([]byte{0}, shares[1][1:]...)},
+	} {
+		if _, err := Combine(bad); err == nil {
+			t.Errorf("Combine(%x) succeeded", bad)
+		}
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/binary"
+	"io"
+	"math/big"
 
 	"upspin.io/errors"
 	"upspin.io/upspin"
@@ -49,10 +52,19 @@ func (d *drng) Read(p []byte) (n int, err error) {
 }
 
 // CreateKeys creates a key pair based on the chosen curve and a slice of entropy.
+// The curve "ed25519" creates an Ed25519 signing key; see createEd25519Keys.
+// Factotum and the ee packing cannot yet use such keys, so keygen does not
+// offer them.
 func CreateKeys(curveName string, entropy []byte) (public upspin.PublicKey, private string, err error) {
 	const op = "pack/ee.CreateKeys"
 	var curve elliptic.Curve
 	switch curveName {
+	case "ed25519":
+		public, private, err = createEd25519Keys(entropy)
+		if err != nil {
+			return public, private, errors.E(op, errors.Invalid, err)
+		}
+		return
 	case "p256":
 		curve = elliptic.P256()
 	case "p384":
@@ -87,6 +99,34 @@ func encodeKeys(priv *ecdsa.PrivateKey, curveName string) (public upspin.PublicK
 	return
 }
 
+// createEd25519Keys creates an Ed25519 key pair from a given entropy.
+// The entropy, normally the 128-bit secret seed, keys the same deterministic
+// generator used for the ECDSA curves. The first ed25519.SeedSize bytes it
+// produces become the RFC 8032 private key seed, from which the private
+// scalar is derived by hashing and clamping. The same secret seed therefore
+// always recreates the same Ed25519 key pair.
+//
+// The public key is written as the curve name followed by the 32-byte
+// encoded point as a big int; the private key is the 32-byte seed as a
+// big int. Both use the same line format as the ECDSA keys.
+func createEd25519Keys(entropy []byte) (public upspin.PublicKey, private string, err error) {
+	if len(entropy) != 16 {
+		return public, private, errors.Errorf("ed25519 requires 128 bits of entropy, got %d", 8*len(entropy))
+	}
+	d := &drng{}
+	d.aes, err = aes.NewCipher(entropy)
+	if err != nil {
+		return public, private, err
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	d.Read(seed)
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	private = new(big.Int).SetBytes(seed).String() + "\n"
+	public = upspin.PublicKey("ed25519\n" + new(big.Int).SetBytes(pub).String() + "\n")
+	return public, private, nil
+}
+
 // createKeysFromEntropy creates an ecsda private key from a given entropy.
 func createKeysFromEntropy(curve elliptic.Curve, entropy []byte) (*ecdsa.PrivateKey, error) {
 	// Create crypto deterministic random generator from b.
@@ -97,10 +137,24 @@ func createKeysFromEntropy(curve elliptic.Curve, entropy []byte) (*ecdsa.Private
 	}
 	d.aes = cipher
 
-	// Generate random key-pair.
-	priv, err := ecdsa.GenerateKey(curve, d)
-	if err != nil {
+	// Derive the key pair as ecdsa.GenerateKey did before Go 1.20: read
+	// BitSize/8+8 bytes and reduce them into [1, N-1]. Since Go 1.20,
+	// GenerateKey deliberately reads a varying number of bytes from its
+	// source, so that even a deterministic source such as d no longer
+	// yields the same key twice, and a seed would not recreate its keys.
+	params := curve.Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(d, b); err != nil {
 		return nil, err
 	}
+	k := new(big.Int).SetBytes(b)
+	n := new(big.Int).Sub(params.N, one)
+	k.Mod(k, n)
+	k.Add(k, one)
+	priv := &ecdsa.PrivateKey{D: k}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(k.Bytes())
 	return priv, nil
 }
+
+var one = big.NewInt(1)
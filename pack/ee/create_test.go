@@ -0,0 +1,59 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ee_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"upspin.io/pack/ee"
+	"upspin.io/upspin"
+)
+
+// TestCreateKeysKnownAnswer checks that a seed always makes the same keys.
+// The entropy is that of the secret seed
+// pibud-sijat-ponam-zizaz.kudol-visin-vakok-jinok. The p256 keys are those
+// ecdsa.GenerateKey made from it before Go 1.20, as recorded by the keygen
+// tests of cmd/upspin; the others are those CreateKeys makes the same way.
+func TestCreateKeysKnownAnswer(t *testing.T) {
+	entropy, err := hex.DecodeString("a431c54daa48f7cf6c67e719e1a65666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		curve   string
+		public  upspin.PublicKey
+		private string
+	}{
+		{
+			"p256",
+			"p256\n20475414006091125411730282854763965332579614918776190347990649355528840360162\n41618798560597642013440926161855187887081385971895806061707694318148863738083\n",
+			"103735382135370212717736500933863354513183407328603457343387144070761075604179\n",
+		},
+		{
+			"p384",
+			"p384\n22795552399073330982079534281241672014503299627858797751068529143890862526887570817756117831959515789496526360862075\n4394881915297365335723778993479160560350680493272953837917967889678850291877753040381991578984432175924779818562643\n",
+			"37846703514617882204051485191363870660399973656560795188461238273078440406725282953922748852915525150636457574557324\n",
+		},
+		{
+			"p521",
+			"p521\n94646078882703219099188438109617196760931877795137676852001632773697354444044659030460146153867934484253944913876081418837322636964681684112982462635846395\n4009689798470920937329061535689683760629247464898021650132229700421432692898712276218502345475009094096946570145187828961183406282898363736140143847099043829\n",
+			"3296912858139948422197766661047826234296695068432329670901330779534148959260424144172817679474480984566239445976030559544096302559945544515629802041044570981\n",
+		},
+	}
+	for _, test := range tests {
+		public, private, err := ee.CreateKeys(test.curve, entropy)
+		if err != nil {
+			t.Errorf("%s: %v", test.curve, err)
+			continue
+		}
+		if public != test.public {
+			t.Errorf("%s: public key = %q, want %q", test.curve, public, test.public)
+		}
+		if private != test.private {
+			t.Errorf("%s: private key = %q, want %q", test.curve, private, test.private)
+		}
+	}
+}
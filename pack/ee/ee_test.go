@@ -543,3 +543,82 @@ func TestConsistentKeyStream(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateEd25519Keys(t *testing.T) {
+	entropy := []byte("0123456789abcdef")
+	public, private, err := ee.CreateKeys("ed25519", entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(public), "ed25519\n") {
+		t.Fatalf("public key %q does not name curve ed25519", public)
+	}
+
+	// The same entropy must yield the same keys.
+	public2, private2, err := ee.CreateKeys("ed25519", entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public != public2 || private != private2 {
+		t.Fatalf("keys not deterministic: got %q %q, then %q %q", public, private, public2, private2)
+	}
+
+	// Different entropy must yield different keys.
+	public3, _, err := ee.CreateKeys("ed25519", []byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public == public3 {
+		t.Fatalf("different entropy produced identical public key %q", public)
+	}
+
+	if _, _, err := ee.CreateKeys("ed25519", entropy[:8]); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Fatalf("short entropy: got error %v, want %v", err, errors.Invalid)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	joe, _ := setup("joe@google.com")
+	bob, _ := setup("bob@google.com")
+	secret := []byte("lusab-babad-gutih-tugad.gutuk-bisog-mudof-sakat")
+
+	sealed, err := ee.Seal(joe.Factotum().PublicKey(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, secret) {
+		t.Fatal("sealed secret holds the secret")
+	}
+	got, err := ee.Unseal(joe.Factotum(), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Errorf("Unseal = %q, want %q", got, secret)
+	}
+
+	// Only the recipient can unseal it.
+	if _, err := ee.Unseal(bob.Factotum(), sealed); err == nil {
+		t.Error("Unseal succeeded with the wrong key")
+	}
+	// Damage is detected, not a panic.
+	for _, bad := range [][]byte{nil, sealed[:len(sealed)/2], append([]byte{0}, sealed[1:]...)} {
+		if _, err := ee.Unseal(joe.Factotum(), bad); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("Unseal of %d damaged bytes: err = %v, want Invalid", len(bad), err)
+		}
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if got, err := ee.Unseal(joe.Factotum(), tampered); err == nil && bytes.Equal(got, secret) {
+		t.Error("Unseal accepted a tampered secret")
+	}
+
+	// Keys that cannot encrypt are refused.
+	public, _, err := ee.CreateKeys("ed25519", []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ee.Seal(public, secret); err == nil {
+		t.Error("Seal succeeded for an ed25519 key")
+	}
+}
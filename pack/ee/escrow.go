@@ -0,0 +1,104 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ee
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/pack/packutil"
+	"upspin.io/upspin"
+)
+
+// Sealed secrets.
+//
+// Seal and Unseal encrypt a small secret, such as the seed of a key pair
+// held in escrow, for a single recipient. The secret is wrapped exactly
+// as ee wraps the key of a file for each of its readers: with a key
+// agreed between a new ephemeral key pair and the recipient's public key,
+// strengthened by HKDF and used once with AES-GCM. The result records
+// the hash of the recipient's key, so that a factotum holding several
+// keys can find the right one.
+
+// sealVersion is the first byte of a sealed secret.
+const sealVersion = 1
+
+var errSealed = errors.Str("malformed sealed secret")
+
+// Seal returns secret encrypted so that only the holder of the private
+// key for pub can recover it, with Unseal. The key must be on one of the
+// NIST curves, as ed25519 keys cannot yet be used for encryption.
+func Seal(pub upspin.PublicKey, secret []byte) ([]byte, error) {
+	const op = "pack/ee.Seal"
+	R, err := factotum.ParsePublicKey(pub)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	w, err := gcmWrap(pub, R, secret)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	n := 1 + 5*binary.MaxVarintLen64 + len(w.keyHash) + len(w.dkey) + len(w.nonce) + 2*marshalBufLen
+	sealed := make([]byte, n)
+	sealed[0] = sealVersion
+	n = 1
+	n += packutil.PutBytes(sealed[n:], w.keyHash)
+	n += packutil.PutBytes(sealed[n:], w.dkey)
+	n += packutil.PutBytes(sealed[n:], w.nonce)
+	n += packutil.PutBytes(sealed[n:], w.ephemeral.X.Bytes())
+	n += packutil.PutBytes(sealed[n:], w.ephemeral.Y.Bytes())
+	return sealed[:n], nil
+}
+
+// Unseal returns the secret sealed by Seal, using the private key held
+// by f for which it was sealed.
+func Unseal(f upspin.Factotum, sealed []byte) ([]byte, error) {
+	const op = "pack/ee.Unseal"
+	if len(sealed) == 0 || sealed[0] != sealVersion {
+		return nil, errors.E(op, errors.Invalid, errSealed)
+	}
+	var fields [5][]byte
+	rest := sealed[1:]
+	for i := range fields {
+		var ok bool
+		fields[i], rest, ok = getBytes(rest)
+		if !ok {
+			return nil, errors.E(op, errors.Invalid, errSealed)
+		}
+	}
+	if len(rest) != 0 || len(fields[0]) != sha256.Size {
+		return nil, errors.E(op, errors.Invalid, errSealed)
+	}
+	w := wrappedKey{
+		keyHash: fields[0],
+		dkey:    fields[1],
+		nonce:   fields[2],
+		ephemeral: ecdsa.PublicKey{
+			X: new(big.Int).SetBytes(fields[3]),
+			Y: new(big.Int).SetBytes(fields[4]),
+		},
+	}
+	secret, err := aesUnwrap(f, w)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return secret, nil
+}
+
+// getBytes returns the bytes at the start of src, written by
+// packutil.PutBytes, and what follows them. Unlike packutil.GetBytes,
+// it reports, rather than panics, if src is malformed.
+func getBytes(src []byte) (b, rest []byte, ok bool) {
+	n, vlen := binary.Varint(src)
+	if vlen <= 0 || n < 0 || n > int64(len(src)-vlen) {
+		return nil, nil, false
+	}
+	end := vlen + int(n)
+	return src[vlen:end], src[end:], true
+}
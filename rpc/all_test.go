@@ -5,8 +5,15 @@
 package rpc
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -312,3 +319,52 @@ func TestAll(t *testing.T) {
 		t.Errorf("Expected client to be on iteration %d, was on %d", srv.iteration, cli.reqCount)
 	}
 }
+
+func TestTLSPins(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+	sum := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	key := hex.EncodeToString(sum[:])
+	other := strings.Repeat("00", sha256.Size)
+
+	// The = in the file name must not be taken for the end of the address.
+	f, err := ioutil.TempFile("", "rpc=pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	f.Close()
+
+	for _, test := range []struct {
+		pins string
+		kind errors.Kind // Of the error, if any.
+	}{
+		{addr + "=sha256:" + key, 0},
+		{addr + "=sha256:" + other, errors.Permission},
+		{addr + "=ca:" + f.Name(), 0},
+		{addr + "=sha256:" + other + " " + addr + "=ca:" + f.Name(), 0},
+		// Not pinned, so the system roots apply, and they do not
+		// include the test server's certificate.
+		{"store.example.com:443=sha256:" + key, errors.IO},
+	} {
+		cfg := config.SetValue(config.New(), "tlspins", test.pins)
+		c, err := NewClient(cfg, upspin.NetAddr(addr), Secure, upspin.Endpoint{})
+		if err != nil {
+			t.Fatalf("%q: %v", test.pins, err)
+		}
+		_, err = c.(*httpClient).makeRequest("test", "Server/Echo", &prototest.EchoRequest{}, make(http.Header))
+		switch {
+		case test.kind == 0 && err != nil:
+			t.Errorf("%q: %v", test.pins, err)
+		case test.kind != 0 && !errors.Match(errors.E(test.kind), err):
+			t.Errorf("%q: got error %v, want kind %v", test.pins, err, test.kind)
+		}
+	}
+
+	cfg := config.SetValue(config.New(), "tlspins", addr+"=md5:"+key)
+	if _, err := NewClient(cfg, upspin.NetAddr(addr), Secure, upspin.Endpoint{}); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("unknown kind of pin: got %v, want Invalid", err)
+	}
+}
@@ -114,6 +114,13 @@ func NewClient(cfg upspin.Config, netAddr upspin.NetAddr, security SecurityLevel
 			return nil, errors.E(op, errors.Invalid, err)
 		}
 		tlsConfig = &tls.Config{RootCAs: certPool}
+		pins, err := pinsFromConfig(cfg, netAddr)
+		if err != nil {
+			return nil, errors.E(op, errors.Invalid, err)
+		}
+		if pins != nil {
+			pins.apply(tlsConfig)
+		}
 		c.baseURL = "https://" + string(netAddr)
 	default:
 		return nil, errors.E(op, errors.Invalid, errors.Errorf("invalid security level to NewClient: %v", security))
@@ -183,6 +190,9 @@ func (c *httpClient) makeRequest(op, method string, req pb.Message, header http.
 	httpReq.Header = header
 	resp, err := c.client.Do(httpReq)
 	if err != nil {
+		if perr := pinError(err); perr != nil {
+			return nil, errors.E(op, errors.Permission, perr)
+		}
 		return nil, errors.E(op, errors.IO, err)
 	}
 	c.setLastActivity()
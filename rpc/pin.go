@@ -0,0 +1,177 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	stderrors "errors"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// TLS pinning.
+//
+// A config may pin the TLS certificates accepted from the servers at some
+// network addresses, so that a connection to one of them trusts neither
+// the system roots nor tlscerts, and a man in the middle holding a
+// certificate from any other authority is refused. The value of its
+// tlspins key is a list of pins separated by white space, each of the
+// form
+//
+//	netaddr=sha256:hex
+//	netaddr=ca:file
+//
+// The first accepts a server at netaddr, such as store.example.com:443,
+// whose certificate has a public key, its SubjectPublicKeyInfo, with the
+// given SHA-256 hash. The second accepts one whose certificate chains,
+// for its host name, to one of the PEM certificates in file. A server
+// with several pins is accepted if it matches any of them. A certificate
+// that matches none fails the connection with a PinError, which the
+// client reports as an error of kind Permission.
+//
+// A server whose address is pinned is not asked for a base URL from which
+// to fetch its blocks by plain HTTP, since that would bypass the pins.
+
+// PinError is the error for a server whose certificate matches none of
+// the pins for its address.
+type PinError struct {
+	NetAddr upspin.NetAddr
+}
+
+func (e *PinError) Error() string {
+	return "TLS certificate of " + string(e.NetAddr) + " matches none of the pinned certificates"
+}
+
+// tlsPins holds the pins for one network address.
+type tlsPins struct {
+	netAddr upspin.NetAddr
+	keys    [][]byte // SHA-256 hashes of accepted public keys.
+	roots   *x509.CertPool
+}
+
+// TLSPinned reports whether the config pins the certificates of the
+// server at netAddr.
+func TLSPinned(cfg upspin.Config, netAddr upspin.NetAddr) bool {
+	for _, p := range strings.Fields(cfg.Value("tlspins")) {
+		if strings.HasPrefix(p, string(netAddr)+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// pinsFromConfig returns the pins the config has for netAddr, or nil if
+// it has none.
+func pinsFromConfig(cfg upspin.Config, netAddr upspin.NetAddr) (*tlsPins, error) {
+	var pins *tlsPins
+	for _, p := range strings.Fields(cfg.Value("tlspins")) {
+		// The file of a ca: pin may have an = in its name.
+		eq := strings.Index(p, "=")
+		if eq < 0 {
+			return nil, errors.Errorf("invalid TLS pin %q", p)
+		}
+		if p[:eq] != string(netAddr) {
+			continue
+		}
+		if pins == nil {
+			pins = &tlsPins{netAddr: netAddr}
+		}
+		kind, val := p[eq+1:], ""
+		if colon := strings.Index(kind, ":"); colon >= 0 {
+			kind, val = kind[:colon], kind[colon+1:]
+		}
+		switch kind {
+		case "sha256":
+			key, err := hex.DecodeString(val)
+			if err != nil || len(key) != sha256.Size {
+				return nil, errors.Errorf("invalid TLS pin %q: want a hex SHA-256 hash", p)
+			}
+			pins.keys = append(pins.keys, key)
+		case "ca":
+			pem, err := ioutil.ReadFile(val)
+			if err != nil {
+				return nil, errors.Errorf("reading TLS pin %q: %v", p, err)
+			}
+			if pins.roots == nil {
+				pins.roots = x509.NewCertPool()
+			}
+			if !pins.roots.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("invalid TLS pin %q: no PEM certificates in %s", p, val)
+			}
+		default:
+			return nil, errors.Errorf("invalid TLS pin %q: want sha256: or ca:", p)
+		}
+	}
+	return pins, nil
+}
+
+// apply sets tlsConfig to accept only the server certificates that
+// match the pins. The usual verification against the roots is replaced
+// by verifyPeer.
+func (pins *tlsPins) apply(tlsConfig *tls.Config) {
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = pins.verifyPeer
+}
+
+// verifyPeer accepts the server's certificates, in raw, if the first,
+// the server's own, has a pinned public key or chains to a pinned
+// certificate, and otherwise returns a PinError.
+func (pins *tlsPins) verifyPeer(raw [][]byte, _ [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	for _, r := range raw {
+		cert, err := x509.ParseCertificate(r)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return &PinError{NetAddr: pins.netAddr}
+	}
+	leaf := certs[0]
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, key := range pins.keys {
+		if bytes.Equal(key, sum[:]) {
+			return nil
+		}
+	}
+	if pins.roots != nil {
+		host, _, err := net.SplitHostPort(string(pins.netAddr))
+		if err != nil {
+			host = string(pins.netAddr)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         pins.roots,
+			Intermediates: intermediates,
+		}
+		if _, err := leaf.Verify(opts); err == nil {
+			return nil
+		}
+	}
+	return &PinError{NetAddr: pins.netAddr}
+}
+
+// pinError returns the PinError within err, the error of a request, or
+// nil if there is none.
+func pinError(err error) *PinError {
+	var perr *PinError
+	if stderrors.As(err, &perr) {
+		return perr
+	}
+	return nil
+}
@@ -68,7 +68,23 @@ func (s *server) Get(session rpc.Session, reqBytes []byte) (pb.Message, error) {
 	}
 	op := logf("Get %q", req.Reference)
 
-	data, refdata, locs, err := store.Get(upspin.Reference(req.Reference))
+	var (
+		ref     = upspin.Reference(req.Reference)
+		data    []byte
+		refdata *upspin.Refdata
+		locs    []upspin.Location
+		partial bool
+	)
+	if hs, ok := store.(hintedStore); ok && (req.NoStore || req.Refresh) {
+		// Send the whole block; the client takes any range from it.
+		data, refdata, locs, err = hs.GetHinted(ref, req.NoStore, req.Refresh)
+	} else if rs, ok := store.(rangeStore); ok && (req.Offset != 0 || req.Length != 0) {
+		data, refdata, locs, err = rs.GetRange(ref, req.Offset, req.Length)
+		partial = len(locs) == 0
+	} else {
+		// Send the whole block; the client takes any range from it.
+		data, refdata, locs, err = store.Get(ref)
+	}
 	if err != nil {
 		op.log(err)
 		return &proto.StoreGetResponse{Error: errors.MarshalError(err)}, nil
@@ -77,10 +93,27 @@ func (s *server) Get(session rpc.Session, reqBytes []byte) (pb.Message, error) {
 		Data:      data,
 		Refdata:   proto.RefdataProto(refdata),
 		Locations: proto.Locations(locs),
+		Partial:   partial,
 	}
 	return resp, nil
 }
 
+// rangeStore is implemented by a StoreServer that can return part of a
+// block, such as the store cache. GetRange returns the length bytes of
+// the data for ref from offset, or all those from offset if length is zero.
+type rangeStore interface {
+	GetRange(ref upspin.Reference, offset, length int64) ([]byte, *upspin.Refdata, []upspin.Location, error)
+}
+
+// hintedStore is implemented by a StoreServer that caches blocks, such as
+// the store cache, and takes hints from the client on how to cache them.
+// With noStore, a block is not to be cached; with refresh, any cached
+// copy is to be fetched afresh.
+type hintedStore interface {
+	GetHinted(ref upspin.Reference, noStore, refresh bool) ([]byte, *upspin.Refdata, []upspin.Location, error)
+	PutHinted(data []byte, noStore bool) (*upspin.Refdata, error)
+}
+
 // Put implements proto.StoreServer.
 func (s *server) Put(session rpc.Session, reqBytes []byte) (pb.Message, error) {
 	var req proto.StorePutRequest
@@ -90,7 +123,12 @@ func (s *server) Put(session rpc.Session, reqBytes []byte) (pb.Message, error) {
 	}
 	op := logf("Put %.30x...", req.Data)
 
-	refdata, err := store.Put(req.Data)
+	var refdata *upspin.Refdata
+	if hs, ok := store.(hintedStore); ok && req.NoStore {
+		refdata, err = hs.PutHinted(req.Data, true)
+	} else {
+		refdata, err = store.Put(req.Data)
+	}
 	if err != nil {
 		op.log(err)
 		return &proto.StorePutResponse{Error: errors.MarshalError(err)}, nil
@@ -78,6 +78,81 @@ func (r *remote) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Lo
 	return resp.Data, proto.UpspinRefdata(resp.Refdata), proto.UpspinLocations(resp.Locations), nil
 }
 
+// GetRange is Get for only the length bytes of the data for ref from
+// offset, or all those from offset if length is zero. If the server can,
+// it sends only those bytes; otherwise it sends the whole block and the
+// rest is dropped here. It is an error of kind Invalid for offset or
+// length to be negative or for offset to lie beyond the end of the data.
+func (r *remote) GetRange(ref upspin.Reference, offset, length int64) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	op := r.opf("GetRange", "%q, %d, %d", ref, offset, length)
+
+	var (
+		data    []byte
+		refdata *upspin.Refdata
+		locs    []upspin.Location
+		partial bool
+	)
+	if r.baseURL != "" {
+		// Fetch it by HTTP, whole, as Get does.
+		var err error
+		data, refdata, locs, err = r.Get(ref)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		req := &proto.StoreGetRequest{
+			Reference: string(ref),
+			Offset:    offset,
+			Length:    length,
+		}
+		resp := new(proto.StoreGetResponse)
+		if err := r.Invoke("Store/Get", req, resp, nil, nil); err != nil {
+			return nil, nil, nil, op.error(err)
+		}
+		if len(resp.Error) != 0 {
+			return nil, nil, nil, errors.UnmarshalError(resp.Error)
+		}
+		data, refdata, locs, partial = resp.Data, proto.UpspinRefdata(resp.Refdata), proto.UpspinLocations(resp.Locations), resp.Partial
+	}
+	if partial || len(locs) > 0 {
+		return data, refdata, locs, nil
+	}
+	size := int64(len(data))
+	if offset < 0 || length < 0 || offset > size {
+		return nil, nil, nil, op.error(errors.Invalid, errors.Str("range is negative or beyond the end of the block"))
+	}
+	if length > 0 && length < size-offset {
+		size = offset + length
+	}
+	return data[offset:size], refdata, nil, nil
+}
+
+// GetHinted is Get with hints for a store cache on how to cache the
+// block: with noStore it is not to be cached, and with refresh any cached
+// copy is to be fetched afresh from the store. A server that does not
+// cache ignores them. A block fetched by HTTP goes around any cache, so
+// the hints are moot.
+func (r *remote) GetHinted(ref upspin.Reference, noStore, refresh bool) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if r.baseURL != "" || !noStore && !refresh {
+		return r.Get(ref)
+	}
+	op := r.opf("GetHinted", "%q, %t, %t", ref, noStore, refresh)
+
+	req := &proto.StoreGetRequest{
+		Reference: string(ref),
+		NoStore:   noStore,
+		Refresh:   refresh,
+	}
+	resp := new(proto.StoreGetResponse)
+	if err := r.Invoke("Store/Get", req, resp, nil, nil); err != nil {
+		return nil, nil, nil, op.error(err)
+	}
+	if len(resp.Error) != 0 {
+		return nil, nil, nil, errors.UnmarshalError(resp.Error)
+	}
+	return resp.Data, proto.UpspinRefdata(resp.Refdata), proto.UpspinLocations(resp.Locations), nil
+}
+
 // Put implements upspin.StoreServer.Put.
 func (r *remote) Put(data []byte) (*upspin.Refdata, error) {
 	op := r.opf("Put", "%v bytes", len(data))
@@ -92,6 +167,23 @@ func (r *remote) Put(data []byte) (*upspin.Refdata, error) {
 	return proto.UpspinRefdata(resp.Refdata), op.error(errors.UnmarshalError(resp.Error))
 }
 
+// PutHinted is Put with a hint for a store cache: with noStore the block
+// is sent on to the store without being cached. A server that does not
+// cache ignores it.
+func (r *remote) PutHinted(data []byte, noStore bool) (*upspin.Refdata, error) {
+	op := r.opf("PutHinted", "%v bytes, %t", len(data), noStore)
+
+	req := &proto.StorePutRequest{
+		Data:    data,
+		NoStore: noStore,
+	}
+	resp := new(proto.StorePutResponse)
+	if err := r.Invoke("Store/Put", req, resp, nil, nil); err != nil {
+		return nil, op.error(err)
+	}
+	return proto.UpspinRefdata(resp.Refdata), op.error(errors.UnmarshalError(resp.Error))
+}
+
 // Delete implements upspin.StoreServer.Delete.
 func (r *remote) Delete(ref upspin.Reference) error {
 	op := r.opf("Delete", "%q", ref)
@@ -165,8 +257,11 @@ func (r *remote) Dial(config upspin.Config, e upspin.Endpoint) (upspin.Service,
 			userName: config.UserName(),
 		},
 	}
-	if err := r2.probeDirect(); err != nil {
-		op.error(err)
+	// Blocks fetched by HTTP would not be checked against any pins.
+	if !rpc.TLSPinned(config, e.NetAddr) {
+		if err := r2.probeDirect(); err != nil {
+			op.error(err)
+		}
 	}
 
 	return r2, nil
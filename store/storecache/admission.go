@@ -0,0 +1,144 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Admission.
+//
+// A cache that keeps every block it fetches fills with blocks read only
+// once, each of which pushes out one that might have been read again. A
+// cache created with the admission option instead estimates how often
+// each reference has been asked for recently, as the TinyLFU policy
+// does, and keeps a block fetched from its store only if there is room
+// for it without evicting anything, if it has been asked for more than
+// once, or if it has been asked for more often than the least recently
+// used block, which it would displace. Other blocks are returned but not
+// cached, and counted as Rejected.
+//
+// The estimates are kept in a count-min sketch: a few rows of small
+// counters, each indexed by a different hash of the reference's file, of
+// which the smallest is the estimate. Collisions can only make an
+// estimate too large, never too small. Every count is halved after ten
+// times as many requests as each row has counters, so the estimates
+// follow changes in what is being read.
+//
+// Blocks Put through the cache, and those fetched by Prefetch, Pin, and
+// Warm, are always cached, since they are expected to be read.
+
+const (
+	sketchDepth = 4  // Rows of counters.
+	sketchMax   = 15 // Largest count kept.
+)
+
+// sketch estimates how often each of a set of keys has been seen.
+type sketch struct {
+	mu    sync.Mutex
+	rows  [sketchDepth][]uint8
+	mask  uint64 // Width of a row, less one; the width is a power of two.
+	added int    // Counts made since the counts were last halved.
+	reset int    // Value of added at which to halve them.
+}
+
+// newSketch returns a sketch with room to tell apart about n keys.
+func newSketch(n int) *sketch {
+	width := 16
+	for width < n {
+		width *= 2
+	}
+	s := &sketch{
+		mask:  uint64(width - 1),
+		reset: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes returns the index of key's counter in each row.
+func (s *sketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// Derive the row hashes from the two halves of one.
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+// add counts one sighting of key.
+func (s *sketch) add(key string) {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range idx {
+		if s.rows[i][j] < sketchMax {
+			s.rows[i][j]++
+		}
+	}
+	s.added++
+	if s.added < s.reset {
+		return
+	}
+	for _, row := range s.rows {
+		for j := range row {
+			row[j] /= 2
+		}
+	}
+	s.added /= 2
+}
+
+// estimate returns the number of times key has been seen recently.
+func (s *sketch) estimate(key string) int {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := sketchMax
+	for i, j := range idx {
+		if c := int(s.rows[i][j]); c < n {
+			n = c
+		}
+	}
+	return n
+}
+
+// requested records a request for the block cached in file.
+// Any locks may be held.
+func (c *storeCache) requested(file string) {
+	if c.admission != nil {
+		c.admission.add(file)
+	}
+}
+
+// admit reports whether a block of size bytes fetched from its store is
+// to be cached in file, and counts it as rejected if not.
+// Any locks may be held.
+func (c *storeCache) admit(file string, size int) bool {
+	if c.admission == nil {
+		return true
+	}
+	if atomic.LoadInt64(&c.inUse)+int64(size) <= c.highWater {
+		// Nothing need be evicted.
+		return true
+	}
+	freq := c.admission.estimate(file)
+	if freq > 1 {
+		return true
+	}
+	victim, _ := c.lru.PeekOldest()
+	if v, ok := victim.(string); !ok || v == file || freq > c.admission.estimate(v) {
+		return true
+	}
+	atomic.AddInt64(&c.counters.rejected, 1)
+	return false
+}
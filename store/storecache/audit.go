@@ -0,0 +1,73 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Audit log.
+//
+// A Delete cannot be undone, so the cache may keep a record of each one,
+// apart from the debug log, saying who asked for it, of which block at
+// which store, and whether it succeeded. The records are written as JSON,
+// an AuditRecord to a line, to the writer given to SetAuditLog.
+
+// AuditRecord records a request made through the cache.
+type AuditRecord struct {
+	Time      time.Time
+	Op        string          // The request; for now always "Delete".
+	User      upspin.UserName // The user on whose behalf it was made.
+	Endpoint  string          // The store to which it was made.
+	Reference upspin.Reference
+	Error     string `json:",omitempty"` // Empty if the request succeeded.
+}
+
+// auditLog is the destination of the audit records.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer // Nil if there is no audit log.
+}
+
+// set directs the audit records to w, or discards them if w is nil.
+func (a *auditLog) set(w io.Writer) {
+	a.mu.Lock()
+	a.w = w
+	a.mu.Unlock()
+}
+
+// record writes an audit record for the op request made by user for
+// ref at e, which returned err.
+func (a *auditLog) record(op string, user upspin.UserName, ref upspin.Reference, e upspin.Endpoint, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:      time.Now(),
+		Op:        op,
+		User:      user,
+		Endpoint:  e.String(),
+		Reference: ref,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	b, jerr := json.Marshal(r)
+	if jerr != nil {
+		log.Error.Printf("store/storecache: audit: %v", jerr)
+		return
+	}
+	if _, werr := a.w.Write(append(b, '\n')); werr != nil {
+		log.Error.Printf("store/storecache: audit: %v", werr)
+	}
+}
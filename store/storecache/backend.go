@@ -0,0 +1,101 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// Cache is the storage behind a store cache server: it holds the cached
+// blocks and fetches from, and writes to, their stores those it does not
+// hold. The Cache made by New keeps the blocks in files in a directory;
+// NewMemory makes one that keeps them in memory. NewServer makes a
+// server from any Cache. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the data for ref at the store e, from the cache
+	// if it is there and from the store if not, using cfg to reach
+	// the store. The Refdata and Locations are as the store's Get
+	// would return them.
+	Get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error)
+
+	// Put caches data and writes it to the store e, or arranges for
+	// it to be written, returning its Refdata.
+	Put(cfg upspin.Config, data []byte, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error)
+
+	// Delete deletes ref from the store e and from the cache.
+	Delete(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) error
+
+	// Usage returns the bytes and references cached.
+	Usage() (bytes, entries int64)
+
+	// Flush returns once every block Put is in its store.
+	Flush() error
+
+	// Close releases the resources of the cache, which is not used
+	// again.
+	Close()
+}
+
+// Invalidator is implemented by a Cache that can drop a block it holds
+// without deleting it from its store. The server's Invalidate uses it.
+type Invalidator interface {
+	// Invalidate drops any copy of ref at the store e held by the
+	// cache, reporting whether there was one.
+	Invalidate(ref upspin.Reference, e upspin.Endpoint) bool
+}
+
+// The sp arguments to the methods of Cache are the spans of the requests
+// they serve, or nil. A Cache may record its work as children of them;
+// see trace.go.
+
+// NewServer returns a store cache server that keeps the blocks it caches
+// in c. The server has the methods of one returned by New, but SetQuota,
+// Prefetch, and Warm, and the passthrough option, apply only to the
+// Cache made by New; others ignore them or, for Warm, report that they
+// are not supported, and their Stats count only the latencies of
+// requests, the bytes and references cached, and the invalidations.
+// Invalidate applies to a Cache that is also an Invalidator.
+func NewServer(cfg upspin.Config, c Cache) upspin.StoreServer {
+	s := &server{
+		cfg:      cfg,
+		cache:    c,
+		counters: new(counters),
+		audit:    new(auditLog),
+		reqs:     &requests{},
+	}
+	if files, ok := c.(*storeCache); ok {
+		s.files = files
+		s.counters = &files.counters
+		s.audit = &files.audit
+	}
+	return s
+}
+
+// storeCache implements Cache and Invalidator with the methods below.
+var (
+	_ Cache       = (*storeCache)(nil)
+	_ Invalidator = (*storeCache)(nil)
+)
+
+func (c *storeCache) Get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	return c.get(cfg, ref, e, sp)
+}
+
+func (c *storeCache) Put(cfg upspin.Config, data []byte, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error) {
+	return c.put(cfg, data, e, sp)
+}
+
+func (c *storeCache) Delete(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) error {
+	return c.delete(cfg, ref, e, sp)
+}
+
+func (c *storeCache) Invalidate(ref upspin.Reference, e upspin.Endpoint) bool {
+	return c.drop(c.cachePath(ref, e))
+}
+
+func (c *storeCache) Usage() (bytes, entries int64) { return c.usage() }
+func (c *storeCache) Flush() error                  { return c.flush() }
+func (c *storeCache) Close()                        { c.close() }
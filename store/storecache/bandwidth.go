@@ -0,0 +1,113 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// Bandwidth limits.
+//
+// On a metered or shared link, a cache filling itself during a large
+// cold read, or writing back a backlog, could saturate the link and
+// starve the interactive users of it. The bandwidth option limits the
+// bytes per second of blocks fetched from and sent to all origin stores
+// together, and storebandwidth those of each store; both are given in
+// bytes, and by default there is no limit. Each limit is a
+// token bucket holding up to a second's worth of bytes.
+//
+// A Put's block is known before it is sent, so a Put first waits until
+// the buckets can pay for it. A Get's block is known only once it has
+// arrived, so a Get waits only until the buckets are out of debt, and
+// pays for its block afterwards, driving them into a debt that later
+// calls must wait out. Either way the transfers are held to the limits
+// on average, and a block larger than a second's worth still passes.
+// Calls wait for bandwidth before taking a turn at a store limited by
+// storelimit, and the time waited is not counted against the timeout.
+// The total time calls have waited is reported in Stats.BandwidthWait.
+
+// bucket is a token bucket limiting transfers to a rate of bytes per
+// second, with a burst of up to a second's worth.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64   // Bytes per second.
+	tokens float64   // Bytes that may be transferred; negative when in debt.
+	last   time.Time // When tokens was last brought up to date.
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take takes n bytes from b at time now, going into debt if need be,
+// and returns how long after now b will be out of debt.
+func (b *bucket) take(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// awaitBandwidth waits until the buckets limiting transfers to and from
+// the store at e are out of debt once n bytes are taken from them.
+// No locks are held on entry or exit.
+func (c *storeCache) awaitBandwidth(e upspin.Endpoint, n int) {
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range c.buckets(e) {
+		if d := b.take(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		atomic.AddInt64(&c.counters.bandwidthWait, int64(wait))
+		time.Sleep(wait)
+	}
+}
+
+// chargeBandwidth takes the n bytes of a block fetched from the store
+// at e from the buckets limiting transfers from it.
+// No locks are held on entry or exit.
+func (c *storeCache) chargeBandwidth(e upspin.Endpoint, n int) {
+	now := time.Now()
+	for _, b := range c.buckets(e) {
+		b.take(n, now)
+	}
+}
+
+// buckets returns the buckets limiting transfers to and from the store
+// at e, if any.
+// No locks are held on entry or exit.
+func (c *storeCache) buckets(e upspin.Endpoint) []*bucket {
+	var bs []*bucket
+	if c.bandwidth != nil {
+		bs = append(bs, c.bandwidth)
+	}
+	if c.storeBandwidth > 0 {
+		c.Lock()
+		b, ok := c.storeBuckets[e]
+		if !ok {
+			b = newBucket(c.storeBandwidth)
+			c.storeBuckets[e] = b
+		}
+		c.Unlock()
+		bs = append(bs, b)
+	}
+	return bs
+}
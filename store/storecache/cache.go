@@ -5,8 +5,9 @@
 package storecache // import "upspin.io/store/storecache"
 
 import (
-	"errors"
+	"expvar"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,8 +18,10 @@ import (
 
 	"upspin.io/bind"
 	"upspin.io/cache"
+	"upspin.io/errors"
 	"upspin.io/key/sha256key"
 	"upspin.io/log"
+	"upspin.io/metric"
 	"upspin.io/upspin"
 )
 
@@ -41,25 +44,194 @@ type cachedRef struct {
 	hold   *sync.Cond      // Wait here if some other func is caching the ref.
 	valid  bool            // True if successfully cached.
 	remove bool            // Remove when no longer busy.
+	cold   bool            // True if the file is in the cold tier; see tier.go.
+	used   time.Time       // When the data was last read or written; see list.go.
+	pinned bool            // True if the ref is never evicted; see pin.go.
+
+	// recorded is when the use of the data was last recorded in the
+	// index; see index.go.
+	recorded time.Time
+
+	// revalidating is set while stale data is being fetched again in
+	// the background; see stale.go.
+	revalidating bool
+
+	// expires is when the cached data becomes stale, as predicted by
+	// the Refdata.Duration the store returned for it. It is zero if
+	// the data never expires.
+	expires time.Time
+
+	// owner is the user charged for the cached data, if any.
+	owner *userCache
 }
 
-// storeCache represents a cache for references. If, upon adding to the cache,
-// we find more than limit bytes in use, we will remove the oldest entry until below
-// the limit. It is possible to push past the limit; it is a soft limit.
+// Terminating characters for the names of files recording the expiry
+// time of a cached reference. The expiry file sits beside the cache file.
+const expirySuffix = "_exp"
+
+// storeCache represents a cache for references.
 //
+// Eviction is least recently used. The LRU records the order in which
+// cached references were last read or written and each cachedRef records
+// the size of its file. Before a put, and after a get has added a file,
+// the least recently used files are removed until the bytes in use,
+// including those about to be added, are within limit. A reference that
+// is busy, that is, being read into the cache or written from it, is
+// never evicted; it is instead moved to the front of the LRU. Since busy
+// references may hold us over the limit, it is a soft limit. If the cache
+// has a cold tier, evicted files are moved there instead; see tier.go.
+// Pinned references are never evicted either; see pin.go.
 type storeCache struct {
-	inUse int64 // Current bytes cached.
-	cfg   upspin.Config
+	inUse       int64 // Current bytes cached, not counting the cold tier.
+	coldInUse   int64 // Current bytes cached in the cold tier.
+	pinnedBytes int64 // Current bytes of pinned references, not counted in inUse.
+	entries     int64 // Current number of references cached in either tier.
+	cfg         upspin.Config
 	sync.Mutex
 	dir   string     // Top directory for cached references.
 	limit int64      // Soft limit of the maximum bytes to store.
 	lru   *cache.LRU // Key is the reference. Value is &cachedRef.
 	wbq   *writebackQueue
+	pf    *prefetcher
+	index *index // See index.go.
+
+	// shardLevels is the number of levels of subdirectories
+	// into which the files in dir are sharded. See layout.go.
+	shardLevels int
+
+	// highWater and lowWater are the bytes in use above which
+	// enforceByteLimit starts evicting and to which it evicts.
+	// By default both are limit.
+	highWater, lowWater int64
+
+	// verify, if set, causes cached data to be checked against its
+	// reference before it is returned.
+	verify bool
+
+	// compress, if set, causes blocks to be compressed in the
+	// cache directory. See compress.go.
+	compress bool
+
+	// passthrough holds the stores whose blocks are not cached.
+	// Requests for them are forwarded by the server; see server.go.
+	passthrough map[upspin.Endpoint]bool
+
+	// logging holds how the server logs the requests of each operation
+	// named by a loglevel or logsample option. See logging.go.
+	logging map[string]*opLog
+
+	// mirrors holds the stores to which the blocks Put to each store
+	// are also put, and mirrorQuorum the stores that must acknowledge
+	// a Put or Delete, or zero for all. See mirror.go.
+	mirrors      map[upspin.Endpoint][]upspin.Endpoint
+	mirrorQuorum int
+
+	// timeout, if positive, limits the time spent waiting for an
+	// origin store. See origin.go.
+	timeout time.Duration
+
+	// retries is the number of times a Get that fails transiently is
+	// tried again, and retryWait the wait before the first retry.
+	// See origin.go.
+	retries   int
+	retryWait time.Duration
+
+	// storeLimit, if positive, limits the calls in progress to each
+	// origin store, and storeWait the time a call waits for its turn.
+	// See origin.go.
+	storeLimit int
+	storeWait  time.Duration
+	turns      map[upspin.Endpoint]chan struct{} // By store. Protected by the Mutex.
+
+	origins origins // The health of the origin stores. See origin.go.
+
+	// bandwidth, if not nil, limits the bytes per second transferred
+	// to and from all origin stores, and storeBuckets, if
+	// storeBandwidth is positive, those to and from each.
+	// See bandwidth.go.
+	bandwidth      *bucket
+	storeBandwidth int64
+	storeBuckets   map[upspin.Endpoint]*bucket // Protected by the Mutex.
+
+	// maxEntryBytes, if positive, is the most bytes of a block that
+	// is cached. Larger blocks are refused by put and returned but not
+	// cached by fetch.
+	maxEntryBytes int64
+
+	// fsync is the policy for committing Put blocks to stable storage,
+	// and syncer, for fsync=interval, does so every syncInterval.
+	// See fsync.go.
+	fsync        syncPolicy
+	syncInterval time.Duration
+	syncer       *syncer
+
+	// userQuota is the default limit on the bytes charged to any one
+	// user, or zero for no limit. See quota.go.
+	userQuota int64
+	users     map[upspin.UserName]*userCache // Protected by the Mutex.
+	maxRefs   int                            // Size of the LRUs.
+
+	// coldDir, if set, is the top directory of the cold tier, which
+	// holds up to coldLimit bytes of the references evicted from dir.
+	// See tier.go.
+	coldDir   string
+	coldLimit int64
+	coldLRU   *cache.LRU // Like lru, for the references in the cold tier.
+
+	flights    map[string]*flight // Fetches in progress, by cache file. Protected by the Mutex.
+	putFlights map[string]*flight // Writethrough Puts in progress, by cache file. Protected by the Mutex.
+
+	// negativeTTL, if positive, is how long NotExist errors from
+	// stores are remembered. See negative.go.
+	negativeTTL time.Duration
+	notExist    map[string]notExist // By cache file. Protected by the Mutex.
+	putGen      int64               // Count of Puts. Protected by the Mutex.
+
+	// maxStale, if positive, is how long after it expires data may be
+	// returned while it is fetched again in the background. See stale.go.
+	maxStale      time.Duration
+	revalidations sync.WaitGroup // Background fetches in progress.
+
+	// accessTTL, if positive, is the longest an Access or Group file
+	// fetched from a store is cached. See control.go.
+	accessTTL time.Duration
+
+	// pinLimit is the most bytes of pinned references, which are
+	// counted in pinnedBytes rather than inUse, and pins their number.
+	// evictedPins holds those dropped from the LRU, to be put back.
+	// See pin.go.
+	pinLimit    int64
+	pins        int          // Protected by the Mutex.
+	evictedPins []evictedPin // Protected by the Mutex.
+
+	audit auditLog // See audit.go.
+
+	// dedup, if set, causes a block cached for several stores to be
+	// kept on disk only once. See dedup.go.
+	dedup bool
+
+	// admission, if not nil, estimates how often references are
+	// requested, to decide which blocks fetched are worth caching.
+	// See admission.go.
+	admission *sketch
+
+	disk diskState // See diskfull.go.
+
+	// compactInterval, if positive, is the interval between
+	// compactions, which remove the files in the cache directories
+	// that the cache does not know of, one at a time, and compactStop
+	// stops them. See compact.go.
+	compactInterval time.Duration
+	compacting      sync.Mutex
+	compactStop     chan struct{}
+	compactDone     chan struct{} // Closed once compactLoop returns.
+
+	counters counters
 }
 
 // newCache returns the cache rooted at dir. It will walk the cache to put all files
-// into the LRU.
-func newCache(cfg upspin.Config, dir string, maxBytes int64, writethrough bool) (*storeCache, func(upspin.Location), error) {
+// into the LRU. The options are those accepted by New.
+func newCache(cfg upspin.Config, dir string, maxBytes int64, writethrough bool, options ...string) (*storeCache, func(upspin.Location), error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, nil, err
 	}
@@ -67,29 +239,125 @@ func newCache(cfg upspin.Config, dir string, maxBytes int64, writethrough bool)
 	if maxRefs > 100000 {
 		maxRefs = 100000
 	}
-	c := &storeCache{cfg: cfg, dir: dir, limit: maxBytes, lru: cache.NewLRU(maxRefs)}
+	c := &storeCache{
+		cfg:        cfg,
+		dir:        dir,
+		limit:      maxBytes,
+		lru:        cache.NewLRU(maxRefs),
+		users:      make(map[upspin.UserName]*userCache),
+		maxRefs:    maxRefs,
+		flights:    make(map[string]*flight),
+		putFlights: make(map[string]*flight),
+		notExist:   make(map[string]notExist),
+		turns:      make(map[upspin.Endpoint]chan struct{}),
+
+		storeBuckets: make(map[upspin.Endpoint]*bucket),
+
+		shardLevels:     defaultShardLevels,
+		syncInterval:    defaultSyncInterval,
+		compactInterval: defaultCompactInterval,
+		compactStop:     make(chan struct{}),
+		compactDone:     make(chan struct{}),
+	}
+	if err := c.setOptions(options); err != nil {
+		return nil, nil, err
+	}
+	if c.coldDir != "" {
+		if within(c.coldDir, dir) || within(dir, c.coldDir) {
+			return nil, nil, errors.E("store/storecache.New", errors.Invalid, errors.Errorf("cold tier %s overlaps cache directory %s", c.coldDir, dir))
+		}
+		if err := os.MkdirAll(c.coldDir, 0700); err != nil {
+			return nil, nil, err
+		}
+		if err := c.relayout(c.coldDir); err != nil {
+			return nil, nil, err
+		}
+		coldRefs := int(c.coldLimit / 128)
+		if coldRefs > 1000000 {
+			coldRefs = 1000000
+		}
+		c.coldLRU = cache.NewLRU(coldRefs)
+	}
+	if err := c.relayout(dir); err != nil {
+		return nil, nil, err
+	}
+	if !c.dedup {
+		// Shared copies left from when the cache shared blocks
+		// are still linked from the stores' files.
+		os.RemoveAll(path.Join(dir, sharedDir))
+	}
+	c.index = newIndex(c)
+	c.pf = newPrefetcher(c)
+	if c.fsync == syncInterval {
+		c.syncer = newSyncer(c.syncInterval)
+	}
 	var blockFlusher func(upspin.Location)
 	if !writethrough {
 		c.wbq = newWritebackQueue(c)
 		blockFlusher = func(l upspin.Location) { c.wbq.flush(l) }
 	}
-	c.walk(dir)
+	loaded := c.loadIndex()
+	if !loaded {
+		c.walk(dir, false)
+		if c.coldDir != "" {
+			c.walk(c.coldDir, true)
+		}
+	}
+	c.startIndex(loaded)
+	// The walk has removed any orphans already.
+	go c.compactLoop(loaded)
+	publishUsage(c)
 	return c, blockFlusher, nil
 }
 
+var (
+	publishOnce sync.Once
+	published   atomic.Value // *storeCache whose usage is published.
+)
+
+// publishUsage publishes the bytes and references held by c
+// as the expvars storecache-bytes and storecache-entries,
+// and its Stats as storecache-stats.
+// expvar names may be published only once, so if there is more than one
+// cache in the process the most recently created one is reported.
+func publishUsage(c *storeCache) {
+	published.Store(c)
+	publishOnce.Do(func() {
+		expvar.Publish("storecache-bytes", expvar.Func(func() interface{} {
+			bytes, _ := published.Load().(*storeCache).usage()
+			return bytes
+		}))
+		expvar.Publish("storecache-entries", expvar.Func(func() interface{} {
+			_, entries := published.Load().(*storeCache).usage()
+			return entries
+		}))
+		expvar.Publish("storecache-stats", expvar.Func(func() interface{} {
+			return published.Load().(*storeCache).stats()
+		}))
+	})
+}
+
 func (c *storeCache) close() {
+	close(c.compactStop)
+	<-c.compactDone
+	c.pf.close()
 	if c.wbq != nil {
 		c.wbq.close()
 	}
+	c.revalidations.Wait()
+	if c.syncer != nil {
+		c.syncer.close()
+	}
+	// Pending writebacks are found only by walking the directory.
+	c.index.close(c.wbq == nil || atomic.LoadInt64(&c.wbq.pending) == 0 && len(c.wbq.request) == 0)
 }
 
 // walk does a recursive walk of the cache directories adding cached references
-// to the LRU. If we encounter errors while walking, try to correct by removing
-// the offending files or directories.
-// TODO(p): We lose ordering doing this. When we add a log for the write
-// through cache, we will use it to restore the ordering after this
-// operation.
-func (c *storeCache) walk(dir string) error {
+// to the LRU, or to the cold tier's LRU if cold is set. If we encounter errors
+// while walking, try to correct by removing the offending files or directories.
+// We lose ordering doing this, so it is done only when the index cannot be
+// used instead; see index.go.
+func (c *storeCache) walk(dir string, cold bool) error {
 	f, err := os.Open(dir)
 	if err != nil {
 		return os.RemoveAll(dir)
@@ -106,38 +374,87 @@ func (c *storeCache) walk(dir string) error {
 	}
 	for _, i := range info {
 		pathName := path.Join(dir, i.Name())
+		if i.Name() == layoutFile && (dir == c.dir || dir == c.coldDir) {
+			continue
+		}
+		if i.Name() == indexFile && dir == c.dir {
+			continue
+		}
+		if i.Name() == sharedDir && dir == c.dir {
+			c.sweepShared(pathName)
+			continue
+		}
 		if i.IsDir() {
-			if err := c.walk(pathName); err != nil {
+			if err := c.walk(pathName, cold); err != nil {
 				return err
 			}
 			continue
 		}
+		// Temporary files are left only by writes interrupted by
+		// a crash.
+		if strings.HasSuffix(pathName, ".tmp") {
+			os.Remove(pathName)
+			continue
+		}
+		// Expiry files are read along with the cache file they
+		// describe. Remove any whose cache file has gone.
+		if f := strings.TrimSuffix(pathName, expirySuffix); f != pathName {
+			if _, err := os.Stat(f); os.IsNotExist(err) {
+				os.Remove(pathName)
+			}
+			continue
+		}
 		// If this is a writeback link, assume the write back cache
 		// will assume responsibility for it.
-		if c.wbq.enqueueWritebackFile(pathName) {
+		if !cold && c.wbq.enqueueWritebackFile(pathName) {
+			continue
+		}
+		// Drop anything that expired while we were not running,
+		// unless it may still be used while stale.
+		expires, err := readExpiryFile(pathName)
+		if err != nil || (!expires.IsZero() && time.Since(expires) > c.maxStale) {
+			os.Remove(pathName)
+			os.Remove(pathName + expirySuffix)
+			continue
+		}
+		if cold {
+			// Known by its name in the cache directory. If it is
+			// there too, a move between tiers was interrupted.
+			file := path.Join(c.dir, strings.TrimPrefix(pathName, c.coldDir))
+			if _, ok := c.lru.Get(file); ok {
+				os.Remove(pathName)
+				os.Remove(pathName + expirySuffix)
+				continue
+			}
+			cr := &cachedRef{c: c, cold: true, size: i.Size(), used: i.ModTime(), expires: expires, valid: true}
+			cr.hold = sync.NewCond(cr)
+			c.coldLRU.Add(file, cr)
+			atomic.AddInt64(&c.coldInUse, cr.size)
+			atomic.AddInt64(&c.entries, 1)
 			continue
 		}
 		// Not a writeback link, remember it and account for its size.
 		cr := c.newCachedRef(pathName)
 		cr.size = i.Size()
+		cr.used = i.ModTime()
+		cr.expires = expires
 		cr.valid = true
 		cr.busy = false
+		atomic.AddInt64(&c.inUse, cr.size)
+		atomic.AddInt64(&c.entries, 1)
 	}
 	return err
 }
 
-// cachePath builds a path to the local cache file.
+// cachePath builds a path to the local cache file. Its layout is
+// described in layout.go.
 //
 // The actual cache file depends on the server endpoint because we have
 // not yet decided on any constraints on reference names, for example
 // when mapping host file names to references.
 // TODO(p): Revisit when we do.
 func (c *storeCache) cachePath(ref upspin.Reference, e upspin.Endpoint) string {
-	subdir := "zz"
-	if len(ref) > 1 {
-		subdir = string(ref[:2])
-	}
-	return path.Join(c.dir, e.String(), subdir, string(ref))
+	return path.Join(c.dir, e.String(), c.shardDir(string(ref)), string(ref))
 }
 
 // newCachedRef creates a new locked and busy cachedRef.
@@ -146,18 +463,56 @@ func (c *storeCache) newCachedRef(file string) *cachedRef {
 	cr := &cachedRef{busy: true, c: c}
 	cr.hold = sync.NewCond(cr)
 	c.lru.Add(file, cr)
+	c.restorePins()
 	return cr
 }
 
-// get fetches a reference. If possible, it stores it as a local file.
+// get fetches a reference and starts prefetching any blocks
+// known to follow it. The work is traced beneath sp, if it is not nil.
+// No locks are held on entry or exit.
+func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	c.pf.readAhead(cfg, upspin.Location{Endpoint: e, Reference: ref})
+	return c.fetch(cfg, ref, e, false, sp)
+}
+
+// fetch fetches a reference. If possible, it stores it as a local file.
+// The returned Refdata is the one provided by the store, with Duration
+// reduced by the time the data has already spent in the cache.
+// A prefetch that finds the data already cached is not counted as a hit.
+// Concurrent fetches of the same reference share a single flight; see
+// flight.go. A reference the store recently reported missing may fail
+// without asking it again; see negative.go.
+// The work is traced beneath sp, if it is not nil.
 // No locks are held on entry or exit.
-func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint) ([]byte, []upspin.Location, error) {
+func (c *storeCache) fetch(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, prefetch bool, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
 	if ref == upspin.HealthMetadata {
-		return []byte("you never write, you never call, I could be dead for all you know"), nil, nil
+		refdata := &upspin.Refdata{Reference: ref, Volatile: true}
+		return []byte("you never write, you never call, I could be dead for all you know"), refdata, nil, nil
 	}
 
 	file := c.cachePath(ref, e)
-	c.enforceByteLimitByRemovingLeastRecentlyUsedFile()
+	if !prefetch {
+		c.requested(file)
+	}
+	if err := c.missing(file); err != nil {
+		return nil, nil, nil, err
+	}
+	f, leader := c.joinFlight(file)
+	if !leader {
+		return f.wait(c, prefetch)
+	}
+	gen := c.putGeneration()
+	f.data, f.refdata, f.locs, f.err = c.fetchFile(cfg, ref, e, file, prefetch, sp)
+	c.rememberMissing(file, f.err, gen)
+	c.land(c.flights, file, f)
+	return f.data, f.refdata, f.locs, f.err
+}
+
+// fetchFile does the work of fetch for the reference cached in file.
+// No locks are held on entry or exit.
+func (c *storeCache) fetchFile(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, file string, prefetch bool, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	u := c.user(cfg.UserName())
+	lookup := lookupSpan(sp, ref, e)
 
 	// The loop terminates either by returning the cached data
 	// or while holding the cachedRef's Lock, ready to fetch
@@ -166,6 +521,15 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 	for {
 		c.Lock()
 		value, ok := c.lru.Get(file)
+		if !ok && c.coldLRU != nil {
+			// Bring a reference in the cold tier back into the
+			// main LRU. Its file follows once it has been read.
+			if value = c.coldLRU.Remove(file); value != nil {
+				c.lru.Add(file, value)
+				c.restorePins()
+				ok = true
+			}
+		}
 		if !ok {
 			// First time we've seen this. Create a new cachedRef and add to LRU.
 			cr = c.newCachedRef(file)
@@ -190,16 +554,53 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			cr.Unlock()
 			continue
 		}
-		data, err := readFromCacheFile(file)
+		stale := cr.expired()
+		if stale && !cr.usable() {
+			// The store's predicted lifetime has passed.
+			// Discard it and fetch it again.
+			cr.removeFile(file)
+			break
+		}
+		data, err := readFromCacheFile(cr.path(file))
 		if err != nil {
 			// Could not read the cached data.
 			// Invalidate the cachedRef so that it will be fetched again.
-			cr.valid = false
+			cr.removeFile(file)
+			break
+		}
+		if c.verify && corrupt(ref, data) {
+			log.Error.Printf("store/storecache: cached data for %s does not match reference; refetching", file)
+			atomic.AddInt64(&c.counters.corrupt, 1)
+			c.dropShared(file)
+			cr.removeFile(file)
 			break
 		}
+		refdata := &upspin.Refdata{Reference: ref}
+		if stale {
+			// Return it, but not to be kept, and refresh it.
+			refdata.Volatile = true
+			cr.revalidate(cfg, ref, e, file)
+			atomic.AddInt64(&c.counters.stale, 1)
+		} else if !cr.expires.IsZero() {
+			refdata.Duration = time.Until(cr.expires)
+		}
+		promoted := cr.cold
+		if promoted {
+			cr.promote(file)
+		}
+		cr.touch(file)
 		cr.Unlock()
-		return data, nil, nil
+		if promoted {
+			c.enforceByteLimit(0)
+		}
+		if !prefetch {
+			atomic.AddInt64(&c.counters.hits, 1)
+			atomic.AddInt64(&c.counters.cacheBytes, int64(len(data)))
+		}
+		endSpan(lookup)
+		return data, refdata, nil, nil
 	}
+	endSpan(lookup)
 	defer func() {
 		cr.busy = false
 		cr.hold.Signal()
@@ -207,6 +608,11 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			cr.removeFile(file)
 		}
 		cr.Unlock()
+		// We may have added to the cache; trim it back to the limit,
+		// or further if the disk is full.
+		c.makeRoom()
+		c.enforceByteLimit(0)
+		c.enforceUserQuota(u, 0)
 	}()
 
 	// isError reports whether err is non-nil and remembers it if it is.
@@ -241,7 +647,9 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			// In case of a serviceUnavailable error, retry a few times.
 			var locs []upspin.Location
 			var refdata *upspin.Refdata
-			data, refdata, locs, err = store.Get(loc.Reference)
+			origin := originSpan(sp, loc.Reference, loc.Endpoint)
+			data, refdata, locs, err = c.originGet(store, loc.Reference)
+			endSpan(origin)
 			if isError(err) {
 				if !strings.Contains(err.Error(), serviceUnavailable) {
 					fatal = true
@@ -250,12 +658,19 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			}
 			if locs == nil && err == nil {
 				// Success, maybe cache the data.
-				if !refdata.Volatile {
-					if err := cr.saveToCacheFile(file, data); err != nil {
+				atomic.AddInt64(&c.counters.misses, 1)
+				atomic.AddInt64(&c.counters.originBytes, int64(len(data)))
+				if c.oversize(data) {
+					// Pass it on without keeping it.
+					atomic.AddInt64(&c.counters.oversize, 1)
+				} else if !refdata.Volatile && (prefetch || c.admit(file, len(data))) && c.cacheable() {
+					refdata.Duration = c.duration(refdata.Duration, data)
+					cr.setExpiry(refdata.Duration)
+					if err := cr.saveToCacheFile(file, data, u); err != nil {
 						log.Info.Printf("saving cached ref %s to %s: %s", string(ref), file, err)
 					}
 				}
-				return data, nil, nil
+				return data, refdata, nil, nil
 			}
 			// Add new locs to the list. Skip ones already there - they've been processed.
 			for _, newLoc := range locs {
@@ -272,41 +687,94 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 	}
 
 	// Failure.
-	return nil, nil, firstError
+	return nil, nil, nil, firstError
 }
 
 // put saves a reference in the cache. put has the same invariants as get.
-func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (upspin.Reference, error) {
-	var ref upspin.Reference
+// For a writethrough cache it returns the Refdata provided by the store,
+// and caches nothing if the store says the reference is volatile. A
+// writeback cache cannot know that until the block is written back, so
+// it returns a Refdata of its own and drops the block once the store
+// says so. The work is traced beneath sp, if it is not nil.
+//
+// A writeback cache does not Put again a block it already holds, as it
+// writes back every block it holds. A writethrough cache always sends
+// the block to the store, which may have lost or deleted it since it
+// was cached, but concurrent writethrough Puts of the same block share
+// a single flight to the store; see flight.go.
+func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error) {
+	defer c.makeRoom()
+	ref := upspin.Reference(sha256key.Of(data).String())
+	file := c.cachePath(ref, e)
+	if c.wbq != nil && c.holds(file) {
+		atomic.AddInt64(&c.counters.dedupedPuts, 1)
+		return &upspin.Refdata{Reference: ref}, nil
+	}
+	if c.wbq != nil {
+		// Concurrent Puts of the same block are serialized by the
+		// lock on its cachedRef, and all but the first find it cached.
+		return c.putBlock(cfg, data, ref, e, sp)
+	}
+	f, leader := c.joinPut(file)
+	if !leader {
+		return f.putResult()
+	}
+	f.refdata, f.err = c.putBlock(cfg, data, ref, e, sp)
+	c.land(c.putFlights, file, f)
+	return f.putResult()
+}
+
+// putBlock is put for a block, with reference ref, that is not cached.
+// No locks are held on entry or exit.
+func (c *storeCache) putBlock(cfg upspin.Config, data []byte, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error) {
+	if c.oversize(data) {
+		atomic.AddInt64(&c.counters.oversize, 1)
+		return nil, errors.E(errors.Invalid, errors.Errorf("block of %d bytes exceeds the cache's limit of %d bytes per block", len(data), c.maxEntryBytes))
+	}
+	if !c.cacheable() {
+		// The disk is full; see diskfull.go.
+		return c.putThrough(cfg, data, e, sp)
+	}
+	var refdata *upspin.Refdata
 	if c.wbq == nil {
 		// If we can't put it to the store, don't cache.
 		store, err := bind.StoreServer(cfg, e)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		refdata, err := store.Put(data)
+		origin := originSpan(sp, "", e)
+		refdata, err = c.mirroredPut(cfg, store, data)
+		endSpan(origin)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		if refdata.Volatile {
+			// Nothing worth caching, but the store has it now.
+			c.forgetMissing(c.cachePath(refdata.Reference, e))
+			return refdata, nil
 		}
-		ref = refdata.Reference
 	} else {
-		ref = upspin.Reference(sha256key.Of(data).String())
+		refdata = &upspin.Refdata{Reference: ref}
 	}
+	// A store may name the block otherwise.
+	ref = refdata.Reference
 	file := c.cachePath(ref, e)
-	c.enforceByteLimitByRemovingLeastRecentlyUsedFile()
+	c.forgetMissing(file)
+	c.enforceByteLimit(int64(len(data)))
+	u := c.user(cfg.UserName())
+	c.enforceUserQuota(u, int64(len(data)))
 
 	c.Lock()
-	value, ok := c.lru.Get(file)
-	var cr *cachedRef
+	cr, ok := c.lookup(file)
 	if ok {
-		cr = value.(*cachedRef)
 		cr.Lock()
 		defer cr.Unlock()
 		c.Unlock()
 
 		// Already cached or being cached?
 		if cr.valid || cr.busy {
-			return ref, nil
+			cr.touch(file)
+			return refdata, nil
 		}
 	} else {
 		cr = c.newCachedRef(file)
@@ -316,57 +784,188 @@ func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (ups
 	}
 
 	// Save the data in a file and remember we cached it.
-	if err := cr.saveToCacheFile(file, data); err != nil {
+	if c.wbq == nil {
+		cr.setExpiry(c.duration(refdata.Duration, data))
+	} else {
+		cr.setExpiry(refdata.Duration)
+	}
+	if err := cr.saveToCacheFile(file, data, u); err != nil {
 		log.Info.Printf("saving cached ref %s to %s: %s", string(ref), file, err)
 		if c.wbq != nil {
-			// When writing back, any problem writing the file into the
-			// cache is fatal.
-			return "", err
+			if noSpace(err) {
+				// Send it to the store instead; see diskfull.go.
+				return c.putThrough(cfg, data, e, sp)
+			}
+			// When writing back, any other problem writing the file
+			// into the cache is fatal.
+			return nil, err
 		}
 	}
 
 	// Add to list of files to write back.
 	if c.wbq != nil {
 		if err := c.wbq.requestWriteback(ref, e); err != nil {
-			return "", err
+			return nil, err
+		}
+	}
+
+	// Commit it, and any writeback link, as the fsync policy says.
+	if cr.valid {
+		if err := c.committed(file); err != nil {
+			log.Info.Printf("syncing cached ref %s to %s: %s", string(ref), file, err)
+			if c.wbq != nil {
+				return nil, err
+			}
 		}
 	}
 
 	// Wake up anyone waiting for us to finish.
 	cr.hold.Signal()
-	return ref, nil
+	return refdata, nil
+}
+
+// holds reports whether the block to be cached in file is cached,
+// valid, and fresh, and if so counts it as used.
+// No locks are held on entry or exit.
+func (c *storeCache) holds(file string) bool {
+	c.Lock()
+	cr, ok := c.lookup(file)
+	if !ok {
+		c.Unlock()
+		return false
+	}
+	cr.Lock()
+	c.Unlock()
+	defer cr.Unlock()
+	if !cr.valid || cr.busy || cr.expired() {
+		return false
+	}
+	cr.touch(file)
+	return true
 }
 
 // delete removes a reference from the cache.
 // - No locks are held on entry or exit.
 // - If the cache file is busy, don't remove it.
-func (c *storeCache) delete(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint) error {
+// - Any pending writeback of the reference is cancelled first.
+// - The work is traced beneath sp, if it is not nil.
+func (c *storeCache) delete(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) error {
+	// Otherwise the writeback could recreate the reference
+	// in the store after we delete it.
+	cancelled := false
+	if c.wbq != nil {
+		cancelled = c.wbq.cancel(upspin.Location{Endpoint: e, Reference: ref})
+	}
 	store, err := bind.StoreServer(cfg, e)
 	if err != nil {
 		return err
 	}
-	if err := store.Delete(ref); err != nil {
-		return err
+	origin := originSpan(sp, ref, e)
+	err = c.mirroredDelete(cfg, store, ref)
+	endSpan(origin)
+	if err != nil {
+		// If the writeback was cancelled the store may never have seen it.
+		if !cancelled || !errors.Match(errors.E(errors.NotExist), err) {
+			return err
+		}
 	}
-	file := c.cachePath(ref, e)
+	c.drop(c.cachePath(ref, e))
+	return nil
+}
+
+// drop removes the reference cached in file, if any, from the cache,
+// unless it is busy. It reports whether cached data was removed.
+// No locks are held on entry or exit.
+func (c *storeCache) drop(file string) bool {
 	c.Lock()
 	defer c.Unlock()
-	value, ok := c.lru.Get(file)
+	cr, ok := c.lookup(file)
 	if !ok {
-		return nil
+		return false
 	}
-	cr := value.(*cachedRef)
 	cr.Lock()
 	defer cr.Unlock()
 	if cr.busy {
-		return nil
+		return false
 	}
-	c.lru.Remove(file)
+	dropped := cr.valid
+	c.forget(file)
 	cr.removeFile(file)
-	return nil
+	return dropped
 }
 
-// readFromCachefile reads in the cache file, if it exists.
+// flush waits for any pending writebacks to complete and then
+// commits the cached files to stable storage.
+// No locks are held on entry or exit.
+func (c *storeCache) flush() error {
+	if c.wbq != nil {
+		c.wbq.drain()
+	}
+
+	// Collect the files first; syncing them all with c
+	// locked would hold up every other request.
+	var files []string
+	c.Lock()
+	for it := c.lru.NewIterator(); ; {
+		key, _, ok := it.GetAndAdvance()
+		if !ok {
+			break
+		}
+		files = append(files, key.(string))
+	}
+	if c.coldLRU != nil {
+		for it := c.coldLRU.NewIterator(); ; {
+			key, _, ok := it.GetAndAdvance()
+			if !ok {
+				break
+			}
+			files = append(files, c.coldPath(key.(string)))
+		}
+	}
+	c.Unlock()
+
+	var firstErr error
+	for _, file := range files {
+		// The file may have been evicted meanwhile.
+		if err := syncFile(file); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// syncFile commits the named file to stable storage.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// corrupt reports whether data does not match ref. Only references that
+// are SHA-256 hashes, as used by most stores, can be checked; any other
+// reference is assumed to match.
+func corrupt(ref upspin.Reference, data []byte) bool {
+	hash, err := sha256key.Parse(string(ref))
+	if err != nil {
+		return false
+	}
+	return sha256key.Of(data) != hash
+}
+
+// oversize reports whether data is too large to cache,
+// by the maxentrybytes option.
+func (c *storeCache) oversize(data []byte) bool {
+	return c.maxEntryBytes > 0 && int64(len(data)) > c.maxEntryBytes
+}
+
+// readFromCachefile reads in the cache file, if it exists,
+// and returns the block it holds, uncompressed if need be.
 // Called with the cachedFile locked.
 func readFromCacheFile(name string) ([]byte, error) {
 	f, err := os.Open(name)
@@ -387,12 +986,16 @@ func readFromCacheFile(name string) ([]byte, error) {
 		}
 		buf = buf[:n]
 	}
-	return buf, nil
+	return decodeBlock(buf)
 }
 
-// saveToCacheFile saves a ref in the cache.
+// saveToCacheFile saves a ref in the cache, compressed if the cache
+// compresses and the data is worth it, charging it to u.
 // Called with cr locked.
-func (cr *cachedRef) saveToCacheFile(file string, data []byte) error {
+func (cr *cachedRef) saveToCacheFile(file string, data []byte, u *userCache) (err error) {
+	defer func() { cr.c.saved(err) }()
+	hash := cr.c.shareKey(data)
+	data = encodeBlock(data, cr.c.compress)
 	tmpName := file + ".tmp"
 	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
 	if err != nil {
@@ -415,49 +1018,126 @@ func (cr *cachedRef) saveToCacheFile(file string, data []byte) error {
 	}
 	if n != len(data) {
 		cleanup()
-		return errors.New("writing cache file")
+		return errors.Str("writing cache file")
 	}
 	if err := f.Close(); err != nil {
 		cleanup()
 		return err
 	}
+	return cr.install(tmpName, file, int64(len(data)), u, hash)
+}
+
+// install moves the cache file for cr, of size bytes, from tmpName, where
+// it was written, to file, charging it to u. If hash, that of the
+// block's contents, is not empty the block is shared with other stores
+// and references; see dedup.go.
+// Called with cr locked.
+func (cr *cachedRef) install(tmpName, file string, size int64, u *userCache, hash string) error {
 	if err := os.Rename(tmpName, file); err != nil {
-		cleanup()
+		if err := os.Remove(tmpName); err != nil {
+			log.Info.Printf("removing cache file: %s", err)
+		}
 		return err
 	}
+	if hash != "" {
+		cr.c.share(file, size, hash)
+	}
+	if !cr.expires.IsZero() {
+		if err := writeExpiryFile(file, cr.expires); err != nil {
+			// Without a record of the expiry, a restart would
+			// keep the data forever. Don't cache it.
+			os.Remove(file)
+			return err
+		}
+	}
 
-	cr.size = int64(len(data))
+	cr.size = size
 	cr.valid = true
 	cr.busy = false
+	cr.used = time.Now()
+	cr.recorded = cr.used
+	cr.c.index.add(file, cr)
+
+	// Update the total bytes and references cached.
+	cr.account(cr.size)
+	atomic.AddInt64(&cr.c.entries, 1)
+	if u != nil {
+		u.charge(cr, file)
+	}
 
 	// If the file was purged from the cache during the put, remove it.
 	// Unususual but possible with a small cache and simultaneous puts.
 	if cr.remove {
 		cr.removeFile(file)
 	}
-
-	// Update the total bytes cached.
-	atomic.AddInt64(&cr.c.inUse, cr.size)
 	return nil
 }
 
-// enforceByteLimitByRemovingLeastRecentlyUsedFile removes the oldest entries until inUse is below limit. We take a leap
-// of faith that the least recently used entry is not currently in use.
-func (c *storeCache) enforceByteLimitByRemovingLeastRecentlyUsedFile() {
+// enforceByteLimit, once the bytes in use plus need exceed the high
+// watermark, removes the least recently used files in one pass until
+// they are within the low watermark. Busy references are skipped and
+// moved to the front of the LRU. Each reference is considered at most
+// once, so if everything is busy we give up and exceed the limit.
+// If there is a cold tier, the files are demoted to it instead.
+// No locks are held on entry or exit.
+func (c *storeCache) enforceByteLimit(need int64) {
+	if atomic.LoadInt64(&c.inUse)+need <= c.highWater && atomic.LoadInt64(&c.coldInUse) <= c.coldLimit {
+		// Nothing to do, so don't contend for the lock.
+		return
+	}
 	c.Lock()
 	defer c.Unlock()
-	for {
-		if atomic.LoadInt64(&c.inUse) < c.limit {
+	if atomic.LoadInt64(&c.inUse)+need > c.highWater {
+		c.evictTo(c.lowWater - need)
+	}
+	c.enforceColdLimit()
+}
+
+// evictTo removes the least recently used files, or demotes them to the
+// cold tier, until the bytes in use are within target, as described for
+// enforceByteLimit.
+// This is called with c locked.
+func (c *storeCache) evictTo(target int64) {
+	for n := c.lru.Len(); atomic.LoadInt64(&c.inUse) > target; n-- {
+		if n == 0 {
+			log.Info.Printf("exceeding cache byte limit")
 			break
 		}
 		key, value := c.lru.RemoveOldest()
 		if value == nil {
 			// Nothing left.
-			log.Info.Printf("exceeding cache byte limit")
 			break
 		}
-		value.(*cachedRef).OnEviction(key)
+		cr := value.(*cachedRef)
+		if c.coldLRU != nil && cr.demote(key.(string)) {
+			c.coldLRU.Add(key, cr)
+			continue
+		}
+		if !cr.evict(key.(string)) {
+			c.lru.Add(key, cr)
+		}
+	}
+}
+
+// usage returns the number of bytes and references currently cached.
+func (c *storeCache) usage() (bytes, entries int64) {
+	return atomic.LoadInt64(&c.inUse), atomic.LoadInt64(&c.entries)
+}
+
+// evict removes the cached file unless the reference is busy or pinned.
+// It reports whether the reference may be dropped from the LRU.
+// This is called with c locked.
+func (cr *cachedRef) evict(file string) bool {
+	cr.Lock()
+	defer cr.Unlock()
+	if cr.busy || cr.pinned {
+		return false
 	}
+	if cr.valid {
+		cr.removeFile(file)
+		atomic.AddInt64(&cr.c.counters.evictions, 1)
+	}
+	return true
 }
 
 // OnEviction implements cache.OnEviction.
@@ -465,24 +1145,94 @@ func (cr *cachedRef) OnEviction(key interface{}) {
 	file := key.(string)
 	cr.Lock()
 	defer cr.Unlock()
+	if cr.pinned {
+		// Put it back once the LRU is done; see pin.go.
+		// The LRU is only added to with c locked.
+		cr.c.evictedPins = append(cr.c.evictedPins, evictedPin{file, cr})
+		return
+	}
 	if cr.busy {
 		// Someone is trying to read this in or put it. Don't bother removing anything
 		// but this is an odd situation so log it.
 		log.Info.Printf("cache file busy on eviction: %s", file)
 		// Remember to remove it when it is no longer busy.
 		cr.remove = true
+		atomic.AddInt64(&cr.c.counters.evictions, 1)
 		return
 	}
-	cr.removeFile(file)
+	if cr.valid {
+		cr.removeFile(file)
+		atomic.AddInt64(&cr.c.counters.evictions, 1)
+	}
 }
 
 // removeFile removes a file from the cache and updates the count of bytes in use.
 // This is called with cr locked.
 func (cr *cachedRef) removeFile(file string) {
+	name := cr.path(file)
+	if cr.valid {
+		if cr.cold {
+			atomic.AddInt64(&cr.c.coldInUse, -cr.size)
+		} else {
+			cr.account(-cr.size)
+		}
+		atomic.AddInt64(&cr.c.entries, -1)
+		cr.uncharge(file)
+		cr.c.index.remove(file)
+	}
 	cr.valid = false
 	cr.remove = false
-	atomic.AddInt64(&cr.c.inUse, -cr.size)
-	if err := os.Remove(file); err != nil {
+	cr.cold = false
+	cr.size = 0
+	if err := os.Remove(name); err != nil {
 		log.Info.Printf("can't remove file on eviction: %s", err)
 	}
+	cr.c.unshare(file)
+	if !cr.expires.IsZero() {
+		cr.expires = time.Time{}
+		if err := os.Remove(name + expirySuffix); err != nil && !os.IsNotExist(err) {
+			log.Info.Printf("can't remove expiry file on eviction: %s", err)
+		}
+	}
+}
+
+// setExpiry records when the data for cr expires, given the
+// Refdata.Duration returned by the store. A zero duration means never.
+// This is called with cr locked.
+func (cr *cachedRef) setExpiry(d time.Duration) {
+	if d <= 0 {
+		cr.expires = time.Time{}
+		return
+	}
+	cr.expires = time.Now().Add(d)
+}
+
+// expired reports whether the data for cr has outlived its expiry time.
+// This is called with cr locked.
+func (cr *cachedRef) expired() bool {
+	return !cr.expires.IsZero() && time.Now().After(cr.expires)
+}
+
+// writeExpiryFile records the expiry time of the cache file.
+func writeExpiryFile(file string, expires time.Time) error {
+	b, err := expires.MarshalText()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+expirySuffix, b, 0600)
+}
+
+// readExpiryFile returns the expiry time recorded for the cache file,
+// or the zero time if there is none.
+func readExpiryFile(file string) (time.Time, error) {
+	var expires time.Time
+	b, err := ioutil.ReadFile(file + expirySuffix)
+	if os.IsNotExist(err) {
+		return expires, nil
+	}
+	if err != nil {
+		return expires, err
+	}
+	err = expires.UnmarshalText(b)
+	return expires, err
 }
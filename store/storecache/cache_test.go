@@ -0,0 +1,3202 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/key/sha256key"
+	"upspin.io/log"
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// testStore is an in-memory StoreServer whose Refdata can be set by tests.
+// It counts the calls made to it so tests can tell whether the cache
+// went to the store.
+type testStore struct {
+	mu      sync.Mutex
+	blob    map[upspin.Reference][]byte
+	refdata map[upspin.Reference]upspin.Refdata
+	gets    int
+	puts    int
+	deletes int
+
+	// gate, if not nil, holds up Gets until it is closed,
+	// and putGate likewise Puts.
+	gate, putGate chan struct{}
+
+	// failures, if positive, is the number of Gets of failRef still
+	// to fail with failErr.
+	failures int
+	failRef  upspin.Reference
+	failErr  error
+
+	// putErr, if not nil, fails Puts and Deletes.
+	putErr error
+
+	// down, if set, fails Pings, pingDelay slows them, and pingGate,
+	// if not nil, holds them up until it is closed.
+	down      bool
+	pingDelay time.Duration
+	pingGate  chan struct{}
+
+	// endpoint is the endpoint at which the store was first dialed.
+	endpoint upspin.Endpoint
+}
+
+// testStores are the test stores, by the endpoints at which they are
+// dialed. Each test has stores of its own, so that what one test leaves
+// in a store cannot upset another.
+var testStores = struct {
+	sync.Mutex
+	m map[upspin.Endpoint]*testStore
+}{m: make(map[upspin.Endpoint]*testStore)}
+
+func init() {
+	if err := bind.RegisterStoreServer(upspin.Remote, new(testStore)); err != nil {
+		panic(err)
+	}
+}
+
+// newTestStore returns a new, empty test store, dialed at an endpoint
+// of its own.
+func newTestStore() *testStore {
+	s := &testStore{
+		blob:    make(map[upspin.Reference][]byte),
+		refdata: make(map[upspin.Reference]upspin.Refdata),
+	}
+	s.endpoint = s.alias()
+	return s
+}
+
+// alias returns a new endpoint at which s is also dialed, with a
+// directory of its own in the cache.
+func (s *testStore) alias() upspin.Endpoint {
+	testStores.Lock()
+	defer testStores.Unlock()
+	e := upspin.Endpoint{
+		Transport: upspin.Remote,
+		NetAddr:   upspin.NetAddr(fmt.Sprintf("store%d.example.com:443", len(testStores.m))),
+	}
+	testStores.m[e] = s
+	return e
+}
+
+func (s *testStore) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	s.mu.Lock()
+	s.gets++
+	gate := s.gate
+	s.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 && ref == s.failRef {
+		s.failures--
+		return nil, nil, nil, s.failErr
+	}
+	data, ok := s.blob[ref]
+	if !ok {
+		return nil, nil, nil, errors.E(errors.NotExist, errors.Errorf("no such blob: %s", ref))
+	}
+	refdata, ok := s.refdata[ref]
+	if !ok {
+		refdata.Reference = ref
+	}
+	return append([]byte(nil), data...), &refdata, nil, nil
+}
+
+func (s *testStore) Put(data []byte) (*upspin.Refdata, error) {
+	s.mu.Lock()
+	s.puts++
+	gate := s.putGate
+	s.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.putErr != nil {
+		return nil, s.putErr
+	}
+	ref := upspin.Reference(sha256key.Of(data).String())
+	s.blob[ref] = append([]byte(nil), data...)
+	refdata, ok := s.refdata[ref]
+	if !ok {
+		refdata.Reference = ref
+	}
+	return &refdata, nil
+}
+
+func (s *testStore) Delete(ref upspin.Reference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deletes++
+	if s.putErr != nil {
+		return s.putErr
+	}
+	if _, ok := s.blob[ref]; !ok {
+		return errors.E(errors.NotExist, errors.Errorf("no such blob: %s", ref))
+	}
+	delete(s.blob, ref)
+	return nil
+}
+
+func (s *testStore) Close() {}
+
+func (s *testStore) Ping() bool {
+	s.mu.Lock()
+	down, delay, gate := s.down, s.pingDelay, s.pingGate
+	s.mu.Unlock()
+	time.Sleep(delay)
+	if gate != nil {
+		<-gate
+	}
+	return !down
+}
+
+func (s *testStore) Dial(_ upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
+	testStores.Lock()
+	defer testStores.Unlock()
+	if m, ok := testStores.m[e]; ok {
+		return m, nil
+	}
+	return nil, errors.E(errors.NotExist, errors.Errorf("no test store at %s", e))
+}
+
+func (s *testStore) Endpoint() upspin.Endpoint {
+	return s.endpoint
+}
+
+// has reports whether s holds the block with reference ref.
+func (s *testStore) has(ref upspin.Reference) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blob[ref]
+	return ok
+}
+
+// add stores data in the test store with the given Refdata
+// and returns its reference.
+func (s *testStore) add(data string, refdata upspin.Refdata) upspin.Reference {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := upspin.Reference(sha256key.Of([]byte(data)).String())
+	s.blob[ref] = []byte(data)
+	refdata.Reference = ref
+	s.refdata[ref] = refdata
+	return ref
+}
+
+// getCount returns the number of calls to Get so far.
+func (s *testStore) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+// cfg is the configuration of the caches under test.
+var cfg = config.SetUserName(config.New(), "cache@example.com")
+
+// tempDir returns a new temporary directory, which the caller must remove.
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newTestCache returns a cache of maxBytes with the given options in a
+// new temporary directory, which the caller must remove, and a new test
+// store for it to cache.
+func newTestCache(t testing.TB, maxBytes int64, writethrough bool, options ...string) (*storeCache, *testStore, string) {
+	dir := tempDir(t)
+	c, _, err := newCache(cfg, dir, maxBytes, writethrough, options...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, newTestStore(), dir
+}
+
+// newTestServer returns a writethrough cache server with the given
+// options in a new temporary directory, which the caller must remove,
+// dialed to a new test store.
+func newTestServer(t *testing.T, options ...string) (*server, *testStore, string) {
+	dir := tempDir(t)
+	ss, _, err := New(cfg, dir, 1e6, true, options...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	store := newTestStore()
+	return dial(t, ss, store), store, dir
+}
+
+// newMemoryServer returns a server caching in memory, dialed to a new
+// test store.
+func newMemoryServer(t *testing.T) (*server, *testStore) {
+	store := newTestStore()
+	return dial(t, NewServer(cfg, NewMemory(1e6)), store), store
+}
+
+// dial returns the server s dialed to store.
+func dial(t testing.TB, s upspin.StoreServer, store *testStore) *server {
+	svc, err := s.Dial(cfg, store.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc.(*server)
+}
+
+// get fetches ref from s and checks that it has the expected contents.
+func get(t *testing.T, s upspin.StoreServer, ref upspin.Reference, want string) *upspin.Refdata {
+	data, refdata, _, err := s.Get(ref)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", ref, err)
+	}
+	if string(data) != want {
+		t.Fatalf("Get(%q) = %q, want %q", ref, data, want)
+	}
+	return refdata
+}
+
+func TestGetDuration(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	ref := store.add("short lived", upspin.Refdata{Duration: 50 * time.Millisecond})
+	refdata := get(t, s, ref, "short lived")
+	if refdata.Duration != 50*time.Millisecond {
+		t.Errorf("Duration = %v, want %v", refdata.Duration, 50*time.Millisecond)
+	}
+	n := store.getCount()
+
+	// Within the duration, the data comes from the cache.
+	refdata = get(t, s, ref, "short lived")
+	if got := store.getCount(); got != n {
+		t.Errorf("store Get called %d times within duration, want none", got-n)
+	}
+	if refdata.Duration <= 0 || refdata.Duration > 50*time.Millisecond {
+		t.Errorf("cached Duration = %v, want remaining lifetime", refdata.Duration)
+	}
+
+	// Once it has expired, the data is fetched again.
+	time.Sleep(60 * time.Millisecond)
+	get(t, s, ref, "short lived")
+	if got := store.getCount(); got != n+1 {
+		t.Errorf("store Get called %d times after expiry, want 1", got-n)
+	}
+}
+
+func TestGetVolatile(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	ref := store.add("volatile", upspin.Refdata{Volatile: true})
+	n := store.getCount()
+	for i := 0; i < 2; i++ {
+		refdata := get(t, s, ref, "volatile")
+		if !refdata.Volatile {
+			t.Errorf("Volatile = false, want true")
+		}
+	}
+	if got := store.getCount(); got != n+2 {
+		t.Errorf("store Get called %d times, want 2", got-n)
+	}
+}
+
+func TestExpiryPersists(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	ref := store.add("persisted expiry", upspin.Refdata{Duration: 50 * time.Millisecond})
+	if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	file := c.cachePath(ref, store.endpoint)
+	if _, err := os.Stat(file + expirySuffix); err != nil {
+		t.Fatalf("no expiry file: %v", err)
+	}
+
+	// After expiry, a new cache on the same directory drops the entry.
+	time.Sleep(60 * time.Millisecond)
+	c, _, err := newCache(cfg, dir, 1e6, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.lru.Get(file); ok {
+		t.Errorf("expired entry reloaded into cache")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expired cache file not removed: %v", err)
+	}
+}
+
+func TestMaxStale(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "maxstale=1h")
+	defer os.RemoveAll(dir)
+	defer c.close()
+	ref := store.add("version 1", upspin.Refdata{Duration: 50 * time.Millisecond})
+	set := func(data string) {
+		store.mu.Lock()
+		store.blob[ref] = []byte(data)
+		store.mu.Unlock()
+	}
+	get := func(want string, volatile bool) {
+		data, refdata, _, err := c.get(cfg, ref, store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want || refdata.Volatile != volatile {
+			t.Fatalf("get = %q, volatile %t; want %q, %t", data, refdata.Volatile, want, volatile)
+		}
+	}
+	get("version 1", false)
+
+	// Once expired, the stale data is returned at once and
+	// replaced in the background.
+	time.Sleep(60 * time.Millisecond)
+	set("version 2")
+	n := store.getCount()
+	get("version 1", true)
+	c.revalidations.Wait()
+	if got := store.getCount(); got != n+1 {
+		t.Errorf("store Get called %d times, want 1", got-n)
+	}
+	get("version 2", false)
+	if st := c.stats(); st.Stale != 1 || st.Revalidations != 1 {
+		t.Errorf("Stale, Revalidations = %d, %d; want 1, 1", st.Stale, st.Revalidations)
+	}
+
+	// Data staler than the maximum is fetched while the client waits.
+	c.maxStale = time.Millisecond
+	time.Sleep(60 * time.Millisecond)
+	set("version 3")
+	get("version 3", false)
+	if st := c.stats(); st.Stale != 1 {
+		t.Errorf("Stale = %d, want 1", st.Stale)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, opt := range []string{
+		"verify=maybe",
+		"maxentrybytes=-1",
+		"fsync=sometimes",
+		"fsyncinterval=0s",
+		"fsyncinterval=soon",
+		"negativettl=-1s",
+		"storelimit=many",
+		"bandwidth=-1",
+		"highwater=0",
+		"lowwater=101",
+		"retrywait=soon",
+		"colddir=",
+	} {
+		_, _, err := newCache(cfg, dir, 1e6, true, opt)
+		k := strings.SplitN(opt, "=", 2)[0]
+		if !errors.Match(errors.E(errors.Invalid), err) || !strings.Contains(err.Error(), "invalid value for "+k) {
+			t.Errorf("%s: err = %v, want invalid value", opt, err)
+		}
+	}
+	c, _, err := newCache(cfg, dir, 1e6, true, "fsyncinterval=1s", "bandwidth=1000", "highwater=90", "lowwater=80", "retries=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.syncInterval != time.Second || c.bandwidth == nil || c.highWater != 9e5 || c.lowWater != 8e5 || c.retries != 3 {
+		t.Errorf("options not applied: syncInterval %v, bandwidth %v, highWater %d, lowWater %d, retries %d", c.syncInterval, c.bandwidth, c.highWater, c.lowWater, c.retries)
+	}
+}
+
+func TestShardLevels(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	if _, _, err := newCache(cfg, dir, 1e6, true, "shardlevels=5"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("shardlevels=5: err = %v, want Invalid", err)
+	}
+	ref := store.add("sharded", upspin.Refdata{Duration: time.Hour})
+	if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	old := c.cachePath(ref, store.endpoint)
+	if want := filepath.Join(dir, store.endpoint.String(), string(ref[:2]), string(ref)); old != want {
+		t.Errorf("cache file = %s, want %s", old, want)
+	}
+
+	// A cache with more levels moves the file and its expiry
+	// to their new places and finds them there.
+	n := store.getCount()
+	c, _, err := newCache(cfg, dir, 1e6, true, "shardlevels=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := c.cachePath(ref, store.endpoint)
+	if want := filepath.Join(dir, store.endpoint.String(), string(ref[:2]), string(ref[2:4]), string(ref)); file != want {
+		t.Errorf("cache file = %s, want %s", file, want)
+	}
+	for _, f := range []string{file, file + expirySuffix} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("not moved: %v", err)
+		}
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old cache file remains: %v", err)
+	}
+	if _, ok := c.lru.Get(file); !ok {
+		t.Errorf("moved file not loaded into cache")
+	}
+	if data, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil || string(data) != "sharded" {
+		t.Errorf("get = %q, %v; want %q", data, err, "sharded")
+	}
+	if got := store.getCount(); got != n {
+		t.Errorf("store Get called %d times, want 0", got-n)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, layoutFile)); err != nil || string(data) != "2\n" {
+		t.Errorf("layout file = %q, %v; want \"2\\n\"", data, err)
+	}
+
+	// And back to none.
+	c, _, err = newCache(cfg, dir, 1e6, true, "shardlevels=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = c.cachePath(ref, store.endpoint)
+	if want := filepath.Join(dir, store.endpoint.String(), string(ref)); file != want {
+		t.Errorf("cache file = %s, want %s", file, want)
+	}
+	if _, ok := c.lru.Get(file); !ok {
+		t.Errorf("moved file not loaded into cache")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// Room for three 1000 byte blocks.
+	const limit = 3500
+	c, store, dir := newTestCache(t, limit, true)
+	defer os.RemoveAll(dir)
+	var refs []upspin.Reference
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 1000)
+		data[0] = byte(i)
+		refdata, err := c.put(cfg, data, store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, refdata.Reference)
+		// Touch the first block so it is never the least recently used.
+		if _, _, _, err := c.get(cfg, refs[0], store.endpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.stats().Evictions; got != 2 {
+		t.Errorf("Evictions = %d, want 2", got)
+	}
+	bytes, entries := c.usage()
+	if bytes != 3000 || entries != 3 {
+		t.Errorf("usage() = %d bytes, %d entries; want 3000, 3", bytes, entries)
+	}
+	for i, ref := range refs {
+		_, err := os.Stat(c.cachePath(ref, store.endpoint))
+		cached := err == nil
+		want := i == 0 || i >= 3
+		if cached != want {
+			t.Errorf("block %d cached = %t, want %t", i, cached, want)
+		}
+	}
+
+	// A new cache on the same directory accounts for what is there.
+	c, _, err := newCache(cfg, dir, limit, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, entries = c.usage()
+	if bytes != 3000 || entries != 3 {
+		t.Errorf("after restart usage() = %d bytes, %d entries; want 3000, 3", bytes, entries)
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	c, store, dir := newTestCache(t, 10000, true, "highwater=80", "lowwater=50")
+	defer os.RemoveAll(dir)
+	defer c.close()
+	for _, opts := range [][]string{
+		{"highwater=0"},
+		{"highwater=101"},
+		{"lowwater=x"},
+		{"highwater=50", "lowwater=80"},
+	} {
+		if _, _, err := newCache(cfg, dir, 10000, true, opts...); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("%q: err = %v, want Invalid", opts, err)
+		}
+	}
+
+	put := func(i int) {
+		data := make([]byte, 1000)
+		data[0], data[1] = 'w', byte(i)
+		if _, err := c.put(cfg, data, store.endpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is evicted up to the high watermark.
+	for i := 0; i < 8; i++ {
+		put(i)
+	}
+	if st := c.stats(); st.Evictions != 0 || st.Bytes != 8000 {
+		t.Fatalf("at high watermark: Evictions, Bytes = %d, %d; want 0, 8000", st.Evictions, st.Bytes)
+	}
+
+	// Passing it evicts down to the low watermark, leaving room
+	// for the new block.
+	put(8)
+	if st := c.stats(); st.Evictions != 4 || st.Bytes != 5000 {
+		t.Fatalf("past high watermark: Evictions, Bytes = %d, %d; want 4, 5000", st.Evictions, st.Bytes)
+	}
+
+	// After which there is room again before more are evicted.
+	for i := 9; i < 12; i++ {
+		put(i)
+	}
+	if st := c.stats(); st.Evictions != 4 || st.Bytes != 8000 {
+		t.Errorf("back at high watermark: Evictions, Bytes = %d, %d; want 4, 8000", st.Evictions, st.Bytes)
+	}
+}
+
+func TestColdTier(t *testing.T) {
+	coldDir := tempDir(t)
+	defer os.RemoveAll(coldDir)
+
+	// Room for two 1000 byte blocks in each tier.
+	options := []string{"colddir=" + coldDir, "coldbytes=2500"}
+	c, store, dir := newTestCache(t, 2500, true, options...)
+	defer os.RemoveAll(dir)
+	var refs []upspin.Reference
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 1000)
+		data[0] = byte(i)
+		refdata, err := c.put(cfg, data, store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, refdata.Reference)
+	}
+	// Blocks 0 to 2 were demoted in turn and block 0 then evicted.
+	st := c.stats()
+	if st.Demotions != 3 || st.Evictions != 1 {
+		t.Errorf("Demotions, Evictions = %d, %d; want 3, 1", st.Demotions, st.Evictions)
+	}
+
+	// Reading block 1 promotes it, demoting block 3.
+	gets := store.getCount()
+	data, _, _, err := c.get(cfg, refs[1], store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1000 || data[0] != 1 {
+		t.Errorf("got wrong data for block 1")
+	}
+	if store.getCount() != gets {
+		t.Errorf("block in the cold tier fetched from the store")
+	}
+	st = c.stats()
+	if st.Promotions != 1 || st.Demotions != 4 {
+		t.Errorf("Promotions, Demotions = %d, %d; want 1, 4", st.Promotions, st.Demotions)
+	}
+
+	where := []string{"none", "hot", "cold", "cold", "hot"}
+	check := func(c *storeCache) {
+		for i, ref := range refs {
+			file := c.cachePath(ref, store.endpoint)
+			_, err := os.Stat(file)
+			hot := err == nil
+			_, err = os.Stat(c.coldPath(file))
+			cold := err == nil
+			if hot != (where[i] == "hot") || cold != (where[i] == "cold") {
+				t.Errorf("block %d: hot %t, cold %t; want %s", i, hot, cold, where[i])
+			}
+		}
+		st := c.stats()
+		if st.Bytes != 2000 || st.ColdBytes != 2000 || st.Entries != 4 {
+			t.Errorf("Bytes, ColdBytes, Entries = %d, %d, %d; want 2000, 2000, 4", st.Bytes, st.ColdBytes, st.Entries)
+		}
+	}
+	check(c)
+
+	// A new cache on the same directories accounts for what is there.
+	c, _, err = newCache(cfg, dir, 2500, true, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	if _, _, err := newCache(cfg, dir, 2500, true, "colddir="+coldDir); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("colddir without coldbytes: err = %v, want Invalid", err)
+	}
+	if _, _, err := newCache(cfg, filepath.Join(dir, "storecache", "x"), 2500, true, "colddir="+dir, "coldbytes=2500"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("overlapping colddir: err = %v, want Invalid", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	// lru returns the files in the LRU of c, most recently used first,
+	// and when each was used.
+	lru := func(c *storeCache) ([]string, []time.Time) {
+		c.Lock()
+		defer c.Unlock()
+		var files []string
+		var used []time.Time
+		for it := c.lru.NewIterator(); ; {
+			key, value, ok := it.GetAndAdvance()
+			if !ok {
+				break
+			}
+			cr := value.(*cachedRef)
+			cr.Lock()
+			files = append(files, key.(string))
+			used = append(used, cr.used)
+			cr.Unlock()
+		}
+		return files, used
+	}
+
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	var files []string
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1000)
+		data[0] = byte(i)
+		refdata, err := c.put(cfg, data, store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, c.cachePath(refdata.Reference, store.endpoint))
+	}
+	wantFiles, wantUsed := lru(c)
+	c.close()
+
+	// After a clean close, a new cache on the directory replays the
+	// index, restoring the order and times of use of the blocks.
+	c, _, err := newCache(cfg, dir, 1e6, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotFiles, gotUsed := lru(c)
+	if len(gotFiles) != len(wantFiles) {
+		t.Fatalf("got %d files in the LRU, want %d", len(gotFiles), len(wantFiles))
+	}
+	for i := range gotFiles {
+		if gotFiles[i] != wantFiles[i] || !gotUsed[i].Equal(wantUsed[i]) {
+			t.Errorf("LRU entry %d = %s used %v; want %s used %v", i, gotFiles[i], gotUsed[i], wantFiles[i], wantUsed[i])
+		}
+	}
+	if bytes, entries := c.usage(); bytes != 3000 || entries != 3 {
+		t.Errorf("usage() = %d bytes, %d entries; want 3000, 3", bytes, entries)
+	}
+	c.close()
+
+	// An index that does not match the files is not used.
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err = newCache(cfg, dir, 1e6, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes, entries := c.usage(); bytes != 2000 || entries != 2 {
+		t.Errorf("after removing a file usage() = %d bytes, %d entries; want 2000, 2", bytes, entries)
+	}
+	c.close()
+
+	// Nor is one left incomplete, as by a crash; the walk finds a
+	// file the index does not list.
+	index := filepath.Join(dir, indexFile)
+	info, err := os.Stat(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(index, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, store.endpoint.String(), "zz", "zz")
+	if err := os.MkdirAll(filepath.Dir(extra), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(extra, make([]byte, 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err = newCache(cfg, dir, 1e6, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if bytes, entries := c.usage(); bytes != 3000 || entries != 3 {
+		t.Errorf("after a crash usage() = %d bytes, %d entries; want 3000, 3", bytes, entries)
+	}
+}
+
+func TestEvictionSkipsBusy(t *testing.T) {
+	c, store, dir := newTestCache(t, 2500, true)
+	defer os.RemoveAll(dir)
+	refdata, err := c.put(cfg, make([]byte, 1000), store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := c.cachePath(refdata.Reference, store.endpoint)
+
+	// Mark the oldest block busy, as if it were being read.
+	value, _ := c.lru.Get(file)
+	cr := value.(*cachedRef)
+	cr.Lock()
+	cr.busy = true
+	cr.Unlock()
+
+	if _, err := c.put(cfg, make([]byte, 2000), store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("busy block evicted: %v", err)
+	}
+	if _, ok := c.lru.Get(file); !ok {
+		t.Errorf("busy block dropped from LRU")
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	ref := store.add("counted", upspin.Refdata{})
+	for i := 0; i < 3; i++ {
+		get(t, s, ref, "counted")
+	}
+	if _, err := s.Put([]byte("put")); err != nil {
+		t.Fatal(err)
+	}
+	st := s.Stats()
+	if st.Hits != 2 || st.Misses != 1 {
+		t.Errorf("Hits, Misses = %d, %d; want 2, 1", st.Hits, st.Misses)
+	}
+	if st.CacheBytes != 14 || st.OriginBytes != 7 {
+		t.Errorf("CacheBytes, OriginBytes = %d, %d; want 14, 7", st.CacheBytes, st.OriginBytes)
+	}
+	if r := st.HitRatio(); r < 0.66 || r > 0.67 {
+		t.Errorf("HitRatio = %g, want 2/3", r)
+	}
+	if st.Get.Count != 3 || st.Put.Count != 1 || st.Delete.Count != 0 {
+		t.Errorf("Get, Put, Delete counts = %d, %d, %d; want 3, 1, 0", st.Get.Count, st.Put.Count, st.Delete.Count)
+	}
+	if n := st.Get.Buckets[len(LatencyBuckets)-1]; n != 3 {
+		t.Errorf("Get requests within %v = %d, want 3", LatencyBuckets[len(LatencyBuckets)-1], n)
+	}
+	if st.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", st.Entries)
+	}
+}
+
+func TestGetIfChanged(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	// A volatile reference, like a directory root, whose data the
+	// client holds and knows by its hash.
+	ref := upspin.Reference("root")
+	have := upspin.Reference(sha256key.Of([]byte("version 1")).String())
+	setRoot := func(data string) {
+		store.mu.Lock()
+		store.blob[ref] = []byte(data)
+		store.refdata[ref] = upspin.Refdata{Reference: ref, Volatile: true}
+		store.mu.Unlock()
+	}
+	setRoot("version 1")
+
+	n := store.getCount()
+	data, refdata, _, unchanged, err := s.GetIfChanged(ref, have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unchanged || data != nil || refdata == nil {
+		t.Errorf("same data: unchanged %t, data %q, refdata %v; want true, nil, non-nil", unchanged, data, refdata)
+	}
+	if store.getCount() != n+1 {
+		t.Errorf("store not asked whether volatile data changed")
+	}
+
+	setRoot("version 2")
+	data, _, _, unchanged, err = s.GetIfChanged(ref, have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged || string(data) != "version 2" {
+		t.Errorf("new data: unchanged %t, data %q; want false, %q", unchanged, data, "version 2")
+	}
+
+	if st := s.Stats(); st.Unchanged != 1 || st.Get.Count != 2 {
+		t.Errorf("Unchanged, Gets = %d, %d; want 1, 2", st.Unchanged, st.Get.Count)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	ref := store.add("traced", upspin.Refdata{})
+	note := annotation(ref, store.endpoint)
+
+	// spans fetches ref and returns the names of the spans recorded,
+	// checking that each is annotated with ref and the endpoint.
+	spans := func() []string {
+		m, sp := trace("Get", ref, store.endpoint)
+		if _, _, _, err := c.get(cfg, ref, store.endpoint, sp); err != nil {
+			t.Fatal(err)
+		}
+		sp.End()
+		var names []string
+		for _, s := range m.Spans() {
+			names = append(names, s.Name)
+			if s.Annotation != note {
+				t.Errorf("span %s annotated %q, want %q", s.Name, s.Annotation, note)
+			}
+			if s.EndTime.IsZero() {
+				t.Errorf("span %s not ended", s.Name)
+			}
+			if s.Name == "origin" && s.Kind != metric.Client {
+				t.Errorf("origin span kind = %v, want Client", s.Kind)
+			}
+		}
+		m.Done()
+		return names
+	}
+	// A miss goes to the store; a hit does not.
+	if got, want := strings.Join(spans(), " "), "store/storecache.Get lookup origin"; got != want {
+		t.Errorf("miss: spans = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(spans(), " "), "store/storecache.Get lookup"; got != want {
+		t.Errorf("hit: spans = %q, want %q", got, want)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	ref := store.add("described", upspin.Refdata{})
+	get(t, s, ref, "described")
+	i := s.Info()
+	if i.Origin != store.endpoint || i.Passthrough {
+		t.Errorf("Origin, Passthrough = %v, %t; want %v, false", i.Origin, i.Passthrough, store.endpoint)
+	}
+	if want := filepath.Join(dir, "storecache"); i.Dir != want {
+		t.Errorf("Dir = %q, want %q", i.Dir, want)
+	}
+	if i.Limit != 1e6 {
+		t.Errorf("Limit = %d, want 1e6", i.Limit)
+	}
+	if i.Stats.Entries != 1 || i.Stats.Bytes != int64(len("described")) {
+		t.Errorf("Entries, Bytes = %d, %d; want 1, %d", i.Stats.Entries, i.Stats.Bytes, len("described"))
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	var locs []upspin.Location
+	for i := 0; i < 6; i++ {
+		ref := store.add(fmt.Sprintf("block %d", i), upspin.Refdata{})
+		locs = append(locs, upspin.Location{Endpoint: store.endpoint, Reference: ref})
+	}
+	s.Prefetch(locs)
+	c := s.files
+
+	// Reading the first block brings in the next prefetchAhead.
+	get(t, s, locs[0].Reference, "block 0")
+	deadline := time.Now().Add(5 * time.Second)
+	for c.stats().Misses < 1+prefetchAhead {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetched %d blocks, want %d", c.stats().Misses-1, prefetchAhead)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reading them is then served from the cache.
+	n := store.getCount()
+	for i := 1; i <= prefetchAhead; i++ {
+		get(t, s, locs[i].Reference, fmt.Sprintf("block %d", i))
+	}
+	if got := store.getCount(); got-n > 1 {
+		// Reading block 4 may prefetch block 5, but no more.
+		t.Errorf("store Get called %d times reading prefetched blocks, want at most 1", got-n)
+	}
+	if st := c.stats(); st.Hits != prefetchAhead || st.Prefetches < prefetchAhead {
+		t.Errorf("Hits, Prefetches = %d, %d; want %d, at least %d", st.Hits, st.Prefetches, prefetchAhead, prefetchAhead)
+	}
+}
+
+func TestPutVolatile(t *testing.T) {
+	// A writethrough cache returns the store's Refdata.
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+
+	// volatile makes the store report the reference of data as volatile.
+	volatile := func(data string) upspin.Reference {
+		ref := upspin.Reference(sha256key.Of([]byte(data)).String())
+		store.mu.Lock()
+		store.refdata[ref] = upspin.Refdata{Reference: ref, Volatile: true}
+		store.mu.Unlock()
+		return ref
+	}
+	check := func(c *storeCache, ref upspin.Reference, want string) {
+		if _, err := os.Stat(c.cachePath(ref, store.endpoint)); !os.IsNotExist(err) {
+			t.Errorf("volatile block cached: %v", err)
+		}
+		data, refdata, _, err := c.get(cfg, ref, store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want || !refdata.Volatile {
+			t.Errorf("get = %q, volatile %t; want %q, true", data, refdata.Volatile, want)
+		}
+	}
+
+	ref := volatile("put through")
+	refdata, err := c.put(cfg, []byte("put through"), store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refdata.Volatile {
+		t.Errorf("put: Volatile = false, want true")
+	}
+	check(c, ref, "put through")
+
+	// A writeback cache drops the block once written back.
+	c, flush, err := newCache(cfg, dir, 1e6, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	ref = volatile("put back")
+	if _, err := c.put(cfg, []byte("put back"), store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	flush(upspin.Location{Endpoint: store.endpoint, Reference: ref})
+	check(c, ref, "put back")
+}
+
+func TestWritebackDelete(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, false)
+	defer os.RemoveAll(dir)
+	defer c.close()
+	flush := c.wbq.flush
+
+	// Flushing a block puts it in the store.
+	refdata, err := c.put(cfg, []byte("written back"), store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := upspin.Location{Endpoint: store.endpoint, Reference: refdata.Reference}
+	flush(loc)
+	if _, _, _, err := store.Get(loc.Reference); err != nil {
+		t.Fatalf("flushed block not in store: %v", err)
+	}
+	if n := c.stats().Pending; n != 0 {
+		t.Errorf("Pending = %d after flush, want 0", n)
+	}
+
+	// Deleting a block before it is written back leaves it
+	// in neither the cache nor the store.
+	refdata, err = c.put(cfg, []byte("deleted before writeback"), store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc = upspin.Location{Endpoint: store.endpoint, Reference: refdata.Reference}
+	if err := c.delete(cfg, loc.Reference, store.endpoint, nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	flush(loc)
+	if _, _, _, err := store.Get(loc.Reference); !errors.Match(errors.E(errors.NotExist), err) {
+		t.Errorf("deleted block in store: err = %v", err)
+	}
+	if _, err := os.Stat(c.cachePath(loc.Reference, store.endpoint)); !os.IsNotExist(err) {
+		t.Errorf("deleted block in cache: err = %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ss, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	ss.SetAuditLog(&buf)
+
+	// The record names the user for whom the server was dialed.
+	ann := config.SetUserName(config.New(), "ann@example.com")
+	svc, err := ss.Dial(ann, store.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := svc.(upspin.StoreServer)
+	ref := store.add("audited", upspin.Refdata{})
+	get(t, s, ref, "audited")
+	if err := s.Delete(ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ref); err == nil {
+		t.Fatal("second Delete succeeded")
+	}
+
+	dec := json.NewDecoder(&buf)
+	for i, wantErr := range []bool{false, true} {
+		var r AuditRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if r.Op != "Delete" || r.User != "ann@example.com" || r.Reference != ref || r.Endpoint != store.endpoint.String() {
+			t.Errorf("record %d = %+v, want Delete of %s at %s by ann@example.com", i, r, ref, store.endpoint)
+		}
+		if (r.Error != "") != wantErr {
+			t.Errorf("record %d: Error = %q, want error %t", i, r.Error, wantErr)
+		}
+		if time.Since(r.Time) > time.Minute {
+			t.Errorf("record %d: Time = %v, want now", i, r.Time)
+		}
+	}
+	if dec.More() {
+		t.Errorf("more records than Deletes")
+	}
+}
+
+func TestNotDialed(t *testing.T) {
+	s := NewServer(cfg, NewMemory(1e6))
+	_, _, _, err := s.Get("ref")
+	if !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("Get on undialed server: err = %v, want Invalid", err)
+	}
+	if _, err := s.Put([]byte("data")); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("Put on undialed server: err = %v, want Invalid", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, false)
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	var refs []upspin.Reference
+	for i := 0; i < 10; i++ {
+		refdata, err := c.put(cfg, []byte(fmt.Sprintf("flushed %d", i)), store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, refdata.Reference)
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.stats().Pending; n != 0 {
+		t.Errorf("Pending = %d after flush, want 0", n)
+	}
+	for _, ref := range refs {
+		if _, _, _, err := store.Get(ref); err != nil {
+			t.Errorf("flushed block not in store: %v", err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s, store, dir := newTestServer(t, "verify=true")
+	defer os.RemoveAll(dir)
+	if _, _, err := New(cfg, dir, 1e6, true, "verify=maybe"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("New with bad option: err = %v, want Invalid", err)
+	}
+	c := s.files
+
+	ref := store.add("intact", upspin.Refdata{})
+	get(t, s, ref, "intact")
+
+	// Damage the cached copy; it should be refetched.
+	if err := ioutil.WriteFile(c.cachePath(ref, store.endpoint), []byte("damage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n := store.getCount()
+	get(t, s, ref, "intact")
+	if got := store.getCount(); got != n+1 {
+		t.Errorf("store Get called %d times for damaged block, want 1", got-n)
+	}
+	if got := c.stats().Corrupt; got != 1 {
+		t.Errorf("Corrupt = %d, want 1", got)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	c.userQuota = 2500
+	ann := config.SetUserName(config.New(), "ann@example.com")
+	bob := config.SetUserName(config.New(), "bob@example.com")
+
+	put := func(cfg upspin.Config, i int) string {
+		data := make([]byte, 1000)
+		data[0] = byte(i)
+		refdata, err := c.put(cfg, data, store.endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.cachePath(refdata.Reference, store.endpoint)
+	}
+	cached := func(file string) bool {
+		_, err := os.Stat(file)
+		return err == nil
+	}
+
+	bobs := put(bob, 0)
+	var anns []string
+	for i := 1; i <= 3; i++ {
+		anns = append(anns, put(ann, i))
+	}
+	if cached(anns[0]) {
+		t.Errorf("ann's oldest block not evicted")
+	}
+	if !cached(anns[1]) || !cached(anns[2]) {
+		t.Errorf("ann's newest blocks evicted")
+	}
+	if !cached(bobs) {
+		t.Errorf("bob's block evicted by ann's quota")
+	}
+
+	// Lifting ann's quota lets her use more.
+	c.setQuota(ann.UserName(), -1)
+	anns = append(anns, put(ann, 4))
+	if !cached(anns[1]) || !cached(anns[2]) || !cached(anns[3]) {
+		t.Errorf("ann's blocks evicted with no quota")
+	}
+	if got := atomic.LoadInt64(&c.user(ann.UserName()).inUse); got != 3000 {
+		t.Errorf("ann's usage = %d, want 3000", got)
+	}
+}
+
+func TestSharedFetch(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	// Volatile data is not kept in the cache, so only the flight
+	// keeps the Gets from each going to the store.
+	ref := store.add("thundering herd", upspin.Refdata{Volatile: true})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+
+	const n = 20
+	before := store.getCount()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, _, _, err := s.Get(ref)
+			if err == nil && string(data) != "thundering herd" {
+				err = fmt.Errorf("got %q", data)
+			}
+			errs <- err
+		}()
+	}
+
+	// Release the store once every Get is in flight.
+	for i := 0; s.Stats().Shared < n-1; i++ {
+		if i > 500 {
+			t.Fatalf("Shared = %d, want %d", s.Stats().Shared, n-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := store.getCount() - before; got != 1 {
+		t.Errorf("store Gets = %d, want 1", got)
+	}
+	st := s.Stats()
+	if st.Hits != n-1 || st.Misses != 1 {
+		t.Errorf("Hits, Misses = %d, %d; want %d, 1", st.Hits, st.Misses, n-1)
+	}
+}
+
+func TestSharedPut(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.putGate = gate
+	before := store.puts
+	store.mu.Unlock()
+
+	const n = 2
+	data := []byte("put twice at once")
+	want := upspin.Reference(sha256key.Of(data).String())
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refdata, err := s.Put(data)
+			if err == nil && refdata.Reference != want {
+				err = fmt.Errorf("got reference %q", refdata.Reference)
+			}
+			errs <- err
+		}()
+	}
+
+	// Release the store once every Put is in flight.
+	for i := 0; s.Stats().DedupedPuts < n-1; i++ {
+		if i > 500 {
+			t.Fatalf("DedupedPuts = %d, want %d", s.Stats().DedupedPuts, n-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Once the block is cached, a Put of it still goes to the store.
+	if _, err := s.Put(data); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	puts := store.puts - before
+	store.mu.Unlock()
+	if puts != 2 {
+		t.Errorf("store Puts = %d, want 2", puts)
+	}
+	if got := s.Stats().DedupedPuts; got != n-1 {
+		t.Errorf("DedupedPuts = %d, want %d", got, n-1)
+	}
+}
+
+func TestPutAfterOriginDelete(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	data := []byte("deleted behind the cache's back")
+	refdata, err := s.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The store loses the block, but the cache still holds it.
+	store.mu.Lock()
+	delete(store.blob, refdata.Reference)
+	store.mu.Unlock()
+	if got, _, _, err := s.Get(refdata.Reference); err != nil || string(got) != string(data) {
+		t.Fatalf("Get from cache = %q, %v; want %q", got, err, data)
+	}
+
+	// Putting it again puts it back in the store.
+	if _, err := s.Put(data); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	got, ok := store.blob[refdata.Reference]
+	store.mu.Unlock()
+	if !ok || string(got) != string(data) {
+		t.Errorf("store holds %q, %t after the second Put; want %q", got, ok, data)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	c, store, dir := newTestCache(t, 3500, true)
+	defer os.RemoveAll(dir)
+	s := dial(t, NewServer(cfg, c), store)
+
+	var refs []upspin.Reference
+	for i := 0; i < 5; i++ {
+		refs = append(refs, store.add(fmt.Sprintf("warm %03d %0990d", i, 0), upspin.Refdata{}))
+	}
+	missing := upspin.Reference(sha256key.Of([]byte("not in the store")).String())
+	volatile := store.add("warm volatile", upspin.Refdata{Volatile: true})
+	errs := s.Warm(append([]upspin.Reference{missing, volatile}, refs...), store.endpoint)
+
+	if !errors.Match(errors.E(errors.NotExist), errs[0]) {
+		t.Errorf("missing reference: err = %v, want NotExist", errs[0])
+	}
+	if !errors.Match(errors.E(errors.Invalid), errs[1]) {
+		t.Errorf("volatile reference: err = %v, want Invalid", errs[1])
+	}
+	// Four 1000-byte blocks reach the 3500-byte limit; the fifth
+	// is not fetched.
+	for i, err := range errs[2:6] {
+		if err != nil {
+			t.Errorf("block %d: %v", i, err)
+		}
+	}
+	if errs[6] != errWarmFull {
+		t.Errorf("block 4: err = %v, want %v", errs[6], errWarmFull)
+	}
+
+	// The most recent blocks are cached, so Gets of them are hits.
+	before := store.getCount()
+	get(t, s, refs[3], fmt.Sprintf("warm %03d %0990d", 3, 0))
+	if n := store.getCount() - before; n != 0 {
+		t.Errorf("Get of warmed block went to the store %d times", n)
+	}
+}
+
+func TestOriginTimeout(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "timeout=50ms")
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	ref := store.add("slow", upspin.Refdata{})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+
+	_, _, _, err := c.get(cfg, ref, store.endpoint, nil)
+	close(gate)
+	store.mu.Lock()
+	store.gate = nil
+	store.mu.Unlock()
+	if !errors.Match(errors.E(errors.IO), err) {
+		t.Fatalf("Get from hung store: err = %v, want IO error", err)
+	}
+
+	// Nothing was cached, so the next Get goes to the store.
+	before := store.getCount()
+	data, _, _, err := c.get(cfg, ref, store.endpoint, nil)
+	if err != nil || string(data) != "slow" {
+		t.Fatalf("Get = %q, %v; want %q", data, err, "slow")
+	}
+	if n := store.getCount() - before; n != 1 {
+		t.Errorf("store Gets = %d, want 1", n)
+	}
+}
+
+func TestOriginRetry(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "retries=3", "retrywait=1ms")
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	fail := func(ref upspin.Reference, n int, err error) {
+		store.mu.Lock()
+		store.failures, store.failRef, store.failErr = n, ref, err
+		store.mu.Unlock()
+	}
+	unavailable := errors.E(errors.IO, errors.Str("503 Service Unavailable"))
+
+	// A brief failure is not seen by the client.
+	ref := store.add("retried", upspin.Refdata{})
+	before := store.getCount()
+	fail(ref, 2, unavailable)
+	data, _, _, err := c.get(cfg, ref, store.endpoint, nil)
+	if err != nil || string(data) != "retried" {
+		t.Fatalf("Get = %q, %v; want %q", data, err, "retried")
+	}
+	if n := store.getCount() - before; n != 3 {
+		t.Errorf("store Gets = %d, want 3", n)
+	}
+	if n := c.stats().Retries; n != 2 {
+		t.Errorf("Retries = %d, want 2", n)
+	}
+
+	// A permanent error is not retried.
+	before = store.getCount()
+	ref = store.add("refused", upspin.Refdata{})
+	fail(ref, 1, errors.E(errors.Permission, errors.Str("no")))
+	if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); !errors.Match(errors.E(errors.Permission), err) {
+		t.Fatalf("Get refused by store: err = %v, want Permission error", err)
+	}
+	if n := store.getCount() - before; n != 1 {
+		t.Errorf("store Gets of refused block = %d, want 1", n)
+	}
+
+	// A failure that lasts is reported once the retries run out.
+	before = store.getCount()
+	ref = store.add("down", upspin.Refdata{})
+	fail(ref, 100, unavailable)
+	if _, _, _, err := c.originGet(store, ref); !errors.Match(errors.E(errors.IO), err) {
+		t.Fatalf("Get from failing store: err = %v, want IO error", err)
+	}
+	if n := store.getCount() - before; n != 4 {
+		t.Errorf("store Gets from failing store = %d, want 4", n)
+	}
+
+	// The timeout bounds the retries: after a wait of 40-80ms, a second
+	// of 80-160ms would pass the deadline.
+	c.retries, c.retryWait, c.timeout = 5, 80*time.Millisecond, 100*time.Millisecond
+	ref = store.add("deadline", upspin.Refdata{})
+	fail(ref, 100, unavailable)
+	before = store.getCount()
+	start := time.Now()
+	if _, _, _, err := c.originGet(store, ref); !errors.Match(errors.E(errors.IO), err) {
+		t.Fatalf("Get from failing store with timeout: err = %v, want IO error", err)
+	}
+	if n := store.getCount() - before; n != 2 {
+		t.Errorf("store Gets with timeout = %d, want 2", n)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Get with timeout took %v, want at most 100ms", d)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	s, store, dir := newTestServer(t, "negativettl=200ms")
+	defer os.RemoveAll(dir)
+
+	data := []byte("not there yet")
+	ref := upspin.Reference(sha256key.Of(data).String())
+	getMissing := func() {
+		t.Helper()
+		if _, _, _, err := s.Get(ref); !errors.Match(errors.E(errors.NotExist), err) {
+			t.Fatalf("Get of missing reference: err = %v, want NotExist", err)
+		}
+	}
+
+	// The second Get is answered from the negative cache.
+	before := store.getCount()
+	getMissing()
+	getMissing()
+	if n := store.getCount() - before; n != 1 {
+		t.Errorf("store Gets = %d, want 1", n)
+	}
+	if n := s.Stats().NotExist; n != 1 {
+		t.Errorf("NotExist = %d, want 1", n)
+	}
+
+	// Once the TTL passes the store is asked again.
+	time.Sleep(300 * time.Millisecond)
+	getMissing()
+	if n := store.getCount() - before; n != 2 {
+		t.Errorf("store Gets after TTL = %d, want 2", n)
+	}
+
+	// A Put through the cache forgets the error at once.
+	if _, err := s.Put(data); err != nil {
+		t.Fatal(err)
+	}
+	get(t, s, ref, string(data))
+}
+
+func TestStoreLimit(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "storelimit=1", "storewait=50ms")
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	// Hold the only turn at the store with a Get.
+	first := store.add("first in line", upspin.Refdata{})
+	second := store.add("second in line", upspin.Refdata{})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+	before := store.getCount()
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := c.get(cfg, first, store.endpoint, nil)
+		done <- err
+	}()
+	for i := 0; store.getCount() == before; i++ {
+		if i > 500 {
+			t.Fatal("Get did not reach the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The next Get waits and then gives up.
+	_, _, _, err := c.get(cfg, second, store.endpoint, nil)
+	if !errors.Match(errors.E(errors.Transient), err) {
+		t.Errorf("Get over the limit: err = %v, want Transient", err)
+	}
+	if n := c.stats().Throttled; n != 1 {
+		t.Errorf("Throttled = %d, want 1", n)
+	}
+	if n := store.getCount() - before; n != 1 {
+		t.Errorf("store Gets = %d, want 1", n)
+	}
+
+	// Once the first Get is done, the store may be called again.
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatalf("first Get: %v", err)
+	}
+	data, _, _, err := c.get(cfg, second, store.endpoint, nil)
+	if err != nil || string(data) != "second in line" {
+		t.Errorf("Get = %q, %v; want %q", data, err, "second in line")
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(1000)
+	now := b.last
+	if d := b.take(600, now); d != 0 {
+		t.Errorf("take within burst: wait %v, want 0", d)
+	}
+	if d := b.take(600, now); d != 200*time.Millisecond {
+		t.Errorf("take past burst: wait %v, want 200ms", d)
+	}
+	// Half a second pays the debt and refills 300 bytes.
+	now = now.Add(500 * time.Millisecond)
+	if d := b.take(300, now); d != 0 {
+		t.Errorf("take after refill: wait %v, want 0", d)
+	}
+	// The bucket holds no more than a second's worth.
+	now = now.Add(time.Hour)
+	if d := b.take(1500, now); d != 500*time.Millisecond {
+		t.Errorf("take after long idle: wait %v, want 500ms", d)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "bandwidth=10000")
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	// The first two Gets of 6000 bytes run within the burst of 10000,
+	// leaving the bucket 2000 bytes in debt, which the third waits out.
+	ref := store.add(strings.Repeat("b", 6000), upspin.Refdata{})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := c.originGet(store, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("three Gets took %v, want at least 150ms", d)
+	}
+	if d := c.stats().BandwidthWait; d < 150*time.Millisecond {
+		t.Errorf("BandwidthWait = %v, want at least 150ms", d)
+	}
+
+	// A Put pays before it is sent.
+	before := c.stats().BandwidthWait
+	if _, err := c.originPut(store, []byte(strings.Repeat("p", 6000))); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.stats().BandwidthWait - before; d < 400*time.Millisecond {
+		t.Errorf("Put waited %v, want at least 400ms", d)
+	}
+
+	if _, _, err := newCache(cfg, dir, 1e6, true, "storebandwidth=lots"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("storebandwidth=lots: err = %v, want Invalid", err)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	origin, mirror1, mirror2 := newTestStore(), newTestStore(), newTestStore()
+	e := origin.endpoint
+	c, _, dir := newTestCache(t, 1e6, true,
+		"mirror="+e.String()+"@"+mirror1.endpoint.String(),
+		"mirror="+e.String()+"@"+mirror2.endpoint.String())
+	defer os.RemoveAll(dir)
+	defer c.close()
+	fail := func(s *testStore, err error) {
+		s.mu.Lock()
+		s.putErr = err
+		s.mu.Unlock()
+	}
+	unavailable := errors.E(errors.IO, errors.Str("503 Service Unavailable"))
+
+	// By default every store must take the block.
+	refdata, err := c.put(cfg, []byte("mirrored"), e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := refdata.Reference
+	for _, s := range []*testStore{origin, mirror1, mirror2} {
+		if !s.has(ref) {
+			t.Errorf("%s does not have the block", s.Endpoint())
+		}
+	}
+
+	// A Put fails if a mirror fails, unless the quorum allows it.
+	fail(mirror2, unavailable)
+	if _, err := c.put(cfg, []byte("not everywhere"), e, nil); !errors.Match(errors.E(errors.IO), err) {
+		t.Fatalf("Put with failing mirror: err = %v, want IO error", err)
+	}
+	if n := c.stats().MirrorFailures; n != 1 {
+		t.Fatalf("MirrorFailures = %d, want 1", n)
+	}
+	c.mirrorQuorum = 2
+	refdata, err = c.put(cfg, []byte("quorum"), e, nil)
+	if err != nil {
+		t.Fatalf("Put with quorum of 2: %v", err)
+	}
+	if !origin.has(refdata.Reference) || !mirror1.has(refdata.Reference) {
+		t.Errorf("origin or mirror1 does not have the block")
+	}
+	// The Put to mirror2 may still be running.
+	for i := 0; c.stats().MirrorFailures < 2; i++ {
+		if i > 500 {
+			t.Fatal("Put to mirror2 did not fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Deletes reach the mirrors too; one that lacks the block does
+	// not fail the Delete.
+	fail(mirror2, nil)
+	c.mirrorQuorum = 0
+	if err := c.delete(cfg, refdata.Reference, e, nil); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := c.delete(cfg, ref, e, nil); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, s := range []*testStore{origin, mirror1, mirror2} {
+		if s.has(ref) || s.has(refdata.Reference) {
+			t.Errorf("%s still has a deleted block", s.Endpoint())
+		}
+	}
+
+	for _, bad := range []string{"mirror=remote,origin.example.com:443", "mirror=inprocess@inprocess", "mirrorquorum=-1"} {
+		if _, _, err := newCache(cfg, dir, 1e6, true, bad); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("%s: err = %v, want Invalid", bad, err)
+		}
+	}
+}
+
+// recordLogger is a log.Logger that records the lines logged.
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) { l.Print(fmt.Sprintf(format, v...)) }
+func (l *recordLogger) Println(v ...interface{})               { l.Print(fmt.Sprint(v...)) }
+func (l *recordLogger) Fatal(v ...interface{})                 { panic(fmt.Sprint(v...)) }
+func (l *recordLogger) Fatalf(format string, v ...interface{}) { panic(fmt.Sprintf(format, v...)) }
+
+func (l *recordLogger) Print(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+// count returns the number of lines logged that begin with prefix.
+func (l *recordLogger) count(prefix string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogging(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "loglevel=Put:info", "loglevel=Get:info", "logsample=Get:3", "loglevel=Delete:none")
+	defer os.RemoveAll(dir)
+	defer c.close()
+	if c.logging["Put"].logger != log.Info || c.logging["Get"].sample != 3 || c.logging["Delete"].logger != nil {
+		t.Fatalf("logging = %v", c.logging)
+	}
+	if _, ok := c.logging["Flush"]; ok {
+		t.Errorf("Flush has a logging policy but was given none")
+	}
+
+	// Record the lines the options would log at info.
+	rec := new(recordLogger)
+	c.logging["Put"].logger = rec
+	c.logging["Get"].logger = rec
+	s := dial(t, NewServer(cfg, c), store)
+	refdata, err := s.Put([]byte("logged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, _, err := s.Get(refdata.Reference); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The fifth Get is not sampled, but its failure is logged.
+	if _, _, _, err := s.Get("no such reference"); err == nil {
+		t.Fatal("Get of missing reference succeeded")
+	}
+	if err := s.Delete(refdata.Reference); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		prefix string
+		want   int
+	}{
+		{"store/storecache: Put ", 1},
+		{"store/storecache: Get ", 3}, // The first and fourth, and the failure.
+		{"store/storecache: Get \"no such reference\" failed", 1},
+		{"store/storecache: Delete", 0},
+	} {
+		if n := rec.count(c.prefix); n != c.want {
+			t.Errorf("%q logged %d times, want %d:\n%s", c.prefix, n, c.want, strings.Join(rec.lines, "\n"))
+		}
+	}
+
+	for _, bad := range []string{"loglevel=Put", "loglevel=Pet:info", "loglevel=Put:loud", "logsample=Get:0"} {
+		if _, _, err := newCache(cfg, dir, 1e6, true, bad); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("%s: err = %v, want Invalid", bad, err)
+		}
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	store := newTestStore()
+	c, _, dir := newTestCache(t, 1e6, false, "passthrough="+store.endpoint.String())
+	defer os.RemoveAll(dir)
+	s := dial(t, NewServer(cfg, c), store)
+
+	ref := store.add("not cached", upspin.Refdata{})
+	before := store.getCount()
+	get(t, s, ref, "not cached")
+	get(t, s, ref, "not cached")
+	if n := store.getCount() - before; n != 2 {
+		t.Errorf("store Gets = %d, want 2", n)
+	}
+
+	// Even with a writeback cache, a Put goes straight to the store.
+	store.mu.Lock()
+	puts := store.puts
+	store.mu.Unlock()
+	if _, err := s.Put([]byte("passed through")); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	puts = store.puts - puts
+	store.mu.Unlock()
+	if puts != 1 {
+		t.Errorf("store Puts = %d, want 1", puts)
+	}
+
+	st := s.Stats()
+	if st.Entries != 0 || st.Hits != 0 || st.Misses != 0 {
+		t.Errorf("Entries, Hits, Misses = %d, %d, %d; want all 0", st.Entries, st.Hits, st.Misses)
+	}
+
+	if _, _, err := New(cfg, dir, 1e6, true, "passthrough=nowhere"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("bad passthrough endpoint: err = %v, want Invalid", err)
+	}
+}
+
+func TestOriginPin(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(ca, []byte("certificates"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := strings.Repeat("ab", 32)
+	cfg := config.SetValue(config.New(), "tlspins", "dir.example.com:443=sha256:"+key)
+	cfg = config.SetUserName(cfg, "cache@example.com")
+
+	ss, _, err := New(cfg, dir, 1e6, true,
+		"originpin=remote,store.example.com:443@sha256:"+key,
+		"originpin=remote,store.example.com:443@ca:"+ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.(*server).files.close()
+	want := "dir.example.com:443=sha256:" + key + " store.example.com:443=sha256:" + key + " store.example.com:443=ca:" + ca
+	if got := ss.(*server).cfg.Value("tlspins"); got != want {
+		t.Errorf("tlspins = %q, want %q", got, want)
+	}
+
+	for _, v := range []string{
+		"store.example.com:443",
+		"nowhere@sha256:" + key,
+		"inprocess@sha256:" + key,
+		"remote,store.example.com:443@sha256:abc",
+		"remote,store.example.com:443@ca:" + filepath.Join(dir, "missing.pem"),
+		"remote,store.example.com:443@md5:" + key,
+	} {
+		if _, _, err := New(cfg, dir, 1e6, true, "originpin="+v); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("originpin=%s: err = %v, want Invalid", v, err)
+		}
+	}
+}
+
+func TestOriginHealth(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	// A block found and one missing are both answers.
+	ref := store.add("origin health", upspin.Refdata{})
+	if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.get(cfg, "origin health missing", store.endpoint, nil); !errors.Match(errors.E(errors.NotExist), err) {
+		t.Fatalf("Get of missing block: err = %v, want NotExist", err)
+	}
+	seen := c.stats().Origins
+	if len(seen) != 1 || seen[0].Endpoint != store.endpoint || seen[0].Calls != 2 || seen[0].Errors != 0 {
+		t.Fatalf("Origins = %+v, want 2 calls to %s without errors", seen, store.endpoint)
+	}
+
+	// Failures are kept, the last few of them, and the error rate
+	// covers only the recent calls.
+	var o origins
+	first := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "first.example.com:443"}
+	second := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "second.example.com:443"}
+	start := time.Now()
+	failure := errors.E(errors.IO, errors.Str("connection refused"))
+	for i := 0; i < originErrorsKept+2; i++ {
+		o.record(second, "Get", failure, start)
+	}
+	later := start.Add(originWindow)
+	o.record(second, "Put", nil, later)
+	o.record(second, "Put", failure, later)
+	o.record(first, "Get", nil, later)
+	got := o.snapshot(later)
+	if len(got) != 2 || got[0].Endpoint != first || got[1].Endpoint != second {
+		t.Fatalf("snapshot = %+v, want %s then %s", got, first, second)
+	}
+	other := got[1]
+	if other.Calls != originErrorsKept+4 || other.Errors != originErrorsKept+3 {
+		t.Errorf("Calls, Errors = %d, %d; want %d, %d", other.Calls, other.Errors, originErrorsKept+4, originErrorsKept+3)
+	}
+	if other.ErrorRate != 0.5 {
+		t.Errorf("ErrorRate = %v, want 0.5", other.ErrorRate)
+	}
+	if len(other.Recent) != originErrorsKept {
+		t.Fatalf("%d recent errors, want %d", len(other.Recent), originErrorsKept)
+	}
+	if last := other.Recent[originErrorsKept-1]; last.Call != "Put" || !last.Time.Equal(later) || !strings.Contains(last.Error, "connection refused") {
+		t.Errorf("last error = %+v, want the failed Put", last)
+	}
+}
+
+func TestMaxEntryBytes(t *testing.T) {
+	for _, writethrough := range []bool{true, false} {
+		c, store, dir := newTestCache(t, 1e6, writethrough, "maxentrybytes=100")
+		defer os.RemoveAll(dir)
+		defer c.close()
+		if _, _, err := newCache(cfg, dir, 1e6, writethrough, "maxentrybytes=-1"); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("writethrough=%t: negative maxentrybytes: err = %v, want Invalid", writethrough, err)
+		}
+
+		// A block too large to cache is neither cached nor
+		// sent to the store.
+		store.mu.Lock()
+		puts := store.puts
+		store.mu.Unlock()
+		big := strings.Repeat("x", 101)
+		if _, err := c.put(cfg, []byte(big), store.endpoint, nil); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Errorf("writethrough=%t: Put of %d bytes: err = %v, want Invalid", writethrough, len(big), err)
+		}
+		store.mu.Lock()
+		if store.puts != puts {
+			t.Errorf("writethrough=%t: oversize block sent to the store", writethrough)
+		}
+		store.mu.Unlock()
+		if _, err := c.put(cfg, []byte(big[:100]), store.endpoint, nil); err != nil {
+			t.Errorf("writethrough=%t: Put of 100 bytes: %v", writethrough, err)
+		}
+		if err := c.flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// One fetched from the store is returned but not kept.
+		ref := store.add(big+fmt.Sprint(writethrough), upspin.Refdata{})
+		n := store.getCount()
+		for i := 0; i < 2; i++ {
+			data, _, _, err := c.get(cfg, ref, store.endpoint, nil)
+			if err != nil || !strings.HasPrefix(string(data), big) {
+				t.Fatalf("writethrough=%t: Get = %.20q, %v", writethrough, data, err)
+			}
+		}
+		if got := store.getCount() - n; got != 2 {
+			t.Errorf("writethrough=%t: store Gets = %d, want 2", writethrough, got)
+		}
+		if st := c.stats(); st.Oversize != 3 || st.Entries != 1 {
+			t.Errorf("writethrough=%t: Oversize, Entries = %d, %d; want 3, 1", writethrough, st.Oversize, st.Entries)
+		}
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	c, store, dir := newTestCache(t, 10000, false)
+	defer os.RemoveAll(dir)
+	defer c.close()
+	block := func(i int) []byte {
+		data := make([]byte, 1000)
+		data[0], data[1] = 'd', byte(i)
+		return data
+	}
+	for i := 0; i < 9; i++ {
+		if _, err := c.put(cfg, block(i), store.endpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	full := &os.PathError{Op: "write", Path: dir, Err: syscall.ENOSPC}
+
+	// The first failure to write evicts a tenth of the limit.
+	c.saved(full)
+	c.makeRoom()
+	if st := c.stats(); st.Bytes != 8000 || st.Degraded {
+		t.Fatalf("after a write failed: Bytes, Degraded = %d, %t; want 8000, false", st.Bytes, st.Degraded)
+	}
+
+	// Another soon after degrades the cache, which passes Puts through
+	// to the store and Gets from it without caching the blocks.
+	c.saved(full)
+	c.makeRoom()
+	if !c.stats().Degraded {
+		t.Fatal("not degraded after a second failure")
+	}
+	store.mu.Lock()
+	puts := store.puts
+	store.mu.Unlock()
+	refdata, err := c.put(cfg, block(9), store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	if store.puts != puts+1 {
+		t.Errorf("store Puts = %d, want %d", store.puts-puts, 1)
+	}
+	store.mu.Unlock()
+	ref := store.add("disk full", upspin.Refdata{})
+	if data, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil || string(data) != "disk full" {
+		t.Fatalf("Get = %q, %v", data, err)
+	}
+	for _, r := range []upspin.Reference{refdata.Reference, ref} {
+		if c.holds(c.cachePath(r, store.endpoint)) {
+			t.Errorf("%s cached while degraded", r)
+		}
+	}
+	if st := c.stats(); st.Entries != 8 || st.DiskFull != 4 {
+		t.Errorf("Entries, DiskFull = %d, %d; want 8, 4", st.Entries, st.DiskFull)
+	}
+
+	// Once a block can be cached again, so are the rest.
+	c.disk.Lock()
+	c.disk.tried = time.Now().Add(-diskFullRetry)
+	c.disk.Unlock()
+	if _, err := c.put(cfg, block(10), store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.stats(); st.Entries != 10 || st.Degraded {
+		t.Errorf("after recovery: Entries, Degraded = %d, %t; want 10, false", st.Entries, st.Degraded)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "compress=true")
+	defer os.RemoveAll(dir)
+	defer c.close()
+
+	text := strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+	random := make([]byte, 4400)
+	rand.Read(random)
+	magic := compressMagic + "but not compressed"
+	for _, data := range []string{text, string(random), magic} {
+		ref := store.add(data, upspin.Refdata{})
+		get := func() {
+			got, _, _, err := c.get(cfg, ref, store.endpoint, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Fatalf("got %.20q, want %.20q", got, data)
+			}
+		}
+		get() // From the store.
+		get() // From the cache.
+	}
+
+	// Only the text compresses, so the cache holds less than the
+	// blocks' total size but more than the random block alone.
+	bytes, _ := c.usage()
+	total := int64(len(text) + len(random) + len(magic))
+	if bytes >= total || bytes < int64(len(random)) {
+		t.Errorf("cache holds %d bytes for %d bytes of blocks", bytes, total)
+	}
+	if st := c.stats(); st.Hits != 3 {
+		t.Errorf("Hits = %d, want 3", st.Hits)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	if !linksCounted {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		if _, _, err := newCache(cfg, dir, 1e6, true, "dedup=true"); !errors.Match(errors.E(errors.Invalid), err) {
+			t.Fatalf("dedup=true: err = %v, want Invalid", err)
+		}
+		return
+	}
+	c, store, dir := newTestCache(t, 1e6, false, "dedup=true")
+	defer os.RemoveAll(dir)
+	defer c.close()
+	other := store.alias()
+
+	// A block Put through one store and fetched through another is
+	// kept on disk once.
+	refdata, err := c.put(cfg, []byte("shared block"), store.endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	ref := refdata.Reference
+	if data, _, _, err := c.get(cfg, ref, other, nil); err != nil || string(data) != "shared block" {
+		t.Fatalf("Get from other store = %q, %v", data, err)
+	}
+	var infos []os.FileInfo
+	for _, file := range []string{c.cachePath(ref, store.endpoint), c.cachePath(ref, other), c.sharedPath(string(ref))} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+	if !os.SameFile(infos[0], infos[1]) || !os.SameFile(infos[0], infos[2]) {
+		t.Error("cache files for the two stores are not the same file")
+	}
+	if st := c.stats(); st.Linked != 1 || st.Entries != 2 {
+		t.Errorf("Linked, Entries = %d, %d; want 1, 2", st.Linked, st.Entries)
+	}
+
+	// The shared copy goes with the last store's file.
+	for i, e := range []upspin.Endpoint{store.endpoint, other} {
+		if !c.drop(c.cachePath(ref, e)) {
+			t.Fatalf("%s: not dropped", e)
+		}
+		_, err := os.Stat(c.sharedPath(string(ref)))
+		if kept := err == nil; kept != (i == 0) {
+			t.Errorf("after dropping %s: shared copy kept = %t, want %t", e, kept, i == 0)
+		}
+	}
+
+	// Blocks are shared by their contents, not their references: two
+	// references to the same bytes, neither of them their hash, are
+	// kept on disk once.
+	var files []string
+	for _, ref := range []upspin.Reference{"notahash", "northeother"} {
+		file := c.cachePath(ref, store.endpoint)
+		cr := &cachedRef{c: c}
+		cr.Lock()
+		err = cr.saveToCacheFile(file, []byte("shared block"), nil)
+		cr.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	if _, err := os.Stat(c.sharedPath("notahash")); !os.IsNotExist(err) {
+		t.Errorf("block shared under its reference: %v", err)
+	}
+	infos = infos[:0]
+	for _, file := range append(files, c.sharedPath(string(ref))) {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+	if !os.SameFile(infos[0], infos[1]) || !os.SameFile(infos[0], infos[2]) {
+		t.Error("cache files for the two references are not the same file")
+	}
+
+	// Compaction removes the shared copy once neither file is left.
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(c.sharedPath(string(ref))); err != nil {
+		t.Fatalf("shared copy removed before compaction: %v", err)
+	}
+	c.compact()
+	if _, err := os.Stat(c.sharedPath(string(ref))); !os.IsNotExist(err) {
+		t.Errorf("shared copy kept after compaction: %v", err)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	// Room for two 1000 byte blocks.
+	c, store, dir := newTestCache(t, 2500, true, "admission=true")
+	defer os.RemoveAll(dir)
+	defer c.close()
+	if _, _, err := newCache(cfg, dir, 1e6, true, "admission=maybe"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("admission=maybe: err = %v, want Invalid", err)
+	}
+
+	var refs []upspin.Reference
+	for _, name := range []string{"a", "b", "c"} {
+		refs = append(refs, store.add("admission "+name+strings.Repeat(".", 990), upspin.Refdata{}))
+	}
+	cached := func(i int) bool {
+		_, err := os.Stat(c.cachePath(refs[i], store.endpoint))
+		return err == nil
+	}
+	getRef := func(i int) {
+		if _, _, _, err := c.get(cfg, refs[i], store.endpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// While there is room, blocks are cached when first read.
+	getRef(0)
+	getRef(1)
+	getRef(0)
+	if !cached(0) || !cached(1) {
+		t.Fatal("blocks not cached while there was room")
+	}
+
+	// A block read once is not cached in place of one read as often.
+	getRef(2)
+	if cached(2) || !cached(1) {
+		t.Errorf("after one read: block c cached = %t, block b cached = %t; want false, true", cached(2), cached(1))
+	}
+	if got := c.stats().Rejected; got != 1 {
+		t.Errorf("Rejected = %d, want 1", got)
+	}
+
+	// Read again, it displaces the least recently used block.
+	getRef(2)
+	if !cached(2) || cached(1) || !cached(0) {
+		t.Errorf("after two reads: blocks a, b, c cached = %t, %t, %t; want true, false, true", cached(0), cached(1), cached(2))
+	}
+	if got := c.stats().Rejected; got != 1 {
+		t.Errorf("Rejected = %d, want 1", got)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	text := strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+	random := make([]byte, 4400)
+	rand.Read(random)
+	ranges := []struct {
+		offset, length int64
+		ok             bool
+	}{
+		{0, 0, true},
+		{10, 20, true},
+		{4390, 100, true}, // Cut short by the end of the block.
+		{4400, 0, true},
+		{0, -1, false},
+		{-1, 10, false},
+		{1 << 20, 0, false},
+	}
+	for _, opt := range []string{"compress=false", "compress=true"} {
+		s, store, dir := newTestServer(t, opt)
+		defer os.RemoveAll(dir)
+		c := s.files
+		defer c.close()
+
+		for _, data := range []string{text[:4400], string(random)} {
+			ref := store.add(data, upspin.Refdata{})
+			n := store.getCount()
+			for _, r := range ranges {
+				got, _, _, err := s.GetRange(ref, r.offset, r.length)
+				if !r.ok {
+					if !errors.Match(errors.E(errors.Invalid), err) {
+						t.Errorf("%s: GetRange(%d, %d): err = %v, want Invalid", opt, r.offset, r.length, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: GetRange(%d, %d): %v", opt, r.offset, r.length, err)
+				}
+				want := data[r.offset:]
+				if r.length > 0 && r.length < int64(len(want)) {
+					want = want[:r.length]
+				}
+				if string(got) != want {
+					t.Errorf("%s: GetRange(%d, %d) = %.20q, want %.20q", opt, r.offset, r.length, got, want)
+				}
+			}
+			// Only the first range was fetched from the store.
+			if got := store.getCount() - n; got != 1 {
+				t.Errorf("%s: store Gets = %d, want 1", opt, got)
+			}
+		}
+		// The later ranges were read from the cache files.
+		if st := c.stats(); st.Hits != 6 {
+			t.Errorf("%s: Hits = %d, want 6", opt, st.Hits)
+		}
+	}
+
+	// Other caches cut the range from the whole block.
+	s, store := newMemoryServer(t)
+	ref := store.add(text, upspin.Refdata{})
+	got, _, _, err := s.GetRange(ref, 44, 44)
+	if err != nil || string(got) != text[44:88] {
+		t.Errorf("memory: GetRange = %q, %v; want %q", got, err, text[44:88])
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, store := newMemoryServer(t)
+
+	// Hold a Get in flight at the store.
+	ref := store.add("in flight", upspin.Refdata{})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+	before := store.getCount()
+	got := make(chan error, 1)
+	go func() {
+		data, _, _, err := s.Get(ref)
+		if err == nil && string(data) != "in flight" {
+			err = fmt.Errorf("got %q", data)
+		}
+		got <- err
+	}()
+	for i := 0; store.getCount() == before; i++ {
+		if i > 500 {
+			t.Fatal("Get did not reach the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	// New requests are refused once Shutdown has begun.
+	for i := 0; ; i++ {
+		_, err := s.Put([]byte("too late"))
+		if errors.Match(errors.E(errors.Transient), err) {
+			break
+		}
+		if i > 500 {
+			t.Fatalf("Put during Shutdown: err = %v, want Transient", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a Get in flight", err)
+	default:
+	}
+
+	// The Get in flight completes, and then so does Shutdown.
+	close(gate)
+	if err := <-got; err != nil {
+		t.Errorf("Get in flight: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownExpired(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	ref := store.add("never returned", upspin.Refdata{})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+	defer close(gate)
+	before := store.getCount()
+	go s.Get(ref)
+	for i := 0; store.getCount() == before; i++ {
+		if i > 500 {
+			t.Fatal("Get did not reach the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdownWarm(t *testing.T) {
+	s, store, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	// Hold Warm at the store on the first of its blocks.
+	first := store.add("first", upspin.Refdata{})
+	second := store.add("second", upspin.Refdata{})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+	before := store.getCount()
+	warmed := make(chan []error, 1)
+	go func() { warmed <- s.Warm([]upspin.Reference{first, second}, store.endpoint) }()
+	for i := 0; store.getCount() == before; i++ {
+		if i > 500 {
+			t.Fatal("Warm did not reach the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	for i := 0; s.Ready() == nil; i++ {
+		if i > 500 {
+			t.Fatal("Shutdown did not begin")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Administrative calls are refused once Shutdown has begun.
+	if errs := s.Warm([]upspin.Reference{second}, store.endpoint); errs[0] != errShutdown {
+		t.Errorf("Warm during Shutdown: err = %v, want %v", errs[0], errShutdown)
+	}
+	if err := s.Pin(second, store.endpoint); err != errShutdown {
+		t.Errorf("Pin during Shutdown: err = %v, want %v", err, errShutdown)
+	}
+	if _, err := s.Compact(); err != errShutdown {
+		t.Errorf("Compact during Shutdown: err = %v, want %v", err, errShutdown)
+	}
+	if _, _, err := s.List("", 0); err != errShutdown {
+		t.Errorf("List during Shutdown: err = %v, want %v", err, errShutdown)
+	}
+	if _, err := s.PingOrigin(upspin.Endpoint{}); err != errShutdown {
+		t.Errorf("PingOrigin during Shutdown: err = %v, want %v", err, errShutdown)
+	}
+	if s.Invalidate(first, store.endpoint) {
+		t.Error("Invalidate during Shutdown dropped a block")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with Warm in flight", err)
+	default:
+	}
+
+	// The Warm in flight caches the block it is fetching, abandons the
+	// rest, and then Shutdown completes.
+	close(gate)
+	errs := <-warmed
+	if errs[0] != nil || errs[1] != errShutdown {
+		t.Errorf("Warm in flight: errs = %v, want [<nil> %v]", errs, errShutdown)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if n := store.getCount() - before; n != 1 {
+		t.Errorf("store Gets = %d, want 1", n)
+	}
+}
+
+// closeCheckCache is a Cache that records whether it was closed while
+// a Get was in progress or before it was flushed.
+type closeCheckCache struct {
+	Cache
+
+	mu       sync.Mutex
+	gets     int // Gets in progress.
+	flushed  bool
+	closed   bool
+	badClose bool
+}
+
+func (c *closeCheckCache) Get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	c.mu.Lock()
+	c.gets++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.gets--
+		c.mu.Unlock()
+	}()
+	return c.Cache.Get(cfg, ref, e, sp)
+}
+
+func (c *closeCheckCache) Flush() error {
+	err := c.Cache.Flush()
+	c.mu.Lock()
+	c.flushed = true
+	c.mu.Unlock()
+	return err
+}
+
+func (c *closeCheckCache) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.badClose = c.gets > 0 || !c.flushed
+	c.mu.Unlock()
+	c.Cache.Close()
+}
+
+func (c *closeCheckCache) state() (closed, badClose bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed, c.badClose
+}
+
+func TestShutdownSlowOrigin(t *testing.T) {
+	cache := &closeCheckCache{Cache: NewMemory(1e6)}
+	store := newTestStore()
+	s := dial(t, NewServer(cfg, cache), store)
+
+	// Hold a Get at the store past the deadline given to Shutdown.
+	ref := store.add("slow origin", upspin.Refdata{})
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+	before := store.getCount()
+	got := make(chan error, 1)
+	go func() {
+		data, _, _, err := s.Get(ref)
+		if err == nil && string(data) != "slow origin" {
+			err = fmt.Errorf("got %q", data)
+		}
+		got <- err
+	}()
+	for i := 0; store.getCount() == before; i++ {
+		if i > 500 {
+			t.Fatal("Get did not reach the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if closed, _ := cache.state(); closed {
+		t.Fatal("cache closed by Shutdown with a Get in flight")
+	}
+
+	// Once the store answers, the Get completes, and only then is the
+	// cache flushed and closed.
+	close(gate)
+	if err := <-got; err != nil {
+		t.Errorf("Get in flight: %v", err)
+	}
+	for i := 0; ; i++ {
+		closed, badClose := cache.state()
+		if closed {
+			if badClose {
+				t.Error("cache closed with a Get in flight or before it was flushed")
+			}
+			break
+		}
+		if i > 500 {
+			t.Fatal("cache not closed after the Get completed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func BenchmarkGetHit(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			c, store, dir := newTestCache(b, 1e8, true, fmt.Sprintf("compress=%t", compress))
+			defer os.RemoveAll(dir)
+			defer c.close()
+			data := strings.Repeat("All work and no play makes Jack a dull boy.\n", 1500)
+			ref := store.add(data, upspin.Refdata{})
+			if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDedup caches the Go source of this repository as blocks, each
+// once for each of two stores under its hash and once more under another
+// reference, as a second copy of the tree stored otherwise would be, and
+// reports the disk the cache uses with and without dedup.
+func BenchmarkDedup(b *testing.B) {
+	if !linksCounted {
+		b.Skip("link counts not available")
+	}
+	var blocks [][]byte
+	filepath.Walk("../..", func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(name, ".go") {
+			if data, err := ioutil.ReadFile(name); err == nil {
+				blocks = append(blocks, data)
+			}
+		}
+		return nil
+	})
+	for _, dedup := range []bool{false, true} {
+		b.Run(fmt.Sprintf("dedup=%t", dedup), func(b *testing.B) {
+			var logical, disk float64
+			for i := 0; i < b.N; i++ {
+				c, store, dir := newTestCache(b, 1e9, false, fmt.Sprintf("dedup=%t", dedup))
+				other := store.alias()
+				for j, data := range blocks {
+					ref := upspin.Reference(sha256key.Of(data).String())
+					files := []string{
+						c.cachePath(ref, store.endpoint),
+						c.cachePath(ref, other),
+						c.cachePath(upspin.Reference(fmt.Sprintf("copy%d", j)), store.endpoint),
+					}
+					for _, file := range files {
+						cr := &cachedRef{c: c}
+						cr.Lock()
+						err := cr.saveToCacheFile(file, data, nil)
+						cr.Unlock()
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.StopTimer()
+				logical, disk = 0, 0
+				filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+					if err != nil || info.IsDir() || path.Base(name) == "index" {
+						return nil
+					}
+					n, _ := linkCount(info)
+					disk += float64(info.Size()) / float64(n)
+					if !strings.HasPrefix(name, path.Join(dir, sharedDir)) {
+						logical += float64(info.Size())
+					}
+					return nil
+				})
+				c.close()
+				os.RemoveAll(dir)
+				b.StartTimer()
+			}
+			b.ReportMetric(logical/1e6, "cached-MB")
+			b.ReportMetric(disk/1e6, "disk-MB")
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	store := newTestStore()
+	s := dial(t, NewServer(cfg, NewMemory(100)), store)
+
+	// A Get goes to the store only the first time.
+	ref := store.add("in memory", upspin.Refdata{})
+	n := store.getCount()
+	get(t, s, ref, "in memory")
+	get(t, s, ref, "in memory")
+	if got := store.getCount() - n; got != 1 {
+		t.Errorf("store Get called %d times, want 1", got)
+	}
+
+	// Volatile data is not kept.
+	volatile := store.add("volatile in memory", upspin.Refdata{Volatile: true})
+	n = store.getCount()
+	get(t, s, volatile, "volatile in memory")
+	get(t, s, volatile, "volatile in memory")
+	if got := store.getCount() - n; got != 2 {
+		t.Errorf("store Get of volatile data called %d times, want 2", got)
+	}
+
+	// A Put is written through and kept.
+	refdata, err := s.Put([]byte("put in memory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = store.getCount()
+	get(t, s, refdata.Reference, "put in memory")
+	if store.getCount() != n {
+		t.Errorf("Get after Put went to the store")
+	}
+	if st := s.Stats(); st.Entries != 2 || st.Bytes != 22 || st.Get.Count != 5 || st.Put.Count != 1 {
+		t.Errorf("Entries, Bytes, Gets, Puts = %d, %d, %d, %d; want 2, 22, 5, 1", st.Entries, st.Bytes, st.Get.Count, st.Put.Count)
+	}
+
+	// Deleted blocks are gone from the cache as well as the store.
+	if err := s.Delete(refdata.Reference); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Get(refdata.Reference); !errors.Match(errors.E(errors.NotExist), err) {
+		t.Errorf("Get after Delete: err = %v, want NotExist", err)
+	}
+
+	// The least recently used blocks make room for new ones.
+	for i := 0; i < 10; i++ {
+		if _, err := s.Put(bytes.Repeat([]byte{byte(i)}, 30)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.Stats(); st.Entries != 3 || st.Bytes != 90 {
+		t.Errorf("after eviction Entries, Bytes = %d, %d; want 3, 90", st.Entries, st.Bytes)
+	}
+
+	if errs := s.Warm([]upspin.Reference{ref}, store.endpoint); errs[0] != upspin.ErrNotSupported {
+		t.Errorf("Warm: %v, want ErrNotSupported", errs[0])
+	}
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	for _, policy := range []string{"always", "interval", "never"} {
+		for _, writethrough := range []bool{true, false} {
+			c, store, dir := newTestCache(t, 1e6, writethrough, "fsync="+policy, "fsyncinterval=10ms")
+			defer os.RemoveAll(dir)
+			data := []byte(policy + fmt.Sprint(writethrough))
+			refdata, err := c.put(cfg, data, store.endpoint, nil)
+			if err != nil {
+				t.Fatalf("fsync=%s, writethrough=%t: Put: %v", policy, writethrough, err)
+			}
+			if c.syncer != nil {
+				// Wait for the batch holding the block.
+				for i := 0; ; i++ {
+					c.syncer.mu.Lock()
+					n := len(c.syncer.pending)
+					c.syncer.mu.Unlock()
+					if n == 0 {
+						break
+					}
+					if i == 100 {
+						t.Fatalf("fsync=%s, writethrough=%t: %d names never synced", policy, writethrough, n)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			got, _, _, err := c.get(cfg, refdata.Reference, store.endpoint, nil)
+			if err != nil || string(got) != string(data) {
+				t.Errorf("fsync=%s, writethrough=%t: Get = %q, %v; want %q", policy, writethrough, got, err, data)
+			}
+			if err := c.flush(); err != nil {
+				t.Fatal(err)
+			}
+			c.close()
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	defer c.close()
+	for _, cache := range []Cache{c, NewMemory(1e6)} {
+		s := dial(t, NewServer(cfg, cache), store)
+		ref := store.add(fmt.Sprintf("invalidate %T", cache), upspin.Refdata{})
+		if _, _, _, err := s.Get(ref); err != nil {
+			t.Fatal(err)
+		}
+
+		// Once dropped, the block is fetched again from the store.
+		if !s.Invalidate(ref, store.endpoint) {
+			t.Errorf("%T: Invalidate of a cached block reported false", cache)
+		}
+		if s.Invalidate(ref, store.endpoint) {
+			t.Errorf("%T: Invalidate of a dropped block reported true", cache)
+		}
+		n := store.getCount()
+		if _, _, _, err := s.Get(ref); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.getCount() - n; got != 1 {
+			t.Errorf("%T: store Gets after Invalidate = %d, want 1", cache, got)
+		}
+		st := s.Stats()
+		if st.Invalidations != 1 || st.Entries != 1 {
+			t.Errorf("%T: Invalidations, Entries = %d, %d; want 1, 1", cache, st.Invalidations, st.Entries)
+		}
+	}
+}
+
+func TestHints(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true)
+	defer os.RemoveAll(dir)
+	defer c.close()
+	for _, cache := range []Cache{c, NewMemory(1e6)} {
+		s := dial(t, NewServer(cfg, cache), store)
+		data := fmt.Sprintf("hints %T", cache)
+		ref := store.add(data, upspin.Refdata{})
+		gets := func(f func() error) int {
+			n := store.getCount()
+			if err := f(); err != nil {
+				t.Fatal(err)
+			}
+			return store.getCount() - n
+		}
+
+		// A block got with no-store is fetched each time and not cached.
+		for i := 0; i < 2; i++ {
+			if got := gets(func() error {
+				got, _, _, err := s.GetHinted(ref, true, false)
+				if err == nil && string(got) != data {
+					t.Errorf("%T: GetHinted = %q, want %q", cache, got, data)
+				}
+				return err
+			}); got != 1 {
+				t.Errorf("%T: store Gets for no-store GetHinted = %d, want 1", cache, got)
+			}
+		}
+		if st := s.Stats(); st.Entries != 0 || st.NoStore != 2 {
+			t.Errorf("%T: Entries, NoStore = %d, %d; want 0, 2", cache, st.Entries, st.NoStore)
+		}
+
+		// A block cached by Get is fetched again with refresh, and
+		// cached again.
+		if _, _, _, err := s.Get(ref); err != nil {
+			t.Fatal(err)
+		}
+		if got := gets(func() error {
+			_, _, _, err := s.GetHinted(ref, false, true)
+			return err
+		}); got != 1 {
+			t.Errorf("%T: store Gets for refresh GetHinted = %d, want 1", cache, got)
+		}
+		if got := gets(func() error {
+			_, _, _, err := s.Get(ref)
+			return err
+		}); got != 0 {
+			t.Errorf("%T: store Gets after refresh = %d, want 0", cache, got)
+		}
+		if st := s.Stats(); st.Entries != 1 || st.Refreshes != 1 {
+			t.Errorf("%T: Entries, Refreshes = %d, %d; want 1, 1", cache, st.Entries, st.Refreshes)
+		}
+
+		// A block put with no-store goes to the store and is not cached.
+		refdata, err := s.PutHinted([]byte(data+" put"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := store.Get(refdata.Reference); err != nil {
+			t.Errorf("%T: block put with no-store: %v", cache, err)
+		}
+		if st := s.Stats(); st.Entries != 1 || st.NoStore != 3 {
+			t.Errorf("%T: Entries, NoStore = %d, %d; want 1, 3", cache, st.Entries, st.NoStore)
+		}
+	}
+}
+
+func TestPutFrom(t *testing.T) {
+	big := make([]byte, 1<<20)
+	rand.Read(big)
+	blocks := [][]byte{
+		big,
+		[]byte(strings.Repeat("compressible ", 1000)),
+		[]byte(compressMagic + "looks compressed"),
+		nil,
+	}
+	for _, opts := range [][]string{{"compress=false"}, {"compress=true"}} {
+		for _, writethrough := range []bool{false, true} {
+			c, store, dir := newTestCache(t, 10e6, writethrough, append(opts, "maxentrybytes=2000000")...)
+			defer os.RemoveAll(dir)
+			s := dial(t, NewServer(cfg, c), store)
+			for _, data := range blocks {
+				refdata, err := s.PutFrom(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("%v, writethrough=%t: PutFrom of %d bytes: %v", opts, writethrough, len(data), err)
+				}
+				if want := upspin.Reference(sha256key.Of(data).String()); refdata.Reference != want {
+					t.Errorf("%v, writethrough=%t: reference %s, want %s", opts, writethrough, refdata.Reference, want)
+				}
+				got, _, _, err := s.Get(refdata.Reference)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("%v, writethrough=%t: Get = %.20q, %v; want %.20q", opts, writethrough, got, err, data)
+				}
+			}
+			if _, err := s.PutFrom(io.MultiReader(bytes.NewReader(big), bytes.NewReader(big))); !errors.Match(errors.E(errors.Invalid), err) {
+				t.Errorf("%v, writethrough=%t: PutFrom of an oversize block: err = %v, want Invalid", opts, writethrough, err)
+			}
+			if err := c.flush(); err != nil {
+				t.Fatal(err)
+			}
+			store.mu.Lock()
+			for _, data := range blocks {
+				if got := store.blob[upspin.Reference(sha256key.Of(data).String())]; !bytes.Equal(got, data) {
+					t.Errorf("%v, writethrough=%t: store holds %.20q, want %.20q", opts, writethrough, got, data)
+				}
+			}
+			store.mu.Unlock()
+			if st := c.stats(); st.Entries != int64(len(blocks)) || st.Oversize != 1 {
+				t.Errorf("%v, writethrough=%t: Entries, Oversize = %d, %d; want %d, 1", opts, writethrough, st.Entries, st.Oversize, len(blocks))
+			}
+			c.close()
+
+			// Nothing is left behind in the directory.
+			leftovers, _ := filepath.Glob(filepath.Join(dir, "storecache", "*.tmp"))
+			if len(leftovers) > 0 {
+				t.Errorf("%v, writethrough=%t: left %q", opts, writethrough, leftovers)
+			}
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s, _, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	if err := s.Health(); err != nil {
+		t.Errorf("Health: %v", err)
+	}
+	if err := s.Ready(); err != nil {
+		t.Errorf("Ready: %v", err)
+	}
+
+	// A cache that cannot write its directory is neither.
+	cacheDir := filepath.Join(dir, "storecache")
+	if err := os.Rename(cacheDir, cacheDir+".away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Health(); !errors.Match(errors.E(errors.IO), err) {
+		t.Errorf("Health without a directory: err = %v, want IO", err)
+	}
+	if err := s.Ready(); !errors.Match(errors.E(errors.IO), err) {
+		t.Errorf("Ready without a directory: err = %v, want IO", err)
+	}
+	if err := os.Rename(cacheDir+".away", cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Health(); err != nil {
+		t.Errorf("Health with the directory back: %v", err)
+	}
+
+	// One shutting down is healthy but not ready.
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Health(); err != nil {
+		t.Errorf("Health after Shutdown: %v", err)
+	}
+	if err := s.Ready(); !errors.Match(errors.E(errors.Transient), err) {
+		t.Errorf("Ready after Shutdown: err = %v, want Transient", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(cacheDir, "*.tmp")); len(leftovers) > 0 {
+		t.Errorf("left %q", leftovers)
+	}
+}
+
+func TestIsAccessControl(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		want bool
+	}{
+		{"Read, List: ann@example.com\nWrite: bob@example.com # Bob.\n", true},
+		{"*: all\n", true},
+		{"ann@example.com, friends\n", true},
+		{"# Only a comment.\n", false},
+		{"hello world\n", false},
+		{"key: value\n", false},
+		{"friends\nfamily\n", false},
+		{"\xff\xfe: ann@example.com\n", false},
+		{"", false},
+	} {
+		if got := isAccessControl([]byte(test.data)); got != test.want {
+			t.Errorf("isAccessControl(%q) = %t, want %t", test.data, got, test.want)
+		}
+	}
+}
+
+func TestAccessTTL(t *testing.T) {
+	s, store, dir := newTestServer(t, "accessttl=50ms")
+	defer os.RemoveAll(dir)
+	if _, _, err := New(cfg, dir, 1e6, true, "accessttl=-1s"); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("negative accessttl: err = %v, want Invalid", err)
+	}
+
+	const accessFile = "read: ann@example.com\n"
+	control := store.add(accessFile, upspin.Refdata{})
+	data := store.add("not an Access file", upspin.Refdata{})
+	refdata := get(t, s, control, accessFile)
+	if refdata.Duration != 50*time.Millisecond {
+		t.Errorf("Access file Duration = %v, want 50ms", refdata.Duration)
+	}
+	if refdata := get(t, s, data, "not an Access file"); refdata.Duration != 0 {
+		t.Errorf("data Duration = %v, want 0", refdata.Duration)
+	}
+	n := store.getCount()
+
+	// Within the limit both come from the cache; after it, only the
+	// data does.
+	get(t, s, control, accessFile)
+	get(t, s, data, "not an Access file")
+	if got := store.getCount(); got != n {
+		t.Errorf("store Get called %d times within accessttl, want none", got-n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	get(t, s, control, accessFile)
+	get(t, s, data, "not an Access file")
+	if got := store.getCount(); got != n+1 {
+		t.Errorf("store Get called %d times after accessttl, want 1", got-n)
+	}
+	if got := s.Stats().AccessControl; got != 2 {
+		t.Errorf("AccessControl = %d, want 2", got)
+	}
+}
+
+func TestPingOrigin(t *testing.T) {
+	s, store, dir := newTestServer(t, "timeout=100ms")
+	defer os.RemoveAll(dir)
+	undialed := NewServer(cfg, s.files).(*server)
+
+	// An undialed server has no store to ping unless it is named.
+	if _, err := undialed.PingOrigin(upspin.Endpoint{}); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("PingOrigin undialed: err = %v, want Invalid", err)
+	}
+
+	// The round trip includes the time the store takes to answer.
+	store.mu.Lock()
+	store.pingDelay = 20 * time.Millisecond
+	store.mu.Unlock()
+	rtt, err := s.PingOrigin(upspin.Endpoint{})
+	if err != nil || rtt < 20*time.Millisecond {
+		t.Errorf("PingOrigin = %v, %v; want at least 20ms", rtt, err)
+	}
+	store.mu.Lock()
+	store.pingDelay = 0
+	store.mu.Unlock()
+
+	// A store that does not answer, or not within the timeout, fails.
+	store.mu.Lock()
+	store.down = true
+	store.mu.Unlock()
+	if _, err := undialed.PingOrigin(store.endpoint); !errors.Match(errors.E(errors.IO), err) {
+		t.Errorf("PingOrigin of store that is down: err = %v, want IO", err)
+	}
+	gate := make(chan struct{})
+	defer close(gate)
+	store.mu.Lock()
+	store.down = false
+	store.pingGate = gate
+	store.mu.Unlock()
+	if _, err := undialed.PingOrigin(store.endpoint); !errors.Match(errors.E(errors.IO), err) || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("PingOrigin of slow store: err = %v, want IO timeout", err)
+	}
+}
+
+func TestPin(t *testing.T) {
+	c, store, dir := newTestCache(t, 3500, true)
+	defer os.RemoveAll(dir)
+	var refs []upspin.Reference
+	for i := 0; i < 5; i++ {
+		refs = append(refs, store.add(fmt.Sprintf("pin %03d %0990d", i, 0), upspin.Refdata{}))
+	}
+	if err := dial(t, NewServer(cfg, c), store).Pin(refs[0], store.endpoint); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("Pin without pinbytes: err = %v, want Invalid", err)
+	}
+
+	// Room for three unpinned 998 byte blocks and one pinned one.
+	c, _, dir = newTestCache(t, 3500, true, "pinbytes=1500")
+	defer os.RemoveAll(dir)
+	s := dial(t, NewServer(cfg, c), store)
+	if err := s.Pin(refs[0], store.endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pin(refs[1], store.endpoint); !errors.Match(errors.E(errors.Invalid), err) {
+		t.Errorf("Pin beyond pinbytes: err = %v, want Invalid", err)
+	}
+	missing := upspin.Reference(sha256key.Of([]byte("not in the store")).String())
+	if err := s.Pin(missing, store.endpoint); !errors.Match(errors.E(errors.NotExist), err) {
+		t.Errorf("Pin of missing block: err = %v, want NotExist", err)
+	}
+
+	// Reading the other blocks, and many small ones to overflow the
+	// LRU, evicts everything but the pinned block.
+	for i := 1; i < len(refs); i++ {
+		get(t, s, refs[i], fmt.Sprintf("pin %03d %0990d", i, 0))
+	}
+	for i := 0; i < 50; i++ {
+		text := fmt.Sprintf("small %d", i)
+		get(t, s, store.add(text, upspin.Refdata{}), text)
+	}
+	n := store.getCount()
+	get(t, s, refs[0], fmt.Sprintf("pin %03d %0990d", 0, 0))
+	if got := store.getCount(); got != n {
+		t.Errorf("Get of pinned block went to the store %d times", got-n)
+	}
+	st := s.Stats()
+	if st.Pinned != 1 || st.PinnedBytes != 998 || st.Bytes > 3500 {
+		t.Errorf("Pinned, PinnedBytes, Bytes = %d, %d, %d; want 1, 998, at most 3500", st.Pinned, st.PinnedBytes, st.Bytes)
+	}
+
+	// Once unpinned it counts against the byte limit again.
+	if !s.Unpin(refs[0], store.endpoint) {
+		t.Error("Unpin of pinned block reported false")
+	}
+	if s.Unpin(refs[0], store.endpoint) {
+		t.Error("second Unpin reported true")
+	}
+	if st := s.Stats(); st.Pinned != 0 || st.PinnedBytes != 0 || st.Bytes > 3500 {
+		t.Errorf("after Unpin Pinned, PinnedBytes, Bytes = %d, %d, %d; want 0, 0, at most 3500", st.Pinned, st.PinnedBytes, st.Bytes)
+	}
+
+	// Invalidate still drops a pinned block.
+	if err := s.Pin(refs[1], store.endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Invalidate(refs[1], store.endpoint) {
+		t.Error("Invalidate of pinned block reported false")
+	}
+	if st := s.Stats(); st.Pinned != 0 || st.PinnedBytes != 0 {
+		t.Errorf("after Invalidate Pinned, PinnedBytes = %d, %d; want 0, 0", st.Pinned, st.PinnedBytes)
+	}
+}
+
+func TestList(t *testing.T) {
+	s, store, dir := newTestServer(t, "pinbytes=1000")
+	defer os.RemoveAll(dir)
+	want := make(map[upspin.Reference]string)
+	for i := 0; i < 10; i++ {
+		text := fmt.Sprintf("list %d", i)
+		ref := store.add(text, upspin.Refdata{})
+		get(t, s, ref, text)
+		want[ref] = text
+	}
+	var pinned upspin.Reference
+	for ref := range want {
+		pinned = ref
+		break
+	}
+	if err := s.Pin(pinned, store.endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages of three list every block once, in order.
+	var entries []Entry
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatal("too many pages")
+		}
+		page, next, err := s.List(cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 3 {
+			t.Fatalf("page of %d entries, want at most 3", len(page))
+		}
+		entries = append(entries, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("listed %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		text, ok := want[e.Location.Reference]
+		if !ok || e.Location.Endpoint != store.endpoint {
+			t.Errorf("entry %d: unexpected location %v", i, e.Location)
+			continue
+		}
+		delete(want, e.Location.Reference)
+		if e.Size != int64(len(text)) || e.LastUsed.IsZero() || e.Pinned != (e.Location.Reference == pinned) {
+			t.Errorf("entry %d = %+v; want size %d, a last use, pinned %t", i, e, len(text), e.Location.Reference == pinned)
+		}
+		if i > 0 && entries[i-1].Location.Reference >= e.Location.Reference {
+			t.Errorf("entry %d out of order", i)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	c, store, dir := newTestCache(t, 1e6, true, "compactinterval=0")
+	defer os.RemoveAll(dir)
+	ref := store.add("compact", upspin.Refdata{Duration: time.Hour})
+	if _, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave files a crash might: a block in no LRU with its expiry
+	// file, and temporary files old and new. A block waiting to be
+	// written back is not an orphan.
+	write := func(name, data string) string {
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	orphan := c.cachePath("orphan", store.endpoint)
+	write(orphan, "orphan")
+	write(orphan+expirySuffix, "x")
+	oldTmp := write(c.cachePath("old", store.endpoint)+".tmp", "old tmp")
+	long := time.Now().Add(-2 * tmpGrace)
+	if err := os.Chtimes(oldTmp, long, long); err != nil {
+		t.Fatal(err)
+	}
+	newTmp := write(c.cachePath("new", store.endpoint)+".tmp", "new tmp")
+	pending := write(c.cachePath("pending", store.endpoint)+writebackSuffix, "pending")
+
+	want := Compaction{Files: 3, Bytes: int64(len("orphan") + len("x") + len("old tmp"))}
+	if got := c.compact(); got != want {
+		t.Errorf("compact = %+v, want %+v", got, want)
+	}
+	for _, name := range []string{orphan, orphan + expirySuffix, oldTmp} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("orphan %s not removed: %v", name, err)
+		}
+	}
+	for _, name := range []string{c.cachePath(ref, store.endpoint), c.cachePath(ref, store.endpoint) + expirySuffix, newTmp, pending} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s removed: %v", name, err)
+		}
+	}
+	if s := c.stats(); s.Orphans != want.Files || s.OrphanBytes != want.Bytes {
+		t.Errorf("Orphans, OrphanBytes = %d, %d; want %d, %d", s.Orphans, s.OrphanBytes, want.Files, want.Bytes)
+	}
+	if got := c.compact(); got != (Compaction{}) {
+		t.Errorf("second compact = %+v, want nothing removed", got)
+	}
+	c.close()
+
+	// A cache started from its index, which does not walk the
+	// directories, compacts them at startup.
+	write(orphan, "orphan")
+	c, _, err := newCache(cfg, dir, 1e6, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	for start := time.Now(); c.stats().Orphans != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("orphan not removed at startup")
+		}
+	}
+	if data, _, _, err := c.get(cfg, ref, store.endpoint, nil); err != nil || string(data) != "compact" {
+		t.Errorf("Get after compaction = %q, %v; want %q", data, err, "compact")
+	}
+
+	// Only a cache made by New can be compacted.
+	if _, err := NewServer(cfg, NewMemory(1e6)).(*server).Compact(); err != upspin.ErrNotSupported {
+		t.Errorf("Compact of memory cache: err = %v, want ErrNotSupported", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Compaction.
+//
+// A crash, or a failure partway through a Put, an eviction, or a move
+// between tiers, can leave files in the cache directories that the cache
+// knows nothing of: temporary files from interrupted writes, expiry files
+// whose blocks have gone, and blocks in neither LRU. The walk of the
+// directories at startup removes them, but a cache started from a
+// complete index does not walk them, and files left by failures while
+// the cache runs are found by neither, so they would hold disk forever
+// without being counted against maxBytes.
+//
+// So the cache compacts its directories, walking those of both tiers and
+// removing each file that is not a block in the LRUs, the expiry file of
+// one, or a block waiting to be written back. A temporary file is removed
+// only once it is older than tmpGrace, since a younger one may be a write
+// in progress. The shared copies of dedup.go are swept as the walk at
+// startup sweeps them, removing those no cache file links to. Whether a
+// block is known is decided, and an orphan removed, with c locked, so
+// that a fetch cannot cache the block meanwhile.
+//
+// A cache started from its index compacts once in the background at
+// startup. Every cache compacts every c.compactInterval, set by the
+// compactinterval=duration option and by default defaultCompactInterval,
+// and whenever Compact is called; an interval of 0 compacts only then.
+// The files removed and the bytes they held are logged and counted in
+// Stats.
+
+const (
+	// defaultCompactInterval is the interval between compactions if
+	// the compactinterval option is not given.
+	defaultCompactInterval = time.Hour
+
+	// tmpGrace is the age beyond which a temporary file is taken to be
+	// left by a crash rather than being written.
+	tmpGrace = time.Hour
+)
+
+// Compaction reports the orphaned files removed from the cache
+// directories by a compaction and the bytes they held.
+type Compaction struct {
+	Files int64
+	Bytes int64
+}
+
+// errCompactStopped aborts the walk of a compaction when the cache is
+// closed.
+var errCompactStopped = errors.Str("cache closed")
+
+// compact removes the orphaned files from the directories of both tiers
+// and reports what it removed.
+// No locks are held on entry or exit.
+func (c *storeCache) compact() Compaction {
+	c.compacting.Lock()
+	defer c.compacting.Unlock()
+	var done Compaction
+	for _, dir := range []string{c.dir, c.coldDir} {
+		if dir == "" {
+			continue
+		}
+		err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			select {
+			case <-c.compactStop:
+				return errCompactStopped
+			default:
+			}
+			if err != nil {
+				// Unreadable directories are cleaned up by walk.
+				return nil
+			}
+			if info.IsDir() {
+				if name == path.Join(c.dir, sharedDir) {
+					c.sweepShared(name)
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if c.removeOrphan(dir, name, info) {
+				done.Files++
+				done.Bytes += info.Size()
+			}
+			return nil
+		})
+		if err == errCompactStopped {
+			break
+		}
+	}
+	atomic.AddInt64(&c.counters.orphans, done.Files)
+	atomic.AddInt64(&c.counters.orphanBytes, done.Bytes)
+	if done.Files > 0 {
+		log.Info.Printf("store/storecache: compaction removed %d orphaned files holding %d bytes", done.Files, done.Bytes)
+	}
+	return done
+}
+
+// removeOrphan removes name, a file found beneath dir, the top directory
+// of a tier, if the cache does not know of it, and reports whether it did.
+// No locks are held on entry or exit.
+func (c *storeCache) removeOrphan(dir, name string, info os.FileInfo) bool {
+	if strings.HasSuffix(name, ".tmp") {
+		return time.Since(info.ModTime()) > tmpGrace && os.Remove(name) == nil
+	}
+	rel := strings.TrimPrefix(name, dir+"/")
+	if !strings.Contains(rel, "/") {
+		// The layout and index files.
+		return false
+	}
+	if strings.HasSuffix(name, writebackSuffix) {
+		return false
+	}
+	// Blocks in either tier are known by their names in the cache
+	// directory.
+	file := strings.TrimSuffix(path.Join(c.dir, rel), expirySuffix)
+	c.Lock()
+	defer c.Unlock()
+	if c.known(file) {
+		return false
+	}
+	if _, err := os.Stat(file + writebackSuffix); err == nil {
+		return false
+	}
+	return os.Remove(name) == nil
+}
+
+// known reports whether the block cached in file is in either LRU or is
+// a pinned block about to be put back in one.
+// This is called with c locked.
+func (c *storeCache) known(file string) bool {
+	if _, ok := c.lru.Peek(file); ok {
+		return true
+	}
+	if c.coldLRU != nil {
+		if _, ok := c.coldLRU.Peek(file); ok {
+			return true
+		}
+	}
+	for _, p := range c.evictedPins {
+		if p.file == file {
+			return true
+		}
+	}
+	return false
+}
+
+// compactLoop compacts the cache every c.compactInterval, if it is
+// positive, and at once if now is set, until c.compactStop is closed.
+func (c *storeCache) compactLoop(now bool) {
+	defer close(c.compactDone)
+	if now {
+		c.compact()
+	}
+	if c.compactInterval <= 0 {
+		<-c.compactStop
+		return
+	}
+	t := time.NewTicker(c.compactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.compact()
+		case <-c.compactStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"upspin.io/errors"
+)
+
+// Compression.
+//
+// If the cache is created with the compress option, blocks are gzipped
+// before being written to the cache directory and unzipped as they are
+// read back. Compressed files begin with compressMagic, which tells
+// them apart from blocks stored as they are, so a cache directory may
+// hold both and the option may be changed from one run to the next.
+// The cache's byte limit and the user quotas apply to the compressed
+// size, that is, to the disk actually used.
+//
+// Much of what is cached, encrypted blocks and already compressed files
+// for instance, does not compress. To avoid spending time on such blocks,
+// the start of each is compressed first as a sample, and unless that
+// shrinks by a worthwhile amount the block is stored as it is.
+
+// compressMagic begins each compressed cache file.
+const compressMagic = "upspin-cache-gz\n"
+
+const (
+	// compressMin is the size below which blocks are not compressed.
+	compressMin = 512
+
+	// compressSample is the size of the sample compressed to judge
+	// whether a block is worth compressing.
+	compressSample = 4096
+)
+
+// encodeBlock returns the contents of the cache file for data.
+// Blocks that happen to begin with compressMagic are always compressed,
+// so they are not mistaken for compressed files when read back.
+func encodeBlock(data []byte, compress bool) []byte {
+	if bytes.HasPrefix(data, []byte(compressMagic)) {
+		return gzipBlock(data)
+	}
+	if !compress || len(data) < compressMin {
+		return data
+	}
+	sample := data
+	if len(sample) > compressSample {
+		sample = sample[:compressSample]
+	}
+	if !worthwhile(len(gzipBlock(sample)), len(sample)) {
+		return data
+	}
+	z := gzipBlock(data)
+	if !worthwhile(len(z), len(data)) {
+		return data
+	}
+	return z
+}
+
+// worthwhile reports whether compressing n bytes to z bytes
+// saves enough to be worth doing, taken to be a tenth.
+func worthwhile(z, n int) bool {
+	return z <= n-n/10
+}
+
+// gzipBlock returns data compressed, preceded by compressMagic.
+func gzipBlock(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(compressMagic)
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed) // Cannot fail for a valid level.
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// decodeBlock returns the block held in the contents of a cache file.
+func decodeBlock(contents []byte) ([]byte, error) {
+	if !bytes.HasPrefix(contents, []byte(compressMagic)) {
+		return contents, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(contents[len(compressMagic):]))
+	if err != nil {
+		return nil, errors.E(errors.IO, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.E(errors.IO, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"upspin.io/access"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Access control blocks.
+//
+// Access and Group files decide who may do what with the rest, so
+// keeping an old one too long risks clients acting on permissions since
+// revoked. With the accessttl option, a block holding an Access or Group
+// file is cached for no longer than that, and then fetched again from its
+// store; a shorter Duration given by the store still applies. Such blocks
+// are signed but not encrypted, so the cache recognizes them by their
+// contents, which must parse as an Access file granting some right, or
+// as a Group file naming at least one user. Blocks Put through a
+// writeback cache are not limited, lest they expire before they are
+// written back.
+//
+// Upspin names most blocks by the hash of their contents, so an edited
+// Access file is stored as a new block and the old one, though no longer
+// in use, is still correct. The limit matters most for stores whose
+// references name contents that can change, and bounds how long the cache
+// serves a block the store has since deleted.
+
+// maxControlBytes is the size of the largest block that is checked for
+// being an Access or Group file.
+const maxControlBytes = 64 << 10
+
+// controlPath is the name with which a block is parsed as an Access or
+// Group file. Only its syntax matters.
+const controlPath = upspin.PathName("storecache@upspin.io/Group/control")
+
+// isAccessControl reports whether data holds an Access or Group file.
+func isAccessControl(data []byte) bool {
+	if len(data) == 0 || len(data) > maxControlBytes || !utf8.Valid(data) {
+		return false
+	}
+	if a, err := access.Parse("storecache@upspin.io/Access", data); err == nil {
+		return len(a.List(access.AnyRight)) > 0
+	}
+	parsed, err := path.Parse(controlPath)
+	if err != nil {
+		return false
+	}
+	group, err := access.ParseGroup(parsed, data)
+	if err != nil {
+		return false
+	}
+	for _, member := range group {
+		if member.IsRoot() {
+			// A user, not a group.
+			return true
+		}
+	}
+	return false
+}
+
+// duration returns how long to keep data, given the Duration the store
+// gave for it: no longer than the cache's accessttl if it holds an Access
+// or Group file.
+func (c *storeCache) duration(d time.Duration, data []byte) time.Duration {
+	if c.accessTTL <= 0 || (d > 0 && d <= c.accessTTL) || !isAccessControl(data) {
+		return d
+	}
+	atomic.AddInt64(&c.counters.accessControl, 1)
+	return c.accessTTL
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"upspin.io/key/sha256key"
+	"upspin.io/log"
+)
+
+// Sharing blocks between stores.
+//
+// References are usually the SHA-256 hashes of the blocks they name, so
+// the same block fetched from two stores usually has the same reference
+// at both. A cache created with the dedup option keeps a single copy on
+// disk of such a block however many stores it is cached for. Each store
+// still has its own cache file for the block, in its own directory and
+// with its own expiry, so every request is answered just as it would be
+// without the option; but the files are hard links to one copy, which is
+// also linked from the shared directory beneath the cache directory under
+// the SHA-256 hash of its contents. That directory maps contents to
+// blocks: a block about to be cached for a store becomes a link to the
+// copy there, if there is one, and otherwise becomes that copy. Blocks
+// are shared by their contents rather than by their references, so a
+// block is kept once even if stores name it differently, or one store
+// names it twice: no two references to the same bytes are kept as two
+// copies on disk.
+//
+// The shared copy is removed once no store's file links to it, as its
+// link count shows. For a block whose reference is its hash, that is
+// noticed as the last file goes. The shared copy of a block named
+// otherwise cannot be found from the file's name, so it is removed by
+// the next compaction; see compact.go.
+//
+// Sharing is by whole blocks only; blocks are deliberately not split
+// into smaller chunks. Content-defined chunking could share the runs of
+// bytes that blocks of different files have in common, but blocks
+// packed with ee, as most are, are each encrypted under a key of their
+// own, so that the same plaintext never makes the same block and finer
+// chunks would find nothing to share.
+//
+// Every store's file still counts against the cache's
+// byte limit, so sharing saves disk but does not let more blocks be
+// cached. A cold tier on another file system keeps copies of its own.
+// Link counts are not available everywhere; where they are not the
+// option is refused.
+
+// sharedDir is the directory beneath the cache directory holding the
+// shared copies of blocks, sharded and named by the hashes of their
+// contents.
+const sharedDir = "shared"
+
+// sharedPath returns the name of the shared copy of the block whose
+// contents have the given hash.
+func (c *storeCache) sharedPath(hash string) string {
+	return path.Join(c.dir, sharedDir, c.shardDir(hash), hash)
+}
+
+// shareKey returns the name under which data, a block to be cached, is
+// shared with other stores and references: the hash of its contents, or
+// "" if the cache does not share blocks.
+func (c *storeCache) shareKey(data []byte) string {
+	if !c.dedup {
+		return ""
+	}
+	return sha256key.Of(data).String()
+}
+
+// share makes file, a cache file of size bytes just written, a link to
+// the shared copy of its block, whose contents have the given hash, if
+// there is one, and otherwise makes it the shared copy. A shared copy of
+// another size, compressed when file is not or the other way about, is
+// left alone.
+// This is called with the cachedRef for file locked.
+func (c *storeCache) share(file string, size int64, hash string) {
+	shared := c.sharedPath(hash)
+	info, err := os.Stat(shared)
+	if err != nil {
+		os.MkdirAll(filepath.Dir(shared), 0700)
+		if err := os.Link(file, shared); err != nil && !os.IsExist(err) {
+			log.Info.Printf("store/storecache: sharing %s: %s", file, err)
+		}
+		return
+	}
+	if info.Size() != size {
+		return
+	}
+	tmpName := file + ".tmp"
+	if err := os.Link(shared, tmpName); err != nil {
+		log.Info.Printf("store/storecache: sharing %s: %s", file, err)
+		return
+	}
+	if err := os.Rename(tmpName, file); err != nil {
+		log.Info.Printf("store/storecache: sharing %s: %s", file, err)
+		os.Remove(tmpName)
+		return
+	}
+	atomic.AddInt64(&c.counters.linked, 1)
+}
+
+// unshare removes the shared copy of the block cached in file, if no
+// store's file links to it any longer and the file is named by the hash
+// of the block, as most are; compaction removes the others.
+// Any locks may be held.
+func (c *storeCache) unshare(file string) {
+	if !c.dedup {
+		return
+	}
+	shared := c.sharedPath(path.Base(file))
+	info, err := os.Stat(shared)
+	if err != nil {
+		return
+	}
+	if n, ok := linkCount(info); ok && n == 1 {
+		os.Remove(shared)
+	}
+}
+
+// dropShared removes the shared copy of the block cached in file, which
+// has been found damaged, so that it is not shared again.
+// Any locks may be held.
+func (c *storeCache) dropShared(file string) {
+	if c.dedup {
+		os.Remove(c.sharedPath(path.Base(file)))
+	}
+}
+
+// sweepShared removes from the shared directory, dir, the copies that no
+// store's file links to, as a crash or the removal of a block named
+// otherwise than by its hash may leave, and temporary files.
+// This is called by walk and compact.
+func (c *storeCache) sweepShared(dir string) {
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if n, ok := linkCount(info); strings.HasSuffix(name, ".tmp") || ok && n == 1 {
+			os.Remove(name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/log"
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// Running out of disk.
+//
+// The cache's byte limit does not stop the file system holding it from
+// filling, perhaps with the files of others. When a cache file cannot be
+// written for lack of space, the block is not cached but the request is
+// otherwise served as usual: a fetched block is still returned, and a
+// Put to a writeback cache is sent straight to its store rather than
+// failing. The cache then makes room by evicting a tenth of its limit
+// more than it must. If writes fail again within diskFullRetry of that,
+// evicting has not helped, and the cache is degraded: blocks fetched are
+// returned without being cached, and all Puts go straight to their
+// stores, as for a writethrough cache, while blocks already cached are
+// still served. While degraded the cache tries to cache one block every
+// diskFullRetry, and leaves degraded mode once one is cached. Entering
+// and leaving it are logged.
+//
+// A block Put through PutFrom is copied to the cache as it is read, so if
+// that copy fails for lack of space there is nothing left to pass
+// through and the Put fails; while degraded such blocks are read into
+// memory and passed through instead.
+
+// diskFullRetry is both the interval within which failures to write
+// after making room degrade the cache, and that between attempts to
+// cache a block while degraded.
+const diskFullRetry = time.Minute
+
+// diskState records whether the file system holding a cache is full.
+type diskState struct {
+	sync.Mutex
+	full     bool      // A write failed for lack of space since makeRoom last ran.
+	degraded bool      // Blocks are passed through rather than cached.
+	evicted  time.Time // When makeRoom last evicted for lack of space.
+	tried    time.Time // When a block was last tried while degraded.
+}
+
+// noSpace reports whether err is the error of a write to a full file
+// system.
+func noSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+// cacheable reports whether a block is to be written to the cache, which
+// it is not while the cache is degraded, except for one every
+// diskFullRetry to learn whether there is room again.
+// Any locks may be held.
+func (c *storeCache) cacheable() bool {
+	d := &c.disk
+	d.Lock()
+	defer d.Unlock()
+	if !d.degraded {
+		return true
+	}
+	if time.Since(d.tried) >= diskFullRetry {
+		d.tried = time.Now()
+		return true
+	}
+	atomic.AddInt64(&c.counters.diskFull, 1)
+	return false
+}
+
+// isDegraded reports whether the cache is degraded.
+// Any locks may be held.
+func (c *storeCache) isDegraded() bool {
+	c.disk.Lock()
+	defer c.disk.Unlock()
+	return c.disk.degraded
+}
+
+// saved records the result, err, of writing a cache file.
+// Any locks may be held.
+func (c *storeCache) saved(err error) {
+	d := &c.disk
+	d.Lock()
+	defer d.Unlock()
+	switch {
+	case err == nil:
+		if d.degraded {
+			d.degraded = false
+			log.Error.Printf("store/storecache: %s has room again; caching blocks", c.dir)
+		}
+	case noSpace(err):
+		d.full = true
+		atomic.AddInt64(&c.counters.diskFull, 1)
+	}
+}
+
+// makeRoom, if a write has failed for lack of space since it last ran,
+// evicts a tenth of the cache's limit more than it must, or degrades the
+// cache if it last did so less than diskFullRetry ago.
+// No locks are held on entry or exit.
+func (c *storeCache) makeRoom() {
+	d := &c.disk
+	d.Lock()
+	if !d.full || d.degraded {
+		d.full = false
+		d.Unlock()
+		return
+	}
+	d.full = false
+	if time.Since(d.evicted) < diskFullRetry {
+		d.degraded = true
+		d.tried = time.Now()
+		d.Unlock()
+		log.Error.Printf("store/storecache: %s is full; passing blocks through without caching them", c.dir)
+		return
+	}
+	d.evicted = time.Now()
+	d.Unlock()
+	log.Info.Printf("store/storecache: %s is full; evicting to make room", c.dir)
+	c.enforceByteLimit(c.limit - atomic.LoadInt64(&c.inUse) + c.limit/10)
+}
+
+// putThrough puts data to the store at e without caching it, as for a
+// passthrough store.
+func (c *storeCache) putThrough(cfg upspin.Config, data []byte, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error) {
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	origin := originSpan(sp, "", e)
+	refdata, err := c.mirroredPut(cfg, store, data)
+	endSpan(origin)
+	if err != nil {
+		return nil, err
+	}
+	c.forgetMissing(c.cachePath(refdata.Reference, e))
+	return refdata, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+
+	"upspin.io/upspin"
+)
+
+// A flight is a fetch of a reference that is in progress. Gets of the
+// same reference and endpoint that arrive while it is under way wait
+// for it to land and return its result rather than going to the store
+// themselves.
+//
+// The cachedRef locking already keeps concurrent misses from fetching
+// data the cache can keep, but volatile data, data that could not be
+// saved, and errors are not recorded in the cache, so without flights
+// every waiter would go on to fetch the reference again in turn.
+//
+// Writethrough Puts of the same block and endpoint fly together in the
+// same way, so that identical blocks Put by several clients at once go
+// to the store only once. Their reference is known before the Put, as
+// blocks are named by the SHA-256 hash of their contents. A later Put
+// of a block already cached still goes to the store, which may have
+// deleted it since, but the cache file is not written again.
+type flight struct {
+	done chan struct{} // Closed when the fetch or Put is complete.
+
+	// The result of the fetch or Put, set before done is closed.
+	data    []byte
+	refdata *upspin.Refdata
+	locs    []upspin.Location
+	err     error
+}
+
+// joinFlight returns the flight for the reference cached in file.
+// If there is none, it starts one and reports that the caller is
+// its leader, which must do the fetch and then call land.
+// No locks are held on entry or exit.
+func (c *storeCache) joinFlight(file string) (f *flight, leader bool) {
+	c.Lock()
+	defer c.Unlock()
+	if f, ok := c.flights[file]; ok {
+		atomic.AddInt64(&c.counters.shared, 1)
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	c.flights[file] = f
+	return f, true
+}
+
+// joinPut is joinFlight for a writethrough Put of the block to be
+// cached in file.
+// No locks are held on entry or exit.
+func (c *storeCache) joinPut(file string) (f *flight, leader bool) {
+	c.Lock()
+	defer c.Unlock()
+	if f, ok := c.putFlights[file]; ok {
+		atomic.AddInt64(&c.counters.dedupedPuts, 1)
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	c.putFlights[file] = f
+	return f, true
+}
+
+// land completes the flight for file among flights, which is c.flights
+// or c.putFlights, releasing its waiters.
+// No locks are held on entry or exit.
+func (c *storeCache) land(flights map[string]*flight, file string, f *flight) {
+	c.Lock()
+	delete(flights, file)
+	c.Unlock()
+	close(f.done)
+}
+
+// wait waits for f to land and returns its result. The data is shared
+// with the other waiters and must not be modified. A successful result
+// is counted as a hit unless it is for a prefetch.
+func (f *flight) wait(c *storeCache, prefetch bool) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	<-f.done
+	if f.err != nil {
+		return nil, nil, nil, f.err
+	}
+	if !prefetch && f.locs == nil {
+		atomic.AddInt64(&c.counters.hits, 1)
+		atomic.AddInt64(&c.counters.cacheBytes, int64(len(f.data)))
+	}
+	var refdata *upspin.Refdata
+	if f.refdata != nil {
+		rd := *f.refdata
+		refdata = &rd
+	}
+	return f.data, refdata, f.locs, nil
+}
+
+// putResult waits for the Put flight f to land and returns its result.
+func (f *flight) putResult() (*upspin.Refdata, error) {
+	<-f.done
+	if f.err != nil {
+		return nil, f.err
+	}
+	refdata := *f.refdata
+	return &refdata, nil
+}
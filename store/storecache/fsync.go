@@ -0,0 +1,156 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Durability.
+//
+// The fsync policy says when the blocks Put through the cache are
+// committed to stable storage. Until they are, a crash of the machine,
+// though not of the cache server alone, may lose them. For a writethrough
+// cache that costs only refetching them, as each Put is in its store
+// before it returns; for a writeback cache a block not yet written back is
+// lost with it. Blocks fetched from stores can always be fetched again and
+// are never synced.
+//
+// With fsync=always, each block and the directory entries naming it are
+// synced before the Put returns, so nothing is lost, at the cost of a
+// disk flush for every Put. With fsync=interval, blocks are synced in
+// batches every fsyncinterval, by default a second, so a crash may lose
+// those Put in that last interval. With fsync=never, the default, the
+// cache leaves it to the operating system, which typically writes dirty
+// data within half a minute; Flush, and shutdown, sync every block
+// whatever the policy.
+
+// syncPolicy is the fsync policy of a cache.
+type syncPolicy int
+
+const (
+	syncNever syncPolicy = iota
+	syncInterval
+	syncAlways
+)
+
+// defaultSyncInterval is the interval between batches of syncs
+// when the policy is fsync=interval.
+const defaultSyncInterval = time.Second
+
+// parseSyncPolicy returns the policy named s.
+func parseSyncPolicy(s string) (syncPolicy, error) {
+	switch s {
+	case "never":
+		return syncNever, nil
+	case "interval":
+		return syncInterval, nil
+	case "always":
+		return syncAlways, nil
+	}
+	return syncNever, errors.Errorf("unknown fsync policy %q", s)
+}
+
+// syncer syncs, in batches, the cache files and directories written
+// since the last batch.
+type syncer struct {
+	mu      sync.Mutex
+	pending map[string]bool // Files and directories to sync; true for directories.
+
+	stop chan bool
+	done chan bool
+}
+
+// newSyncer returns a syncer that syncs every interval until closed.
+func newSyncer(interval time.Duration) *syncer {
+	s := &syncer{
+		pending: make(map[string]bool),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+	go s.loop(interval)
+	return s
+}
+
+// add arranges for the named cache file, and the directory holding it,
+// to be synced with the next batch.
+func (s *syncer) add(file string) {
+	s.mu.Lock()
+	s.pending[file] = false
+	s.pending[filepath.Dir(file)] = true
+	s.mu.Unlock()
+}
+
+func (s *syncer) loop(interval time.Duration) {
+	defer close(s.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.sync()
+		case <-s.stop:
+			s.sync()
+			return
+		}
+	}
+}
+
+// sync syncs the files and directories pending.
+func (s *syncer) sync() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]bool)
+	s.mu.Unlock()
+	for name, dir := range pending {
+		sync := syncFile
+		if dir {
+			sync = syncDir
+		}
+		// The file may have been evicted meanwhile.
+		if err := sync(name); err != nil && !os.IsNotExist(err) {
+			log.Info.Printf("store/storecache: syncing %s: %s", name, err)
+		}
+	}
+}
+
+// close syncs what is pending and stops the syncer.
+func (s *syncer) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// committed commits, as the fsync policy says, the cache file just
+// written by a Put.
+// No locks need be held on entry or exit.
+func (c *storeCache) committed(file string) error {
+	switch c.fsync {
+	case syncAlways:
+		if err := syncFile(file); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(file))
+	case syncInterval:
+		c.syncer.add(file)
+	}
+	return nil
+}
+
+// syncDir commits the entries of the named directory to stable storage,
+// where the system allows it.
+func syncDir(name string) error {
+	if runtime.GOOS == "windows" {
+		// Directories cannot be opened for syncing.
+		return nil
+	}
+	return syncFile(name)
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"io/ioutil"
+	"os"
+
+	"upspin.io/errors"
+)
+
+// Health checks.
+//
+// Something that runs the cache server, such as a cluster's orchestrator,
+// needs to know whether it works, not only whether it is listening.
+// Health reports whether the cache can still write its directories, by
+// writing and removing a small file in each: a cache that cannot, because
+// its disk has failed or filled or been remounted read-only, fails every
+// Put and keeps nothing it fetches. Ready reports as well whether the
+// server is accepting requests, which it stops doing once Shutdown is
+// called. A Cache other than that made by New is taken to be healthy.
+
+// Health returns an error of kind IO describing why the cache cannot
+// work, or nil if it can.
+func (s *server) Health() error {
+	if s.files == nil {
+		return nil
+	}
+	return s.files.checkWritable()
+}
+
+// Ready returns an error unless the server is healthy and accepting
+// requests. Once Shutdown is called it returns an error of kind
+// Transient.
+func (s *server) Ready() error {
+	if s.reqs.shuttingDown() {
+		return errShutdown
+	}
+	return s.Health()
+}
+
+// checkWritable returns an error unless a file can be written to, and
+// removed from, each of the cache's directories.
+func (c *storeCache) checkWritable() error {
+	const op = "store/storecache.Health"
+	for _, dir := range []string{c.dir, c.coldDir} {
+		if dir == "" {
+			continue
+		}
+		f, err := ioutil.TempFile(dir, "health*.tmp")
+		if err != nil {
+			return errors.E(op, errors.IO, errors.Errorf("cache directory is not writable: %v", err))
+		}
+		_, err = f.WriteString("ok\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(f.Name()); err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return errors.E(op, errors.IO, errors.Errorf("cache directory %s is not writable: %v", dir, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"os"
+	"sync/atomic"
+
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// Cache-control hints.
+//
+// A client sometimes knows better than the cache what is worth keeping.
+// A one-off scan of a large tree reads blocks that will not be read
+// again, and would push out those that will; a client that knows a
+// block has changed behind the cache's back wants the store's copy, not
+// the cached one. GetHinted and PutHinted take hints for such requests,
+// which remote clients send in StoreGetRequest and StorePutRequest.
+//
+// With the no-store hint, a Get is served from the cache if the block is
+// already there, since that costs nothing, and is otherwise sent on to
+// the store and the block returned without being cached; a Put is sent
+// on to the store at once, even by a writeback cache, and the block is
+// not cached. Either way the request is counted as NoStore.
+//
+// With the refresh hint, a Get first drops any cached copy of the block,
+// and any NotExist error remembered for it, and then proceeds as it
+// would without the hint, fetching the block from the store. A block
+// still to be written back is kept, since the store has no copy to
+// fetch. Each copy dropped is counted as a Refresh.
+//
+// Hints for a store the cache passes through are moot and ignored.
+
+// getHinted does the work of GetHinted, tracing it beneath sp.
+func (s *server) getHinted(ref upspin.Reference, noStore, refresh bool, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if s.passthrough() {
+		return s.get(ref, sp)
+	}
+	if refresh && s.dropForRefresh(ref) {
+		atomic.AddInt64(&s.counters.refreshes, 1)
+	}
+	if !noStore {
+		return s.cache.Get(s.cfg, ref, s.authority, sp)
+	}
+	if !refresh && s.files != nil && !s.files.verify {
+		data, refdata, ok, err := s.files.cachedRange(ref, s.authority, 0, 0, sp)
+		if ok {
+			return data, refdata, nil, err
+		}
+	}
+	atomic.AddInt64(&s.counters.noStore, 1)
+	return s.getOrigin(ref, sp)
+}
+
+// putNoStore does the work of PutHinted with the no-store hint, tracing
+// it beneath sp.
+func (s *server) putNoStore(data []byte, sp *metric.Span) (*upspin.Refdata, error) {
+	if s.passthrough() {
+		return s.put(data, sp)
+	}
+	refdata, err := s.putOrigin(data, sp)
+	if err != nil {
+		return nil, err
+	}
+	if s.files != nil {
+		s.files.forgetMissing(s.files.cachePath(refdata.Reference, s.authority))
+	}
+	atomic.AddInt64(&s.counters.noStore, 1)
+	return refdata, nil
+}
+
+// dropForRefresh drops any cached copy of ref, so that the next Get
+// fetches it from the store, and reports whether there was one.
+func (s *server) dropForRefresh(ref upspin.Reference) bool {
+	if s.files != nil {
+		return s.files.dropForRefresh(ref, s.authority)
+	}
+	inv, ok := s.cache.(Invalidator)
+	return ok && inv.Invalidate(ref, s.authority)
+}
+
+// dropForRefresh drops the copy of ref at e, if it is cached and not
+// waiting to be written back, and any NotExist error remembered for it.
+// It reports whether a copy was dropped.
+// No locks are held on entry or exit.
+func (c *storeCache) dropForRefresh(ref upspin.Reference, e upspin.Endpoint) bool {
+	file := c.cachePath(ref, e)
+	c.forgetMissing(file)
+	if c.wbq != nil {
+		if _, err := os.Stat(file + writebackSuffix); err == nil {
+			return false
+		}
+	}
+	return c.drop(file)
+}
@@ -0,0 +1,637 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"upspin.io/cache"
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Index.
+//
+// Walking the cache directories to learn what they hold reads every
+// directory and every expiry file, which takes a long time for a large
+// cache, and loses the order in which the blocks were used. So the cache
+// also keeps an index of its blocks in a file in its top directory: a
+// header describing the layout, then binary records, one for each block
+// cached, removed, or moved between tiers, and for each read of a block,
+// though no more than one a minute for each. Records are only appended,
+// so keeping the index up to date costs little; they are flushed every
+// second, and the index is rewritten without the records that no longer
+// matter when those outnumber the blocks.
+//
+// Closing the cache appends a record marking the index complete. A cache
+// started on a directory with a complete index for the same layout
+// replays it to fill its LRUs, in the order the blocks were used, without
+// walking the directories, once it has checked a sample of the blocks
+// listed against the files on disk. If the index is missing, incomplete
+// because the cache did not close cleanly, or inconsistent with the
+// files, the cache walks the directories as before and writes a new
+// index. A writeback cache closed with blocks still to write back does
+// not mark its index complete, since only the walk finds them.
+
+const (
+	// indexFile holds the index in the top directory of the cache.
+	indexFile = "index"
+
+	// indexVersion is recorded in the header of the index and changes
+	// with its format.
+	indexVersion = 1
+
+	// indexFlushInterval is the interval between flushes of the records
+	// appended to the index.
+	indexFlushInterval = time.Second
+
+	// useInterval is the least interval between records of the reads
+	// of a block.
+	useInterval = time.Minute
+
+	// indexSample is about the number of blocks checked against their
+	// files before a complete index is used.
+	indexSample = 32
+
+	// indexSlack is how many more records than twice the number of
+	// blocks the index may hold before it is rewritten.
+	indexSlack = 10000
+
+	// maxIndexName is the longest name of a cache file in the index.
+	maxIndexName = 4096
+)
+
+// Types of index records.
+const (
+	recAdd    = 'a' // A block was cached, with its size, use, and expiry.
+	recRemove = 'r' // A block was removed.
+	recCold   = 'c' // A block was moved to the cold tier.
+	recHot    = 'h' // A block was moved back from the cold tier.
+	recUse    = 'u' // A block was read or written, at the time given.
+	recEnd    = 'e' // The cache was closed; nothing follows.
+)
+
+// indexEntry describes a block in the index.
+type indexEntry struct {
+	size    int64
+	used    int64 // Unix time in nanoseconds.
+	expires int64 // Unix time in nanoseconds, or zero if never.
+	cold    bool
+	seq     int64 // Order of the last record adding, using, or moving it.
+}
+
+// indexRecord is a record of the index. The indexEntry is used only for
+// the records that carry one.
+type indexRecord struct {
+	op   byte
+	name string // Of the cache file, relative to the cache directory.
+	indexEntry
+}
+
+// index is the index of a cache. The blocks it lists are kept in memory
+// as well as on disk, to rewrite it from.
+type index struct {
+	mu      sync.Mutex
+	dir     string // Top directory of the cache.
+	file    string // The index file.
+	header  string
+	entries map[string]*indexEntry // By name relative to dir.
+	seq     int64
+	records int           // Records in the file.
+	stale   bool          // Entries were dropped that the file lists.
+	f       *os.File      // Nil until the index is written, or if it could not be.
+	w       *bufio.Writer // Buffers writes to f.
+	buf     []byte
+
+	stop chan bool
+	done chan bool
+}
+
+// newIndex returns an index for c, which is written to only once
+// startIndex has been called.
+func newIndex(c *storeCache) *index {
+	x := &index{
+		dir:     c.dir,
+		file:    path.Join(c.dir, indexFile),
+		header:  fmt.Sprintf("upspin storecache index %d shardlevels=%d colddir=%q\n", indexVersion, c.shardLevels, c.coldDir),
+		entries: make(map[string]*indexEntry),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+	go x.loop()
+	return x
+}
+
+// loadIndex fills the LRUs from a complete index, if there is one
+// consistent with the cache directories, and reports whether it did.
+// No locks are held on entry or exit.
+func (c *storeCache) loadIndex() bool {
+	c.Lock()
+	defer c.Unlock()
+	files, crs, ok := c.readIndex()
+	if !ok {
+		return false
+	}
+	// The LRU may drop some if it is smaller than it was; the index
+	// is then rewritten by startIndex.
+	for i, cr := range crs {
+		if cr.cold {
+			c.coldLRU.Add(files[i], cr)
+			atomic.AddInt64(&c.coldInUse, cr.size)
+		} else {
+			c.lru.Add(files[i], cr)
+			atomic.AddInt64(&c.inUse, cr.size)
+		}
+		atomic.AddInt64(&c.entries, 1)
+	}
+	return true
+}
+
+// readIndex reads a complete index and returns the cache files it lists,
+// and cachedRefs for them, in the order in which they were used. Those
+// that expired while the cache was not running are removed.
+// This is called with c locked.
+func (c *storeCache) readIndex() (files []string, crs []*cachedRef, ok bool) {
+	x := c.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.read(); err != nil {
+		if !os.IsNotExist(err) {
+			log.Info.Printf("store/storecache: not using index %s: %s", x.file, err)
+		}
+		x.reset()
+		return nil, nil, false
+	}
+	names := x.order()
+
+	// Check a sample spread through the index against the disk.
+	step := len(names)/indexSample + 1
+	for i := 0; i < len(names); i += step {
+		e := x.entries[names[i]]
+		name := path.Join(c.dir, names[i])
+		if e.cold {
+			name = c.coldPath(name)
+		}
+		info, err := os.Stat(name)
+		if err != nil || info.Size() != e.size {
+			log.Info.Printf("store/storecache: not using index %s: it does not match %s", x.file, name)
+			x.reset()
+			return nil, nil, false
+		}
+	}
+
+	now := time.Now()
+	for _, n := range names {
+		e := x.entries[n]
+		if e.cold && c.coldLRU == nil {
+			log.Info.Printf("store/storecache: not using index %s: it lists a cold tier", x.file)
+			x.reset()
+			return nil, nil, false
+		}
+		file := path.Join(c.dir, n)
+		cr := &cachedRef{c: c, size: e.size, used: time.Unix(0, e.used), cold: e.cold, valid: true}
+		cr.hold = sync.NewCond(cr)
+		cr.recorded = cr.used
+		if e.expires != 0 {
+			cr.expires = time.Unix(0, e.expires)
+		}
+		if !cr.expires.IsZero() && now.Sub(cr.expires) > c.maxStale {
+			// Expired while we were not running; see walk.
+			os.Remove(cr.path(file))
+			os.Remove(cr.path(file) + expirySuffix)
+			delete(x.entries, n)
+			x.stale = true
+			continue
+		}
+		files = append(files, file)
+		crs = append(crs, cr)
+	}
+	return files, crs, true
+}
+
+// startIndex starts recording changes to the cache in the index. It
+// appends to the index loaded by loadIndex, if any, and if that still
+// describes the LRUs and is not too long; otherwise it writes the index
+// afresh from the LRUs.
+// No locks are held on entry or exit.
+func (c *storeCache) startIndex(loaded bool) {
+	c.Lock()
+	defer c.Unlock()
+	x := c.index
+	n := c.lru.Len()
+	if c.coldLRU != nil {
+		n += c.coldLRU.Len()
+	}
+	x.mu.Lock()
+	if loaded && !x.stale && n == len(x.entries) && x.records <= 2*n+indexSlack {
+		err := x.reopen()
+		if err == nil {
+			x.mu.Unlock()
+			return
+		}
+		log.Info.Printf("store/storecache: rewriting index %s: %s", x.file, err)
+	}
+	x.mu.Unlock()
+
+	// Gather the records before locking x, to lock in the usual order.
+	var records []*indexRecord
+	for _, lru := range []*cache.LRU{c.coldLRU, c.lru} {
+		if lru != nil {
+			records = append(records, c.indexRecords(lru)...)
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.reset()
+	for _, r := range records {
+		x.apply(r)
+	}
+	if err := x.rewrite(); err != nil {
+		log.Info.Printf("store/storecache: writing index %s: %s", x.file, err)
+	}
+}
+
+// indexRecords returns records adding the valid references in lru, from
+// the least recently used. This is called with c locked.
+func (c *storeCache) indexRecords(lru *cache.LRU) []*indexRecord {
+	var files []string
+	var crs []*cachedRef
+	for it := lru.NewIterator(); ; {
+		key, value, ok := it.GetAndAdvance()
+		if !ok {
+			break
+		}
+		files = append(files, key.(string))
+		crs = append(crs, value.(*cachedRef))
+	}
+	var records []*indexRecord
+	for i := len(crs) - 1; i >= 0; i-- {
+		cr := crs[i]
+		cr.Lock()
+		if cr.valid {
+			records = append(records, cr.record(recAdd, c.index.name(files[i])))
+		}
+		cr.Unlock()
+	}
+	return records
+}
+
+// record returns an index record of type op for cr, cached in the file
+// with the given name. This is called with cr locked.
+func (cr *cachedRef) record(op byte, name string) *indexRecord {
+	r := &indexRecord{op: op, name: name}
+	r.size = cr.size
+	r.used = cr.used.UnixNano()
+	if !cr.expires.IsZero() {
+		r.expires = cr.expires.UnixNano()
+	}
+	r.cold = cr.cold
+	return r
+}
+
+// add records that cr is cached in file.
+// This is called with cr locked.
+func (x *index) add(file string, cr *cachedRef) {
+	x.log(cr.record(recAdd, x.name(file)))
+}
+
+// remove records that the block cached in file was removed.
+func (x *index) remove(file string) {
+	x.log(&indexRecord{op: recRemove, name: x.name(file)})
+}
+
+// move records that the block cached in file was moved to the cold tier,
+// if cold is set, or back from it.
+func (x *index) move(file string, cold bool) {
+	r := &indexRecord{op: recHot, name: x.name(file)}
+	if cold {
+		r.op = recCold
+	}
+	x.log(r)
+}
+
+// use records that the block cached in file was used at the given time.
+func (x *index) use(file string, used time.Time) {
+	r := &indexRecord{op: recUse, name: x.name(file)}
+	r.used = used.UnixNano()
+	x.log(r)
+}
+
+// name returns the name of file in the index.
+func (x *index) name(file string) string {
+	return strings.TrimPrefix(file, x.dir+"/")
+}
+
+// log appends r to the index, if it is being written, and applies it.
+func (x *index) log(r *indexRecord) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.f == nil {
+		return
+	}
+	x.apply(r)
+	x.write(r)
+}
+
+// apply applies r to the entries of x.
+// This is called with x locked.
+func (x *index) apply(r *indexRecord) {
+	x.seq++
+	switch r.op {
+	case recAdd:
+		e := r.indexEntry
+		e.seq = x.seq
+		x.entries[r.name] = &e
+	case recRemove:
+		delete(x.entries, r.name)
+	case recCold, recHot:
+		if e, ok := x.entries[r.name]; ok {
+			e.cold = r.op == recCold
+			e.seq = x.seq
+		}
+	case recUse:
+		if e, ok := x.entries[r.name]; ok {
+			e.used = r.used
+			e.seq = x.seq
+		}
+	}
+}
+
+// write appends r to the file. If that fails the index is abandoned,
+// incomplete, so that the next cache on the directory walks it.
+// This is called with x locked.
+func (x *index) write(r *indexRecord) {
+	x.buf = r.append(x.buf[:0])
+	if _, err := x.w.Write(x.buf); err != nil {
+		log.Error.Printf("store/storecache: writing index: %s", err)
+		x.f.Close()
+		x.f, x.w = nil, nil
+		return
+	}
+	x.records++
+}
+
+// order returns the names of the entries in the order of their records.
+// This is called with x locked.
+func (x *index) order() []string {
+	names := make([]string, 0, len(x.entries))
+	for n := range x.entries {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return x.entries[names[i]].seq < x.entries[names[j]].seq
+	})
+	return names
+}
+
+// reset forgets the entries of x.
+// This is called with x locked.
+func (x *index) reset() {
+	x.entries = make(map[string]*indexEntry)
+	x.seq = 0
+	x.records = 0
+	x.stale = false
+}
+
+// read reads the index file into x, returning an error if it is not
+// complete or not for this cache's layout.
+// This is called with x locked.
+func (x *index) read() error {
+	f, err := os.Open(x.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return errors.Str("bad header")
+	}
+	if header != x.header {
+		return errors.Str("written for another layout")
+	}
+	for {
+		var r indexRecord
+		err := r.read(br)
+		if err == io.EOF {
+			return errors.Str("incomplete")
+		}
+		if err != nil {
+			return err
+		}
+		if r.op == recEnd {
+			if _, err := br.ReadByte(); err != io.EOF {
+				return errors.Str("records follow the end")
+			}
+			return nil
+		}
+		x.apply(&r)
+		x.records++
+	}
+}
+
+// reopen opens the complete index file read by read to append to it,
+// dropping the record that marks it complete.
+// This is called with x locked.
+func (x *index) reopen() error {
+	info, err := os.Stat(x.file)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(x.file, info.Size()-1); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(x.file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	x.f, x.w = f, bufio.NewWriter(f)
+	return nil
+}
+
+// rewrite writes the index file afresh from the entries of x and leaves
+// it open to append to.
+// This is called with x locked.
+func (x *index) rewrite() error {
+	if x.f != nil {
+		x.f.Close()
+		x.f, x.w = nil, nil
+	}
+	tmpName := x.file + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	x.f, x.w = f, bufio.NewWriter(f)
+	x.records = 0
+	x.w.WriteString(x.header)
+	for _, n := range x.order() {
+		x.write(&indexRecord{op: recAdd, name: n, indexEntry: *x.entries[n]})
+		if x.f == nil {
+			os.Remove(tmpName)
+			return errors.Str("write failed")
+		}
+	}
+	err = x.w.Flush()
+	if err == nil {
+		err = os.Rename(tmpName, x.file)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		x.f, x.w = nil, nil
+	}
+	return err
+}
+
+// loop flushes the index every indexFlushInterval, rewriting it if it
+// has grown too long, until x is closed.
+func (x *index) loop() {
+	defer close(x.done)
+	t := time.NewTicker(indexFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			x.flush()
+		case <-x.stop:
+			return
+		}
+	}
+}
+
+// flush writes out the records appended to the index, first rewriting it
+// if it holds too many.
+func (x *index) flush() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.f == nil {
+		return
+	}
+	if x.records > 2*len(x.entries)+indexSlack {
+		if err := x.rewrite(); err != nil {
+			log.Error.Printf("store/storecache: rewriting index: %s", err)
+		}
+		return
+	}
+	if err := x.w.Flush(); err != nil {
+		log.Error.Printf("store/storecache: writing index: %s", err)
+		x.f.Close()
+		x.f, x.w = nil, nil
+	}
+}
+
+// close stops recording changes in the index, marking it complete if
+// complete is set.
+func (x *index) close(complete bool) {
+	close(x.stop)
+	<-x.done
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.f == nil {
+		return
+	}
+	if complete {
+		x.w.WriteByte(recEnd)
+	}
+	err := x.w.Flush()
+	if cerr := x.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Error.Printf("store/storecache: writing index: %s", err)
+	}
+	x.f, x.w = nil, nil
+}
+
+// append appends the encoding of r to b and returns the result.
+func (r *indexRecord) append(b []byte) []byte {
+	b = append(b, r.op)
+	if r.op == recEnd {
+		return b
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(r.name)))]...)
+	b = append(b, r.name...)
+	switch r.op {
+	case recAdd:
+		for _, v := range []int64{r.size, r.used, r.expires} {
+			b = append(b, tmp[:binary.PutVarint(tmp[:], v)]...)
+		}
+		cold := byte(0)
+		if r.cold {
+			cold = 1
+		}
+		b = append(b, cold)
+	case recUse:
+		b = append(b, tmp[:binary.PutVarint(tmp[:], r.used)]...)
+	}
+	return b
+}
+
+// read reads into r the next record from br. It returns io.EOF only if
+// there are no more records; a record cut short is an error.
+func (r *indexRecord) read(br *bufio.Reader) error {
+	op, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	*r = indexRecord{op: op}
+	switch op {
+	case recEnd:
+		return nil
+	case recAdd, recRemove, recCold, recHot, recUse:
+	default:
+		return errors.Errorf("bad record type %q", op)
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return noEOF(err)
+	}
+	if n > maxIndexName {
+		return errors.Errorf("bad name length %d", n)
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return noEOF(err)
+	}
+	r.name = string(name)
+	switch op {
+	case recAdd:
+		for _, v := range []*int64{&r.size, &r.used, &r.expires} {
+			if *v, err = binary.ReadVarint(br); err != nil {
+				return noEOF(err)
+			}
+		}
+		cold, err := br.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		r.cold = cold != 0
+	case recUse:
+		if r.used, err = binary.ReadVarint(br); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
+
+// noEOF returns err, or io.ErrUnexpectedEOF if it is io.EOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// On-disk layout.
+//
+// Each cached reference is kept in a file named after it, beneath a
+// directory for its store. To keep directories small when millions of
+// references are cached, the files are sharded into subdirectories named
+// by successive pairs of characters of the reference, which is usually a
+// hash, much as git stores its objects. With the default of one level,
+// reference 1b4f0e... at a store is cached in <store>/1b/1b4f0e...; with
+// two levels, in <store>/1b/4f/1b4f0e.... References too short to supply
+// a pair use "zz". The shardlevels=n option sets the number of levels,
+// from 0 to maxShardLevels.
+//
+// The number of levels is recorded in a file in the top directory of the
+// cache, and of its cold tier if any. If it differs from the number the
+// cache is created with, the files are moved to their new places before
+// the cache is loaded. A directory without the record is taken to have
+// the original layout of one level.
+
+const (
+	// defaultShardLevels is the number of levels of subdirectories
+	// if the shardlevels option is not given.
+	defaultShardLevels = 1
+
+	// maxShardLevels is the most levels allowed.
+	maxShardLevels = 4
+
+	// layoutFile records the levels in use in a cache directory.
+	layoutFile = "layout"
+)
+
+// shardDir returns the subdirectories, relative to the directory for
+// its store, in which the file for ref is kept.
+func (c *storeCache) shardDir(ref string) string {
+	elems := make([]string, c.shardLevels)
+	for i := range elems {
+		if len(ref) >= 2*i+2 {
+			elems[i] = ref[2*i : 2*i+2]
+		} else {
+			elems[i] = "zz"
+		}
+	}
+	return path.Join(elems...)
+}
+
+// relayout moves the files in the cache directory dir to where the
+// current number of levels puts them, if it was last used with a
+// different number, and records the number used.
+func (c *storeCache) relayout(dir string) error {
+	const op = "store/storecache.New"
+	marker := path.Join(dir, layoutFile)
+	old := defaultShardLevels
+	data, err := ioutil.ReadFile(marker)
+	switch {
+	case err == nil:
+		old, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || old < 0 || old > maxShardLevels {
+			return errors.E(op, errors.Invalid, errors.Errorf("bad layout file %s: %q", marker, data))
+		}
+	case !os.IsNotExist(err):
+		return errors.E(op, errors.IO, err)
+	}
+	if old != c.shardLevels {
+		log.Info.Printf("store/storecache: moving files in %s from %d to %d levels of subdirectories", dir, old, c.shardLevels)
+		moved, failed := 0, 0
+		filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				// Unreadable directories are cleaned up by walk.
+				return nil
+			}
+			// The first element is the directory for the store,
+			// the last the file name.
+			elems := strings.Split(strings.TrimPrefix(name, dir+"/"), "/")
+			if len(elems) < 2 {
+				return nil
+			}
+			file := elems[len(elems)-1]
+			ref := file
+			for _, suffix := range []string{expirySuffix, writebackSuffix, ".tmp"} {
+				ref = strings.TrimSuffix(ref, suffix)
+			}
+			to := path.Join(dir, elems[0], c.shardDir(ref), file)
+			if to == name {
+				return nil
+			}
+			err = os.MkdirAll(filepath.Dir(to), 0700)
+			if err == nil {
+				err = os.Rename(name, to)
+			}
+			if err != nil {
+				log.Info.Printf("store/storecache: moving %s: %s", name, err)
+				failed++
+				return nil
+			}
+			moved++
+			return nil
+		})
+		log.Info.Printf("store/storecache: moved %d files in %s", moved, dir)
+		if failed > 0 {
+			// Leave the old record so the move is tried again
+			// next time; the files not moved are unreachable
+			// until then and are eventually evicted.
+			return nil
+		}
+	}
+	if err := ioutil.WriteFile(marker, []byte(strconv.Itoa(c.shardLevels)+"\n"), 0600); err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows plan9
+
+package storecache
+
+import "os"
+
+// linksCounted reports whether linkCount can count links.
+const linksCounted = false
+
+// linkCount returns the number of links to the file described by info,
+// and whether it could tell, which it cannot here.
+func linkCount(info os.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows,!plan9
+
+package storecache
+
+import (
+	"os"
+	"syscall"
+)
+
+// linksCounted reports whether linkCount can count links.
+const linksCounted = true
+
+// linkCount returns the number of links to the file described by info,
+// and whether it could tell.
+func linkCount(info os.FileInfo) (int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Nlink), true
+}
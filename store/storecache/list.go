@@ -0,0 +1,170 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+	"time"
+
+	"upspin.io/cache"
+	"upspin.io/upspin"
+)
+
+// Listing.
+//
+// For debugging, List describes the blocks in the cache a page at a
+// time, in the order of the names of their cache files, which is that of
+// their stores' endpoints and then their references. Each page ends with
+// a cursor naming its last block, from which the next page starts, so
+// that blocks added or evicted between pages do not shift the rest. The
+// cache is locked while a page is gathered, which takes time in
+// proportion to the number of blocks in it, not in the page; listing is
+// meant for people, not to be done continually.
+
+// maxListEntries is the most entries List returns at once.
+const maxListEntries = 1000
+
+// Entry describes a block held in the cache, as reported by List.
+type Entry struct {
+	// Location is the store the block is cached from and its
+	// reference there.
+	Location upspin.Location
+
+	// Size is the bytes the block takes in the cache, which are
+	// fewer than those of the block if it is compressed.
+	Size int64
+
+	// LastUsed is when the block was last read or written through the
+	// cache. For a block cached before the cache last started, it is
+	// that recorded in the index, to within a minute, or, if the
+	// directory had to be walked, when its file was written.
+	LastUsed time.Time
+
+	// Expires is when the block must be fetched again from its store,
+	// or zero if never. Blocks the store marks as Volatile are never
+	// cached, so never listed.
+	Expires time.Time
+
+	// Pinned and Cold report whether the block is pinned, and whether
+	// it is in the cold tier.
+	Pinned, Cold bool
+}
+
+// list returns up to max entries for the blocks in the cache whose files
+// come after cursor, and the cursor from which to continue, which is
+// empty if there are no more. It returns no more than maxListEntries
+// entries, or than that if max is not positive.
+// No locks are held on entry or exit.
+func (c *storeCache) list(cursor string, max int) ([]Entry, string) {
+	if max <= 0 || max > maxListEntries {
+		max = maxListEntries
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	// Keep the first max names after cursor, and count the rest.
+	var page listHeap
+	more := false
+	for _, lru := range []*cache.LRU{c.lru, c.coldLRU} {
+		if lru == nil {
+			continue
+		}
+		for it := lru.NewIterator(); ; {
+			key, value, ok := it.GetAndAdvance()
+			if !ok {
+				break
+			}
+			item := listItem{name: c.listName(key.(string)), cr: value.(*cachedRef)}
+			if item.name <= cursor || !item.cr.isValid() {
+				continue
+			}
+			if len(page) < max {
+				heap.Push(&page, item)
+				continue
+			}
+			more = true
+			if item.name < page[0].name {
+				page[0] = item
+				heap.Fix(&page, 0)
+			}
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].name < page[j].name })
+
+	entries := make([]Entry, 0, len(page))
+	for _, item := range page {
+		loc, ok := c.location(item.name)
+		if !ok {
+			continue
+		}
+		cr := item.cr
+		cr.Lock()
+		entries = append(entries, Entry{
+			Location: loc,
+			Size:     cr.size,
+			LastUsed: cr.used,
+			Expires:  cr.expires,
+			Pinned:   cr.pinned,
+			Cold:     cr.cold,
+		})
+		cr.Unlock()
+	}
+	if !more || len(page) == 0 {
+		return entries, ""
+	}
+	return entries, page[len(page)-1].name
+}
+
+// listName returns the name of file within the cache directory, by
+// which List orders the blocks.
+func (c *storeCache) listName(file string) string {
+	return strings.TrimPrefix(file, c.dir+"/")
+}
+
+// location returns the store and reference of the block in the cache
+// file with the given name within the cache directory. The endpoint is
+// the first element and the reference the last; the shard directories
+// lie between.
+func (c *storeCache) location(name string) (upspin.Location, bool) {
+	elems := strings.Split(name, "/")
+	if len(elems) < 2 {
+		return upspin.Location{}, false
+	}
+	e, err := upspin.ParseEndpoint(elems[0])
+	if err != nil {
+		return upspin.Location{}, false
+	}
+	return upspin.Location{Endpoint: *e, Reference: upspin.Reference(elems[len(elems)-1])}, true
+}
+
+// isValid reports whether cr holds cached data.
+func (cr *cachedRef) isValid() bool {
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.valid
+}
+
+// listItem is a block considered for a page of List.
+type listItem struct {
+	name string // Name within the cache directory.
+	cr   *cachedRef
+}
+
+// listHeap is a heap of listItems with the greatest name at the top,
+// so that the last of those kept for a page can be replaced.
+type listHeap []listItem
+
+func (h listHeap) Len() int            { return len(h) }
+func (h listHeap) Less(i, j int) bool  { return h[i].name > h[j].name }
+func (h listHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *listHeap) Push(x interface{}) { *h = append(*h, x.(listItem)) }
+func (h *listHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
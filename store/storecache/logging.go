@@ -0,0 +1,133 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Request logging.
+//
+// The server logs each request as it starts, and again if it fails, by
+// default at log.Debug, so that requests are seen only when everything
+// else is too. A busy cache serves many more Gets than Puts, so at that
+// level the Gets drown out the rest. The loglevel=op:level option logs
+// the requests of one operation, named for the method that serves them,
+// such as Put or GetHinted, at another level, debug, info, or error, or
+// with none not at all, and the logsample=op:n option logs only the first
+// of every n of them, so that a sample of frequent Gets can be kept in
+// the logs of a production cache. Failures are always logged, at the
+// operation's level.
+
+// logOps lists the operations whose requests are logged.
+var logOps = []string{
+	"Compact", "Delete", "Flush", "Get", "GetHinted", "GetRange", "Invalidate", "List",
+	"Pin", "Put", "PutFrom", "PutHinted", "Shutdown", "Unpin", "Warm",
+}
+
+// opLog says how the requests of an operation are logged.
+type opLog struct {
+	logger log.Logger // Nil to not log them.
+	sample int64      // Log the first of every sample requests.
+	count  int64      // Requests so far. Accessed atomically.
+}
+
+// defaultOpLog is how requests are logged if no option says otherwise.
+var defaultOpLog = &opLog{logger: log.Debug, sample: 1}
+
+// logs reports whether the request just made is to be logged, and
+// counts it.
+func (l *opLog) logs() bool {
+	if l.logger == nil {
+		return false
+	}
+	return l.sample <= 1 || (atomic.AddInt64(&l.count, 1)-1)%l.sample == 0
+}
+
+// setLogOption applies a loglevel or logsample option, whose value v is
+// op:level or op:n, to c.
+func (c *storeCache) setLogOption(k, v string) error {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return errors.Errorf("want operation:%s", map[string]string{"loglevel": "level", "logsample": "n"}[k])
+	}
+	name, arg := v[:i], v[i+1:]
+	known := false
+	for _, op := range logOps {
+		known = known || op == name
+	}
+	if !known {
+		return errors.Errorf("unknown operation %q", name)
+	}
+	if c.logging == nil {
+		c.logging = make(map[string]*opLog)
+	}
+	l, ok := c.logging[name]
+	if !ok {
+		l = &opLog{logger: log.Debug, sample: 1}
+		c.logging[name] = l
+	}
+	if k == "logsample" {
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 1 {
+			return errors.Errorf("invalid sample %q", arg)
+		}
+		l.sample = n
+		return nil
+	}
+	switch arg {
+	case "debug":
+		l.logger = log.Debug
+	case "info":
+		l.logger = log.Info
+	case "error":
+		l.logger = log.Error
+	case "none":
+		l.logger = nil
+	default:
+		return errors.Errorf("level %q is not debug, info, error, or none", arg)
+	}
+	return nil
+}
+
+// logf logs the start of a request, as c's loglevel and logsample
+// options say for its operation, the first word of format, and returns
+// the operation for reporting its failure.
+func (s *server) logf(format string, args ...interface{}) operation {
+	name := format
+	if i := strings.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
+	}
+	l := defaultOpLog
+	if s.files != nil {
+		if ol, ok := s.files.logging[name]; ok {
+			l = ol
+		}
+	}
+	op := operation{s: fmt.Sprintf(format, args...), logger: l.logger}
+	if l.logs() {
+		l.logger.Print("store/storecache: " + op.s)
+	}
+	return op
+}
+
+// operation is a request being served, as logged when it started.
+type operation struct {
+	s      string
+	logger log.Logger // Nil if its operation is not logged.
+}
+
+func (op operation) error(err error) error {
+	if op.logger != nil {
+		op.logger.Printf("store/storecache: %s failed: %v", op.s, err)
+	}
+	return errors.E("store/storecache."+op.s, err)
+}
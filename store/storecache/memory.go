@@ -0,0 +1,181 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/cache"
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// memCache is a writethrough Cache and Invalidator that keeps the blocks in memory,
+// for tests and for clients that need not keep them across restarts.
+// Eviction is least recently used, as for the cache in files.
+type memCache struct {
+	mu    sync.Mutex
+	limit int64      // Most bytes to hold.
+	bytes int64      // Bytes held.
+	lru   *cache.LRU // Key is the memKey. Value is *memBlock.
+}
+
+// memKey identifies a block in a memCache.
+type memKey struct {
+	e   upspin.Endpoint
+	ref upspin.Reference
+}
+
+// memBlock is a block held in a memCache.
+type memBlock struct {
+	c       *memCache
+	data    []byte
+	expires time.Time // Zero if the block never expires.
+}
+
+// OnEviction implements cache.EvictionNotifier. It is called
+// with c.mu held, by the Add that evicts b.
+func (b *memBlock) OnEviction(key interface{}) {
+	b.c.bytes -= int64(len(b.data))
+}
+
+// NewMemory returns a Cache that keeps up to maxBytes of blocks in
+// memory. It writes each Put through to its store before returning.
+func NewMemory(maxBytes int64) Cache {
+	// The bytes are the real limit; that on the references only
+	// keeps many tiny blocks in check.
+	maxRefs := int(maxBytes / 128)
+	if maxRefs < 100 {
+		maxRefs = 100
+	} else if maxRefs > 100000 {
+		maxRefs = 100000
+	}
+	return &memCache{
+		limit: maxBytes,
+		lru:   cache.NewLRU(maxRefs),
+	}
+}
+
+func (c *memCache) Get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	lookup := lookupSpan(sp, ref, e)
+	key := memKey{e, ref}
+	c.mu.Lock()
+	if v, ok := c.lru.Get(key); ok {
+		b := v.(*memBlock)
+		if b.expires.IsZero() || time.Now().Before(b.expires) {
+			refdata := &upspin.Refdata{Reference: ref}
+			if !b.expires.IsZero() {
+				refdata.Duration = time.Until(b.expires)
+			}
+			c.mu.Unlock()
+			endSpan(lookup)
+			return append([]byte(nil), b.data...), refdata, nil, nil
+		}
+		c.remove(key)
+	}
+	c.mu.Unlock()
+	endSpan(lookup)
+
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	origin := originSpan(sp, ref, e)
+	data, refdata, locs, err := store.Get(ref)
+	endSpan(origin)
+	if err != nil || len(locs) > 0 {
+		return data, refdata, locs, err
+	}
+	c.add(key, data, refdata)
+	return data, refdata, nil, nil
+}
+
+func (c *memCache) Put(cfg upspin.Config, data []byte, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error) {
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	origin := originSpan(sp, "", e)
+	refdata, err := store.Put(data)
+	endSpan(origin)
+	if err != nil {
+		return nil, err
+	}
+	c.add(memKey{e, refdata.Reference}, data, refdata)
+	return refdata, nil
+}
+
+func (c *memCache) Delete(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, sp *metric.Span) error {
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		return err
+	}
+	origin := originSpan(sp, ref, e)
+	err = store.Delete(ref)
+	endSpan(origin)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.remove(memKey{e, ref})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memCache) Invalidate(ref upspin.Reference, e upspin.Endpoint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remove(memKey{e, ref})
+}
+
+func (c *memCache) Usage() (bytes, entries int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes, int64(c.lru.Len())
+}
+
+// Flush returns at once, as every Put is written through.
+func (c *memCache) Flush() error { return nil }
+
+func (c *memCache) Close() {}
+
+// add caches data for key, unless refdata says it is volatile or it
+// would not fit, evicting the least recently used blocks to make room.
+func (c *memCache) add(key memKey, data []byte, refdata *upspin.Refdata) {
+	size := int64(len(data))
+	if refdata.Volatile || size > c.limit {
+		return
+	}
+	// Copy the data, which belongs to the caller.
+	b := &memBlock{c: c, data: append([]byte(nil), data...)}
+	if refdata.Duration > 0 {
+		b.expires = time.Now().Add(refdata.Duration)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	for c.bytes+size > c.limit {
+		_, v := c.lru.RemoveOldest()
+		if v == nil {
+			break
+		}
+		c.bytes -= int64(len(v.(*memBlock).data))
+	}
+	c.lru.Add(key, b)
+	c.bytes += size
+}
+
+// remove drops the block for key, if any, reporting whether there was one.
+// This is called with c.mu held.
+func (c *memCache) remove(key memKey) bool {
+	v := c.lru.Remove(key)
+	if v == nil {
+		return false
+	}
+	c.bytes -= int64(len(v.(*memBlock).data))
+	return true
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"upspin.io/bind"
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Mirrored writes.
+//
+// A block Put through the cache is kept in one store, and until a
+// writeback cache writes it back, on one disk. For durability the cache
+// may also put each block for a store to mirror stores, named by the
+// mirror=endpoint@mirror option, which may be repeated, and report a Put
+// done only once a quorum of them, the store itself among them, have
+// acknowledged it. The quorum is c.mirrorQuorum stores, set by the
+// mirrorquorum=n option, or all of them if it is zero or more than there
+// are. The cache keeps its one copy of the block as usual, filed under
+// the store itself.
+//
+// The Puts are made to all the stores at once, each as originPut makes
+// a Put to a single store, and the Put returns as soon as the store
+// itself has answered and the quorum is reached, or as soon as it can
+// no longer be reached; the other Puts run on in the background. The
+// Refdata returned is the store's own, or if it failed, a mirror's.
+// Deletes are made to the mirrors in the same way, and a mirror that
+// does not have the block counts as acknowledging its Delete.
+//
+// Gets go to the store alone; the mirrors hold copies for when it is
+// lost, not to serve the cache. Each failure of a mirror is logged and
+// counted in Stats.MirrorFailures.
+
+// parseMirror parses the value of a mirror option, endpoint@mirror,
+// and returns the two endpoints.
+func parseMirror(v string) (e, mirror upspin.Endpoint, err error) {
+	at := strings.LastIndex(v, "@")
+	if at < 0 {
+		return e, mirror, errors.Str("want endpoint@mirror")
+	}
+	pe, err := upspin.ParseEndpoint(v[:at])
+	if err != nil {
+		return e, mirror, err
+	}
+	me, err := upspin.ParseEndpoint(v[at+1:])
+	if err != nil {
+		return e, mirror, err
+	}
+	if *pe == *me {
+		return e, mirror, errors.Errorf("%s cannot mirror itself", pe)
+	}
+	return *pe, *me, nil
+}
+
+// quorum returns the number of acknowledgements needed from n stores.
+func (c *storeCache) quorum(n int) int {
+	if c.mirrorQuorum <= 0 || c.mirrorQuorum > n {
+		return n
+	}
+	return c.mirrorQuorum
+}
+
+// A mirrorResult is the outcome of a call to one of a set of mirrored
+// stores.
+type mirrorResult struct {
+	i       int // Index of the store; 0 is the store itself.
+	refdata *upspin.Refdata
+	err     error
+}
+
+// mirroredPut puts data to store and to its mirrors, if any, and
+// returns once the quorum of them have acknowledged it.
+// No locks are held on entry or exit.
+func (c *storeCache) mirroredPut(cfg upspin.Config, store upspin.StoreServer, data []byte) (*upspin.Refdata, error) {
+	mirrors := c.mirrors[store.Endpoint()]
+	if len(mirrors) == 0 {
+		return c.originPut(store, data)
+	}
+	var refdata *upspin.Refdata
+	err := c.mirrored(cfg, store, "Put", func(r mirrorResult) {
+		if r.err == nil && (refdata == nil || r.i == 0) {
+			refdata = r.refdata
+		}
+	}, func(s upspin.StoreServer) (*upspin.Refdata, error) {
+		return c.originPut(s, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refdata, nil
+}
+
+// mirroredDelete deletes ref from store and from its mirrors, if any,
+// and returns once the quorum of them have acknowledged it. An error
+// from store itself is returned as is, so that callers may tell what it
+// was.
+// No locks are held on entry or exit.
+func (c *storeCache) mirroredDelete(cfg upspin.Config, store upspin.StoreServer, ref upspin.Reference) error {
+	mirrors := c.mirrors[store.Endpoint()]
+	if len(mirrors) == 0 {
+		return store.Delete(ref)
+	}
+	var storeErr error
+	err := c.mirrored(cfg, store, "Delete", func(r mirrorResult) {
+		if r.i == 0 {
+			storeErr = r.err
+		}
+	}, func(s upspin.StoreServer) (*upspin.Refdata, error) {
+		err := s.Delete(ref)
+		if err != nil && s != store && errors.Match(errors.E(errors.NotExist), err) {
+			// The mirror does not have it, which is what was wanted.
+			err = nil
+		}
+		return nil, err
+	})
+	if storeErr != nil {
+		return storeErr
+	}
+	return err
+}
+
+// mirrored makes call to store and its mirrors at once and waits until
+// store has answered and the quorum is reached, or until the quorum can
+// no longer be reached. Each result is passed to seen as it arrives
+// until mirrored returns. It returns an error, of the kind of the first
+// failure, if the quorum was not reached.
+// No locks are held on entry or exit.
+func (c *storeCache) mirrored(cfg upspin.Config, store upspin.StoreServer, op string, seen func(mirrorResult), call func(upspin.StoreServer) (*upspin.Refdata, error)) error {
+	mirrors := c.mirrors[store.Endpoint()]
+	n := 1 + len(mirrors)
+	need := c.quorum(n)
+	results := make(chan mirrorResult, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			s := store
+			if i > 0 {
+				var err error
+				s, err = bind.StoreServer(cfg, mirrors[i-1])
+				if err != nil {
+					results <- mirrorResult{i: i, err: err}
+					return
+				}
+			}
+			refdata, err := call(s)
+			if err != nil && i > 0 {
+				atomic.AddInt64(&c.counters.mirrorFailures, 1)
+				log.Info.Printf("store/storecache: %s to mirror %s of %s: %v", op, mirrors[i-1], store.Endpoint(), err)
+			}
+			results <- mirrorResult{i: i, refdata: refdata, err: err}
+		}(i)
+	}
+	var (
+		acks, fails int
+		storeDone   bool
+		firstErr    error
+	)
+	for acks < need || !storeDone {
+		if n-fails < need {
+			break
+		}
+		r := <-results
+		seen(r)
+		if r.i == 0 {
+			storeDone = true
+		}
+		if r.err != nil {
+			fails++
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		acks++
+	}
+	if acks >= need {
+		return nil
+	}
+	kind := errors.IO
+	if e, ok := firstErr.(*errors.Error); ok && e.Kind != errors.Other {
+		kind = e.Kind
+	}
+	return errors.E(kind, errors.Errorf("%s to %s and its mirrors acknowledged by %d of %d stores, %d needed: %v", op, store.Endpoint(), acks, n, need, firstErr))
+}
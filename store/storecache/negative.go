@@ -0,0 +1,104 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"upspin.io/errors"
+)
+
+// Negative caching.
+//
+// Clients sometimes ask again and again for a reference the store does
+// not have, such as one whose block is still being written elsewhere. If
+// the cache has a negative TTL, given by the negativettl=duration option,
+// a NotExist error from the store is remembered for that long and
+// returned to later Gets of the reference without asking the store again.
+// A Put of the reference through the cache forgets the error at once.
+//
+// A fetch that was already under way when the Put arrived may still
+// report NotExist; the put generation keeps it from being remembered.
+
+// A notExist records a NotExist error returned by a store.
+type notExist struct {
+	err     error
+	expires time.Time
+}
+
+// missing returns the remembered NotExist error for the reference cached
+// in file, or nil if there is none.
+// No locks are held on entry or exit.
+func (c *storeCache) missing(file string) error {
+	if c.negativeTTL <= 0 {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	n, ok := c.notExist[file]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(n.expires) {
+		delete(c.notExist, file)
+		return nil
+	}
+	atomic.AddInt64(&c.counters.notExist, 1)
+	return n.err
+}
+
+// rememberMissing records err for the reference cached in file if it
+// is a NotExist error and no Put has been seen since generation gen.
+// No locks are held on entry or exit.
+func (c *storeCache) rememberMissing(file string, err error, gen int64) {
+	if c.negativeTTL <= 0 || !errors.Match(errors.E(errors.NotExist), err) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.putGen != gen {
+		return
+	}
+	now := time.Now()
+	if len(c.notExist) >= c.maxRefs {
+		// Make room by dropping the expired entries; if there
+		// are none, don't remember this one.
+		for f, n := range c.notExist {
+			if now.After(n.expires) {
+				delete(c.notExist, f)
+			}
+		}
+		if len(c.notExist) >= c.maxRefs {
+			return
+		}
+	}
+	c.notExist[file] = notExist{err: err, expires: now.Add(c.negativeTTL)}
+}
+
+// putGeneration returns the current put generation, to be passed to
+// rememberMissing after a fetch.
+// No locks are held on entry or exit.
+func (c *storeCache) putGeneration() int64 {
+	if c.negativeTTL <= 0 {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.putGen
+}
+
+// forgetMissing forgets any NotExist error for the reference cached in
+// file, which is being Put, and starts a new put generation.
+// No locks are held on entry or exit.
+func (c *storeCache) forgetMissing(file string) {
+	if c.negativeTTL <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.putGen++
+	delete(c.notExist, file)
+}
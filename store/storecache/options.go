@@ -0,0 +1,258 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"math"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Options.
+//
+// The options given to New are strings of the form key=value. Most are
+// described with the code that implements them:
+//
+//	accessttl=duration                      control.go
+//	admission=true                          admission.go
+//	bandwidth=bytes, storebandwidth=bytes   bandwidth.go
+//	colddir=dir, coldbytes=bytes            tier.go
+//	compactinterval=duration                compact.go
+//	compress=true                           compress.go
+//	dedup=true                              dedup.go
+//	fsync=policy, fsyncinterval=duration    fsync.go
+//	loglevel=op:level, logsample=op:n       logging.go
+//	maxstale=duration                       stale.go
+//	mirror=endpoint@mirror, mirrorquorum=n  mirror.go
+//	negativettl=duration                    negative.go
+//	originpin=endpoint@pin                  origin.go
+//	pinbytes=bytes                          pin.go
+//	retries=n, retrywait=duration           origin.go
+//	shardlevels=n                           layout.go
+//	storelimit=n, storewait=duration        origin.go
+//	timeout=duration                        origin.go
+//	userquota=bytes                         quota.go
+//
+// The rest are these.
+//
+// verify=true causes cached blocks to be checked against their
+// references before being returned, so that blocks damaged on the local
+// disk are discarded and fetched again.
+//
+// maxentrybytes=bytes limits the size of a cached block. A Put of a larger
+// block fails with an errors.Invalid error and is neither cached nor
+// written to its store; a larger block fetched from a store is returned
+// but not cached. By default there is no limit.
+//
+// highwater=percent and lowwater=percent set the watermarks of eviction,
+// as percentages of the cache's byte limit. Once the bytes cached pass
+// the high watermark, the least recently used blocks are evicted in one
+// pass until they are within the low watermark, so that a busy cache
+// evicts in batches rather than a block at a time. The high watermark is
+// by default 100, and the low one the same as the high.
+//
+// passthrough=endpoint names a store that is not to be cached, such as
+// one that is already fast. Requests for its blocks are forwarded to it
+// directly and nothing about them is kept. The option may be repeated.
+
+// setOptions applies the options given to New.
+func (c *storeCache) setOptions(options []string) error {
+	const op = "store/storecache.New"
+	highWater, lowWater := 100, 0 // Percentages of limit; lowWater defaults to highWater.
+	// Entries for tlspins; see origin.go.
+	var pins []string
+	for _, opt := range options {
+		o := strings.Split(opt, "=")
+		if len(o) != 2 {
+			return errors.E(op, errors.Invalid, errors.Errorf("invalid option format: %q", opt))
+		}
+		k, v := o[0], o[1]
+		var err error
+		switch k {
+		case "verify":
+			c.verify, err = parseBoolOption(k, v)
+		case "compress":
+			c.compress, err = parseBoolOption(k, v)
+		case "dedup":
+			c.dedup, err = parseBoolOption(k, v)
+			if c.dedup && !linksCounted {
+				err = errors.E(errors.Invalid, errors.Errorf("%s is not supported on %s", k, runtime.GOOS))
+			}
+		case "admission":
+			var b bool
+			b, err = parseBoolOption(k, v)
+			c.admission = nil
+			if b {
+				c.admission = newSketch(c.maxRefs)
+			}
+		case "maxentrybytes":
+			c.maxEntryBytes, err = parseIntOption(k, v, 0, math.MaxInt64)
+		case "fsync":
+			c.fsync, err = parseSyncPolicy(v)
+			if err != nil {
+				err = invalidValue(k, v, nil)
+			}
+		case "fsyncinterval":
+			c.syncInterval, err = parseDurationOption(k, v, time.Nanosecond)
+		case "userquota":
+			c.userQuota, err = parseIntOption(k, v, 0, math.MaxInt64)
+		case "passthrough":
+			e, perr := upspin.ParseEndpoint(v)
+			if perr != nil {
+				err = invalidValue(k, v, nil)
+				break
+			}
+			if c.passthrough == nil {
+				c.passthrough = make(map[upspin.Endpoint]bool)
+			}
+			c.passthrough[*e] = true
+		case "originpin":
+			pin, perr := parseOriginPin(v)
+			if perr != nil {
+				err = invalidValue(k, v, perr)
+				break
+			}
+			pins = append(pins, pin)
+		case "mirror":
+			e, mirror, perr := parseMirror(v)
+			if perr != nil {
+				err = invalidValue(k, v, perr)
+				break
+			}
+			if c.mirrors == nil {
+				c.mirrors = make(map[upspin.Endpoint][]upspin.Endpoint)
+			}
+			c.mirrors[e] = append(c.mirrors[e], mirror)
+		case "mirrorquorum":
+			c.mirrorQuorum, err = parseCountOption(k, v, 0, maxInt)
+		case "loglevel", "logsample":
+			if perr := c.setLogOption(k, v); perr != nil {
+				err = invalidValue(k, v, perr)
+			}
+		case "negativettl":
+			c.negativeTTL, err = parseDurationOption(k, v, 0)
+		case "storelimit":
+			c.storeLimit, err = parseCountOption(k, v, 0, maxInt)
+		case "bandwidth":
+			var n int64
+			n, err = parseIntOption(k, v, 0, math.MaxInt64)
+			c.bandwidth = nil
+			if n > 0 {
+				c.bandwidth = newBucket(n)
+			}
+		case "storebandwidth":
+			c.storeBandwidth, err = parseIntOption(k, v, 0, math.MaxInt64)
+		case "storewait":
+			c.storeWait, err = parseDurationOption(k, v, 0)
+		case "colddir":
+			if v == "" {
+				err = invalidValue(k, v, nil)
+				break
+			}
+			c.coldDir = path.Join(v, "storecache")
+		case "highwater":
+			highWater, err = parseCountOption(k, v, 1, 100)
+		case "lowwater":
+			lowWater, err = parseCountOption(k, v, 1, 100)
+		case "pinbytes":
+			c.pinLimit, err = parseIntOption(k, v, 0, math.MaxInt64)
+		case "coldbytes":
+			c.coldLimit, err = parseIntOption(k, v, 0, math.MaxInt64)
+		case "shardlevels":
+			c.shardLevels, err = parseCountOption(k, v, 0, maxShardLevels)
+		case "maxstale":
+			c.maxStale, err = parseDurationOption(k, v, 0)
+		case "accessttl":
+			c.accessTTL, err = parseDurationOption(k, v, 0)
+		case "retries":
+			c.retries, err = parseCountOption(k, v, 0, maxInt)
+		case "retrywait":
+			c.retryWait, err = parseDurationOption(k, v, 0)
+		case "compactinterval":
+			c.compactInterval, err = parseDurationOption(k, v, 0)
+		case "timeout":
+			c.timeout, err = parseDurationOption(k, v, 0)
+		default:
+			err = errors.E(errors.Invalid, errors.Errorf("unknown option %q", k))
+		}
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+	if (c.coldDir == "") != (c.coldLimit == 0) {
+		return errors.E(op, errors.Invalid, errors.Str("colddir and coldbytes must be given together"))
+	}
+	if lowWater == 0 {
+		lowWater = highWater
+	}
+	if lowWater > highWater {
+		return errors.E(op, errors.Invalid, errors.Str("lowwater must not exceed highwater"))
+	}
+	c.highWater = c.limit * int64(highWater) / 100
+	c.lowWater = c.limit * int64(lowWater) / 100
+	if len(pins) > 0 {
+		pins = append(strings.Fields(c.cfg.Value("tlspins")), pins...)
+		c.cfg = config.SetValue(c.cfg, "tlspins", strings.Join(pins, " "))
+	}
+	return nil
+}
+
+// invalidValue returns the error for option k given the value v,
+// giving the reason, err, if it is not nil.
+func invalidValue(k, v string, err error) error {
+	if err != nil {
+		return errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q: %v", k, v, err))
+	}
+	return errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+}
+
+// parseBoolOption parses the value v of the boolean option k.
+func parseBoolOption(k, v string) (bool, error) {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, invalidValue(k, v, nil)
+	}
+	return b, nil
+}
+
+// parseIntOption parses the value v of option k, a 64-bit integer
+// between min and max inclusive.
+func parseIntOption(k, v string, min, max int64) (int64, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < min || n > max {
+		return 0, invalidValue(k, v, nil)
+	}
+	return n, nil
+}
+
+// maxInt is the largest int.
+const maxInt = int(^uint(0) >> 1)
+
+// parseCountOption parses the value v of option k, an int between min
+// and max inclusive.
+func parseCountOption(k, v string, min, max int) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, invalidValue(k, v, nil)
+	}
+	return n, nil
+}
+
+// parseDurationOption parses the value v of option k, a duration of at
+// least min.
+func parseDurationOption(k, v string, min time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < min {
+		return 0, invalidValue(k, v, nil)
+	}
+	return d, nil
+}
@@ -0,0 +1,361 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Calls to origin stores.
+//
+// A store that stops responding would hold up every request for its
+// blocks, and the goroutines serving them, indefinitely. If the cache has
+// a timeout, given by the timeout=duration option, calls to stores that
+// take longer than that are abandoned and fail with an IO error whose
+// text includes "timeout". Nothing is cached for them. StoreServer calls
+// cannot be cancelled, so an abandoned call runs on in the background and
+// its result, when it arrives, is discarded.
+//
+// To avoid flooding a store, for instance when a cold cache misses on
+// many blocks at once, the cache may also limit the calls in progress to
+// each store with the storelimit=n option. Calls beyond the limit wait
+// their turn, but only for c.storeWait, set by the storewait=duration
+// option and by default defaultStoreWait; then they fail with a Transient
+// error, which the client may retry. An abandoned call keeps its place
+// until it returns, since the store is still working on it.
+//
+// A store that fails briefly, say while it restarts, need not fail the
+// clients of the cache. If the cache has retries, given by the retries=n
+// option, a Get that fails with an IO or Transient error, such as a
+// network failure, an unavailable store, or a call refused for want of a
+// turn, is tried again up to that many times, after a wait that starts at
+// c.retryWait, set by the retrywait=duration option and by default
+// defaultRetryWait, and doubles each time, up to maxRetryWait, with
+// random jitter so that the clients of a recovering store do not return
+// to it all at once. Other errors, such as NotExist or Permission, are
+// the store's answer and are not retried. Gets are idempotent; Puts,
+// whose failures a writeback cache already retries, are not retried here.
+// If the cache also has a timeout, it bounds the Get as a whole rather
+// than each try: a retry is given only the time remaining, and none is
+// made once the wait for it would pass the deadline. Each retry is
+// counted in Stats.Retries.
+//
+// So that a failing store can be noticed without reading the logs, the
+// cache keeps for each store the number of calls made to it and of
+// those that failed, the fraction that failed within the last
+// originWindow, and the last originErrorsKept errors with their times.
+// They are reported in Stats.Origins. A NotExist error is the store's
+// answer, not a failure, and is not counted as one; a call refused for
+// want of a turn never reaches the store and is not counted at all.
+//
+// The cache holds many users' blocks, so a man in the middle of its
+// connection to a store could do much harm. The originpin option, which
+// may be repeated, pins the TLS certificates the cache accepts from a
+// store, by the hash of its public key or by the CA certificates it must
+// chain to, in place of the system roots. Its value is
+// endpoint@sha256:hash, for a certificate whose public key, its
+// SubjectPublicKeyInfo, has that SHA-256 hash in hex, or
+// endpoint@ca:file, for one that chains to a CA certificate in the PEM
+// file. The pins are added to the tlspins of the cache's config; see
+// upspin.io/rpc. Package bind dials a store afresh for each value of
+// tlspins, so the cache never shares a connection dialed without the
+// pins, such as one of a client in the same process. A store whose
+// certificate does not match fails every call with a Permission error
+// naming the mismatch.
+
+const (
+	originErrorsKept = 10              // Errors kept for each store.
+	originWindow     = 5 * time.Minute // Period over which the error rate is measured.
+	originBuckets    = 5               // Divisions of originWindow.
+)
+
+// parseOriginPin parses the value of an originpin option,
+// endpoint@sha256:hex or endpoint@ca:file, and returns it as an entry
+// for tlspins.
+func parseOriginPin(v string) (string, error) {
+	at := strings.LastIndex(v, "@")
+	if at < 0 {
+		return "", errors.Str("want endpoint@pin")
+	}
+	e, err := upspin.ParseEndpoint(v[:at])
+	if err != nil {
+		return "", err
+	}
+	if e.Transport != upspin.Remote {
+		return "", errors.Errorf("%s is not a remote endpoint", e)
+	}
+	pin := v[at+1:]
+	switch {
+	case strings.HasPrefix(pin, "sha256:"):
+		if b, err := hex.DecodeString(pin[len("sha256:"):]); err != nil || len(b) != sha256.Size {
+			return "", errors.Errorf("invalid SHA-256 hash in %q", pin)
+		}
+	case strings.HasPrefix(pin, "ca:"):
+		if _, err := os.Stat(pin[len("ca:"):]); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.Errorf("pin %q is neither sha256:hash nor ca:file", pin)
+	}
+	return string(e.NetAddr) + "=" + pin, nil
+}
+
+// defaultRetryWait is the wait before the first retry of a failed Get
+// if the retrywait option is not given, and maxRetryWait the longest
+// wait between retries.
+const (
+	defaultRetryWait = 100 * time.Millisecond
+	maxRetryWait     = 5 * time.Second
+)
+
+// defaultStoreWait is how long a call waits for a turn at a store
+// if the storewait option is not given.
+const defaultStoreWait = 10 * time.Second
+
+// acquire waits for a turn to call the store at e, if the calls to
+// each store are limited. It returns a function to be called when the
+// call is complete.
+// No locks are held on entry or exit.
+func (c *storeCache) acquire(e upspin.Endpoint) (release func(), err error) {
+	if c.storeLimit <= 0 {
+		return func() {}, nil
+	}
+	c.Lock()
+	sem, ok := c.turns[e]
+	if !ok {
+		sem = make(chan struct{}, c.storeLimit)
+		c.turns[e] = sem
+	}
+	c.Unlock()
+	release = func() { <-sem }
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	wait := c.storeWait
+	if wait <= 0 {
+		wait = defaultStoreWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		atomic.AddInt64(&c.counters.throttled, 1)
+		return nil, errors.E(errors.Transient, errors.Errorf("%d requests to %s in progress; gave up waiting after %v", c.storeLimit, e, wait))
+	}
+}
+
+// originGet calls store.Get, giving up after c.timeout if it is set,
+// and retrying transient failures if the cache has retries.
+func (c *storeCache) originGet(store upspin.StoreServer, ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	wait := c.retryWait
+	if wait <= 0 {
+		wait = defaultRetryWait
+	}
+	timeout := c.timeout
+	for try := 0; ; try++ {
+		data, refdata, locs, err := c.originGetOnce(store, ref, timeout)
+		if err == nil || try >= c.retries || !retriable(err) {
+			return data, refdata, locs, err
+		}
+		// Wait between half and all of wait, so that clients that
+		// failed together do not all retry together.
+		d := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline) - d; timeout <= 0 {
+				return data, refdata, locs, err
+			}
+		}
+		atomic.AddInt64(&c.counters.retries, 1)
+		time.Sleep(d)
+		if wait *= 2; wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+	}
+}
+
+// retriable reports whether err, from a store, may be cured by trying
+// again.
+func retriable(err error) bool {
+	return errors.Match(errors.E(errors.IO), err) || errors.Match(errors.E(errors.Transient), err)
+}
+
+// originGetOnce calls store.Get, giving up after timeout if it is
+// positive. Like originPut, it first waits for any bandwidth limits;
+// see bandwidth.go.
+func (c *storeCache) originGetOnce(store upspin.StoreServer, ref upspin.Reference, timeout time.Duration) (data []byte, refdata *upspin.Refdata, locs []upspin.Location, err error) {
+	c.awaitBandwidth(store.Endpoint(), 0)
+	release, err := c.acquire(store.Endpoint())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() { c.origins.record(store.Endpoint(), "Get", err, time.Now()) }()
+	if timeout <= 0 {
+		defer release()
+		data, refdata, locs, err = store.Get(ref)
+		c.chargeBandwidth(store.Endpoint(), len(data))
+		return data, refdata, locs, err
+	}
+	type result struct {
+		data    []byte
+		refdata *upspin.Refdata
+		locs    []upspin.Location
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, refdata, locs, err := store.Get(ref)
+		c.chargeBandwidth(store.Endpoint(), len(data))
+		release()
+		done <- result{data, refdata, locs, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.data, r.refdata, r.locs, r.err
+	case <-timer.C:
+		return nil, nil, nil, timeoutError(store, "Get", timeout)
+	}
+}
+
+// originPut calls store.Put, giving up after c.timeout if it is set.
+func (c *storeCache) originPut(store upspin.StoreServer, data []byte) (refdata *upspin.Refdata, err error) {
+	c.awaitBandwidth(store.Endpoint(), len(data))
+	release, err := c.acquire(store.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { c.origins.record(store.Endpoint(), "Put", err, time.Now()) }()
+	if c.timeout <= 0 {
+		defer release()
+		return store.Put(data)
+	}
+	type result struct {
+		refdata *upspin.Refdata
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		refdata, err := store.Put(data)
+		release()
+		done <- result{refdata, err}
+	}()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.refdata, r.err
+	case <-timer.C:
+		return nil, timeoutError(store, "Put", c.timeout)
+	}
+}
+
+func timeoutError(store upspin.StoreServer, call string, timeout time.Duration) error {
+	return errors.E(errors.IO, errors.Errorf("%s to %s: timeout after %v", call, store.Endpoint(), timeout))
+}
+
+// origins records the calls made to each origin store.
+type origins struct {
+	mu sync.Mutex
+	m  map[upspin.Endpoint]*originHealth
+}
+
+// originHealth records the calls made to one origin store.
+type originHealth struct {
+	calls, errors int64
+	recent        []OriginError // The last originErrorsKept, oldest first.
+
+	// rate holds the calls and failures in each of the last
+	// originBuckets periods, indexed by the period's number modulo
+	// originBuckets.
+	rate [originBuckets]struct{ period, calls, errors int64 }
+}
+
+// period returns the number of the division of originWindow holding t.
+func period(t time.Time) int64 {
+	return t.UnixNano() / int64(originWindow/originBuckets)
+}
+
+// record records a call to the store at e that returned err at time now.
+// Any locks may be held.
+func (o *origins) record(e upspin.Endpoint, call string, err error, now time.Time) {
+	failed := err != nil && !errors.Match(errors.E(errors.NotExist), err)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.m == nil {
+		o.m = make(map[upspin.Endpoint]*originHealth)
+	}
+	h := o.m[e]
+	if h == nil {
+		h = &originHealth{}
+		o.m[e] = h
+	}
+	p := period(now)
+	b := &h.rate[p%originBuckets]
+	if b.period != p {
+		b.period, b.calls, b.errors = p, 0, 0
+	}
+	h.calls++
+	b.calls++
+	if !failed {
+		return
+	}
+	h.errors++
+	b.errors++
+	if len(h.recent) == originErrorsKept {
+		h.recent = append(h.recent[:0], h.recent[1:]...)
+	}
+	h.recent = append(h.recent, OriginError{Time: now, Call: call, Error: err.Error()})
+}
+
+// snapshot returns the health of each store at time now, in order of
+// endpoint.
+// Any locks may be held.
+func (o *origins) snapshot(now time.Time) []Origin {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]Origin, 0, len(o.m))
+	p := period(now)
+	for e, h := range o.m {
+		origin := Origin{
+			Endpoint: e,
+			Calls:    h.calls,
+			Errors:   h.errors,
+			Recent:   append([]OriginError(nil), h.recent...),
+		}
+		var calls, errs int64
+		for _, b := range h.rate {
+			if b.period > p-originBuckets {
+				calls += b.calls
+				errs += b.errors
+			}
+		}
+		if calls > 0 {
+			origin.ErrorRate = float64(errs) / float64(calls)
+		}
+		list = append(list, origin)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Endpoint.String() < list[j].Endpoint.String() })
+	return list
+}
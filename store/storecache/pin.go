@@ -0,0 +1,128 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Pinning.
+//
+// Some blocks, such as those of root directories and of the Access files
+// that guard them, are worth keeping whatever else is read. A pinned block
+// stays in the main tier until it is unpinned: it is neither evicted nor
+// demoted to keep within the byte limit or a user's quota, though it is
+// still dropped by Delete and Invalidate. Its bytes count not against the
+// cache's byte limit but against a separate one, given by the pinbytes
+// option, so that pinning cannot leave the cache no room for anything
+// else. Nor may more than half the references the cache holds be pinned.
+// Pins are not recorded on disk; a restarted cache holds the blocks it
+// held but they are no longer pinned.
+
+// pin fetches the block ref from the store at e into the cache, if it is
+// not there already, and pins it.
+// No locks are held on entry or exit.
+func (c *storeCache) pin(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint) error {
+	const op = "store/storecache.Pin"
+	if c.pinLimit <= 0 {
+		return errors.E(op, errors.Invalid, errors.Str("pinning is not enabled"))
+	}
+	if c.passthrough[e] {
+		return errors.E(op, errors.Invalid, errors.Errorf("blocks of %s are not cached", e))
+	}
+	if _, _, _, err := c.fetch(cfg, ref, e, true, nil); err != nil {
+		return errors.E(op, err)
+	}
+	file := c.cachePath(ref, e)
+	c.Lock()
+	defer c.Unlock()
+	value, ok := c.lru.Get(file)
+	if !ok {
+		return errors.E(op, errors.NotExist, errors.Errorf("%s could not be cached", ref))
+	}
+	cr := value.(*cachedRef)
+	cr.Lock()
+	defer cr.Unlock()
+	if cr.pinned {
+		return nil
+	}
+	if !cr.valid || cr.cold {
+		return errors.E(op, errors.NotExist, errors.Errorf("%s could not be cached", ref))
+	}
+	if atomic.LoadInt64(&c.pinnedBytes)+cr.size > c.pinLimit {
+		return errors.E(op, errors.Invalid, errors.Errorf("pinning %s would exceed pinbytes", ref))
+	}
+	if c.pins+1 > c.maxRefs/2 {
+		return errors.E(op, errors.Invalid, errors.Str("too many references pinned"))
+	}
+	cr.pinned = true
+	c.pins++
+	atomic.AddInt64(&c.inUse, -cr.size)
+	atomic.AddInt64(&c.pinnedBytes, cr.size)
+	return nil
+}
+
+// unpin unpins the block ref from the store at e, reporting whether it
+// was pinned. The block stays in the cache, subject to eviction like any
+// other.
+// No locks are held on entry or exit.
+func (c *storeCache) unpin(ref upspin.Reference, e upspin.Endpoint) bool {
+	file := c.cachePath(ref, e)
+	c.Lock()
+	value, ok := c.lru.Get(file)
+	if !ok {
+		c.Unlock()
+		return false
+	}
+	cr := value.(*cachedRef)
+	cr.Lock()
+	pinned := cr.pinned
+	if pinned {
+		cr.pinned = false
+		c.pins--
+		atomic.AddInt64(&c.pinnedBytes, -cr.size)
+		atomic.AddInt64(&c.inUse, cr.size)
+	}
+	cr.Unlock()
+	c.Unlock()
+	if pinned {
+		c.enforceByteLimit(0)
+	}
+	return pinned
+}
+
+// account adds delta to the bytes counted for cr's file in the main
+// tier, which are those pinned if cr is pinned.
+// This is called with cr locked.
+func (cr *cachedRef) account(delta int64) {
+	if cr.pinned {
+		atomic.AddInt64(&cr.c.pinnedBytes, delta)
+		return
+	}
+	atomic.AddInt64(&cr.c.inUse, delta)
+}
+
+// restorePins puts back in the LRU the pinned references it dropped to
+// stay within its size; see OnEviction. Each is put back as the most
+// recently used, so another may be dropped in its turn, but since no more
+// than half the references may be pinned that ends.
+// This is called with c locked.
+func (c *storeCache) restorePins() {
+	for len(c.evictedPins) > 0 {
+		p := c.evictedPins[0]
+		c.evictedPins = c.evictedPins[1:]
+		c.lru.Add(p.file, p.cr)
+	}
+	c.evictedPins = nil
+}
+
+// evictedPin is a pinned reference dropped from the LRU, to be restored.
+type evictedPin struct {
+	file string
+	cr   *cachedRef
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Probing origins.
+//
+// A client that finds the cache slow cannot tell from its own requests
+// whether the time goes between it and the cache or between the cache
+// and the store. PingOrigin measures the second: it pings the store
+// through the connection the cache itself uses, and reports the round
+// trip. The ping neither waits for a turn at the store nor for any
+// bandwidth limit, so that it measures the store and the network rather
+// than the cache's queues, and it is not counted in Stats.Origins, which
+// describes the cache's Gets and Puts. If the cache has a timeout, a
+// ping that takes longer is abandoned and fails as a Get would.
+
+// PingOrigin pings the store at e, or the one the server was dialed for
+// if e is the zero Endpoint, and returns the time the store took to
+// answer. It fails with an IO error if the store does not answer.
+func (s *server) PingOrigin(e upspin.Endpoint) (time.Duration, error) {
+	const op = "store/storecache.PingOrigin"
+	if e == (upspin.Endpoint{}) {
+		e = s.authority
+	}
+	if e.Transport == upspin.Unassigned {
+		return 0, errNotDialed
+	}
+	s.logf("PingOrigin %s", e)
+	if !s.reqs.start() {
+		return 0, errShutdown
+	}
+	defer s.reqs.done()
+	store, err := bind.StoreServer(s.cfg, e)
+	if err != nil {
+		return 0, errors.E(op, err)
+	}
+	var timeout time.Duration
+	if s.files != nil {
+		timeout = s.files.timeout
+	}
+	rtt, err := originPing(store, timeout)
+	if err != nil {
+		return 0, errors.E(op, err)
+	}
+	return rtt, nil
+}
+
+// originPing calls store.Ping and returns the time it took, giving up
+// after timeout if it is positive.
+func originPing(store upspin.StoreServer, timeout time.Duration) (time.Duration, error) {
+	done := make(chan bool, 1)
+	start := time.Now()
+	go func() {
+		done <- store.Ping()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			return 0, errors.E(errors.IO, errors.Errorf("Ping to %s: no answer", store.Endpoint()))
+		}
+		return time.Since(start), nil
+	case <-expired:
+		return 0, timeoutError(store, "Ping", timeout)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+
+	"upspin.io/cache"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Read ahead.
+//
+// A client reading a file Gets its blocks one after another. To avoid
+// paying a round trip to the origin store for each, the cache may be
+// told the block list of a file that is likely to be read. When one of
+// those blocks is then fetched through the cache, the next few blocks
+// are fetched from their stores concurrently in the background, so
+// they are already cached when the client asks for them.
+//
+// Prefetched blocks are cached like any other and so count against the
+// cache's byte limit. Prefetching only runs ahead of actual reads, so
+// when a client stops reading, or disconnects, prefetching of its file
+// stops too. Outstanding prefetches are abandoned when the cache closes.
+
+const (
+	// prefetchAhead is how many blocks beyond the one being read
+	// are prefetched.
+	prefetchAhead = 4
+
+	// prefetchers is the maximum number of concurrent prefetches.
+	prefetchers = 8
+
+	// prefetchLists is the number of locations for which we remember
+	// the blocks that follow.
+	prefetchLists = 10000
+)
+
+// prefetcher remembers block lists and prefetches from them.
+type prefetcher struct {
+	c *storeCache
+
+	// following maps a block's Location to the Locations of the
+	// blocks that follow it in its file.
+	following *cache.LRU
+
+	sem  chan bool     // Limits the number of concurrent prefetches.
+	done chan struct{} // Closed when the cache closes.
+}
+
+func newPrefetcher(c *storeCache) *prefetcher {
+	return &prefetcher{
+		c:         c,
+		following: cache.NewLRU(prefetchLists),
+		sem:       make(chan bool, prefetchers),
+		done:      make(chan struct{}),
+	}
+}
+
+// hint records the block list of a file that is likely to be read.
+func (p *prefetcher) hint(locs []upspin.Location) {
+	for i := 0; i < len(locs)-1; i++ {
+		p.following.Add(locs[i], locs[i+1:])
+	}
+}
+
+// readAhead starts prefetching the blocks that follow loc,
+// if it is part of a hinted block list.
+func (p *prefetcher) readAhead(cfg upspin.Config, loc upspin.Location) {
+	value, ok := p.following.Get(loc)
+	if !ok {
+		return
+	}
+	next := value.([]upspin.Location)
+	if len(next) > prefetchAhead {
+		next = next[:prefetchAhead]
+	}
+	for _, l := range next {
+		if _, ok := p.c.lru.Get(p.c.cachePath(l.Reference, l.Endpoint)); ok {
+			// Cached or being cached. A block in the cold tier
+			// is fetched anyway, which promotes it.
+			continue
+		}
+		select {
+		case p.sem <- true:
+		default:
+			// Enough going on already; the client's own Get
+			// will fetch it if need be.
+			return
+		}
+		go p.fetch(cfg, l)
+	}
+}
+
+// fetch reads loc into the cache.
+func (p *prefetcher) fetch(cfg upspin.Config, loc upspin.Location) {
+	defer func() { <-p.sem }()
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	atomic.AddInt64(&p.c.counters.prefetches, 1)
+	if _, _, _, err := p.c.fetch(cfg, loc.Reference, loc.Endpoint, true, nil); err != nil {
+		log.Debug.Printf("store/storecache: prefetch %v: %v", loc, err)
+	}
+}
+
+func (p *prefetcher) close() {
+	close(p.done)
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"upspin.io/cache"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Per-user quotas.
+//
+// Each cached reference is charged to the user whose request brought it
+// into the cache. A user's references are also kept in an LRU of their
+// own so that, when the user's quota is exceeded, the user's own least
+// recently used references are evicted rather than anyone else's.
+// References found in the cache directory on startup are not charged
+// to anyone.
+//
+// The userquota=bytes option sets the quota of every user, and SetQuota
+// that of one user. By default there is none.
+
+// userCache records the references charged to a user.
+type userCache struct {
+	name  upspin.UserName
+	inUse int64      // Bytes charged to the user; accessed atomically.
+	quota int64      // Overrides the default quota if non-zero. Protected by storeCache.Mutex.
+	lru   *cache.LRU // Key is the file name. Value is ownedRef.
+}
+
+// ownedRef is the value stored in a userCache's LRU. It does not
+// implement cache.EvictionNotifier, so dropping it from a user's LRU
+// leaves the cached file alone.
+type ownedRef struct {
+	cr *cachedRef
+}
+
+// user returns the userCache for the named user, creating it if needed.
+// No locks are held on entry or exit.
+func (c *storeCache) user(name upspin.UserName) *userCache {
+	c.Lock()
+	defer c.Unlock()
+	u, ok := c.users[name]
+	if !ok {
+		u = &userCache{name: name, lru: cache.NewLRU(c.maxRefs)}
+		c.users[name] = u
+	}
+	return u
+}
+
+// setQuota sets the quota for the named user, overriding the default.
+// A negative quota means the user is not limited; zero means the default.
+func (c *storeCache) setQuota(name upspin.UserName, bytes int64) {
+	u := c.user(name)
+	c.Lock()
+	u.quota = bytes
+	c.Unlock()
+}
+
+// quotaFor returns the quota for u, or zero if u is not limited.
+// This is called with c locked.
+func (c *storeCache) quotaFor(u *userCache) int64 {
+	switch {
+	case u.quota < 0:
+		return 0
+	case u.quota > 0:
+		return u.quota
+	}
+	return c.userQuota
+}
+
+// charge records that cr, of the given size and held in file, belongs to u.
+// This is called with cr locked.
+func (u *userCache) charge(cr *cachedRef, file string) {
+	cr.owner = u
+	u.lru.Add(file, ownedRef{cr})
+	atomic.AddInt64(&u.inUse, cr.size)
+}
+
+// touch records that file was used, in the index now and then, and
+// marks it as recently used by its owner.
+// This is called with cr locked.
+func (cr *cachedRef) touch(file string) {
+	cr.used = time.Now()
+	if cr.valid && cr.used.Sub(cr.recorded) >= useInterval {
+		cr.recorded = cr.used
+		cr.c.index.use(file, cr.used)
+	}
+	if cr.owner != nil {
+		cr.owner.lru.Get(file)
+	}
+}
+
+// uncharge removes cr, held in file, from its owner's account.
+// This is called with cr locked.
+func (cr *cachedRef) uncharge(file string) {
+	if cr.owner == nil {
+		return
+	}
+	atomic.AddInt64(&cr.owner.inUse, -cr.size)
+	cr.owner.lru.Remove(file)
+	cr.owner = nil
+}
+
+// enforceUserQuota removes u's least recently used files until the bytes
+// charged to u plus need are within u's quota. As with enforceByteLimit,
+// busy references are skipped.
+// No locks are held on entry or exit.
+func (c *storeCache) enforceUserQuota(u *userCache, need int64) {
+	c.Lock()
+	defer c.Unlock()
+	quota := c.quotaFor(u)
+	if quota == 0 {
+		return
+	}
+	for n := u.lru.Len(); atomic.LoadInt64(&u.inUse)+need > quota; n-- {
+		if n == 0 {
+			log.Info.Printf("store/storecache: %s exceeding quota", u.name)
+			break
+		}
+		key, value := u.lru.RemoveOldest()
+		if value == nil {
+			break
+		}
+		file := key.(string)
+		cr := value.(ownedRef).cr
+		if !cr.evict(file) {
+			u.lru.Add(key, value)
+			continue
+		}
+		// Drop it from the global LRUs too, unless it has
+		// already gone and been replaced.
+		if v, ok := c.lookup(file); ok && v == cr {
+			c.forget(file)
+		}
+	}
+}
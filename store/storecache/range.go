@@ -0,0 +1,161 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// Range reads.
+//
+// GetRange returns only part of a block, sparing the client, and the
+// connection to it, the rest. A block that is not cached is fetched whole
+// from its store, as for Get, and cached. Once it is cached, ranges of it
+// are read from its file alone: a block stored as it is is read only as
+// far as the range requires, and a compressed block is decompressed only
+// up to the end of the range. Blocks that are stale, in the cold tier, or
+// being cached, and every block if the cache verifies what it reads, are
+// read whole, as for Get, and the range cut from them.
+
+// errRange is returned for a range that is negative or begins beyond
+// the end of the block.
+var errRange = errors.E(errors.Invalid, errors.Str("range is negative or beyond the end of the block"))
+
+// blockRange returns the length bytes of data from offset, or all those
+// from offset if length is zero.
+func blockRange(data []byte, offset, length int64) ([]byte, error) {
+	size := int64(len(data))
+	if offset < 0 || length < 0 || offset > size {
+		return nil, errRange
+	}
+	end := size
+	if length > 0 && length < size-offset {
+		end = offset + length
+	}
+	return data[offset:end], nil
+}
+
+// getRange is get for the length bytes of ref at e from offset, or all
+// those from offset if length is zero.
+// No locks are held on entry or exit.
+func (c *storeCache) getRange(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, offset, length int64, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if offset < 0 || length < 0 {
+		return nil, nil, nil, errRange
+	}
+	c.pf.readAhead(cfg, upspin.Location{Endpoint: e, Reference: ref})
+	if !c.verify {
+		data, refdata, ok, err := c.cachedRange(ref, e, offset, length, sp)
+		if ok {
+			return data, refdata, nil, err
+		}
+	}
+	data, refdata, locs, err := c.fetch(cfg, ref, e, false, sp)
+	if err != nil || len(locs) > 0 {
+		return nil, refdata, locs, err
+	}
+	data, err = blockRange(data, offset, length)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data, refdata, nil, nil
+}
+
+// cachedRange reads the range of ref at e from its cache file, if it is
+// cached, fresh, and in the main tier. It reports whether it did; if not,
+// the block is to be read as by get.
+// No locks are held on entry or exit.
+func (c *storeCache) cachedRange(ref upspin.Reference, e upspin.Endpoint, offset, length int64, sp *metric.Span) ([]byte, *upspin.Refdata, bool, error) {
+	lookup := lookupSpan(sp, ref, e)
+	defer endSpan(lookup)
+
+	file := c.cachePath(ref, e)
+	c.Lock()
+	value, ok := c.lru.Get(file)
+	if !ok {
+		c.Unlock()
+		return nil, nil, false, nil
+	}
+	cr := value.(*cachedRef)
+	cr.Lock()
+	c.Unlock()
+	defer cr.Unlock()
+	if !cr.valid || cr.busy || cr.cold || cr.expired() {
+		return nil, nil, false, nil
+	}
+	data, err := readRangeFromCacheFile(file, offset, length)
+	if err == errRange {
+		return nil, nil, true, err
+	}
+	if err != nil {
+		// Leave it to get to deal with the damaged file.
+		return nil, nil, false, nil
+	}
+	refdata := &upspin.Refdata{Reference: ref}
+	if !cr.expires.IsZero() {
+		refdata.Duration = time.Until(cr.expires)
+	}
+	cr.touch(file)
+	atomic.AddInt64(&c.counters.hits, 1)
+	atomic.AddInt64(&c.counters.cacheBytes, int64(len(data)))
+	return data, refdata, true, nil
+}
+
+// readRangeFromCacheFile returns the length bytes from offset, or all
+// those from offset if length is zero, of the block held in the cache
+// file name.
+func readRangeFromCacheFile(name string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(compressMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == compressMagic {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, errors.E(errors.IO, err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, z, offset); err == io.EOF {
+			return nil, errRange
+		} else if err != nil {
+			return nil, errors.E(errors.IO, err)
+		}
+		var r io.Reader = z
+		if length > 0 {
+			r = io.LimitReader(z, length)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.E(errors.IO, err)
+		}
+		return data, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if offset > size {
+		return nil, errRange
+	}
+	end := size
+	if length > 0 && length < size-offset {
+		end = offset + length
+	}
+	buf := make([]byte, end-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
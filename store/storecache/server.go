@@ -3,15 +3,23 @@
 // license that can be found in the LICENSE file.
 
 // Package storecache is a caching proxy between a client and all stores.
-// References are stored as files in the local file system.
+// References are stored as files in the local file system, or elsewhere
+// by an implementation of Cache.
 package storecache
 
 import (
-	"fmt"
+	"context"
+	"io"
+	"io/ioutil"
 	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"upspin.io/bind"
 	"upspin.io/errors"
-	"upspin.io/log"
+	"upspin.io/key/sha256key"
+	"upspin.io/metric"
 	"upspin.io/upspin"
 )
 
@@ -19,102 +27,620 @@ import (
 type server struct {
 	cfg upspin.Config
 
-	// The on disk cache.
-	cache *storeCache
+	// Where the blocks are cached. See backend.go.
+	cache Cache
+
+	// files is the cache if it is the one New makes, which keeps
+	// the blocks in files; otherwise it is nil.
+	files *storeCache
+
+	// The running counts and audit log, shared by all dialed copies.
+	// For the cache made by New they are the cache's own.
+	counters *counters
+	audit    *auditLog
 
 	// The store server this dialed server should talk to.
 	authority upspin.Endpoint
+
+	// The user on whose behalf the server was dialed.
+	user upspin.UserName
+
+	// The requests in progress, shared by all dialed copies.
+	reqs *requests
+}
+
+// requests tracks the Gets, Puts, and Deletes in progress so that
+// Shutdown can wait for them.
+type requests struct {
+	sync.Mutex
+	closing bool           // No new requests are accepted.
+	closed  bool           // The cache has been closed.
+	wg      sync.WaitGroup // One for each request in progress.
+}
+
+// start records the start of a request. It reports false, and the
+// request must be refused, if the server is shutting down.
+func (r *requests) start() bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.closing {
+		return false
+	}
+	r.wg.Add(1)
+	return true
 }
 
+// done records the end of a request begun with start.
+func (r *requests) done() { r.wg.Done() }
+
+// shuttingDown reports whether Shutdown has been called.
+func (r *requests) shuttingDown() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.closing
+}
+
+// errShutdown is returned for requests that arrive after Shutdown is called.
+// Callers can recognize it by its Kind, errors.Transient.
+var errShutdown = errors.E("store/storecache", errors.Transient, errors.Str("store cache is shutting down"))
+
 // New creates a new store cache that implements upspin.StoreServer.
-// For writeback caches, it also returns a function to flush Blocks
-// that are waiting to be written back. This is important to allow
-// the client to flush out Access file blocks before writing the
-// DirEntry.
-func New(cfg upspin.Config, cacheDir string, maxBytes int64, writethrough bool) (upspin.StoreServer, func(upspin.Location), error) {
-	c, blockFlusher, err := newCache(cfg, path.Join(cacheDir, "storecache"), maxBytes, writethrough)
+//
+// A writethrough cache Puts each block to its store before returning.
+// A writeback cache instead saves the block in the cache directory and
+// returns at once; the block is written to its store in the background,
+// retrying while the store is unreachable. Pending writebacks are
+// recorded in the cache directory and resumed after a restart.
+//
+// For writeback caches, New also returns a function to flush Blocks
+// that are waiting to be written back. It returns once the block is
+// safely in its store. This is important to allow the client to flush
+// out Access file blocks before writing the DirEntry.
+//
+// The options are strings of the form key=value, such as timeout=30s.
+// They are listed in options.go, and each is described with the code
+// that implements it.
+//
+// The returned server also has Compact, Flush, GetIfChanged, Health, Info,
+// Invalidate, List, Pin, Prefetch, PutFrom, Ready, SetAuditLog,
+// SetQuota, Shutdown, Stats, Unpin, and Warm methods, described below,
+// some in files of their own. To keep the blocks elsewhere than in
+// files, see NewServer.
+func New(cfg upspin.Config, cacheDir string, maxBytes int64, writethrough bool, options ...string) (upspin.StoreServer, func(upspin.Location), error) {
+	c, blockFlusher, err := newCache(cfg, path.Join(cacheDir, "storecache"), maxBytes, writethrough, options...)
 	if err != nil {
 		return nil, nil, err
 	}
-	return &server{
-		cfg:   cfg,
-		cache: c,
-	}, blockFlusher, nil
+	// The cache's config carries any pins given as options.
+	return NewServer(c.cfg, c), blockFlusher, nil
 }
 
 func (s *server) Dial(config upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
 	s2 := *s
 	s2.authority = e
+	s2.user = config.UserName()
 	return &s2, nil
 }
 
-var errNotDialed = errors.Str("store/cache: can't handle request to unassigned authority (must dial first)")
+// errNotDialed is returned by a server that has not been dialed, so has no
+// store to talk to. Callers can recognize it by its Kind, errors.Invalid.
+var errNotDialed = errors.E("store/storecache", errors.Invalid, errors.Str("no store endpoint configured (must dial first)"))
 
 func (s *server) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
 	if s.authority.Transport == upspin.Unassigned {
 		return nil, nil, nil, errNotDialed
 	}
+	if !s.reqs.start() {
+		return nil, nil, nil, errShutdown
+	}
+	defer s.reqs.done()
+
+	op := s.logf("Get %q", ref)
+	defer s.counters.get.since(time.Now())
+	m, sp := trace("Get", ref, s.authority)
+	defer m.Done()
+	defer sp.End()
+
+	data, refdata, locs, err := s.get(ref, sp)
+	if err != nil {
+		return nil, nil, nil, op.error(err)
+	}
+	return data, refdata, locs, nil
+}
+
+// get does the work of Get, tracing it beneath sp.
+func (s *server) get(ref upspin.Reference, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if s.passthrough() {
+		return s.getOrigin(ref, sp)
+	}
+	return s.cache.Get(s.cfg, ref, s.authority, sp)
+}
+
+// getOrigin fetches the data for ref from the store itself, without
+// caching it, tracing the fetch beneath sp.
+func (s *server) getOrigin(ref upspin.Reference, sp *metric.Span) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	store, err := bind.StoreServer(s.cfg, s.authority)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	origin := originSpan(sp, ref, s.authority)
+	defer endSpan(origin)
+	if s.files != nil {
+		return s.files.originGet(store, ref)
+	}
+	return store.Get(ref)
+}
+
+// GetHinted is Get with hints from the client on how to cache the block
+// for ref, such as a one-off scan that would otherwise push out blocks
+// worth keeping. With noStore, a block not already cached is fetched from
+// the store and returned without being cached. With refresh, any cached
+// copy is dropped and the block fetched from the store afresh. See
+// hints.go.
+func (s *server) GetHinted(ref upspin.Reference, noStore, refresh bool) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if !noStore && !refresh {
+		return s.Get(ref)
+	}
+	if s.authority.Transport == upspin.Unassigned {
+		return nil, nil, nil, errNotDialed
+	}
+	if !s.reqs.start() {
+		return nil, nil, nil, errShutdown
+	}
+	defer s.reqs.done()
 
-	op := logf("Get %q", ref)
+	op := s.logf("GetHinted %q, %t, %t", ref, noStore, refresh)
+	defer s.counters.get.since(time.Now())
+	m, sp := trace("GetHinted", ref, s.authority)
+	defer m.Done()
+	defer sp.End()
 
-	data, locs, err := s.cache.get(s.cfg, ref, s.authority)
+	data, refdata, locs, err := s.getHinted(ref, noStore, refresh, sp)
 	if err != nil {
 		return nil, nil, nil, op.error(err)
 	}
-	refdata := &upspin.Refdata{
-		Reference: ref,
-		Volatile:  false, // TODO
-		Duration:  0,     // TODO
+	return data, refdata, locs, nil
+}
+
+// GetRange is Get for a client that wants only length bytes of the data
+// for ref, starting at offset, or all of it from offset if length is
+// zero, such as a media player seeking within a large block. It is an
+// error of kind Invalid for offset or length to be negative or for
+// offset to lie beyond the end of the data. See range.go.
+func (s *server) GetRange(ref upspin.Reference, offset, length int64) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if s.authority.Transport == upspin.Unassigned {
+		return nil, nil, nil, errNotDialed
+	}
+	if !s.reqs.start() {
+		return nil, nil, nil, errShutdown
+	}
+	defer s.reqs.done()
+
+	op := s.logf("GetRange %q, %d, %d", ref, offset, length)
+	defer s.counters.get.since(time.Now())
+	m, sp := trace("GetRange", ref, s.authority)
+	defer m.Done()
+	defer sp.End()
+
+	if s.files != nil && !s.passthrough() {
+		data, refdata, locs, err := s.files.getRange(s.cfg, ref, s.authority, offset, length, sp)
+		if err != nil {
+			return nil, nil, nil, op.error(err)
+		}
+		return data, refdata, locs, nil
+	}
+	data, refdata, locs, err := s.get(ref, sp)
+	if err == nil && len(locs) == 0 {
+		data, err = blockRange(data, offset, length)
+	}
+	if err != nil {
+		return nil, nil, nil, op.error(err)
 	}
 	return data, refdata, locs, nil
 }
 
+// GetIfChanged is Get for a client that already holds data for ref, such
+// as a poller re-reading a directory root, and knows it by its own
+// reference, have: the SHA-256 hash of the data, as made by Put. If the
+// data for ref, fetched from the store if it is not cached or may be
+// stale, still has that hash, GetIfChanged reports it unchanged and
+// returns only the Refdata, sparing the client the data. Otherwise it
+// returns what Get would.
+func (s *server) GetIfChanged(ref, have upspin.Reference) (data []byte, refdata *upspin.Refdata, locs []upspin.Location, unchanged bool, err error) {
+	data, refdata, locs, err = s.Get(ref)
+	if err != nil || len(locs) > 0 {
+		return data, refdata, locs, false, err
+	}
+	if upspin.Reference(sha256key.Of(data).String()) != have {
+		return data, refdata, nil, false, nil
+	}
+	atomic.AddInt64(&s.counters.unchanged, 1)
+	return nil, refdata, nil, true, nil
+}
+
 func (s *server) Put(data []byte) (*upspin.Refdata, error) {
 	if s.authority.Transport == upspin.Unassigned {
 		return nil, errNotDialed
 	}
+	if !s.reqs.start() {
+		return nil, errShutdown
+	}
+	defer s.reqs.done()
 
-	op := logf("Put %.30x...", data)
+	op := s.logf("Put %.30x...", data)
+	defer s.counters.put.since(time.Now())
+	// The reference is not known until the data is stored.
+	m, sp := trace("Put", "", s.authority)
+	defer m.Done()
+	defer sp.End()
 
-	ref, err := s.cache.put(s.cfg, data, s.authority)
+	refdata, err := s.put(data, sp)
 	if err != nil {
 		return nil, op.error(err)
 	}
-	refdata := &upspin.Refdata{
-		Reference: ref,
-		Volatile:  false, // TODO
-		Duration:  0,     // TODO
+	sp.SetAnnotation(annotation(refdata.Reference, s.authority))
+	return refdata, nil
+}
+
+// put does the work of Put, tracing it beneath sp.
+func (s *server) put(data []byte, sp *metric.Span) (*upspin.Refdata, error) {
+	if s.passthrough() {
+		return s.putOrigin(data, sp)
+	}
+	return s.cache.Put(s.cfg, data, s.authority, sp)
+}
+
+// putOrigin stores data in the store itself, without caching it,
+// tracing the store beneath sp.
+func (s *server) putOrigin(data []byte, sp *metric.Span) (*upspin.Refdata, error) {
+	store, err := bind.StoreServer(s.cfg, s.authority)
+	if err != nil {
+		return nil, err
+	}
+	origin := originSpan(sp, "", s.authority)
+	defer endSpan(origin)
+	if s.files != nil {
+		return s.files.mirroredPut(s.cfg, store, data)
+	}
+	return store.Put(data)
+}
+
+// PutHinted is Put with a hint from the client on how to cache the
+// block. With noStore, the block is stored in the store at once and not
+// cached, even by a writeback cache. See hints.go.
+func (s *server) PutHinted(data []byte, noStore bool) (*upspin.Refdata, error) {
+	if !noStore {
+		return s.Put(data)
+	}
+	if s.authority.Transport == upspin.Unassigned {
+		return nil, errNotDialed
+	}
+	if !s.reqs.start() {
+		return nil, errShutdown
 	}
+	defer s.reqs.done()
+
+	op := s.logf("PutHinted %.30x..., %t", data, noStore)
+	defer s.counters.put.since(time.Now())
+	m, sp := trace("PutHinted", "", s.authority)
+	defer m.Done()
+	defer sp.End()
+
+	refdata, err := s.putNoStore(data, sp)
+	if err != nil {
+		return nil, op.error(err)
+	}
+	sp.SetAnnotation(annotation(refdata.Reference, s.authority))
+	return refdata, nil
+}
+
+// PutFrom is Put for the block read from r, up to EOF. A writeback cache
+// made by New copies the block to its cache directory as it is read,
+// without holding it all in memory; otherwise it is read whole and Put.
+// See stream.go.
+func (s *server) PutFrom(r io.Reader) (*upspin.Refdata, error) {
+	if s.authority.Transport == upspin.Unassigned {
+		return nil, errNotDialed
+	}
+	if !s.reqs.start() {
+		return nil, errShutdown
+	}
+	defer s.reqs.done()
+
+	op := s.logf("PutFrom")
+	defer s.counters.put.since(time.Now())
+	m, sp := trace("PutFrom", "", s.authority)
+	defer m.Done()
+	defer sp.End()
+
+	var (
+		refdata *upspin.Refdata
+		err     error
+	)
+	if s.files != nil && !s.passthrough() {
+		refdata, err = s.files.putFrom(s.cfg, r, s.authority, sp)
+	} else {
+		var data []byte
+		data, err = ioutil.ReadAll(r)
+		if err == nil {
+			refdata, err = s.put(data, sp)
+		}
+	}
+	if err != nil {
+		return nil, op.error(err)
+	}
+	sp.SetAnnotation(annotation(refdata.Reference, s.authority))
 	return refdata, nil
 }
 
 // Delete implements proto.StoreServer.
-func (s *server) Delete(ref upspin.Reference) error {
+func (s *server) Delete(ref upspin.Reference) (err error) {
 	if s.authority.Transport == upspin.Unassigned {
 		return errNotDialed
 	}
-	op := logf("Delete %q", ref)
+	if !s.reqs.start() {
+		return errShutdown
+	}
+	defer s.reqs.done()
+	op := s.logf("Delete %q", ref)
+	defer s.counters.delete.since(time.Now())
+	defer func() { s.audit.record("Delete", s.user, ref, s.authority, err) }()
+	m, sp := trace("Delete", ref, s.authority)
+	defer m.Done()
+	defer sp.End()
+
+	if s.passthrough() {
+		store, err := bind.StoreServer(s.cfg, s.authority)
+		if err != nil {
+			return op.error(err)
+		}
+		origin := originSpan(sp, ref, s.authority)
+		err = s.files.mirroredDelete(s.cfg, store, ref)
+		endSpan(origin)
+		if err != nil {
+			return op.error(err)
+		}
+		return nil
+	}
 
-	err := s.cache.delete(s.cfg, ref, s.authority)
+	err = s.cache.Delete(s.cfg, ref, s.authority, sp)
 	if err != nil {
 		return op.error(err)
 	}
 	return nil
 }
 
-func (s *server) Endpoint() upspin.Endpoint { return s.authority }
-func (s *server) Close()                    {}
-func (s *server) Ping() bool                { return true }
+// Flush waits until every block Put to a writeback cache has been written
+// to its store and then commits the cached blocks to stable storage, so
+// that the cache directory may be safely copied. If a store is
+// unreachable, Flush waits until it can be written to.
+func (s *server) Flush() error {
+	op := s.logf("Flush")
+	if err := s.cache.Flush(); err != nil {
+		return op.error(err)
+	}
+	return nil
+}
+
+// Shutdown stops the server accepting Gets, Puts, and Deletes, and the
+// administrative calls such as Warm, Pin, and Compact, which then fail
+// with an errors.Transient error or do nothing, waits for those in progress
+// to finish, flushes the cache as Flush does, and closes it. If ctx is
+// done first, Shutdown returns its error, and the cache is flushed and
+// closed in the background once the requests in progress finish; any
+// writebacks still pending if the program exits before then are resumed
+// when the cache is next started. Once Shutdown has been called the
+// server may not be used again.
+func (s *server) Shutdown(ctx context.Context) error {
+	op := s.logf("Shutdown")
+	s.reqs.Lock()
+	s.reqs.closing = true
+	s.reqs.Unlock()
 
-func logf(format string, args ...interface{}) operation {
-	s := fmt.Sprintf(format, args...)
-	log.Debug.Print("store/storecache: " + s)
-	return operation(s)
+	// Neither waiting for requests nor flushing can be interrupted,
+	// so do them in the background and give up on them if ctx is done.
+	// The cache is closed only after both, so never under a request.
+	done := make(chan error, 1)
+	go func() {
+		s.reqs.wg.Wait()
+		err := s.cache.Flush()
+		s.reqs.Lock()
+		if !s.reqs.closed {
+			s.reqs.closed = true
+			s.cache.Close()
+		}
+		s.reqs.Unlock()
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return op.error(err)
+	}
+	return nil
 }
 
-type operation string
+// Prefetch tells the cache the Locations of the blocks of a file that is
+// likely to be read. When one of the blocks is read through the cache, the
+// ones that follow it are fetched in the background.
+func (s *server) Prefetch(locs []upspin.Location) {
+	if s.files != nil {
+		s.files.pf.hint(locs)
+	}
+}
 
-func (op operation) error(err error) error {
-	logf("%v failed: %v", op, err)
-	return errors.E("store/storecache."+string(op), err)
+// SetQuota sets the limit on the bytes cached on behalf of the user,
+// overriding the default given by the userquota option. A negative
+// limit removes any limit for the user; zero restores the default.
+func (s *server) SetQuota(user upspin.UserName, bytes int64) {
+	if s.files != nil {
+		s.files.setQuota(user, bytes)
+	}
 }
+
+// Invalidate drops from the cache any copy of the block for ref at the
+// store e, leaving the store alone, so that the next Get of it goes to
+// the store. Stores do not announce the blocks deleted from them, so a
+// block deleted by a client not using this cache stays cached until it
+// is evicted; Invalidate lets whoever deletes it, or a coordinator that
+// learns of the deletion, say so. A block being fetched or cached at the
+// time is left alone. Invalidate reports whether a copy was dropped; it
+// always reports false if the Cache is not an Invalidator or the server
+// is shutting down.
+func (s *server) Invalidate(ref upspin.Reference, e upspin.Endpoint) bool {
+	s.logf("Invalidate %q at %s", ref, e)
+	if !s.reqs.start() {
+		return false
+	}
+	defer s.reqs.done()
+	inv, ok := s.cache.(Invalidator)
+	if !ok || !inv.Invalidate(ref, e) {
+		return false
+	}
+	atomic.AddInt64(&s.counters.invalidations, 1)
+	return true
+}
+
+// SetAuditLog directs a record of each Delete made through the cache,
+// whether it succeeds or not, to w. Each record is an AuditRecord in JSON
+// on a line of its own. Writes to w are serialized. A nil w stops the
+// records.
+func (s *server) SetAuditLog(w io.Writer) { s.audit.set(w) }
+
+// Stats returns a snapshot of the activity of the cache.
+func (s *server) Stats() Stats {
+	if s.files != nil {
+		return s.files.stats()
+	}
+	bytes, entries := s.cache.Usage()
+	return Stats{
+		Unchanged:     atomic.LoadInt64(&s.counters.unchanged),
+		Invalidations: atomic.LoadInt64(&s.counters.invalidations),
+		NoStore:       atomic.LoadInt64(&s.counters.noStore),
+		Refreshes:     atomic.LoadInt64(&s.counters.refreshes),
+		Bytes:         bytes,
+		Entries:       entries,
+		Get:           s.counters.get.latency(),
+		Put:           s.counters.put.latency(),
+		Delete:        s.counters.delete.latency(),
+	}
+}
+
+// Info returns the endpoint of the store the server was dialed for,
+// together with the cache's directory, byte limit, and activity.
+func (s *server) Info() Info {
+	info := Info{
+		Origin:      s.authority,
+		Passthrough: s.passthrough(),
+		Stats:       s.Stats(),
+	}
+	if s.files != nil {
+		info.Dir = s.files.dir
+		info.Limit = s.files.limit
+		info.ColdDir = s.files.coldDir
+		info.ColdLimit = s.files.coldLimit
+		info.PinLimit = s.files.pinLimit
+	}
+	return info
+}
+
+// Warm fetches the references from the store at e into the cache, so
+// that later Gets of them are hits. The references are fetched in order
+// until the blocks fetched fill the cache's byte limit. Warm returns an
+// error for each reference, nil if that reference is now cached.
+func (s *server) Warm(refs []upspin.Reference, e upspin.Endpoint) []error {
+	s.logf("Warm %d references from %s", len(refs), e)
+	if s.files == nil {
+		errs := make([]error, len(refs))
+		for i := range errs {
+			errs[i] = upspin.ErrNotSupported
+		}
+		return errs
+	}
+	if !s.reqs.start() {
+		errs := make([]error, len(refs))
+		for i := range errs {
+			errs[i] = errShutdown
+		}
+		return errs
+	}
+	defer s.reqs.done()
+	return s.files.warm(s.cfg, refs, e, s.reqs.shuttingDown)
+}
+
+// Compact removes the files in the cache directories that the cache does
+// not know of, such as those left by a crash, and reports how many it
+// removed and the bytes they held. It fails for a Cache other than that
+// made by New. See compact.go.
+func (s *server) Compact() (Compaction, error) {
+	s.logf("Compact")
+	if s.files == nil {
+		return Compaction{}, upspin.ErrNotSupported
+	}
+	if !s.reqs.start() {
+		return Compaction{}, errShutdown
+	}
+	defer s.reqs.done()
+	return s.files.compact(), nil
+}
+
+// List describes up to max of the blocks in the cache, starting after
+// those listed by the call that returned cursor, or with the first if
+// cursor is empty. It also returns the cursor for the next call, which is
+// empty once every block has been listed. At most 1000 blocks are
+// described at once, as many if max is not positive. See list.go.
+func (s *server) List(cursor string, max int) ([]Entry, string, error) {
+	s.logf("List after %q", cursor)
+	if s.files == nil {
+		return nil, "", upspin.ErrNotSupported
+	}
+	if !s.reqs.start() {
+		return nil, "", errShutdown
+	}
+	defer s.reqs.done()
+	entries, next := s.files.list(cursor, max)
+	return entries, next, nil
+}
+
+// Pin fetches the reference from the store at e into the cache, if it is
+// not there already, and keeps it there until Unpin is called for it.
+// It fails if the cache was not created with the pinbytes option, if
+// pinning the block would exceed it, or if the block cannot be cached.
+// See pin.go.
+func (s *server) Pin(ref upspin.Reference, e upspin.Endpoint) error {
+	s.logf("Pin %q at %s", ref, e)
+	if s.files == nil {
+		return upspin.ErrNotSupported
+	}
+	if !s.reqs.start() {
+		return errShutdown
+	}
+	defer s.reqs.done()
+	return s.files.pin(s.cfg, ref, e)
+}
+
+// Unpin lets the reference from the store at e be evicted again,
+// reporting whether it was pinned. It reports false once the server is
+// shutting down.
+func (s *server) Unpin(ref upspin.Reference, e upspin.Endpoint) bool {
+	s.logf("Unpin %q at %s", ref, e)
+	if s.files == nil || !s.reqs.start() {
+		return false
+	}
+	defer s.reqs.done()
+	return s.files.unpin(ref, e)
+}
+
+// passthrough reports whether the store the server was dialed for
+// is named by a passthrough option.
+func (s *server) passthrough() bool {
+	return s.files != nil && s.files.passthrough[s.authority]
+}
+
+func (s *server) Endpoint() upspin.Endpoint { return s.authority }
+func (s *server) Close()                    {}
+func (s *server) Ping() bool                { return true }
@@ -0,0 +1,99 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Stale data.
+//
+// Data cached with a Duration expires when it has passed, and by default
+// is then discarded and fetched again while the client waits. If the
+// cache has a maximum staleness, given by the maxstale=duration option,
+// data that expired no longer ago than that is instead returned at once,
+// marked Volatile so the client does not keep it, and fetched again in
+// the background to replace it. Only one such revalidation of a reference
+// is in progress at a time. Data staler than the maximum is fetched again
+// while the client waits, as before.
+
+// usable reports whether the expired data for cr may still be returned.
+// This is called with cr locked.
+func (cr *cachedRef) usable() bool {
+	return cr.c.maxStale > 0 && time.Since(cr.expires) <= cr.c.maxStale
+}
+
+// revalidate starts fetching again, in the background, the stale data
+// cached in file for ref at e, unless that is already under way.
+// This is called with cr locked.
+func (cr *cachedRef) revalidate(cfg upspin.Config, ref upspin.Reference, e upspin.Endpoint, file string) {
+	if cr.revalidating {
+		return
+	}
+	cr.revalidating = true
+	c := cr.c
+	c.revalidations.Add(1)
+	go func() {
+		defer c.revalidations.Done()
+		c.refresh(cfg, cr, ref, e, file)
+	}()
+}
+
+// refresh fetches ref from e and, if cr still holds stale data for it,
+// replaces that data. Failures are only logged; the stale data is used
+// until the maximum staleness passes and then fetched while the client
+// waits, which reports any error.
+// No locks are held on entry or exit.
+func (c *storeCache) refresh(cfg upspin.Config, cr *cachedRef, ref upspin.Reference, e upspin.Endpoint, file string) {
+	defer func() {
+		cr.Lock()
+		cr.revalidating = false
+		cr.Unlock()
+	}()
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		log.Info.Printf("store/storecache: revalidating %s: %s", file, err)
+		return
+	}
+	data, refdata, locs, err := c.originGet(store, ref)
+	if err != nil || len(locs) > 0 {
+		// Leave redirections to a fetch in the foreground.
+		log.Info.Printf("store/storecache: revalidating %s: %v", file, err)
+		return
+	}
+	atomic.AddInt64(&c.counters.originBytes, int64(len(data)))
+
+	u := c.user(cfg.UserName())
+	c.Lock()
+	value, ok := c.lru.Get(file)
+	if !ok || value.(*cachedRef) != cr {
+		// Evicted, or replaced, while we were fetching.
+		c.Unlock()
+		return
+	}
+	cr.Lock()
+	c.Unlock()
+	if cr.busy || !cr.valid || cr.cold || !cr.expired() {
+		cr.Unlock()
+		return
+	}
+	cr.removeFile(file)
+	if !refdata.Volatile && !c.oversize(data) && c.cacheable() {
+		cr.setExpiry(c.duration(refdata.Duration, data))
+		if err := cr.saveToCacheFile(file, data, u); err != nil {
+			log.Info.Printf("saving cached ref %s to %s: %s", string(ref), file, err)
+		}
+	}
+	atomic.AddInt64(&c.counters.revalidations, 1)
+	cr.Unlock()
+	c.makeRoom()
+	c.enforceByteLimit(0)
+	c.enforceUserQuota(u, 0)
+}
@@ -0,0 +1,355 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// Stats is a snapshot of the activity of a store cache. The StoreServer
+// returned by New has a Stats method that returns the current value.
+// The same value is published as the expvar storecache-stats.
+type Stats struct {
+	// Hits and Misses count the Gets answered from the cache
+	// and from the origin store. Misses include prefetches.
+	Hits, Misses int64
+
+	// CacheBytes and OriginBytes count the bytes returned by Gets
+	// answered from the cache and from the origin store.
+	CacheBytes, OriginBytes int64
+
+	// Shared counts the Gets that found a fetch of the same reference
+	// already in progress and waited for its result instead of
+	// starting their own. Those that succeed are also counted as Hits.
+	Shared int64
+
+	// DedupedPuts counts the Puts of blocks already held by a writeback
+	// cache, or already being Put through to the store by another
+	// client, that were not sent to the store again.
+	DedupedPuts int64
+
+	// NotExist counts the Gets answered with a NotExist error
+	// remembered from an earlier Get, without asking the store.
+	NotExist int64
+
+	// Unchanged counts the calls to GetIfChanged that found the data
+	// the client already held and so did not return it. They are also
+	// counted as Gets.
+	Unchanged int64
+
+	// Stale counts the Gets answered with data that had expired, while
+	// it was fetched again in the background, and Revalidations the
+	// fetches that replaced such data. Stale Gets are also counted as
+	// Hits. Both are always zero unless the cache was created with the
+	// maxstale option.
+	Stale, Revalidations int64
+
+	// Throttled counts the requests to origin stores that failed
+	// because too many others to the same store were in progress.
+	// It is always zero unless the cache was created with the
+	// storelimit option.
+	Throttled int64
+
+	// BandwidthWait is the total time calls to origin stores have
+	// waited for bandwidth. It is always zero unless the cache was
+	// created with the bandwidth or storebandwidth option.
+	BandwidthWait time.Duration
+
+	// MirrorFailures counts the Puts and Deletes to mirror stores that
+	// failed. It is always zero unless the cache was created with the
+	// mirror option.
+	MirrorFailures int64
+
+	// Orphans counts the files removed by compactions because the
+	// cache did not know of them, and OrphanBytes the bytes they held.
+	Orphans, OrphanBytes int64
+
+	// Retries counts the Gets from origin stores that were tried
+	// again after a transient failure. It is always zero unless the
+	// cache was created with the retries option.
+	Retries int64
+
+	// Prefetches counts the blocks fetched ahead of being read.
+	Prefetches int64
+
+	// Evictions counts the references removed to stay within the
+	// cache's byte limits.
+	Evictions int64
+
+	// Demotions and Promotions count the references moved to the cold
+	// tier to stay within the cache's byte limit and moved back when
+	// read. They are always zero unless the cache was created with the
+	// colddir option.
+	Demotions, Promotions int64
+
+	// Oversize counts the Puts refused, and the blocks fetched from
+	// stores but not cached, because they were larger than the cache
+	// allows. It is always zero unless the cache was created with the
+	// maxentrybytes option.
+	Oversize int64
+
+	// DiskFull counts the blocks not cached because the disk holding
+	// the cache was full, and Degraded reports whether the cache is
+	// passing blocks through for that reason. See New.
+	DiskFull int64
+	Degraded bool
+
+	// Linked counts the blocks cached for one store as links to the
+	// copy already cached for another, rather than as copies of their
+	// own. It is always zero unless the cache was created with the
+	// dedup option.
+	Linked int64
+
+	// Rejected counts the blocks fetched from stores but not cached
+	// because they had been requested less often than the blocks they
+	// would have displaced. It is always zero unless the cache was
+	// created with the admission option.
+	Rejected int64
+
+	// Invalidations counts the cached references dropped by the
+	// server's Invalidate.
+	Invalidations int64
+
+	// NoStore counts the Gets and Puts sent on to stores without
+	// caching the block, as asked by the client's no-store hint.
+	NoStore int64
+
+	// Refreshes counts the cached references dropped to be fetched
+	// afresh, as asked by the client's refresh hint.
+	Refreshes int64
+
+	// AccessControl counts the blocks recognized as Access or Group
+	// files and so cached for no longer than accessttl. It is always
+	// zero unless the cache was created with the accessttl option.
+	AccessControl int64
+
+	// Corrupt counts the cached references found not to match their
+	// contents and so refetched. It is always zero unless the cache
+	// was created with the verify option.
+	Corrupt int64
+
+	// Bytes and Entries are the bytes and references currently cached.
+	// Bytes does not count the cold tier, whose bytes are in ColdBytes;
+	// Entries counts both.
+	Bytes, Entries int64
+	ColdBytes      int64
+
+	// Pinned and PinnedBytes are the references currently pinned and
+	// their bytes, which are not counted in Bytes but are in Entries.
+	Pinned, PinnedBytes int64
+
+	// Pending is the number of blocks waiting to be written back
+	// to their stores. It is always zero for a writethrough cache.
+	Pending int64
+
+	// Latencies of the Get, Put, and Delete requests.
+	Get, Put, Delete Latency
+
+	// Origins describes the calls the cache has made to each origin
+	// store, in order of endpoint, so that failing stores can be
+	// noticed. It is empty for a cache not made by New.
+	Origins []Origin
+}
+
+// HitRatio returns the fraction of Gets answered from the cache,
+// or zero if there have been none.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Info describes a dialed store cache server: the store it stands in
+// for and the cache behind it. The StoreServer returned by New has an
+// Info method that returns it, so a diagnostic tool can show both in
+// one call.
+type Info struct {
+	// Origin is the endpoint of the store the server was dialed for.
+	Origin upspin.Endpoint
+
+	// Passthrough reports whether Origin is named by a passthrough
+	// option, so its blocks are not cached.
+	Passthrough bool
+
+	// Dir is the directory in which the blocks are cached,
+	// or empty if they are not kept in files.
+	Dir string
+
+	// Limit is the most bytes the cache may hold. The bytes it holds
+	// now are in Stats.
+	Limit int64
+
+	// ColdDir and ColdLimit describe the cold tier, if there is one,
+	// as Dir and Limit do the cache. ColdDir is empty if there is not.
+	ColdDir   string
+	ColdLimit int64
+
+	// PinLimit is the most bytes of blocks that may be pinned, or zero
+	// if none may be.
+	PinLimit int64
+
+	// Stats is the activity of the cache as a whole, shared by all
+	// the stores it serves.
+	Stats Stats
+}
+
+// Latency is a histogram of request latencies.
+type Latency struct {
+	Count int64         // Number of requests.
+	Total time.Duration // Sum of their latencies.
+
+	// Buckets holds, for each bound in LatencyBuckets, the number of
+	// requests that took no longer than that bound. The counts are
+	// cumulative; requests slower than the last bound appear only
+	// in Count.
+	Buckets []int64
+}
+
+// Origin describes the calls a cache has made to an origin store.
+type Origin struct {
+	Endpoint upspin.Endpoint
+
+	// Calls and Errors count the Gets and Puts made to the store and
+	// those that failed. A NotExist error is not a failure.
+	Calls, Errors int64
+
+	// ErrorRate is the fraction of the calls in the last five minutes
+	// that failed, or zero if there were none.
+	ErrorRate float64
+
+	// Recent holds the last few failures, oldest first.
+	Recent []OriginError
+}
+
+// OriginError records a failed call to an origin store.
+type OriginError struct {
+	Time  time.Time
+	Call  string // Get or Put.
+	Error string
+}
+
+// LatencyBuckets are the upper bounds of the buckets of a Latency.
+var LatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// counters holds the running counts for a storeCache.
+// All fields are accessed atomically.
+type counters struct {
+	hits, misses            int64
+	cacheBytes, originBytes int64
+	shared                  int64
+	dedupedPuts             int64
+	notExist                int64
+	unchanged               int64
+	stale, revalidations    int64
+	throttled               int64
+	retries                 int64
+	orphans, orphanBytes    int64
+	bandwidthWait           int64 // Nanoseconds.
+	mirrorFailures          int64
+	prefetches              int64
+	evictions               int64
+	demotions, promotions   int64
+	oversize                int64
+	linked                  int64
+	rejected                int64
+	diskFull                int64
+	invalidations           int64
+	noStore, refreshes      int64
+	corrupt                 int64
+	accessControl           int64
+
+	get, put, delete histogram
+}
+
+// histogram accumulates a Latency. All fields are accessed atomically.
+type histogram struct {
+	count   int64
+	total   int64 // Nanoseconds.
+	buckets [len(LatencyBuckets)]int64
+}
+
+// since records the time elapsed since start.
+func (h *histogram) since(start time.Time) {
+	d := time.Since(start)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.total, int64(d))
+	for i, b := range LatencyBuckets {
+		if d <= b {
+			atomic.AddInt64(&h.buckets[i], 1)
+		}
+	}
+}
+
+func (h *histogram) latency() Latency {
+	l := Latency{
+		Count:   atomic.LoadInt64(&h.count),
+		Total:   time.Duration(atomic.LoadInt64(&h.total)),
+		Buckets: make([]int64, len(LatencyBuckets)),
+	}
+	for i := range l.Buckets {
+		l.Buckets[i] = atomic.LoadInt64(&h.buckets[i])
+	}
+	return l
+}
+
+// stats returns a snapshot of the activity of c.
+func (c *storeCache) stats() Stats {
+	s := Stats{
+		Hits:           atomic.LoadInt64(&c.counters.hits),
+		Misses:         atomic.LoadInt64(&c.counters.misses),
+		CacheBytes:     atomic.LoadInt64(&c.counters.cacheBytes),
+		OriginBytes:    atomic.LoadInt64(&c.counters.originBytes),
+		Shared:         atomic.LoadInt64(&c.counters.shared),
+		DedupedPuts:    atomic.LoadInt64(&c.counters.dedupedPuts),
+		NotExist:       atomic.LoadInt64(&c.counters.notExist),
+		Unchanged:      atomic.LoadInt64(&c.counters.unchanged),
+		Stale:          atomic.LoadInt64(&c.counters.stale),
+		Revalidations:  atomic.LoadInt64(&c.counters.revalidations),
+		Throttled:      atomic.LoadInt64(&c.counters.throttled),
+		Retries:        atomic.LoadInt64(&c.counters.retries),
+		Orphans:        atomic.LoadInt64(&c.counters.orphans),
+		OrphanBytes:    atomic.LoadInt64(&c.counters.orphanBytes),
+		BandwidthWait:  time.Duration(atomic.LoadInt64(&c.counters.bandwidthWait)),
+		MirrorFailures: atomic.LoadInt64(&c.counters.mirrorFailures),
+		Prefetches:     atomic.LoadInt64(&c.counters.prefetches),
+		Evictions:      atomic.LoadInt64(&c.counters.evictions),
+		Demotions:      atomic.LoadInt64(&c.counters.demotions),
+		Promotions:     atomic.LoadInt64(&c.counters.promotions),
+		ColdBytes:      atomic.LoadInt64(&c.coldInUse),
+		Oversize:       atomic.LoadInt64(&c.counters.oversize),
+		DiskFull:       atomic.LoadInt64(&c.counters.diskFull),
+		Linked:         atomic.LoadInt64(&c.counters.linked),
+		Rejected:       atomic.LoadInt64(&c.counters.rejected),
+		Degraded:       c.isDegraded(),
+		Invalidations:  atomic.LoadInt64(&c.counters.invalidations),
+		NoStore:        atomic.LoadInt64(&c.counters.noStore),
+		Refreshes:      atomic.LoadInt64(&c.counters.refreshes),
+		Corrupt:        atomic.LoadInt64(&c.counters.corrupt),
+		AccessControl:  atomic.LoadInt64(&c.counters.accessControl),
+		Get:            c.counters.get.latency(),
+		Put:            c.counters.put.latency(),
+		Delete:         c.counters.delete.latency(),
+	}
+	s.Bytes, s.Entries = c.usage()
+	s.Origins = c.origins.snapshot(time.Now())
+	s.PinnedBytes = atomic.LoadInt64(&c.pinnedBytes)
+	c.Lock()
+	s.Pinned = int64(c.pins)
+	c.Unlock()
+	if c.wbq != nil {
+		s.Pending = atomic.LoadInt64(&c.wbq.pending)
+	}
+	return s
+}
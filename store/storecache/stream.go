@@ -0,0 +1,173 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"upspin.io/errors"
+	"upspin.io/key/sha256key"
+	"upspin.io/log"
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// Streaming Puts.
+//
+// PutFrom is Put for a block read from an io.Reader, for a client that
+// would rather not hold a large block in memory while the cache holds it
+// too. A writeback cache copies the block to a cache file as it is read,
+// computing its reference on the way, and never holds it whole; it is
+// written back from the file, like any other. Everywhere else the block
+// is read into memory and Put as usual: a writethrough cache must hand
+// it whole to its store, as upspin.StoreServer's Put requires; one that
+// compresses must see it whole to judge whether it compresses well; and
+// a block that begins like a compressed cache file is always compressed.
+// Upspin's RPC protocol also carries each block whole, so only clients in
+// the same process as the cache can stream to it. A cache degraded for
+// lack of disk space also reads blocks into memory, to pass them through;
+// see diskfull.go.
+
+// putFrom is put for a block read from r.
+// No locks are held on entry or exit.
+func (c *storeCache) putFrom(cfg upspin.Config, r io.Reader, e upspin.Endpoint, sp *metric.Span) (*upspin.Refdata, error) {
+	br := bufio.NewReader(r)
+	if start, _ := br.Peek(len(compressMagic)); c.wbq == nil || c.compress || c.isDegraded() || string(start) == compressMagic {
+		data, err := readBlock(br, c.maxEntryBytes)
+		if err != nil {
+			if errors.Match(errOversize, err) {
+				atomic.AddInt64(&c.counters.oversize, 1)
+			}
+			return nil, err
+		}
+		return c.put(cfg, data, e, sp)
+	}
+
+	// Copy the block to a temporary file, which is renamed to be its
+	// cache file once its reference is known.
+	defer c.makeRoom()
+	f, err := ioutil.TempFile(c.dir, "stream*.tmp")
+	if err != nil {
+		c.saved(err)
+		return nil, err
+	}
+	tmpName := f.Name()
+	h := sha256.New()
+	size, err := copyBlock(io.MultiWriter(f, h), br, c.maxEntryBytes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		c.saved(err)
+		if errors.Match(errOversize, err) {
+			atomic.AddInt64(&c.counters.oversize, 1)
+		}
+		return nil, err
+	}
+	var hash sha256key.Hash
+	copy(hash[:], h.Sum(nil))
+	refdata := &upspin.Refdata{Reference: upspin.Reference(hash.String())}
+	ref := refdata.Reference
+	file := c.cachePath(ref, e)
+	c.forgetMissing(file)
+	u := c.user(cfg.UserName())
+
+	c.Lock()
+	cr, ok := c.lookup(file)
+	if ok {
+		cr.Lock()
+		c.Unlock()
+		if cr.valid || cr.busy {
+			// Already cached or being cached.
+			cr.touch(file)
+			cr.Unlock()
+			os.Remove(tmpName)
+			return refdata, nil
+		}
+	} else {
+		cr = c.newCachedRef(file)
+		cr.Lock()
+		c.Unlock()
+	}
+	err = c.installStream(cr, tmpName, file, size, u, ref, e)
+	c.saved(err)
+	cr.hold.Signal()
+	cr.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The block's size was not known in time to make room for it
+	// beforehand, so make it now.
+	c.enforceByteLimit(0)
+	c.enforceUserQuota(u, 0)
+	return refdata, nil
+}
+
+// installStream makes tmpName, holding size bytes of the block ref at e,
+// the cache file for cr, and arranges for it to be written back.
+// Called with cr locked.
+func (c *storeCache) installStream(cr *cachedRef, tmpName, file string, size int64, u *userCache, ref upspin.Reference, e upspin.Endpoint) error {
+	cr.setExpiry(0)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	var shared string
+	if c.dedup {
+		shared = string(ref) // The hash of the block.
+	}
+	if err := cr.install(tmpName, file, size, u, shared); err != nil {
+		log.Info.Printf("saving cached ref %s to %s: %s", string(ref), file, err)
+		return err
+	}
+	if err := c.wbq.requestWriteback(ref, e); err != nil {
+		return err
+	}
+	return c.committed(file)
+}
+
+// errOversize is returned by readBlock and copyBlock for a block larger
+// than the cache allows.
+var errOversize = errors.E(errors.Invalid, errors.Str("block exceeds the cache's limit on the size of a block"))
+
+// readBlock reads all of r, failing with errOversize if it holds more
+// than max bytes and max is positive.
+func readBlock(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errOversize
+	}
+	return data, nil
+}
+
+// copyBlock copies all of r to w, returning the bytes copied and failing
+// with errOversize if r holds more than max bytes and max is positive.
+func copyBlock(w io.Writer, r io.Reader, max int64) (int64, error) {
+	if max <= 0 {
+		return io.Copy(w, r)
+	}
+	n, err := io.Copy(w, io.LimitReader(r, max+1))
+	if err != nil {
+		return n, err
+	}
+	if n > max {
+		return n, errOversize
+	}
+	return n, nil
+}
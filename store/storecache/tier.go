@@ -0,0 +1,193 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"upspin.io/log"
+)
+
+// Cold tier.
+//
+// A cache may have a second, cold, tier, typically a large slow disk
+// behind the small fast one holding the cache directory. Blocks evicted
+// from the cache directory to stay within its byte limit are demoted to
+// the cold tier rather than removed, and blocks read from the cold tier
+// are promoted back. The cold tier has a byte limit of its own, beyond
+// which its least recently used blocks are removed. The colddir=dir
+// option names the cold tier's directory and coldbytes=bytes its limit;
+// they must be given together.
+//
+// The references in the cold tier are kept in an LRU of their own,
+// c.coldLRU, but are known by the name of the file that would hold them
+// in the cache directory, both there and in the users' LRUs. The file
+// actually holding the data is in the same place beneath the cold
+// directory and is given by cachedRef.path. A reference found in the
+// cold tier by a Get is moved to the main LRU at once and its file
+// follows once it has been read.
+
+// coldPath returns the name of the file in the cold tier that holds the
+// reference cached in file.
+func (c *storeCache) coldPath(file string) string {
+	return path.Join(c.coldDir, strings.TrimPrefix(file, c.dir))
+}
+
+// within reports whether the directory a is b or lies beneath it.
+func within(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	return a == b || strings.HasPrefix(a, b+string(filepath.Separator))
+}
+
+// path returns the name of the file holding the data for the reference
+// cached in file, which is in the cold tier if cr has been demoted.
+// This is called with cr locked.
+func (cr *cachedRef) path(file string) string {
+	if cr.cold {
+		return cr.c.coldPath(file)
+	}
+	return file
+}
+
+// lookup returns the cachedRef for file from whichever tier holds it.
+// This is called with c locked.
+func (c *storeCache) lookup(file string) (*cachedRef, bool) {
+	value, ok := c.lru.Get(file)
+	if !ok && c.coldLRU != nil {
+		value, ok = c.coldLRU.Get(file)
+	}
+	if !ok {
+		return nil, false
+	}
+	return value.(*cachedRef), true
+}
+
+// forget drops file from the LRUs of both tiers.
+// This is called with c locked.
+func (c *storeCache) forget(file string) {
+	if cr, ok := c.lru.Remove(file).(*cachedRef); ok && cr.pinned {
+		c.pins--
+	}
+	if c.coldLRU != nil {
+		c.coldLRU.Remove(file)
+	}
+}
+
+// demote moves the file for cr to the cold tier unless cr is busy or
+// pinned.
+// It reports whether cr is now in the cold tier; if not, the caller
+// should evict it instead.
+// This is called with c locked.
+func (cr *cachedRef) demote(file string) bool {
+	cr.Lock()
+	defer cr.Unlock()
+	if cr.busy || cr.pinned || !cr.valid {
+		return false
+	}
+	if cr.cold {
+		return true
+	}
+	cold := cr.c.coldPath(file)
+	if !cr.expires.IsZero() {
+		if err := moveFile(file+expirySuffix, cold+expirySuffix); err != nil {
+			log.Info.Printf("store/storecache: demoting %s: %s", file, err)
+			return false
+		}
+	}
+	if err := moveFile(file, cold); err != nil {
+		log.Info.Printf("store/storecache: demoting %s: %s", file, err)
+		if !cr.expires.IsZero() {
+			moveFile(cold+expirySuffix, file+expirySuffix)
+		}
+		return false
+	}
+	cr.cold = true
+	cr.c.unshare(file)
+	cr.c.index.move(file, true)
+	atomic.AddInt64(&cr.c.inUse, -cr.size)
+	atomic.AddInt64(&cr.c.coldInUse, cr.size)
+	atomic.AddInt64(&cr.c.counters.demotions, 1)
+	return true
+}
+
+// promote moves the file for cr from the cold tier back to file.
+// If that fails the data stays where it is and is still found there.
+// This is called with cr locked.
+func (cr *cachedRef) promote(file string) {
+	cold := cr.c.coldPath(file)
+	if !cr.expires.IsZero() {
+		if err := moveFile(cold+expirySuffix, file+expirySuffix); err != nil {
+			log.Info.Printf("store/storecache: promoting %s: %s", file, err)
+			return
+		}
+	}
+	if err := moveFile(cold, file); err != nil {
+		log.Info.Printf("store/storecache: promoting %s: %s", file, err)
+		if !cr.expires.IsZero() {
+			moveFile(file+expirySuffix, cold+expirySuffix)
+		}
+		return
+	}
+	cr.cold = false
+	cr.c.index.move(file, false)
+	atomic.AddInt64(&cr.c.coldInUse, -cr.size)
+	atomic.AddInt64(&cr.c.inUse, cr.size)
+	atomic.AddInt64(&cr.c.counters.promotions, 1)
+}
+
+// enforceColdLimit removes the least recently used files from the cold
+// tier until the bytes in it are within its limit. As with
+// enforceByteLimit, busy references are skipped.
+// This is called with c locked.
+func (c *storeCache) enforceColdLimit() {
+	if c.coldLRU == nil {
+		return
+	}
+	for n := c.coldLRU.Len(); atomic.LoadInt64(&c.coldInUse) > c.coldLimit; n-- {
+		if n == 0 {
+			log.Info.Printf("exceeding cold tier byte limit")
+			break
+		}
+		key, value := c.coldLRU.RemoveOldest()
+		if value == nil {
+			break
+		}
+		cr := value.(*cachedRef)
+		if !cr.evict(key.(string)) {
+			c.coldLRU.Add(key, cr)
+		}
+	}
+}
+
+// moveFile moves a file from one tier to the other. The tiers are
+// usually on different file systems, so if it cannot be renamed it is
+// copied and the original removed.
+func moveFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	tmpName := to + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0600); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, to); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Remove(from)
+}
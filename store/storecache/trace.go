@@ -0,0 +1,70 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"fmt"
+
+	"upspin.io/metric"
+	"upspin.io/upspin"
+)
+
+// Tracing.
+//
+// Each Get, Put and Delete records a metric, saved by whatever Saver the
+// program has registered with package metric, with a span for the whole
+// request. Within it are child spans for the search of the cache, named
+// "lookup", and for each call to the store, named "origin" and of kind
+// Client. The spans are annotated with the reference and endpoint they
+// concern, so the time taken by a slow request can be put down to the
+// cache or to the store. Requests the cache makes on its own behalf, such
+// as prefetches and writebacks, are not traced.
+//
+// Upspin's RPC protocol carries no trace context, so the metric for a
+// request starts afresh at the cache and is not joined to any the client
+// or the store records for it.
+
+// trace starts the metric for the op request for ref at e, returning it
+// and the span for the whole request.
+func trace(op string, ref upspin.Reference, e upspin.Endpoint) (*metric.Metric, *metric.Span) {
+	m, sp := metric.NewSpan("store/storecache." + op)
+	sp.SetAnnotation(annotation(ref, e))
+	return m, sp
+}
+
+// startSpan starts a child span of parent of the given name and kind,
+// annotated with ref and e, or returns nil if parent is nil, as it is
+// when the request is not traced.
+func startSpan(parent *metric.Span, name string, kind metric.Kind, ref upspin.Reference, e upspin.Endpoint) *metric.Span {
+	if parent == nil {
+		return nil
+	}
+	sp := parent.StartSpan(name)
+	if sp == nil {
+		return nil
+	}
+	return sp.SetKind(kind).SetAnnotation(annotation(ref, e))
+}
+
+// lookupSpan starts the span for searching the cache for ref at e.
+func lookupSpan(parent *metric.Span, ref upspin.Reference, e upspin.Endpoint) *metric.Span {
+	return startSpan(parent, "lookup", metric.Server, ref, e)
+}
+
+// originSpan starts the span for a call to the store at e about ref.
+func originSpan(parent *metric.Span, ref upspin.Reference, e upspin.Endpoint) *metric.Span {
+	return startSpan(parent, "origin", metric.Client, ref, e)
+}
+
+// endSpan ends sp, if it is not nil.
+func endSpan(sp *metric.Span) {
+	if sp != nil {
+		sp.End()
+	}
+}
+
+func annotation(ref upspin.Reference, e upspin.Endpoint) string {
+	return fmt.Sprintf("ref=%s endpoint=%s", ref, e)
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Warm up.
+//
+// A newly started cache has nothing in it, so the first reads of even
+// the most popular blocks go to their stores. To avoid that, the cache
+// may be given a list of references to fetch ahead of any client asking
+// for them. They are fetched in order, one at a time, and cached like
+// any other block. Once the blocks fetched fill the cache's byte limit
+// the rest are not fetched, since they would only evict the earlier
+// ones, and once the server starts to shut down the rest are abandoned,
+// so that Shutdown need not wait for a long list.
+
+// errWarmFull is reported for the references left unfetched because
+// the cache is full.
+var errWarmFull = errors.Str("cache is full")
+
+// warm fetches refs from the store at e into the cache. It returns an
+// error for each reference, in the same order, nil if that reference
+// is now cached. Once stop reports true the remaining references fail
+// with errShutdown.
+// No locks are held on entry or exit.
+func (c *storeCache) warm(cfg upspin.Config, refs []upspin.Reference, e upspin.Endpoint, stop func() bool) []error {
+	errs := make([]error, len(refs))
+	var bytes int64
+	for i, ref := range refs {
+		if stop() {
+			errs[i] = errShutdown
+			continue
+		}
+		if bytes >= c.limit {
+			errs[i] = errWarmFull
+			continue
+		}
+		data, refdata, _, err := c.fetch(cfg, ref, e, true, nil)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case refdata.Volatile:
+			errs[i] = errors.E(errors.Invalid, errors.Str("volatile data is not cached"))
+		default:
+			bytes += int64(len(data))
+		}
+	}
+	return errs
+}
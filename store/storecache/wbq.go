@@ -8,6 +8,8 @@ import (
 	"expvar"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"upspin.io/bind"
@@ -72,12 +74,24 @@ type writebackQueue struct {
 	// exclusively by the scheduler goroutine.
 	queued map[upspin.Location]*request
 
+	// pending is the number of requests in queued.
+	// It is modified by the scheduler and must be accessed atomically.
+	pending int64
+
 	// request carries writeback requests to the scheduler.
 	request chan *request
 
 	// flushRequest carries flush requests to the scheduler.
 	flushRequest chan *flushRequest
 
+	// drainRequest carries requests to wait for the queue to empty.
+	// Each requester waits for its chan to close.
+	drainRequest chan chan bool
+
+	// drainers are waiting for the queue to empty. Used/modified
+	// exclusively by the scheduler goroutine.
+	drainers []chan bool
+
 	// ready carries requests ready for writers.
 	ready chan *request
 
@@ -97,6 +111,14 @@ type writebackQueue struct {
 	output  *serverutil.RateCounter
 }
 
+// rateCounters are shared by all writeback queues in the process,
+// since an expvar can be published only once.
+var rateCounters struct {
+	sync.Once
+	goodput *serverutil.RateCounter
+	output  *serverutil.RateCounter
+}
+
 func newWritebackQueue(sc *storeCache) *writebackQueue {
 	wbq := &writebackQueue{
 		sc:           sc,
@@ -104,16 +126,21 @@ func newWritebackQueue(sc *storeCache) *writebackQueue {
 		queued:       make(map[upspin.Location]*request),
 		request:      make(chan *request, writers),
 		flushRequest: make(chan *flushRequest, writers),
+		drainRequest: make(chan chan bool),
 		ready:        make(chan *request, writers),
 		done:         make(chan *request, writers),
 		retry:        make(chan *endpointQueue, writers),
 		die:          make(chan bool),
 		terminated:   make(chan bool),
 	}
-	wbq.goodput, _ = serverutil.NewRateCounter(60, 5*time.Second)
-	expvar.Publish("storecache-goodput", wbq.goodput)
-	wbq.output, _ = serverutil.NewRateCounter(60, 5*time.Second)
-	expvar.Publish("storecache-output", wbq.output)
+	rateCounters.Do(func() {
+		rateCounters.goodput, _ = serverutil.NewRateCounter(60, 5*time.Second)
+		expvar.Publish("storecache-goodput", rateCounters.goodput)
+		rateCounters.output, _ = serverutil.NewRateCounter(60, 5*time.Second)
+		expvar.Publish("storecache-output", rateCounters.output)
+	})
+	wbq.goodput = rateCounters.goodput
+	wbq.output = rateCounters.output
 
 	// Start scheduler.
 	go wbq.scheduler()
@@ -142,8 +169,10 @@ func (wbq *writebackQueue) enqueueWritebackFile(path string) bool {
 		return true
 	}
 	f = strings.TrimPrefix(f, wbq.sc.dir+"/")
+	// The endpoint is the first element and the reference the last;
+	// the shard directories lie between.
 	elems := strings.Split(f, "/")
-	if len(elems) != 3 {
+	if len(elems) < 2 {
 		log.Error.Printf("%s: odd writeback file %s", op, path)
 		return true
 	}
@@ -153,7 +182,7 @@ func (wbq *writebackQueue) enqueueWritebackFile(path string) bool {
 		return true
 	}
 	wbq.request <- &request{
-		Location:   upspin.Location{Reference: upspin.Reference(elems[2]), Endpoint: *e},
+		Location:   upspin.Location{Reference: upspin.Reference(elems[len(elems)-1]), Endpoint: *e},
 		err:        nil,
 		flushChans: nil,
 	}
@@ -174,23 +203,7 @@ func (wbq *writebackQueue) scheduler() {
 	for {
 		select {
 		case r := <-wbq.request:
-			log.Debug.Printf("%s: received %s %s", op, r.Reference, r.Endpoint)
-			// Keep a map of requests so that we can handle flushes
-			// and avoid Duplicates.
-			if wbq.queued[r.Location] != nil {
-				// Already queued. Unusual but OK.
-				break
-			}
-			wbq.queued[r.Location] = r
-
-			// A new request
-			epq := wbq.byEndpoint[r.Endpoint]
-			if epq == nil {
-				// New endpoints start in unknown state.
-				epq = &endpointQueue{state: unknown}
-				wbq.byEndpoint[r.Endpoint] = epq
-			}
-			epq.queue = append(epq.queue, r)
+			wbq.enqueue(r)
 		case r := <-wbq.done:
 			// A request has been completed.
 			epq := wbq.byEndpoint[r.Endpoint]
@@ -225,11 +238,18 @@ func (wbq *writebackQueue) scheduler() {
 			p.success()
 
 			// Awaken everyone waiting for a flush.
+			delete(wbq.queued, r.Location)
+			atomic.AddInt64(&wbq.pending, -1)
 			for _, c := range r.flushChans {
 				log.Debug.Printf("flushing...")
 				close(c)
 			}
-			delete(wbq.queued, r.Location)
+			if len(wbq.queued) == 0 {
+				for _, c := range wbq.drainers {
+					close(c)
+				}
+				wbq.drainers = nil
+			}
 			log.Debug.Printf("%s: %s %s done", op, r.Reference, r.Endpoint)
 		case epq := <-wbq.retry:
 			// Set its state to unknown so we'll try a single request to feel it out.
@@ -237,6 +257,7 @@ func (wbq *writebackQueue) scheduler() {
 				epq.state = unknown
 			}
 		case fr := <-wbq.flushRequest:
+			wbq.enqueueBuffered()
 			r := wbq.queued[fr.Location]
 			if r == nil {
 				// Not in flight
@@ -245,6 +266,13 @@ func (wbq *writebackQueue) scheduler() {
 			}
 			// Could be multiple outstanding flush requests.
 			r.flushChans = append(r.flushChans, fr.flushed)
+		case c := <-wbq.drainRequest:
+			wbq.enqueueBuffered()
+			if len(wbq.queued) == 0 {
+				close(c)
+				break
+			}
+			wbq.drainers = append(wbq.drainers, c)
 		case <-wbq.die:
 			wbq.terminated <- true
 			return
@@ -259,6 +287,45 @@ func (wbq *writebackQueue) scheduler() {
 	}
 }
 
+// enqueue adds a writeback request to the queue for its endpoint.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) enqueue(r *request) {
+	const op = "store/storecache.enqueue"
+	log.Debug.Printf("%s: received %s %s", op, r.Reference, r.Endpoint)
+	// Keep a map of requests so that we can handle flushes
+	// and avoid Duplicates.
+	if wbq.queued[r.Location] != nil {
+		// Already queued. Unusual but OK.
+		return
+	}
+	wbq.queued[r.Location] = r
+	atomic.AddInt64(&wbq.pending, 1)
+
+	// A new request
+	epq := wbq.byEndpoint[r.Endpoint]
+	if epq == nil {
+		// New endpoints start in unknown state.
+		epq = &endpointQueue{state: unknown}
+		wbq.byEndpoint[r.Endpoint] = epq
+	}
+	epq.queue = append(epq.queue, r)
+}
+
+// enqueueBuffered enqueues the requests waiting in the request channel.
+// A Put sends its request before returning, so once this is done every
+// completed Put is accounted for and a flush or drain cannot overtake it.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) enqueueBuffered() {
+	for {
+		select {
+		case r := <-wbq.request:
+			wbq.enqueue(r)
+		default:
+			return
+		}
+	}
+}
+
 // pickAndQueue makes one round robin pass through the endpoint queues sending
 // the first request in each queue to the ready channel.
 //
@@ -319,6 +386,11 @@ func (wbq *writebackQueue) writeback(r *request) error {
 	// Read it in.
 	file := wbq.sc.cachePath(r.Reference, r.Endpoint) + writebackSuffix
 	data, err := readFromCacheFile(file)
+	if os.IsNotExist(err) {
+		// Cancelled by a Delete.
+		log.Debug.Printf("store/storecache.writer: cancelled before writeback: %s", err)
+		return nil
+	}
 	if err != nil {
 		// Nothing we can do, log it but act like we succeeded.
 		log.Error.Printf("store/storecache.writer: disappeared before writeback: %s", err)
@@ -331,7 +403,7 @@ func (wbq *writebackQueue) writeback(r *request) error {
 	if err != nil {
 		return err
 	}
-	refdata, err := store.Put(data)
+	refdata, err := wbq.sc.mirroredPut(wbq.sc.cfg, store, data)
 	if err != nil {
 		return err
 	}
@@ -342,6 +414,11 @@ func (wbq *writebackQueue) writeback(r *request) error {
 	if err := os.Remove(file); err != nil {
 		log.Info.Printf("store/storecache.writer: fail remove after writeback: %s", err)
 	}
+	if refdata.Volatile {
+		// The store may change it, so it must not be served
+		// from the cache.
+		wbq.sc.drop(strings.TrimSuffix(file, writebackSuffix))
+	}
 	return nil
 }
 
@@ -376,6 +453,28 @@ func (wbq *writebackQueue) flush(loc upspin.Location) {
 	<-flushed
 }
 
+// drain waits until every block queued so far, and any queued while
+// waiting, has been written back.
+func (wbq *writebackQueue) drain() {
+	drained := make(chan bool)
+	wbq.drainRequest <- drained
+	<-drained
+}
+
+// cancel stops any pending writeback of the indicated block and waits
+// for one already under way to finish. It reports whether there was
+// a writeback to cancel.
+func (wbq *writebackQueue) cancel(loc upspin.Location) bool {
+	wbf := wbq.sc.cachePath(loc.Reference, loc.Endpoint) + writebackSuffix
+	if err := os.Remove(wbf); err != nil {
+		return false
+	}
+	// A writer that has not yet read the link will find it gone
+	// and drop the request.
+	wbq.flush(loc)
+	return true
+}
+
 // parallelism controls the number of parallel writebacks.
 // It implements a linear increase/multiplicative decrease
 // model that creates a sawtooth around the maximum usable
@@ -139,6 +139,10 @@ func (*PingResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []in
 
 type StoreGetRequest struct {
 	Reference string `protobuf:"bytes,1,opt,name=reference" json:"reference,omitempty"`
+	Offset    int64  `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
+	Length    int64  `protobuf:"varint,3,opt,name=length" json:"length,omitempty"`
+	NoStore   bool   `protobuf:"varint,4,opt,name=no_store,json=noStore" json:"no_store,omitempty"`
+	Refresh   bool   `protobuf:"varint,5,opt,name=refresh" json:"refresh,omitempty"`
 }
 
 func (m *StoreGetRequest) Reset()                    { *m = StoreGetRequest{} }
@@ -151,6 +155,7 @@ type StoreGetResponse struct {
 	Refdata   *Refdata    `protobuf:"bytes,2,opt,name=refdata" json:"refdata,omitempty"`
 	Locations []*Location `protobuf:"bytes,3,rep,name=locations" json:"locations,omitempty"`
 	Error     []byte      `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	Partial   bool        `protobuf:"varint,5,opt,name=partial" json:"partial,omitempty"`
 }
 
 func (m *StoreGetResponse) Reset()                    { *m = StoreGetResponse{} }
@@ -173,7 +178,8 @@ func (m *StoreGetResponse) GetLocations() []*Location {
 }
 
 type StorePutRequest struct {
-	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	Data    []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	NoStore bool   `protobuf:"varint,2,opt,name=no_store,json=noStore" json:"no_store,omitempty"`
 }
 
 func (m *StorePutRequest) Reset()                    { *m = StorePutRequest{} }
@@ -417,61 +423,64 @@ func init() {
 func init() { proto1.RegisterFile("upspin.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 893 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xc4, 0x55, 0x6d, 0x6e, 0xdb, 0x46,
-	0x10, 0x35, 0x4d, 0x7d, 0x8e, 0xe4, 0xaf, 0x4d, 0x9c, 0x32, 0x6a, 0x8a, 0x0a, 0x1b, 0x24, 0x15,
-	0x6a, 0x34, 0x71, 0x94, 0xa0, 0x08, 0x50, 0xa4, 0xad, 0x51, 0x19, 0x06, 0xea, 0xa0, 0x30, 0x18,
-	0x04, 0xfd, 0x29, 0xd0, 0xe2, 0x24, 0x26, 0xa2, 0x90, 0xec, 0x72, 0x19, 0x40, 0x27, 0xe8, 0x09,
-	0x7a, 0x8f, 0x1e, 0xa2, 0xc7, 0xe9, 0x21, 0x8a, 0xfd, 0xe0, 0x72, 0x49, 0x51, 0x6a, 0xf2, 0x2b,
-	0xbf, 0xac, 0x99, 0x9d, 0x37, 0xf3, 0xe6, 0xed, 0xf2, 0x19, 0x86, 0x79, 0x9a, 0xa5, 0x51, 0xfc,
-	0x28, 0x65, 0x09, 0x4f, 0x48, 0x5b, 0xfe, 0xa1, 0xbf, 0x40, 0xef, 0x3c, 0x0e, 0xd3, 0x24, 0x8a,
-	0x39, 0xb9, 0x07, 0x7d, 0xce, 0x82, 0x38, 0x4b, 0x13, 0xc6, 0x3d, 0x67, 0xec, 0x4c, 0xda, 0x7e,
-	0x99, 0x20, 0x77, 0xa1, 0x17, 0x23, 0x9f, 0x07, 0x61, 0xc8, 0xbc, 0xdd, 0xb1, 0x33, 0xe9, 0xfb,
-	0xdd, 0x18, 0xf9, 0x59, 0x18, 0x32, 0xfa, 0x1a, 0x7a, 0x2f, 0x93, 0x45, 0xc0, 0xa3, 0x24, 0x26,
-	0x27, 0xd0, 0x43, 0xdd, 0x50, 0xf6, 0x18, 0x4c, 0x0f, 0xd4, 0xc4, 0x47, 0xc5, 0x1c, 0xdf, 0x14,
-	0x88, 0x89, 0x0c, 0xdf, 0x20, 0xc3, 0x78, 0x81, 0xba, 0x69, 0x99, 0xa0, 0x73, 0xe8, 0xfa, 0xf8,
-	0x26, 0x0c, 0x78, 0x50, 0x2d, 0x74, 0x6a, 0x85, 0x64, 0x04, 0xbd, 0x0f, 0xc9, 0x32, 0xe0, 0xd1,
-	0x52, 0x75, 0xe9, 0xf9, 0x26, 0x16, 0x67, 0x61, 0xce, 0x24, 0x37, 0xcf, 0x1d, 0x3b, 0x13, 0xd7,
-	0x37, 0x31, 0x3d, 0x82, 0x03, 0x43, 0x0a, 0xff, 0xc8, 0x31, 0xe3, 0xf4, 0x27, 0x38, 0x2c, 0x53,
-	0x59, 0x9a, 0xc4, 0x19, 0x7e, 0xd2, 0x4a, 0x74, 0x0a, 0x83, 0xab, 0x28, 0x7e, 0xab, 0xfb, 0x91,
-	0xfb, 0xb0, 0x97, 0x46, 0xf1, 0xdb, 0x79, 0x26, 0xe2, 0x82, 0x7c, 0xdb, 0x1f, 0x8a, 0xe4, 0x2b,
-	0x9d, 0xa3, 0x4f, 0x61, 0xa8, 0x30, 0x7a, 0xe0, 0x47, 0x81, 0x1e, 0xc3, 0xc1, 0x2b, 0x9e, 0x30,
-	0xbc, 0xc0, 0x82, 0xfc, 0x76, 0x95, 0xe8, 0x5f, 0x0e, 0x1c, 0x96, 0x08, 0x3d, 0x8a, 0x40, 0x4b,
-	0x08, 0x2c, 0xab, 0x87, 0xbe, 0xfc, 0x4d, 0x26, 0xd0, 0x65, 0x4a, 0x77, 0xa9, 0xe6, 0x60, 0xba,
-	0xaf, 0xd7, 0xd5, 0xb7, 0xe1, 0x17, 0xc7, 0xe4, 0x3b, 0xe8, 0x2f, 0xf5, 0xc5, 0x67, 0x9e, 0x3b,
-	0x76, 0x2d, 0x69, 0x8a, 0x07, 0xe1, 0x97, 0x15, 0xe4, 0x36, 0xb4, 0x91, 0xb1, 0x84, 0x79, 0x2d,
-	0x39, 0x4d, 0x05, 0xf4, 0x81, 0x5e, 0xe4, 0x2a, 0x37, 0x8b, 0x34, 0xb0, 0xa2, 0xbe, 0x66, 0x2f,
-	0xcb, 0x34, 0x7b, 0x8b, 0xa9, 0xb3, 0x9d, 0xa9, 0x19, 0xbd, 0x6b, 0x8f, 0x9e, 0x02, 0x91, 0x3d,
-	0x67, 0xb8, 0x44, 0x8e, 0x1f, 0x27, 0xe3, 0x09, 0xdc, 0xaa, 0x60, 0x34, 0x15, 0x33, 0xc0, 0xb1,
-	0x07, 0xfc, 0xe9, 0x40, 0xeb, 0x75, 0x86, 0x4c, 0x6c, 0x14, 0x07, 0xef, 0x8b, 0x76, 0xf2, 0x37,
-	0xb9, 0x0f, 0xad, 0x30, 0x62, 0x99, 0xb7, 0x5b, 0x11, 0xce, 0xbc, 0x29, 0x79, 0x48, 0xbe, 0x81,
-	0x4e, 0x26, 0xc6, 0xd5, 0xf5, 0x35, 0x65, 0xfa, 0x98, 0x7c, 0x05, 0x90, 0xe6, 0xd7, 0xcb, 0x68,
-	0x31, 0x7f, 0x87, 0x2b, 0xa9, 0x70, 0xdf, 0xef, 0xab, 0xcc, 0x25, 0xae, 0xe8, 0x63, 0x38, 0xbc,
-	0xc4, 0xd5, 0xcb, 0x24, 0x79, 0x97, 0xa7, 0xc5, 0xa2, 0x5f, 0x42, 0x3f, 0xcf, 0x90, 0xcd, 0x2d,
-	0x66, 0x3d, 0x91, 0xf8, 0x2d, 0x78, 0x8f, 0xf4, 0x57, 0x38, 0xb2, 0x00, 0x7a, 0xcb, 0xaf, 0xa1,
-	0x25, 0x0a, 0xb4, 0xda, 0x03, 0xcd, 0x45, 0x6c, 0xe8, 0xcb, 0x83, 0x0d, 0x3a, 0x9f, 0xc2, 0xde,
-	0x25, 0xae, 0xac, 0x0b, 0xfe, 0xbf, 0x3e, 0xf4, 0x21, 0xec, 0x17, 0x88, 0xad, 0x02, 0x3f, 0x07,
-	0x38, 0x8f, 0x39, 0x5b, 0x9d, 0x8b, 0x48, 0xd6, 0x88, 0xc8, 0xd4, 0x88, 0x60, 0x03, 0xa7, 0x1f,
-	0x61, 0x28, 0x90, 0x11, 0x66, 0x0a, 0xeb, 0x41, 0x17, 0x55, 0xec, 0x39, 0x63, 0x77, 0x32, 0xf4,
-	0x8b, 0x70, 0x03, 0xfe, 0x21, 0x1c, 0xce, 0x22, 0x56, 0x15, 0xb4, 0xe1, 0x96, 0xe9, 0x03, 0xd8,
-	0x9b, 0x45, 0xcc, 0xda, 0xbd, 0x91, 0x24, 0xfd, 0x16, 0xf6, 0x67, 0x11, 0xbb, 0x58, 0x26, 0xd7,
-	0x45, 0x9d, 0x07, 0xdd, 0x34, 0xe0, 0x1c, 0x59, 0xac, 0xfb, 0x15, 0xa1, 0x1e, 0x5d, 0x7d, 0xb4,
-	0x4d, 0xa3, 0x4f, 0xe0, 0x78, 0x16, 0xb1, 0xdf, 0x6f, 0xa2, 0xc5, 0xcd, 0xd9, 0x62, 0x81, 0x59,
-	0xb6, 0xad, 0xf8, 0x07, 0x38, 0x10, 0xc5, 0x01, 0x5f, 0xdc, 0x6c, 0x29, 0x13, 0xec, 0x13, 0x16,
-	0xa2, 0x12, 0xc3, 0xf5, 0x55, 0x40, 0x03, 0x68, 0x9f, 0x7f, 0xc0, 0x98, 0x6f, 0xbe, 0x81, 0x75,
-	0x10, 0xb9, 0x03, 0x9d, 0x50, 0xee, 0x20, 0x8d, 0xb9, 0xe7, 0xeb, 0xa8, 0xd9, 0x26, 0xa6, 0x7f,
-	0xef, 0x42, 0x5b, 0x7e, 0x78, 0xe4, 0x85, 0xf5, 0x3f, 0xeb, 0x4e, 0xfd, 0x73, 0x50, 0xd4, 0x47,
-	0x5f, 0xac, 0xe5, 0xd5, 0x33, 0xa2, 0x3b, 0xe4, 0x09, 0xb4, 0x84, 0xdb, 0x12, 0xa2, 0x4b, 0x2c,
-	0xbb, 0x1e, 0xdd, 0xaa, 0xe4, 0x0c, 0xe4, 0x39, 0xb8, 0x17, 0x58, 0x0e, 0xab, 0xf9, 0xae, 0x19,
-	0x56, 0x77, 0x57, 0x85, 0xbc, 0xca, 0x6b, 0xc8, 0xf2, 0x2d, 0x54, 0x91, 0xd6, 0x6b, 0xa7, 0x3b,
-	0xe4, 0x0c, 0x3a, 0xea, 0x86, 0xc9, 0x5d, 0xbb, 0xa8, 0x72, 0xeb, 0xa3, 0x51, 0xd3, 0x51, 0xd1,
-	0x62, 0xfa, 0xaf, 0x03, 0xee, 0x25, 0xae, 0x3e, 0x83, 0x60, 0x2f, 0xa0, 0xa3, 0xbe, 0x0c, 0x52,
-	0xf4, 0xad, 0x9b, 0xcf, 0xc8, 0x5b, 0x3f, 0x30, 0xf0, 0x67, 0x4a, 0xb5, 0xdb, 0x65, 0x89, 0xa5,
-	0xd9, 0x71, 0x2d, 0x6b, 0xd6, 0xfd, 0xc7, 0x05, 0x77, 0x16, 0xb1, 0xcf, 0xb0, 0xee, 0xf7, 0x6b,
-	0xeb, 0xd6, 0xad, 0x61, 0x74, 0x64, 0x06, 0x16, 0x6e, 0x45, 0x77, 0xc8, 0x69, 0x75, 0xcf, 0x8a,
-	0x4f, 0x34, 0x23, 0x9e, 0x41, 0x4b, 0x78, 0x04, 0x39, 0x2e, 0x21, 0x96, 0x67, 0x18, 0x7e, 0xb6,
-	0xb3, 0x29, 0x7e, 0xfa, 0x2d, 0x59, 0xfc, 0xaa, 0x2f, 0xa9, 0x71, 0xda, 0xcf, 0x30, 0xb0, 0xdc,
-	0x83, 0xdc, 0x2b, 0xc1, 0xeb, 0xa6, 0xd2, 0xdc, 0xe1, 0x09, 0xb4, 0xa5, 0xa5, 0x98, 0x8b, 0xa8,
-	0x79, 0xcc, 0x68, 0x58, 0xa0, 0x84, 0x7d, 0xd0, 0x9d, 0x53, 0xe7, 0xba, 0x23, 0x13, 0x4f, 0xff,
-	0x0b, 0x00, 0x00, 0xff, 0xff, 0x07, 0x63, 0xb7, 0x77, 0xb0, 0x0a, 0x00, 0x00,
+	// 935 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x03, 0xc5, 0x55, 0x6b, 0x4e, 0xdb, 0x40,
+	0x10, 0xc6, 0x71, 0x12, 0xc2, 0x10, 0x20, 0x2c, 0x8f, 0x86, 0x94, 0xaa, 0xd5, 0x56, 0xa5, 0xa8,
+	0xa8, 0x94, 0x97, 0x2a, 0xa4, 0x8a, 0x16, 0x54, 0x22, 0xa4, 0x16, 0x55, 0xc8, 0x08, 0xf5, 0x67,
+	0x64, 0x92, 0x0d, 0xb1, 0x48, 0xed, 0x74, 0xbd, 0x41, 0xe2, 0x04, 0xbd, 0x40, 0xef, 0xd1, 0x1e,
+	0xa2, 0xc7, 0xe9, 0x21, 0xba, 0xbb, 0xde, 0xb5, 0xd7, 0x8e, 0x79, 0xf4, 0x17, 0xbf, 0xec, 0x79,
+	0x7c, 0x33, 0xdf, 0x3c, 0x3c, 0x86, 0xea, 0x70, 0x10, 0x0e, 0x3c, 0x7f, 0x7d, 0x40, 0x03, 0x16,
+	0xa0, 0x92, 0x7c, 0xe0, 0x8f, 0x50, 0x69, 0xfa, 0x9d, 0x41, 0xe0, 0xf9, 0x0c, 0x2d, 0xc3, 0x04,
+	0xa3, 0xae, 0x1f, 0x0e, 0x02, 0xca, 0xea, 0xd6, 0x33, 0x6b, 0xb5, 0xe4, 0x24, 0x0a, 0xb4, 0x04,
+	0x15, 0x9f, 0xb0, 0x96, 0xdb, 0xe9, 0xd0, 0x7a, 0x81, 0x1b, 0x27, 0x9c, 0x71, 0x2e, 0x1f, 0x70,
+	0x11, 0x9f, 0x41, 0xe5, 0x38, 0x68, 0xbb, 0xcc, 0x0b, 0x7c, 0xb4, 0x06, 0x15, 0xa2, 0x02, 0xca,
+	0x18, 0x93, 0x5b, 0x33, 0x51, 0xc6, 0x75, 0x9d, 0xc7, 0x89, 0x1d, 0x44, 0x46, 0x4a, 0xba, 0x84,
+	0x12, 0xbf, 0x4d, 0x54, 0xd0, 0x44, 0x81, 0x5b, 0x30, 0xee, 0x90, 0x6e, 0xc7, 0x65, 0x6e, 0xda,
+	0xd1, 0xca, 0x38, 0xa2, 0x06, 0x54, 0xae, 0x82, 0x3e, 0xcf, 0xdf, 0x8f, 0xa2, 0x54, 0x9c, 0x58,
+	0x16, 0xb6, 0xce, 0x90, 0x4a, 0x6e, 0x75, 0x9b, 0xdb, 0x6c, 0x27, 0x96, 0xf1, 0x2c, 0xcc, 0xc4,
+	0xa4, 0xc8, 0xf7, 0x21, 0x09, 0x19, 0xfe, 0x00, 0xb5, 0x44, 0xc5, 0x0b, 0xf7, 0x43, 0xf2, 0x5f,
+	0x25, 0xe1, 0x2d, 0x98, 0x3c, 0xf1, 0xfc, 0x0b, 0x15, 0x0f, 0x3d, 0x87, 0x29, 0xde, 0xf3, 0x8b,
+	0x56, 0x28, 0x64, 0x4d, 0xbe, 0xe4, 0x54, 0x85, 0xf2, 0x54, 0xe9, 0xf0, 0x36, 0x54, 0x23, 0x8c,
+	0x4a, 0x78, 0x2f, 0xd0, 0x4f, 0x0b, 0x66, 0x4e, 0x59, 0x40, 0xc9, 0x11, 0xd1, 0xec, 0xef, 0x68,
+	0xd3, 0x22, 0x94, 0x83, 0x6e, 0x37, 0x24, 0x4c, 0x36, 0xc9, 0x76, 0x94, 0x24, 0xf4, 0x7d, 0xe2,
+	0x5f, 0xb0, 0x9e, 0x6a, 0x90, 0x92, 0xe4, 0xc4, 0x83, 0x56, 0x28, 0x72, 0xd4, 0x8b, 0xb2, 0xad,
+	0xe3, 0x7e, 0x20, 0x53, 0xa2, 0x3a, 0x8c, 0xf3, 0xb8, 0x94, 0x84, 0xbd, 0x7a, 0x29, 0xb2, 0x28,
+	0x11, 0xff, 0xb2, 0xa0, 0x96, 0xd0, 0x52, 0x05, 0x21, 0x28, 0x8a, 0x31, 0x4a, 0x4a, 0x55, 0x47,
+	0xbe, 0xa3, 0x55, 0x19, 0x42, 0xaa, 0x0b, 0xb2, 0xa9, 0xd3, 0xaa, 0xa9, 0x6a, 0xe6, 0x8e, 0x36,
+	0xa3, 0xd7, 0x30, 0xd1, 0x57, 0xeb, 0x15, 0x72, 0x8a, 0xb6, 0x31, 0x00, 0xbd, 0x76, 0x4e, 0xe2,
+	0x81, 0xe6, 0xa1, 0x44, 0x28, 0x0d, 0xa8, 0xe4, 0x5c, 0x75, 0x22, 0x41, 0x30, 0x1e, 0xb8, 0x94,
+	0x79, 0x6e, 0x5f, 0x33, 0x56, 0x22, 0xde, 0x57, 0x7d, 0x3c, 0x19, 0xc6, 0x7d, 0xcc, 0xe3, 0x6b,
+	0x76, 0xa3, 0x90, 0xea, 0x06, 0x76, 0x54, 0xc9, 0x32, 0x82, 0x2a, 0xd9, 0x28, 0xcf, 0xba, 0xbd,
+	0xbc, 0x98, 0x6f, 0xc1, 0xe0, 0xcb, 0xf7, 0x08, 0xc9, 0x98, 0x87, 0xa4, 0x4f, 0x18, 0xb9, 0xd7,
+	0x80, 0xf1, 0x1a, 0xcc, 0xa5, 0x30, 0x8a, 0x4a, 0x9c, 0xc0, 0x32, 0x13, 0xfc, 0xb0, 0xa0, 0x78,
+	0x16, 0x12, 0x2a, 0x8a, 0xf5, 0xdd, 0x6f, 0x3a, 0x9c, 0x7c, 0xe7, 0x1b, 0x58, 0xec, 0x78, 0x34,
+	0xe4, 0x94, 0xec, 0xbc, 0x75, 0x97, 0x46, 0xf4, 0x12, 0xca, 0xb2, 0x1d, 0xd9, 0xa1, 0xc4, 0x6e,
+	0xca, 0x8c, 0x9e, 0x00, 0x0c, 0x86, 0xe7, 0x7d, 0xaf, 0xdd, 0xba, 0x24, 0xd7, 0x72, 0x2c, 0x9c,
+	0x76, 0xa4, 0xf9, 0x4c, 0xae, 0xf1, 0x1b, 0xa8, 0xf1, 0xc7, 0x71, 0x10, 0x5c, 0x0e, 0x07, 0xba,
+	0xd0, 0xc7, 0x30, 0x31, 0xe4, 0xe4, 0x5a, 0x06, 0xb3, 0x8a, 0x50, 0x7c, 0xe1, 0x32, 0xfe, 0x04,
+	0xb3, 0x06, 0x40, 0x55, 0xf9, 0x14, 0x8a, 0xc2, 0x41, 0x75, 0x7b, 0x52, 0x71, 0x11, 0x15, 0x3a,
+	0xd2, 0x70, 0x43, 0x9f, 0x37, 0x60, 0x8a, 0xc7, 0x32, 0x66, 0x7f, 0x57, 0x1c, 0xbc, 0x02, 0xd3,
+	0x1a, 0x71, 0x6b, 0x83, 0x77, 0x01, 0x9a, 0x3e, 0xa3, 0xd7, 0x4d, 0xb9, 0x7f, 0xc2, 0x47, 0x48,
+	0xb1, 0x8f, 0x10, 0x6e, 0xe0, 0xf4, 0x1e, 0xaa, 0x02, 0xe9, 0x91, 0xb0, 0xa9, 0x77, 0x97, 0x44,
+	0x32, 0x47, 0xdb, 0xdc, 0x4f, 0x8b, 0x37, 0xe0, 0x57, 0xa0, 0x76, 0xe8, 0xd1, 0x74, 0x43, 0x73,
+	0xa6, 0x8c, 0x5f, 0xc0, 0x14, 0xf7, 0x33, 0x6a, 0xcf, 0x25, 0x89, 0x5f, 0xc1, 0x34, 0x77, 0x3b,
+	0xea, 0x07, 0xe7, 0xda, 0x4f, 0x7e, 0x4c, 0x8c, 0x11, 0xea, 0xab, 0x78, 0x5a, 0x54, 0xa9, 0xd3,
+	0x4b, 0x9b, 0x97, 0x7a, 0x0d, 0x16, 0xb8, 0xdf, 0xd7, 0x9e, 0xd7, 0xee, 0x1d, 0xb4, 0xdb, 0x24,
+	0x0c, 0x6f, 0x73, 0x7e, 0x07, 0x33, 0xc2, 0xd9, 0x65, 0xed, 0xde, 0x2d, 0x6e, 0x82, 0x7d, 0x40,
+	0x3b, 0x84, 0xaa, 0xf3, 0x16, 0x09, 0xd8, 0x85, 0x52, 0xf3, 0x8a, 0x17, 0x72, 0xf3, 0x04, 0x46,
+	0x41, 0xe2, 0x24, 0x76, 0x64, 0x0d, 0xf2, 0x24, 0x56, 0x1c, 0x25, 0xe5, 0xdf, 0x96, 0xad, 0xdf,
+	0x05, 0x28, 0x45, 0x77, 0x71, 0xcf, 0xf8, 0x9d, 0x2e, 0x66, 0x3f, 0x87, 0x88, 0x7a, 0xe3, 0xd1,
+	0x88, 0x3e, 0x5a, 0x23, 0x3c, 0x86, 0x36, 0xa1, 0x28, 0x7e, 0x04, 0x08, 0x29, 0x17, 0xe3, 0x4f,
+	0xd2, 0x98, 0x4b, 0xe9, 0x62, 0xc8, 0x2e, 0xd8, 0x47, 0x24, 0x49, 0x96, 0xf9, 0x23, 0xc4, 0xc9,
+	0xb2, 0x27, 0x39, 0x42, 0xf2, 0xd1, 0xa7, 0x91, 0xc9, 0x2e, 0xa4, 0x91, 0xc6, 0xb6, 0x73, 0xe4,
+	0x01, 0x94, 0xa3, 0x09, 0xa3, 0x25, 0xd3, 0x29, 0x35, 0xf5, 0x46, 0x23, 0xcf, 0xa4, 0x43, 0x6c,
+	0xfd, 0xb5, 0xc0, 0xe6, 0x5f, 0xd1, 0x03, 0x34, 0x6c, 0x0f, 0xca, 0xd1, 0x97, 0x81, 0x74, 0xdc,
+	0xec, 0xf1, 0x69, 0xd4, 0x47, 0x0d, 0x31, 0x7c, 0x27, 0xea, 0xda, 0x7c, 0xe2, 0x62, 0xf4, 0x6c,
+	0x21, 0xa3, 0x8d, 0xcb, 0xfd, 0x63, 0x83, 0xcd, 0x57, 0xf8, 0x01, 0xca, 0x7d, 0x3b, 0x52, 0x6e,
+	0xf6, 0x34, 0x34, 0x66, 0xe3, 0x84, 0xfa, 0x5a, 0x71, 0xdc, 0x46, 0xba, 0xce, 0xd4, 0x9d, 0xc8,
+	0x47, 0xec, 0x40, 0x51, 0xdc, 0x08, 0xb4, 0x90, 0x40, 0x8c, 0x9b, 0x11, 0xf3, 0x33, 0x2f, 0x5b,
+	0xc4, 0x4f, 0xed, 0x92, 0xc1, 0x2f, 0xbd, 0x49, 0xb9, 0xd9, 0xf6, 0x61, 0xd2, 0xb8, 0x1e, 0x68,
+	0x39, 0x01, 0x8f, 0x1e, 0x95, 0xfc, 0x08, 0x9b, 0x50, 0x92, 0x27, 0x25, 0x1e, 0x44, 0xe6, 0xc6,
+	0x34, 0xaa, 0x1a, 0x25, 0xce, 0x07, 0x1e, 0xdb, 0xb0, 0xce, 0xcb, 0x52, 0xb1, 0xfd, 0x0f, 0x9b,
+	0x9f, 0xea, 0x19, 0x4b, 0x0b, 0x00, 0x00,
 }